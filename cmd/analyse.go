@@ -0,0 +1,133 @@
+// Copyright 2020 James Lee <jamesl33info@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"sync"
+
+	"github.com/jamesl33/goamt/utils"
+	"github.com/jamesl33/goamt/value"
+
+	"github.com/apex/log"
+)
+
+// analyseFunc - The function used when running the first pass ahead of time, used to allow unit testing without
+// ffmpeg.
+var analyseFunc = utils.AnalyseLoudness
+
+// analysis - The result of running the first pass for a single entry, the analysis is run at most once by whichever of
+// the analysers/workers gets to it first; any others will block until it's complete.
+type analysis struct {
+	once  sync.Once
+	stats *utils.LoudnormStats
+	err   error
+}
+
+// run - Run the first pass for the provided entry (unless it has already been run), returning the result.
+func (a *analysis) run(ctx context.Context, entry value.Entry, options utils.TranscodeOptions) (
+	*utils.LoudnormStats, error) {
+	a.once.Do(func() {
+		log.WithFields(entry).Debug("Analysing entry")
+		a.stats, a.err = analyseFunc(ctx, entry.Path, options)
+	})
+
+	return a.stats, a.err
+}
+
+// loudnormAnalyser - Runs the first pass for queued entries ahead of time using a bounded number of analysers, so that
+// idle cores are used whilst the encoders are busy with the second pass of earlier entries. Note that a nil
+// '*loudnormAnalyser' is valid and won't analyse anything.
+type loudnormAnalyser struct {
+	options  utils.TranscodeOptions
+	analyses map[int]*analysis
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+}
+
+// startLoudnormAnalyser - Start 'analysers' number of analysers which will run the first pass for the provided entries,
+// in the order they'll be transcoded. Analysis stops early if the provided context is cancelled (or the analyser is
+// stopped). Returns nil if there's nothing to analyse.
+func startLoudnormAnalyser(ctx context.Context, entries []value.Entry, analysers int,
+	options utils.TranscodeOptions) *loudnormAnalyser {
+	if analysers == 0 || len(entries) == 0 || !utils.RequiresAnalysis(options) {
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+
+	a := &loudnormAnalyser{options: options, analyses: make(map[int]*analysis, len(entries)), cancel: cancel}
+
+	// The analyses are all created up front so the map is never written to once the analysers have started
+	stream := make(chan value.Entry, len(entries))
+
+	for _, entry := range entries {
+		a.analyses[entry.ID] = &analysis{}
+		stream <- entry
+	}
+
+	close(stream)
+
+	for i := 0; i < analysers; i++ {
+		a.wg.Add(1)
+
+		go func() {
+			defer a.wg.Done()
+
+			for entry := range stream {
+				if ctx.Err() != nil {
+					return
+				}
+
+				_, _ = a.analyses[entry.ID].run(ctx, entry, a.options)
+			}
+		}()
+	}
+
+	return a
+}
+
+// stats - Returns the stats for the provided entry, running the first pass if an analyser hasn't got to it yet (or
+// waiting for an analyser which is currently running it). Returns nil if the entry couldn't be analysed ahead of time,
+// in which case the first pass should be run as part of transcoding.
+func (a *loudnormAnalyser) stats(ctx context.Context, entry value.Entry) *utils.LoudnormStats {
+	if a == nil {
+		return nil
+	}
+
+	analysis, ok := a.analyses[entry.ID]
+	if !ok {
+		return nil
+	}
+
+	stats, err := analysis.run(ctx, entry, a.options)
+	if err != nil {
+		log.WithError(err).WithFields(entry).Debug("Failed to analyse entry ahead of time, will analyse when transcoding")
+		return nil
+	}
+
+	return stats
+}
+
+// stop - Stop the analysers, killing any in-progress analyses; this should be called once the entries have been
+// transcoded since any remaining analyses are no longer required.
+func (a *loudnormAnalyser) stop() {
+	if a == nil {
+		return
+	}
+
+	a.cancel()
+	a.wg.Wait()
+}
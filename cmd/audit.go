@@ -0,0 +1,293 @@
+// Copyright 2020 James Lee <jamesl33info@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/jamesl33/goamt/database"
+	"github.com/jamesl33/goamt/utils"
+	"github.com/jamesl33/goamt/value"
+
+	"github.com/apex/log"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+// auditOptions - Encapsulates the options for the audit sub-command.
+var auditOptions = struct {
+	database string
+	paths    []string
+	fix      bool
+}{}
+
+// auditCommand - The audit sub-command, used to cross-check the entries in a goamt database against the media files in
+// the media libraries.
+var auditCommand = &cobra.Command{
+	RunE:  audit,
+	Short: "Report the inconsistencies between a goamt SQLite database and its media libraries",
+	Use:   "audit",
+}
+
+// init - Initialize the flags/arguments for the audit sub-command.
+func init() {
+	auditCommand.Flags().StringVarP(
+		&auditOptions.database,
+		"database",
+		"d",
+		"",
+		"path to a goamt SQLite database",
+	)
+
+	auditCommand.Flags().StringArrayVarP(
+		&auditOptions.paths,
+		"path",
+		"p",
+		nil,
+		"path to a media library, may be provided multiple times",
+	)
+
+	auditCommand.Flags().BoolVar(
+		&auditOptions.fix,
+		"fix",
+		false,
+		"once confirmed, remove the entries whose files are missing and add the untracked media files",
+	)
+
+	markDatabaseRequired(auditCommand)
+	markFlagRequired(auditCommand, "path")
+}
+
+// auditReport - The inconsistencies found between a database and its media libraries.
+type auditReport struct {
+	// missing - Entries whose files no longer exist.
+	missing []value.Entry
+
+	// untracked - Media files (within the library root) which aren't recorded in the database.
+	untracked []string
+
+	// changed - Entries whose files no longer match their recorded hash, e.g. because they were replaced.
+	changed []value.Entry
+}
+
+// write - Write the report to the provided writer, listing the paths in each category.
+func (r auditReport) write(writer io.Writer) error {
+	categories := []struct {
+		name  string
+		paths []string
+	}{
+		{name: "missing", paths: entryPaths(r.missing)},
+		{name: "untracked", paths: r.untracked},
+		{name: "changed", paths: entryPaths(r.changed)},
+	}
+
+	for _, category := range categories {
+		_, err := fmt.Fprintf(writer, "%s: %d\n", category.name, len(category.paths))
+		if err != nil {
+			return err
+		}
+
+		for _, path := range category.paths {
+			_, err = fmt.Fprintf(writer, "  %s\n", path)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// entryPaths - Returns the paths of the provided entries.
+func entryPaths(entries []value.Entry) []string {
+	paths := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		paths = append(paths, entry.Path)
+	}
+
+	return paths
+}
+
+// audit - Run the audit sub-command, this will compare the entries in the database against the media files in the
+// provided media libraries and print a report of the inconsistencies. With '--fix' the missing entries are removed and
+// the untracked files added, entries whose files have changed are left to be updated by the update sub-command.
+func audit(_ *cobra.Command, _ []string) error {
+	open := database.OpenReadOnly
+	if auditOptions.fix {
+		open = database.Open
+	}
+
+	db, err := open(auditOptions.database)
+	if err != nil {
+		return errors.Wrap(err, "failed to open SQLite database")
+	}
+
+	// Incomplete jobs may have moved files (e.g. removed the source once transcoded), these must be resolved before
+	// anything is removed; a read-only audit may therefore report them as missing
+	if auditOptions.fix {
+		err = db.Recover()
+		if err != nil {
+			return errors.Wrap(err, "failed to recover incomplete jobs")
+		}
+	}
+
+	report, err := auditLibraries(db)
+	if err != nil {
+		return err // Purposefully not wrapped
+	}
+
+	err = report.write(os.Stdout)
+	if err != nil {
+		return errors.Wrap(err, "failed to write report")
+	}
+
+	if !auditOptions.fix || (len(report.missing) == 0 && len(report.untracked) == 0) {
+		return db.Close()
+	}
+
+	proceed, err := confirm(fmt.Sprintf("%d missing entries will be removed and %d untracked file(s) added, continue?",
+		len(report.missing), len(report.untracked)))
+	if err != nil {
+		return errors.Wrap(err, "failed to confirm fix")
+	}
+
+	if proceed {
+		err = fixLibraries(db, report)
+		if err != nil {
+			return err // Purposefully not wrapped
+		}
+	}
+
+	err = db.Close()
+	if err != nil {
+		return errors.Wrap(err, "failed to close database")
+	}
+
+	return nil
+}
+
+// auditLibraries - Compare every entry in the provided database against the filesystem, then walk the media libraries
+// looking for media files which aren't recorded in the database.
+func auditLibraries(db *database.Database) (auditReport, error) {
+	entries, err := db.List(database.ListOptions{})
+	if err != nil {
+		return auditReport{}, errors.Wrap(err, "failed to list entries")
+	}
+
+	var (
+		report  auditReport
+		tracked = make(map[string]bool, len(entries))
+		options = utils.HashOptions{Algorithm: db.HashAlgorithm()}
+	)
+
+	for _, entry := range entries {
+		abs, err := filepath.Abs(entry.Path)
+		if err != nil {
+			return auditReport{}, errors.Wrap(err, "failed to determine absolute path")
+		}
+
+		tracked[abs] = true
+
+		if !utils.PathExists(entry.Path) {
+			report.missing = append(report.missing, entry)
+			continue
+		}
+
+		// Unhashed entries will be hashed by the next update, so there's nothing to compare against
+		if entry.Hash == 0 {
+			continue
+		}
+
+		hash, err := utils.HashFileWithOptions(entry.Path, options)
+		if err != nil {
+			return auditReport{}, errors.Wrap(err, "failed to hash file")
+		}
+
+		if hash != entry.Hash {
+			report.changed = append(report.changed, entry)
+		}
+	}
+
+	for _, root := range auditOptions.paths {
+		err = walkMediaFiles(root, pathFilter{}, func(path string, _ os.FileInfo) error {
+			abs, err := filepath.Abs(path)
+			if err != nil {
+				return errors.Wrap(err, "failed to determine absolute path")
+			}
+
+			// Files outside of the library root can't be recorded in the database
+			if !tracked[abs] && db.WithinRoot(path) {
+				report.untracked = append(report.untracked, path)
+			}
+
+			return nil
+		})
+		if err != nil {
+			return auditReport{}, errors.Wrap(err, "unexpected error during file walk")
+		}
+	}
+
+	return report, nil
+}
+
+// fixLibraries - Add the untracked files from the provided report to the database, then remove the entries whose files
+// are missing. Files are added first so that a missing entry which was actually renamed is updated (as it would be by
+// the update sub-command) rather than removed and re-added.
+func fixLibraries(db *database.Database, report auditReport) error {
+	var (
+		clock   = newDiscoveredClock(false)
+		options = utils.HashOptions{Algorithm: db.HashAlgorithm()}
+		added   int
+	)
+
+	for _, path := range report.untracked {
+		outcome, err := upsertEntry(db, value.Entry{Path: path, Discovered: clock()}, options)
+		if err != nil {
+			return errors.Wrap(err, "failed to add untracked file")
+		}
+
+		if outcome != database.UpsertSkipped {
+			added++
+		}
+	}
+
+	// Entries may have been renamed above, so only those which are still missing are removed
+	entries, err := db.List(database.ListOptions{})
+	if err != nil {
+		return errors.Wrap(err, "failed to list entries")
+	}
+
+	var removed int64
+
+	for _, entry := range entries {
+		if utils.PathExists(entry.Path) {
+			continue
+		}
+
+		affected, err := db.Remove(entry)
+		if err != nil {
+			return errors.Wrap(err, "failed to remove missing entry")
+		}
+
+		removed += affected
+	}
+
+	log.WithFields(log.Fields{"added": added, "removed": removed}).Info("Fixed database")
+
+	return nil
+}
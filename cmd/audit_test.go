@@ -0,0 +1,145 @@
+// Copyright 2020 James Lee <jamesl33info@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"hash/crc32"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/jamesl33/goamt/database"
+	"github.com/jamesl33/goamt/value"
+)
+
+func TestAudit(t *testing.T) {
+	tempDir := t.TempDir()
+
+	auditOptions.database = filepath.Join(tempDir, "goamt.db")
+	auditOptions.paths = []string{tempDir}
+	assumeYes(t)
+
+	checksum := func(data string) uint32 { return crc32.Checksum([]byte(data), crc32.MakeTable(crc32.IEEE)) }
+
+	files := map[string]string{
+		"unchanged.mp4": "unchanged",
+		"changed.mp4":   "changed",
+		"untracked.mp4": "untracked",
+		"renamed.mp4":   "renamed",
+		"ignored.txt":   "ignored",
+	}
+
+	for name, contents := range files {
+		err := ioutil.WriteFile(filepath.Join(tempDir, name), []byte(contents), 0o644)
+		if err != nil {
+			t.Fatalf("Expected to be able to create test file: %v", err)
+		}
+	}
+
+	createDatabaseAndPopulate(t, auditOptions.database, []value.Entry{
+		{Path: filepath.Join(tempDir, "unchanged.mp4"), Discovered: 8, Hash: checksum("unchanged")},
+		{Path: filepath.Join(tempDir, "changed.mp4"), Discovered: 8, Hash: checksum("original")},
+		{Path: filepath.Join(tempDir, "missing.mp4"), Discovered: 8, Hash: checksum("missing")},
+		{Path: filepath.Join(tempDir, "original.mp4"), Discovered: 8, Hash: checksum("renamed")},
+	})
+
+	db, err := database.OpenReadOnly(auditOptions.database)
+	if err != nil {
+		t.Fatalf("Expected to be able to open database: %v", err)
+	}
+
+	report, err := auditLibraries(db)
+	if err != nil {
+		t.Fatalf("Expected to be able to audit libraries: %v", err)
+	}
+
+	err = db.Close()
+	if err != nil {
+		t.Fatalf("Expected to be able to close database: %v", err)
+	}
+
+	var buffer bytes.Buffer
+
+	err = report.write(&buffer)
+	if err != nil {
+		t.Fatalf("Expected to be able to write report: %v", err)
+	}
+
+	expected := "missing: 2\n" +
+		"  " + filepath.Join(tempDir, "missing.mp4") + "\n" +
+		"  " + filepath.Join(tempDir, "original.mp4") + "\n" +
+		"untracked: 2\n" +
+		"  " + filepath.Join(tempDir, "renamed.mp4") + "\n" +
+		"  " + filepath.Join(tempDir, "untracked.mp4") + "\n" +
+		"changed: 1\n" +
+		"  " + filepath.Join(tempDir, "changed.mp4") + "\n"
+
+	if buffer.String() != expected {
+		t.Fatalf("Expected report:\n%s\nbut got:\n%s", expected, buffer.String())
+	}
+
+	// Without '--fix' the database is left untouched
+	err = audit(nil, nil)
+	if err != nil {
+		t.Fatalf("Expected to be able to audit libraries: %v", err)
+	}
+
+	assertDatabaseContains(t, auditOptions.database, []value.Entry{
+		{Path: filepath.Join(tempDir, "unchanged.mp4")},
+		{Path: filepath.Join(tempDir, "changed.mp4")},
+		{Path: filepath.Join(tempDir, "missing.mp4")},
+		{Path: filepath.Join(tempDir, "original.mp4")},
+	})
+
+	auditOptions.fix = true
+	defer func() { auditOptions.fix = false }()
+
+	err = audit(nil, nil)
+	if err != nil {
+		t.Fatalf("Expected to be able to fix libraries: %v", err)
+	}
+
+	// The renamed file is recorded against its existing entry, rather than being removed and re-added
+	assertDatabaseContains(t, auditOptions.database, []value.Entry{
+		{Path: filepath.Join(tempDir, "unchanged.mp4")},
+		{Path: filepath.Join(tempDir, "changed.mp4")},
+		{Path: filepath.Join(tempDir, "renamed.mp4")},
+		{Path: filepath.Join(tempDir, "untracked.mp4")},
+	})
+
+	db, err = database.OpenReadOnly(auditOptions.database)
+	if err != nil {
+		t.Fatalf("Expected to be able to open database: %v", err)
+	}
+	defer db.Close()
+
+	entry, err := db.FindByPath(filepath.Join(tempDir, "renamed.mp4"))
+	if err != nil || entry.ID != 4 {
+		t.Fatalf("Expected the renamed entry to keep its id but got %d: %v", entry.ID, err)
+	}
+
+	report, err = auditLibraries(db)
+	if err != nil {
+		t.Fatalf("Expected to be able to audit libraries: %v", err)
+	}
+
+	// Changed files are left for update to handle
+	if len(report.missing) != 0 || len(report.untracked) != 0 ||
+		!reflect.DeepEqual(entryPaths(report.changed), []string{filepath.Join(tempDir, "changed.mp4")}) {
+		t.Fatalf("Expected only the changed file to be reported once fixed, got %+v", report)
+	}
+}
@@ -0,0 +1,204 @@
+// Copyright 2020 James Lee <jamesl33info@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/jamesl33/goamt/database"
+	"github.com/jamesl33/goamt/utils"
+	"github.com/jamesl33/goamt/value"
+
+	"github.com/apex/log"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+// cleanupOptions - Encapsulates the options for the cleanup sub-command.
+var cleanupOptions = struct {
+	database string
+	paths    []string
+	dryRun   bool
+}{}
+
+// cleanupCommand - The cleanup sub-command, used to remove incomplete transcoded files which aren't associated with a
+// job (e.g. left behind by a run which was killed, before its database was recovered).
+var cleanupCommand = &cobra.Command{
+	RunE:  cleanup,
+	Short: "Remove orphaned incomplete transcoded files from a media library",
+	Use:   "cleanup",
+}
+
+// init - Initialize the flags/arguments for the cleanup sub-command.
+func init() {
+	cleanupCommand.Flags().StringVarP(
+		&cleanupOptions.database,
+		"database",
+		"d",
+		"",
+		"path to a goamt SQLite database",
+	)
+
+	cleanupCommand.Flags().StringArrayVarP(
+		&cleanupOptions.paths,
+		"path",
+		"p",
+		nil,
+		"path to a media library, may be provided multiple times",
+	)
+
+	cleanupCommand.Flags().BoolVar(
+		&cleanupOptions.dryRun,
+		"dry-run",
+		false,
+		"list the orphaned files which would be removed without removing them",
+	)
+
+	markDatabaseRequired(cleanupCommand)
+	markFlagRequired(cleanupCommand, "path")
+}
+
+// cleanup - Run the cleanup sub-command, this will walk the provided media libraries listing the incomplete transcoded
+// files which don't belong to a job, then remove them once confirmed. Files belonging to jobs are left for recovery,
+// since the jobs may belong to another goamt process.
+func cleanup(_ *cobra.Command, _ []string) error {
+	db, err := database.OpenReadOnly(cleanupOptions.database)
+	if err != nil {
+		return errors.Wrap(err, "failed to open SQLite database")
+	}
+
+	active, err := activeTranscodingFiles(db)
+	if err != nil {
+		return err // Purposefully not wrapped
+	}
+
+	orphaned := make([]string, 0)
+
+	for _, root := range cleanupOptions.paths {
+		err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() || !strings.HasSuffix(path, value.TranscodingExtension) {
+				return err
+			}
+
+			abs, err := filepath.Abs(path)
+			if err != nil {
+				return err
+			}
+
+			if !active[abs] {
+				fmt.Printf("%s\n", path)
+				orphaned = append(orphaned, path)
+			}
+
+			return nil
+		})
+		if err != nil {
+			return errors.Wrap(err, "unexpected error during file walk")
+		}
+	}
+
+	if cleanupOptions.dryRun || len(orphaned) == 0 {
+		return db.Close()
+	}
+
+	proceed, err := confirm(fmt.Sprintf("%d orphaned file(s) will be removed, continue?", len(orphaned)))
+	if err != nil {
+		return errors.Wrap(err, "failed to confirm removal")
+	}
+
+	if proceed {
+		err = removeOrphaned(db, orphaned)
+		if err != nil {
+			return err // Purposefully not wrapped
+		}
+	}
+
+	err = db.Close()
+	if err != nil {
+		return errors.Wrap(err, "failed to close database")
+	}
+
+	return nil
+}
+
+// removeOrphaned - Remove the provided orphaned files; the jobs are checked again first since another goamt process
+// may have started transcoding one of the entries whilst we were walking (or awaiting confirmation).
+func removeOrphaned(db *database.Database, orphaned []string) error {
+	active, err := activeTranscodingFiles(db)
+	if err != nil {
+		return err // Purposefully not wrapped
+	}
+
+	var removed int
+
+	for _, path := range orphaned {
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return errors.Wrap(err, "failed to determine absolute path")
+		}
+
+		if active[abs] {
+			log.WithField("path", path).Warn("File now belongs to a job, skipping")
+			continue
+		}
+
+		err = os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, "failed to remove orphaned file")
+		}
+
+		removed++
+	}
+
+	log.WithField("removed", removed).Info("Removed orphaned files")
+
+	return nil
+}
+
+// activeTranscodingFiles - Returns the set of (absolute) paths of the incomplete transcoded files which belong to the
+// jobs in the provided database, including those being written to a temporary directory.
+func activeTranscodingFiles(db *database.Database) (map[string]bool, error) {
+	jobs, err := db.Jobs()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get jobs")
+	}
+
+	active := make(map[string]bool, len(jobs))
+
+	for _, job := range jobs {
+		// Jobs created by older versions of goamt won't have a target, they were transcoded alongside the source file
+		target := utils.ReplaceExtension(job.Entry.Path, value.TargetExtension)
+		if job.Target != nil {
+			target = *job.Target
+		}
+
+		abs, err := filepath.Abs(utils.ReplaceExtension(target, value.TranscodingExtension))
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to determine absolute path")
+		}
+
+		active[abs] = true
+
+		// The temporary path is always stored as an absolute path
+		if job.Temporary != nil {
+			active[*job.Temporary] = true
+		}
+	}
+
+	return active, nil
+}
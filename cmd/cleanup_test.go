@@ -0,0 +1,113 @@
+// Copyright 2020 James Lee <jamesl33info@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/jamesl33/goamt/database"
+	"github.com/jamesl33/goamt/utils"
+	"github.com/jamesl33/goamt/value"
+)
+
+func TestCleanup(t *testing.T) {
+	tempDir := t.TempDir()
+
+	cleanupOptions.database = filepath.Join(tempDir, "goamt.db")
+	cleanupOptions.paths = []string{tempDir}
+	cleanupOptions.dryRun = true
+	assumeYes(t)
+
+	defer func() { cleanupOptions.dryRun = false }()
+
+	createDatabaseAndPopulate(t, cleanupOptions.database, []value.Entry{
+		{Path: filepath.Join(tempDir, "active.avi"), Discovered: 8, Hash: 16},
+		{Path: filepath.Join(tempDir, "scratch.avi"), Discovered: 16, Hash: 32},
+	})
+
+	err := os.Mkdir(filepath.Join(tempDir, "scratch"), 0o755)
+	if err != nil {
+		t.Fatalf("Expected to be able to create test directory: %v", err)
+	}
+
+	db, err := database.Open(cleanupOptions.database)
+	if err != nil {
+		t.Fatalf("Expected to be able to open database: %v", err)
+	}
+
+	_, err = db.BeginTranscoding(database.SelectOptions{})
+	if err != nil {
+		t.Fatalf("Expected to be able to begin transcoding: %v", err)
+	}
+
+	// The file being written to a temporary directory belongs to an active job, so mustn't be removed
+	_, err = db.BeginTranscoding(database.SelectOptions{
+		Temporary: func(entry value.Entry) string {
+			return filepath.Join(tempDir, "scratch", strconv.Itoa(entry.ID)+value.TranscodingExtension)
+		},
+	})
+	if err != nil {
+		t.Fatalf("Expected to be able to begin transcoding: %v", err)
+	}
+
+	err = db.Close()
+	if err != nil {
+		t.Fatalf("Expected to be able to close database: %v", err)
+	}
+
+	files := []string{
+		"active.avi",
+		"active.transcoding.mp4",
+		"orphaned.transcoding.mp4",
+		"other.mp4",
+		"scratch.avi",
+		filepath.Join("scratch", "2.transcoding.mp4"),
+	}
+
+	for _, file := range files {
+		err = ioutil.WriteFile(filepath.Join(tempDir, file), []byte(file), 0o755)
+		if err != nil {
+			t.Fatalf("Expected to be able to create test file: %v", err)
+		}
+	}
+
+	err = cleanup(nil, nil)
+	if err != nil {
+		t.Fatalf("Expected to be able to list orphaned files: %v", err)
+	}
+
+	for _, file := range files {
+		if !utils.PathExists(filepath.Join(tempDir, file)) {
+			t.Fatalf("Expected file '%s' not to be removed by a dry run", file)
+		}
+	}
+
+	cleanupOptions.dryRun = false
+
+	err = cleanup(nil, nil)
+	if err != nil {
+		t.Fatalf("Expected to be able to remove orphaned files: %v", err)
+	}
+
+	for _, file := range files {
+		if utils.PathExists(filepath.Join(tempDir, file)) != (file != "orphaned.transcoding.mp4") {
+			t.Fatalf("Expected only the orphaned file to be removed, unexpected state for '%s'", file)
+		}
+	}
+}
@@ -34,8 +34,12 @@ import (
 
 // convertOptions - Encapsulates the options for the convert sub-command.
 var convertOptions = struct {
-	source, sink string
-	threads      int
+	source, sink    string
+	threads         int
+	skipMissing     bool
+	summary         bool
+	fastImport      bool
+	mtimeDiscovered bool
 }{}
 
 // convertCommand - The convert sub-command, used to convert a pytranscoder yaml file into a goamt SQLite database.
@@ -71,8 +75,38 @@ func init() {
 		"the number of threads to use, defaults to the number of vCPUs",
 	)
 
+	convertCommand.Flags().BoolVar(
+		&convertOptions.skipMissing,
+		"skip-missing",
+		false,
+		"warn about (and skip) files referenced in the source file which no longer exist, instead of failing",
+	)
+
+	convertCommand.Flags().BoolVar(
+		&convertOptions.summary,
+		"summary",
+		false,
+		"print the number of entries which were inserted, updated and skipped once complete",
+	)
+
+	convertCommand.Flags().BoolVar(
+		&convertOptions.fastImport,
+		"fast-import",
+		false,
+		"disable syncing database writes to disk, speeding up a bulk import at the cost of durability; a power loss or "+
+			"crash during the import may corrupt the database",
+	)
+
+	convertCommand.Flags().BoolVar(
+		&convertOptions.mtimeDiscovered,
+		"mtime-discovered",
+		false,
+		"use the modification time of each file as the time it was discovered (rather than the current time), "+
+			"preserving the chronological order of the original library",
+	)
+
 	markFlagRequired(convertCommand, "source")
-	markFlagRequired(convertCommand, "database")
+	markDatabaseRequired(convertCommand)
 }
 
 // convert - Run the convert sub-command, this will create a new goamt SQLite database then concurrently hash and insert
@@ -107,13 +141,14 @@ func convert(_ *cobra.Command, _ []string) error {
 	fields := log.Fields{"transcoded": len(overlay.Transcoded), "untranscoded": len(overlay.Untranscoded)}
 	log.WithFields(fields).Debug("Successfully decoded source file")
 
-	db, err := database.Create(convertOptions.sink)
+	db, err := database.CreateWithOptions(convertOptions.sink, databaseOptions(convertOptions.fastImport))
 	if err != nil {
 		return errors.Wrap(err, "failed to create sink database")
 	}
 
 	var (
-		pool                     = NewUpdatePool(db)
+		outcomes                 upsertOutcomes
+		pool                     = NewUpdatePool(db, utils.HashOptions{Algorithm: db.HashAlgorithm()}, &outcomes)
 		entryStream, errorStream = pool.Start(ctx, convertOptions.threads)
 	)
 
@@ -121,12 +156,12 @@ func convert(_ *cobra.Command, _ []string) error {
 	// those in the untranscoded list.
 	err = queueEntries(ctx, entryStream, errorStream, sort.StringSlice(overlay.Untranscoded), false)
 	if err != nil {
-		return err // Purposefully not wrapped
+		return pool.failure(err) // Purposefully not wrapped
 	}
 
 	err = queueEntries(ctx, entryStream, errorStream, sort.StringSlice(overlay.Transcoded), true)
 	if err != nil {
-		return err // Purposefully not wrapped
+		return pool.failure(err) // Purposefully not wrapped
 	}
 
 	err = pool.Stop()
@@ -139,18 +174,49 @@ func convert(_ *cobra.Command, _ []string) error {
 		return errors.Wrap(err, "failed to close database")
 	}
 
+	if !convertOptions.summary {
+		return nil
+	}
+
+	err = outcomes.write(os.Stdout)
+	if err != nil {
+		return errors.Wrap(err, "failed to write summary")
+	}
+
 	return nil
 }
 
 // queueEntries - Convert the provided slice of paths into entries and queue them for processing by the worker pool.
+// pytranscoder inventories often reference files which have since been moved/removed, these are either skipped or
+// result in an error depending on whether '--skip-missing' was supplied. Entries are discovered now, unless
+// '--mtime-discovered' was supplied in which case each file's modification time is used instead.
 func queueEntries(ctx context.Context, entryStream chan<- value.Entry, errorStream <-chan error, paths []string,
 	populateTranscoded bool) error {
 	for _, path := range paths {
+		if !utils.PathExists(path) {
+			if !convertOptions.skipMissing {
+				return fmt.Errorf("referenced file not found: %s", path)
+			}
+
+			log.WithField("path", path).Warn("Skipping referenced file which no longer exists")
+
+			continue
+		}
+
 		var (
 			discovered = time.Now().Unix()
 			transcoded *int64
 		)
 
+		if convertOptions.mtimeDiscovered {
+			stats, err := os.Stat(path)
+			if err != nil {
+				return errors.Wrap(err, "failed to stat referenced file")
+			}
+
+			discovered = stats.ModTime().Unix()
+		}
+
 		if populateTranscoded {
 			transcoded = utils.Int64P(discovered)
 		}
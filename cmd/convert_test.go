@@ -17,10 +17,13 @@ package cmd
 import (
 	"fmt"
 	"io/ioutil"
+	"os"
 	"path/filepath"
 	"strconv"
 	"testing"
+	"time"
 
+	"github.com/jamesl33/goamt/database"
 	"github.com/jamesl33/goamt/utils"
 	"github.com/jamesl33/goamt/value"
 
@@ -123,3 +126,135 @@ func TestConvert(t *testing.T) {
 
 	assertDatabaseContains(t, convertOptions.sink, expected)
 }
+
+func TestConvertMtimeDiscovered(t *testing.T) {
+	tempDir := t.TempDir()
+
+	convertOptions.source = filepath.Join(tempDir, "pytranscoder.yml")
+	convertOptions.sink = filepath.Join(tempDir, "goamt.db")
+	convertOptions.mtimeDiscovered = true
+
+	defer func() { convertOptions.mtimeDiscovered = false }()
+
+	var (
+		transcoded   = filepath.Join(tempDir, "transcoded1.mp4")
+		untranscoded = filepath.Join(tempDir, "untranscoded1.avi")
+		modified     = map[string]time.Time{
+			transcoded:   time.Unix(1_000_000_000, 0),
+			untranscoded: time.Unix(1_200_000_000, 0),
+		}
+	)
+
+	for path, mtime := range modified {
+		err := ioutil.WriteFile(path, []byte(path), 0o755)
+		if err != nil {
+			t.Fatalf("Expected to be able to create test file: %v", err)
+		}
+
+		err = os.Chtimes(path, mtime, mtime)
+		if err != nil {
+			t.Fatalf("Expected to be able to set modification time: %v", err)
+		}
+	}
+
+	data, err := yaml.Marshal(map[string][]string{"transcoded": {transcoded}, "untranscoded": {untranscoded}})
+	if err != nil {
+		t.Fatalf("Expected to be able to marshal contents: %v", err)
+	}
+
+	err = ioutil.WriteFile(convertOptions.source, data, 0o755)
+	if err != nil {
+		t.Fatalf("Expected to be able to create test source file: %v", err)
+	}
+
+	err = convert(nil, nil)
+	if err != nil {
+		t.Fatalf("Expected to be able to convert file: %v", err)
+	}
+
+	db, err := database.Open(convertOptions.sink)
+	if err != nil {
+		t.Fatalf("Expected to be able to open database: %v", err)
+	}
+	defer db.Close()
+
+	for path, mtime := range modified {
+		hash, err := utils.HashFile(path)
+		if err != nil {
+			t.Fatalf("Expected to be able to hash file: %v", err)
+		}
+
+		entry, err := db.FindByHash(hash)
+		if err != nil {
+			t.Fatalf("Expected to be able to find entry: %v", err)
+		}
+
+		if entry.Discovered != mtime.Unix() {
+			t.Fatalf("Expected '%s' to have been discovered at %d but got %d", path, mtime.Unix(), entry.Discovered)
+		}
+
+		if path == transcoded && (entry.Transcoded == nil || *entry.Transcoded != mtime.Unix()) {
+			t.Fatalf("Expected '%s' to have been transcoded at %d", path, mtime.Unix())
+		}
+	}
+}
+
+func TestConvertReferencedFileNotFound(t *testing.T) {
+	tempDir := t.TempDir()
+
+	convertOptions.source = filepath.Join(tempDir, "pytranscoder.yml")
+	convertOptions.sink = filepath.Join(tempDir, "goamt.db")
+
+	missing := filepath.Join(tempDir, "missing.avi")
+
+	data, err := yaml.Marshal(map[string][]string{"untranscoded": {missing}})
+	if err != nil {
+		t.Fatalf("Expected to be able to marshal contents: %v", err)
+	}
+
+	err = ioutil.WriteFile(convertOptions.source, data, 0o755)
+	if err != nil {
+		t.Fatalf("Expected to be able to create test source file: %v", err)
+	}
+
+	err = convert(nil, nil)
+	if err == nil || err.Error() != fmt.Sprintf("referenced file not found: %s", missing) {
+		t.Fatalf("Expected an error if a referenced file does not exist, got %v", err)
+	}
+}
+
+func TestConvertSkipMissing(t *testing.T) {
+	tempDir := t.TempDir()
+
+	convertOptions.source = filepath.Join(tempDir, "pytranscoder.yml")
+	convertOptions.sink = filepath.Join(tempDir, "goamt.db")
+	convertOptions.skipMissing = true
+
+	defer func() { convertOptions.skipMissing = false }()
+
+	present := filepath.Join(tempDir, "present.avi")
+
+	err := ioutil.WriteFile(present, []byte("present"), 0o755)
+	if err != nil {
+		t.Fatalf("Expected to be able to create test file: %v", err)
+	}
+
+	data, err := yaml.Marshal(map[string][]string{
+		"untranscoded": {filepath.Join(tempDir, "missing.avi"), present},
+	})
+	if err != nil {
+		t.Fatalf("Expected to be able to marshal contents: %v", err)
+	}
+
+	err = ioutil.WriteFile(convertOptions.source, data, 0o755)
+	if err != nil {
+		t.Fatalf("Expected to be able to create test source file: %v", err)
+	}
+
+	err = convert(nil, nil)
+	if err != nil {
+		t.Fatalf("Expected to be able to convert file: %v", err)
+	}
+
+	assertDatabaseContains(t, convertOptions.sink, []value.Entry{{Path: present}})
+}
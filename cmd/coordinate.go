@@ -0,0 +1,606 @@
+// Copyright 2020 James Lee <jamesl33info@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jamesl33/goamt/database"
+	"github.com/jamesl33/goamt/utils"
+	"github.com/jamesl33/goamt/utils/sqlite"
+	"github.com/jamesl33/goamt/value"
+
+	"github.com/apex/log"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+// coordinatorShutdownTimeout - The maximum amount of time to wait for in-flight worker requests when stopping.
+const coordinatorShutdownTimeout = 5 * time.Second
+
+// coordinatorTokenEnv - The environment variable which may be used to provide the token, rather than passing '--token'
+// (which would be visible to other users in the process list).
+const coordinatorTokenEnv = "GOAMT_COORDINATOR_TOKEN"
+
+// coordinatorLeaseInterval - How often the coordinator checks for (and rolls back) jobs whose lease has expired.
+const coordinatorLeaseInterval = time.Minute
+
+// coordinateOptions - Encapsulates the options for the coordinate sub-command.
+var coordinateOptions = struct {
+	database, listen, only, token string
+	lease                         time.Duration
+	minSavings                    float64
+	verifyDecode, onlyIfSmaller   bool
+}{}
+
+// coordinateCommand - The coordinate sub-command, used to hand out entries to remote workers over HTTP.
+var coordinateCommand = &cobra.Command{
+	RunE:  coordinate,
+	Short: "Serve transcode jobs from a goamt SQLite database to remote workers",
+	Use:   "coordinate",
+}
+
+// init - Initialize the flags/arguments for the coordinate sub-command.
+func init() {
+	coordinateCommand.Flags().StringVarP(
+		&coordinateOptions.database,
+		"database",
+		"d",
+		"",
+		"path to a goamt SQLite database",
+	)
+
+	coordinateCommand.Flags().StringVar(
+		&coordinateOptions.listen,
+		"listen",
+		"127.0.0.1:8090",
+		"the address to serve the coordinator API on",
+	)
+
+	coordinateCommand.Flags().StringVar(
+		&coordinateOptions.token,
+		"token",
+		"",
+		"the token workers must provide to use the coordinator API, defaults to $"+coordinatorTokenEnv,
+	)
+
+	coordinateCommand.Flags().DurationVar(
+		&coordinateOptions.lease,
+		"lease",
+		time.Hour,
+		"roll back jobs which aren't completed, cancelled or renewed by the worker within this duration",
+	)
+
+	coordinateCommand.Flags().BoolVar(
+		&coordinateOptions.verifyDecode,
+		"verify-decode",
+		true,
+		"fully decode each file written by a worker before it replaces the source, cancelling the job if ffmpeg reports "+
+			"any errors",
+	)
+
+	coordinateCommand.Flags().BoolVar(
+		&coordinateOptions.onlyIfSmaller,
+		"only-if-smaller",
+		false,
+		"cancel jobs whose file written by the worker isn't smaller than the source",
+	)
+
+	coordinateCommand.Flags().Float64Var(
+		&coordinateOptions.minSavings,
+		"min-savings",
+		0,
+		"the percentage by which files written by workers must be smaller than their source when using "+
+			"--only-if-smaller",
+	)
+
+	coordinateCommand.Flags().StringVar(
+		&coordinateOptions.only,
+		"only",
+		"",
+		"only hand out entries whose path is equal to (or within) this path",
+	)
+
+	markDatabaseRequired(coordinateCommand)
+}
+
+// coordinatorJob - A job handed out to a worker; the worker should transcode the file at 'Path' writing the result to
+// 'Transcoding', then complete (or cancel) the job.
+type coordinatorJob struct {
+	ID          int    `json:"id"`
+	Path        string `json:"path"`
+	Target      string `json:"target"`
+	Transcoding string `json:"transcoding"`
+}
+
+// coordinator - HTTP handler which hands out jobs to remote workers, the API is:
+//
+// POST /v1/jobs               - Begin a new job, returns a 'coordinatorJob' or 204 when there's nothing to transcode
+// POST /v1/jobs/<id>/renew    - Extend the lease of the job, so that it's not rolled back
+// POST /v1/jobs/<id>/complete - Move the transcoded file into place (replacing the source) and complete the job
+// POST /v1/jobs/<id>/cancel   - Remove any transcoded file and cancel the job, the entry will be handed out again
+//
+// Every request must provide the shared token using the 'Authorization: Bearer <token>' header. Workers must be able
+// to access the media library (e.g. via a network share) using the same paths as the coordinator.
+type coordinator struct {
+	db      *database.Database
+	options database.SelectOptions
+	token   string
+	lease   time.Duration
+
+	// leases - The time at which each job handed out by this coordinator expires, keyed by entry id. Only jobs handed
+	// out by this coordinator may be renewed, completed or cancelled.
+	leases map[int]time.Time
+	now    func() time.Time
+	lock   sync.Mutex
+
+	// The checks run against the file written by the worker before it replaces the source, see 'verify'
+	verifyDecode, onlyIfSmaller bool
+	minSavings                  float64
+}
+
+// newCoordinator - Create a new coordinator handing out jobs from the provided database, optionally limited to entries
+// within the given prefix. Files are always transcoded alongside their source.
+func newCoordinator(db *database.Database, prefix, token string, lease time.Duration) *coordinator {
+	target := func(entry value.Entry) (string, error) {
+		return utils.ReplaceExtension(entry.Path, value.TargetExtension), nil
+	}
+
+	return &coordinator{
+		db:      db,
+		options: database.SelectOptions{Target: target, Prefix: prefix},
+		token:   token,
+		lease:   lease,
+		leases:  make(map[int]time.Time),
+		now:     time.Now,
+	}
+}
+
+// ServeHTTP - Implement the 'http.Handler' interface, routing requests to the relevant endpoint.
+func (c *coordinator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !c.authorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	err := c.expireLOCKED()
+	if err != nil {
+		coordinatorError(w, errors.Wrap(err, "failed to expire jobs"))
+		return
+	}
+
+	if r.URL.Path == "/v1/jobs" {
+		c.begin(w)
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/v1/jobs/"), "/")
+	if len(parts) != 2 || !strings.HasPrefix(r.URL.Path, "/v1/jobs/") {
+		http.NotFound(w, r)
+		return
+	}
+
+	id, err := strconv.Atoi(parts[0])
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid job id '%s'", parts[0]), http.StatusBadRequest)
+		return
+	}
+
+	switch parts[1] {
+	case "renew":
+		c.renew(w, id)
+	case "complete":
+		c.complete(r.Context(), w, id)
+	case "cancel":
+		c.cancel(w, id)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// begin - Begin a new job, writing it to the provided response.
+func (c *coordinator) begin(w http.ResponseWriter) {
+	entry, target, err := c.beginTranscoding()
+	if errors.Is(err, sqlite.ErrQueryReturnedNoRows) {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if err != nil {
+		coordinatorError(w, errors.Wrap(err, "failed to begin transcoding"))
+		return
+	}
+
+	job := coordinatorJob{
+		ID:          entry.ID,
+		Path:        entry.Path,
+		Target:      target,
+		Transcoding: utils.ReplaceExtension(target, value.TranscodingExtension),
+	}
+
+	c.leases[entry.ID] = c.now().Add(c.lease)
+
+	log.WithFields(entry).Info("Handed out job to worker")
+
+	w.Header().Set("Content-Type", "application/json")
+
+	err = json.NewEncoder(w).Encode(job)
+	if err != nil {
+		log.WithError(err).Warn("Failed to write job")
+	}
+}
+
+// beginTranscoding - Begin transcoding the next entry, returning it along with its target. Entries whose target
+// collides with another file/entry are skipped (and won't be handed out again by this coordinator), since completing
+// them would overwrite it.
+func (c *coordinator) beginTranscoding() (value.Entry, string, error) {
+	for {
+		entry, err := c.db.BeginTranscoding(c.options)
+		if err != nil {
+			return value.Entry{}, "", err
+		}
+
+		target := utils.ReplaceExtension(entry.Path, value.TargetExtension)
+
+		collision := targetCollision(c.db, entry, target)
+		if collision == nil {
+			return entry, target, nil
+		}
+
+		log.WithError(collision).WithFields(entry).Warn("Target of entry collides, skipping")
+
+		err = c.db.CancelTranscoding(entry)
+		if err != nil {
+			return value.Entry{}, "", errors.Wrap(err, "failed to cancel transcoding")
+		}
+
+		c.options.Exclude = append(c.options.Exclude, entry.ID)
+	}
+}
+
+// renew - Extend the lease of the job for the entry with the provided id.
+func (c *coordinator) renew(w http.ResponseWriter, id int) {
+	_, ok, err := c.findJob(id)
+	if err != nil || !ok {
+		coordinatorJobError(w, id, err)
+		return
+	}
+
+	c.leases[id] = c.now().Add(c.lease)
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// complete - Complete the job for the entry with the provided id, the worker must have written the transcoded file.
+// The file is verified before it replaces the source; the job is cancelled if it's rejected, or if the target has since
+// been created. The lock must be held by the caller, it's released whilst verifying.
+func (c *coordinator) complete(ctx context.Context, w http.ResponseWriter, id int) {
+	job, ok, err := c.findJob(id)
+	if err != nil || !ok {
+		coordinatorJobError(w, id, err)
+		return
+	}
+
+	target := utils.ReplaceExtension(job.Entry.Path, value.TargetExtension)
+	if job.Target != nil {
+		target = *job.Target
+	}
+
+	transcoding := utils.ReplaceExtension(target, value.TranscodingExtension)
+
+	if !utils.PathExists(transcoding) {
+		http.Error(w, fmt.Sprintf("transcoded file for job %d not found", id), http.StatusConflict)
+		return
+	}
+
+	// Verifying may take a while so other requests are handled meanwhile, the lease is removed so that the job can't
+	// expire (or be acted upon by another request) in the meantime
+	delete(c.leases, id)
+
+	c.lock.Unlock()
+	rejected := c.verify(ctx, job.Entry.Path, transcoding)
+	c.lock.Lock()
+
+	if rejected != nil && ctx.Err() != nil {
+		c.leases[id] = c.now().Add(c.lease)
+		coordinatorError(w, errors.Wrap(ctx.Err(), "failed to verify transcoded file"))
+
+		return
+	}
+
+	if rejected == nil {
+		rejected = targetCollision(c.db, job.Entry, target)
+	}
+
+	if rejected != nil {
+		log.WithError(rejected).WithFields(job).Warn("Rejected transcoded file from worker, cancelling job")
+
+		err = c.cancelJob(job)
+		if err != nil {
+			coordinatorError(w, err)
+			return
+		}
+
+		http.Error(w, fmt.Sprintf("transcoded file for job %d rejected: %v", id, rejected),
+			http.StatusUnprocessableEntity)
+
+		return
+	}
+
+	err = finishTranscoding(c.db, job.Entry, target, false, filepath.Dir(target) == filepath.Dir(job.Entry.Path))
+	if err != nil {
+		c.leases[id] = c.now().Add(c.lease)
+		coordinatorError(w, errors.Wrap(err, "failed to complete transcoding"))
+
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// verify - Returns an error if the transcoded file written by the worker shouldn't replace the provided source, i.e.
+// it's not sufficiently smaller or fails to decode (e.g. because it was truncated).
+func (c *coordinator) verify(ctx context.Context, source, transcoding string) error {
+	if c.onlyIfSmaller {
+		smaller, err := smallerBy(source, transcoding, c.minSavings)
+		if err != nil {
+			return errors.Wrap(err, "failed to compare file sizes")
+		}
+
+		if !smaller {
+			return errors.New("transcoded file is not sufficiently smaller than the source")
+		}
+	}
+
+	if !c.verifyDecode {
+		return nil
+	}
+
+	err := verifyDecodeFunc(ctx, transcoding, utils.TranscodeOptions{})
+	if err != nil {
+		return errors.Wrap(err, "failed to verify transcoded file")
+	}
+
+	return nil
+}
+
+// cancel - Cancel the job for the entry with the provided id, removing any transcoded file written by the worker.
+func (c *coordinator) cancel(w http.ResponseWriter, id int) {
+	job, ok, err := c.findJob(id)
+	if err != nil || !ok {
+		coordinatorJobError(w, id, err)
+		return
+	}
+
+	err = c.cancelJob(job)
+	if err != nil {
+		coordinatorError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// cancelJob - Remove any transcoded file written by the worker, then cancel the provided job and forget its lease.
+func (c *coordinator) cancelJob(job value.Job) error {
+	target := utils.ReplaceExtension(job.Entry.Path, value.TargetExtension)
+	if job.Target != nil {
+		target = *job.Target
+	}
+
+	err := os.Remove(utils.ReplaceExtension(target, value.TranscodingExtension))
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "failed to remove transcoded file")
+	}
+
+	err = c.db.CancelTranscoding(job.Entry)
+	if err != nil {
+		return errors.Wrap(err, "failed to cancel transcoding")
+	}
+
+	delete(c.leases, job.Entry.ID)
+
+	return nil
+}
+
+// expire - Roll back any jobs whose lease has expired, i.e. those abandoned by a worker which stopped.
+func (c *coordinator) expire() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.expireLOCKED()
+}
+
+// expireLOCKED - See 'expire', the lock must be held by the caller.
+func (c *coordinator) expireLOCKED() error {
+	now := c.now()
+
+	for id, expires := range c.leases {
+		if now.Before(expires) {
+			continue
+		}
+
+		job, ok, err := c.findJob(id)
+		if err != nil {
+			return err
+		}
+
+		if !ok {
+			delete(c.leases, id)
+			continue
+		}
+
+		log.WithFields(job).Warn("Lease expired, rolling back job")
+
+		err = c.cancelJob(job)
+		if err != nil {
+			return errors.Wrapf(err, "failed to roll back job %d", id)
+		}
+	}
+
+	return nil
+}
+
+// findJob - Returns the job for the entry with the provided id, and whether it was found. Only jobs handed out by this
+// coordinator are returned, so workers can't interfere with those being transcoded by another goamt process.
+func (c *coordinator) findJob(id int) (value.Job, bool, error) {
+	if _, ok := c.leases[id]; !ok {
+		return value.Job{}, false, nil
+	}
+
+	jobs, err := c.db.Jobs()
+	if err != nil {
+		return value.Job{}, false, errors.Wrap(err, "failed to get jobs")
+	}
+
+	for _, job := range jobs {
+		if job.Entry.ID == id {
+			return job, true, nil
+		}
+	}
+
+	return value.Job{}, false, nil
+}
+
+// authorized - Returns a boolean indicating whether the provided request included the shared token.
+func (c *coordinator) authorized(r *http.Request) bool {
+	expected := "Bearer " + c.token
+
+	return c.token != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte(expected)) == 1
+}
+
+// coordinatorJobError - Write the provided error to the response, or a 404 if the error is nil (i.e. the job with the
+// given id wasn't found).
+func coordinatorJobError(w http.ResponseWriter, id int, err error) {
+	if err != nil {
+		coordinatorError(w, err)
+		return
+	}
+
+	http.Error(w, fmt.Sprintf("job %d not found", id), http.StatusNotFound)
+}
+
+// coordinatorError - Log, then write the provided error to the response.
+func coordinatorError(w http.ResponseWriter, err error) {
+	log.WithError(err).Error("Failed to handle worker request")
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
+// coordinate - Run the coordinate sub-command, this will serve jobs to remote workers until interrupted.
+func coordinate(_ *cobra.Command, _ []string) error {
+	token := coordinateOptions.token
+	if token == "" {
+		token = os.Getenv(coordinatorTokenEnv)
+	}
+
+	if token == "" {
+		return fmt.Errorf("a token must be provided using '--token' or $%s", coordinatorTokenEnv)
+	}
+
+	if coordinateOptions.lease <= 0 {
+		return fmt.Errorf("lease %s must be positive", coordinateOptions.lease)
+	}
+
+	if coordinateOptions.minSavings < 0 || coordinateOptions.minSavings >= 100 {
+		return fmt.Errorf("minimum savings %g%% is not in the range 0 to 100", coordinateOptions.minSavings)
+	}
+
+	db, err := database.Open(coordinateOptions.database)
+	if err != nil {
+		return errors.Wrap(err, "failed to open SQLite database")
+	}
+
+	// Jobs handed out by a previous coordinator are recovered, so workers which outlived it can't complete them
+	err = db.Recover()
+	if err != nil {
+		return errors.Wrap(err, "failed to recover incomplete jobs")
+	}
+
+	var prefix string
+	if coordinateOptions.only != "" {
+		prefix = filepath.Clean(coordinateOptions.only)
+	}
+
+	listener, err := net.Listen("tcp", coordinateOptions.listen)
+	if err != nil {
+		return errors.Wrap(err, "failed to listen")
+	}
+
+	var (
+		ctx     = signalHandler()
+		handler = newCoordinator(db, prefix, token, coordinateOptions.lease)
+		server  = &http.Server{Handler: handler}
+		errs    = make(chan error, 1)
+		ticker  = time.NewTicker(coordinatorLeaseInterval)
+	)
+
+	defer ticker.Stop()
+
+	handler.verifyDecode = coordinateOptions.verifyDecode
+	handler.onlyIfSmaller = coordinateOptions.onlyIfSmaller
+	handler.minSavings = coordinateOptions.minSavings
+
+	go func() { errs <- server.Serve(listener) }()
+
+	log.WithField("addr", listener.Addr().String()).Info("Serving jobs to workers")
+
+	for done := false; !done; {
+		select {
+		case err = <-errs:
+			return errors.Wrap(err, "failed to serve coordinator API")
+		case <-ticker.C:
+			err = handler.expire()
+			if err != nil {
+				log.WithError(err).Error("Failed to expire jobs")
+			}
+		case <-ctx.Done():
+			done = true
+		}
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), coordinatorShutdownTimeout)
+	defer cancel()
+
+	err = server.Shutdown(shutdownCtx)
+	if err != nil {
+		return errors.Wrap(err, "failed to stop coordinator")
+	}
+
+	err = db.Close()
+	if err != nil {
+		return errors.Wrap(err, "failed to close database")
+	}
+
+	return nil
+}
@@ -0,0 +1,475 @@
+// Copyright 2020 James Lee <jamesl33info@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jamesl33/goamt/database"
+	"github.com/jamesl33/goamt/utils"
+	"github.com/jamesl33/goamt/value"
+
+	"github.com/pkg/errors"
+)
+
+// testCoordinatorToken - The token used to authenticate requests to coordinators created by tests.
+const testCoordinatorToken = "token"
+
+// coordinatorRequest - Send an authenticated POST request to the provided path, returning the recorded response.
+func coordinatorRequest(handler http.Handler, path string) *httptest.ResponseRecorder {
+	return coordinatorRequestWithToken(handler, path, testCoordinatorToken)
+}
+
+// coordinatorRequestWithToken - Send a POST request to the provided path using the given token, returning the
+// recorded response.
+func coordinatorRequestWithToken(handler http.Handler, path, token string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(http.MethodPost, path, nil)
+	request.Header.Set("Authorization", "Bearer "+token)
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+
+	return recorder
+}
+
+// beginCoordinatorJob - Begin a job using the provided handler, failing the test if one isn't handed out.
+func beginCoordinatorJob(t *testing.T, handler http.Handler) coordinatorJob {
+	recorder := coordinatorRequest(handler, "/v1/jobs")
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected status %d but got %d: %s", http.StatusOK, recorder.Code, recorder.Body)
+	}
+
+	var job coordinatorJob
+
+	err := json.NewDecoder(recorder.Body).Decode(&job)
+	if err != nil {
+		t.Fatalf("Expected to be able to decode job: %v", err)
+	}
+
+	return job
+}
+
+func TestCoordinator(t *testing.T) {
+	var (
+		tempDir = t.TempDir()
+		path    = filepath.Join(tempDir, "goamt.db")
+		source  = filepath.Join(tempDir, "test.mkv")
+	)
+
+	err := ioutil.WriteFile(source, []byte("0"), 0o755)
+	if err != nil {
+		t.Fatalf("Expected to be able to create test file: %v", err)
+	}
+
+	createDatabaseAndPopulate(t, path, []value.Entry{{Path: source, Discovered: 8, Hash: 16}})
+
+	db, err := database.Open(path)
+	if err != nil {
+		t.Fatalf("Expected to be able to open database: %v", err)
+	}
+	defer db.Close()
+
+	handler := newCoordinator(db, "", testCoordinatorToken, time.Hour)
+
+	job := beginCoordinatorJob(t, handler)
+
+	expected := coordinatorJob{
+		ID:          1,
+		Path:        source,
+		Target:      filepath.Join(tempDir, "test.mp4"),
+		Transcoding: filepath.Join(tempDir, "test.transcoding.mp4"),
+	}
+
+	if job != expected {
+		t.Fatalf("Expected %+v but got %+v", expected, job)
+	}
+
+	// The only entry has been handed out
+	recorder := coordinatorRequest(handler, "/v1/jobs")
+	if recorder.Code != http.StatusNoContent {
+		t.Fatalf("Expected status %d but got %d", http.StatusNoContent, recorder.Code)
+	}
+
+	// The worker hasn't written the transcoded file yet
+	recorder = coordinatorRequest(handler, "/v1/jobs/1/complete")
+	if recorder.Code != http.StatusConflict {
+		t.Fatalf("Expected status %d but got %d", http.StatusConflict, recorder.Code)
+	}
+
+	err = ioutil.WriteFile(job.Transcoding, []byte("transcoded"), 0o755)
+	if err != nil {
+		t.Fatalf("Expected to be able to create transcoded file: %v", err)
+	}
+
+	recorder = coordinatorRequest(handler, "/v1/jobs/1/complete")
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected status %d but got %d: %s", http.StatusOK, recorder.Code, recorder.Body)
+	}
+
+	if utils.PathExists(source) || !utils.PathExists(job.Target) {
+		t.Fatalf("Expected the transcoded file to have replaced the source")
+	}
+
+	assertDatabaseContains(t, path, []value.Entry{{Path: job.Target, Discovered: 8, Transcoded: utils.Int64P(0)}})
+
+	// The job has been completed, so can't be completed again
+	recorder = coordinatorRequest(handler, "/v1/jobs/1/complete")
+	if recorder.Code != http.StatusNotFound {
+		t.Fatalf("Expected status %d but got %d", http.StatusNotFound, recorder.Code)
+	}
+}
+
+func TestCoordinatorCancel(t *testing.T) {
+	var (
+		tempDir = t.TempDir()
+		path    = filepath.Join(tempDir, "goamt.db")
+		source  = filepath.Join(tempDir, "test.mkv")
+	)
+
+	err := ioutil.WriteFile(source, []byte("0"), 0o755)
+	if err != nil {
+		t.Fatalf("Expected to be able to create test file: %v", err)
+	}
+
+	createDatabaseAndPopulate(t, path, []value.Entry{{Path: source, Discovered: 8, Hash: 16}})
+
+	db, err := database.Open(path)
+	if err != nil {
+		t.Fatalf("Expected to be able to open database: %v", err)
+	}
+	defer db.Close()
+
+	handler := newCoordinator(db, "", testCoordinatorToken, time.Hour)
+
+	job := beginCoordinatorJob(t, handler)
+
+	err = ioutil.WriteFile(job.Transcoding, []byte("partial"), 0o755)
+	if err != nil {
+		t.Fatalf("Expected to be able to create transcoded file: %v", err)
+	}
+
+	recorder := coordinatorRequest(handler, "/v1/jobs/1/cancel")
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected status %d but got %d: %s", http.StatusOK, recorder.Code, recorder.Body)
+	}
+
+	if utils.PathExists(job.Transcoding) {
+		t.Fatalf("Expected the partially transcoded file to be removed")
+	}
+
+	// The entry should be handed out again
+	if beginCoordinatorJob(t, handler) != job {
+		t.Fatalf("Expected the cancelled job to be handed out again")
+	}
+}
+
+func TestCoordinatorInvalidRequests(t *testing.T) {
+	tempDir := t.TempDir()
+
+	db, err := database.Create(filepath.Join(tempDir, "goamt.db"))
+	if err != nil {
+		t.Fatalf("Expected to be able to create database: %v", err)
+	}
+	defer db.Close()
+
+	handler := newCoordinator(db, "", testCoordinatorToken, time.Hour)
+
+	type test struct {
+		name, method, path string
+		expected           int
+	}
+
+	tests := []*test{
+		{name: "Method", method: http.MethodGet, path: "/v1/jobs", expected: http.StatusMethodNotAllowed},
+		{name: "UnknownPath", method: http.MethodPost, path: "/v2/jobs", expected: http.StatusNotFound},
+		{name: "InvalidID", method: http.MethodPost, path: "/v1/jobs/one/cancel", expected: http.StatusBadRequest},
+		{name: "UnknownAction", method: http.MethodPost, path: "/v1/jobs/1/fail", expected: http.StatusNotFound},
+		{name: "UnknownJob", method: http.MethodPost, path: "/v1/jobs/1/cancel", expected: http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := httptest.NewRequest(test.method, test.path, nil)
+			request.Header.Set("Authorization", "Bearer "+testCoordinatorToken)
+
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, request)
+
+			if recorder.Code != test.expected {
+				t.Fatalf("Expected status %d but got %d", test.expected, recorder.Code)
+			}
+		})
+	}
+}
+
+func TestCoordinatorUnauthorized(t *testing.T) {
+	var (
+		tempDir = t.TempDir()
+		path    = filepath.Join(tempDir, "goamt.db")
+		source  = filepath.Join(tempDir, "test.mkv")
+	)
+
+	err := ioutil.WriteFile(source, []byte("0"), 0o755)
+	if err != nil {
+		t.Fatalf("Expected to be able to create test file: %v", err)
+	}
+
+	createDatabaseAndPopulate(t, path, []value.Entry{{Path: source, Discovered: 8, Hash: 16}})
+
+	db, err := database.Open(path)
+	if err != nil {
+		t.Fatalf("Expected to be able to open database: %v", err)
+	}
+	defer db.Close()
+
+	handler := newCoordinator(db, "", testCoordinatorToken, time.Hour)
+
+	for _, token := range []string{"", "wrong", testCoordinatorToken + "0"} {
+		recorder := coordinatorRequestWithToken(handler, "/v1/jobs", token)
+		if recorder.Code != http.StatusUnauthorized {
+			t.Fatalf("Expected status %d for token '%s' but got %d", http.StatusUnauthorized, token, recorder.Code)
+		}
+	}
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/v1/jobs", nil))
+
+	if recorder.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected status %d but got %d", http.StatusUnauthorized, recorder.Code)
+	}
+
+	// None of the unauthorized requests should have begun a job
+	beginCoordinatorJob(t, handler)
+}
+
+func TestCoordinatorLease(t *testing.T) {
+	var (
+		tempDir = t.TempDir()
+		path    = filepath.Join(tempDir, "goamt.db")
+		source  = filepath.Join(tempDir, "test.mkv")
+	)
+
+	err := ioutil.WriteFile(source, []byte("0"), 0o755)
+	if err != nil {
+		t.Fatalf("Expected to be able to create test file: %v", err)
+	}
+
+	createDatabaseAndPopulate(t, path, []value.Entry{{Path: source, Discovered: 8, Hash: 16}})
+
+	db, err := database.Open(path)
+	if err != nil {
+		t.Fatalf("Expected to be able to open database: %v", err)
+	}
+	defer db.Close()
+
+	now := time.Unix(0, 0)
+
+	handler := newCoordinator(db, "", testCoordinatorToken, time.Hour)
+	handler.now = func() time.Time { return now }
+
+	job := beginCoordinatorJob(t, handler)
+
+	err = ioutil.WriteFile(job.Transcoding, []byte("partial"), 0o755)
+	if err != nil {
+		t.Fatalf("Expected to be able to create transcoded file: %v", err)
+	}
+
+	// Renewing the lease should stop the job from being rolled back
+	now = now.Add(45 * time.Minute)
+
+	recorder := coordinatorRequest(handler, "/v1/jobs/1/renew")
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected status %d but got %d: %s", http.StatusOK, recorder.Code, recorder.Body)
+	}
+
+	now = now.Add(45 * time.Minute)
+
+	recorder = coordinatorRequest(handler, "/v1/jobs")
+	if recorder.Code != http.StatusNoContent {
+		t.Fatalf("Expected status %d but got %d", http.StatusNoContent, recorder.Code)
+	}
+
+	// The worker has abandoned the job, so it should be rolled back and handed out again
+	now = now.Add(time.Hour)
+
+	if beginCoordinatorJob(t, handler) != job {
+		t.Fatalf("Expected the abandoned job to be handed out again")
+	}
+
+	if utils.PathExists(job.Transcoding) {
+		t.Fatalf("Expected the partially transcoded file to be removed")
+	}
+}
+
+func TestCoordinatorForeignJob(t *testing.T) {
+	var (
+		tempDir = t.TempDir()
+		path    = filepath.Join(tempDir, "goamt.db")
+		source  = filepath.Join(tempDir, "test.mkv")
+	)
+
+	err := ioutil.WriteFile(source, []byte("0"), 0o755)
+	if err != nil {
+		t.Fatalf("Expected to be able to create test file: %v", err)
+	}
+
+	createDatabaseAndPopulate(t, path, []value.Entry{{Path: source, Discovered: 8, Hash: 16}})
+
+	db, err := database.Open(path)
+	if err != nil {
+		t.Fatalf("Expected to be able to open database: %v", err)
+	}
+	defer db.Close()
+
+	// Begin a job outside of the coordinator e.g. as a local transcode would
+	handler := newCoordinator(db, "", testCoordinatorToken, time.Hour)
+
+	_, err = db.BeginTranscoding(handler.options)
+	if err != nil {
+		t.Fatalf("Expected to be able to begin transcoding: %v", err)
+	}
+
+	for _, action := range []string{"renew", "complete", "cancel"} {
+		recorder := coordinatorRequest(handler, "/v1/jobs/1/"+action)
+		if recorder.Code != http.StatusNotFound {
+			t.Fatalf("Expected status %d for '%s' but got %d", http.StatusNotFound, action, recorder.Code)
+		}
+	}
+}
+
+func TestCoordinatorTargetCollision(t *testing.T) {
+	var (
+		tempDir = t.TempDir()
+		path    = filepath.Join(tempDir, "goamt.db")
+		source  = filepath.Join(tempDir, "test.mkv")
+		target  = filepath.Join(tempDir, "test.mp4")
+	)
+
+	for _, file := range []string{source, target} {
+		err := ioutil.WriteFile(file, []byte(file), 0o755)
+		if err != nil {
+			t.Fatalf("Expected to be able to create test file: %v", err)
+		}
+	}
+
+	createDatabaseAndPopulate(t, path, []value.Entry{{Path: source, Discovered: 8, Hash: 16}})
+
+	db, err := database.Open(path)
+	if err != nil {
+		t.Fatalf("Expected to be able to open database: %v", err)
+	}
+	defer db.Close()
+
+	handler := newCoordinator(db, "", testCoordinatorToken, time.Hour)
+
+	// Completing the job would overwrite the unrelated file at the target, so it mustn't be handed out
+	recorder := coordinatorRequest(handler, "/v1/jobs")
+	if recorder.Code != http.StatusNoContent {
+		t.Fatalf("Expected status %d but got %d", http.StatusNoContent, recorder.Code)
+	}
+
+	jobs, err := db.Jobs()
+	if err != nil {
+		t.Fatalf("Expected to be able to get jobs: %v", err)
+	}
+
+	if len(jobs) != 0 {
+		t.Fatalf("Expected the job for the colliding entry to be cancelled but got %d job(s)", len(jobs))
+	}
+
+	contents, err := ioutil.ReadFile(target)
+	if err != nil || string(contents) != target {
+		t.Fatalf("Expected the file at the target to be left intact")
+	}
+}
+
+func TestCoordinatorCompleteRejected(t *testing.T) {
+	defer func() { verifyDecodeFunc = utils.VerifyDecode }()
+
+	type test struct {
+		name                        string
+		verifyDecode, onlyIfSmaller bool
+		transcoded                  string
+	}
+
+	tests := []*test{
+		{name: "Decode", verifyDecode: true, transcoded: "corrupt"},
+		{name: "Savings", onlyIfSmaller: true, transcoded: "larger than the source"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var (
+				tempDir = t.TempDir()
+				path    = filepath.Join(tempDir, "goamt.db")
+				source  = filepath.Join(tempDir, "test.mkv")
+			)
+
+			err := ioutil.WriteFile(source, []byte("0"), 0o755)
+			if err != nil {
+				t.Fatalf("Expected to be able to create test file: %v", err)
+			}
+
+			createDatabaseAndPopulate(t, path, []value.Entry{{Path: source, Discovered: 8, Hash: 16}})
+
+			db, err := database.Open(path)
+			if err != nil {
+				t.Fatalf("Expected to be able to open database: %v", err)
+			}
+			defer db.Close()
+
+			verifyDecodeFunc = func(_ context.Context, path string, _ utils.TranscodeOptions) error {
+				contents, err := ioutil.ReadFile(path)
+				if err != nil || string(contents) == "corrupt" {
+					return errors.New("invalid data found when processing input")
+				}
+
+				return nil
+			}
+
+			handler := newCoordinator(db, "", testCoordinatorToken, time.Hour)
+			handler.verifyDecode, handler.onlyIfSmaller = test.verifyDecode, test.onlyIfSmaller
+
+			job := beginCoordinatorJob(t, handler)
+
+			err = ioutil.WriteFile(job.Transcoding, []byte(test.transcoded), 0o755)
+			if err != nil {
+				t.Fatalf("Expected to be able to create transcoded file: %v", err)
+			}
+
+			recorder := coordinatorRequest(handler, "/v1/jobs/1/complete")
+			if recorder.Code != http.StatusUnprocessableEntity {
+				t.Fatalf("Expected status %d but got %d: %s", http.StatusUnprocessableEntity, recorder.Code,
+					recorder.Body)
+			}
+
+			if !utils.PathExists(source) || utils.PathExists(job.Target) || utils.PathExists(job.Transcoding) {
+				t.Fatalf("Expected the source to be left intact and the transcoded file to be removed")
+			}
+
+			// The job was cancelled, so the entry should be handed out again
+			if beginCoordinatorJob(t, handler) != job {
+				t.Fatalf("Expected the rejected job to be handed out again")
+			}
+		})
+	}
+}
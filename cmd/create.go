@@ -15,14 +15,18 @@
 package cmd
 
 import (
+	"fmt"
+
 	"github.com/jamesl33/goamt/database"
+	"github.com/jamesl33/goamt/utils"
+
 	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
 )
 
 // createOptions - Encapsulates the options for the create sub-command.
 var createOptions = struct {
-	database string
+	database, hashAlgorithm, root string
 }{}
 
 // createCommand - The create sub-command, used to create a new empty goamt SQLite database.
@@ -42,16 +46,47 @@ func init() {
 		"path where the database will be created",
 	)
 
-	markFlagRequired(createCommand, "database")
+	createCommand.Flags().StringVar(
+		&createOptions.root,
+		"root",
+		"",
+		"store paths relative to this library root rather than as provided, making the database portable",
+	)
+
+	createCommand.Flags().StringVar(
+		&createOptions.hashAlgorithm,
+		"hash-algorithm",
+		string(utils.HashAlgorithmIEEE),
+		"the CRC32 polynomial used to hash files, either '"+string(utils.HashAlgorithmIEEE)+"' or '"+
+			string(utils.HashAlgorithmCastagnoli)+"' (hardware accelerated on most modern CPUs); can't be changed later",
+	)
+
+	markDatabaseRequired(createCommand)
 }
 
 // create - Run the create sub-command, this will create a new empty goamt SQLite database file.
 func create(_ *cobra.Command, _ []string) error {
+	algorithm := utils.HashAlgorithm(createOptions.hashAlgorithm)
+	if !algorithm.Supported() {
+		return fmt.Errorf("hash algorithm '%s' is not supported, expected '%s' or '%s'", algorithm,
+			utils.HashAlgorithmIEEE, utils.HashAlgorithmCastagnoli)
+	}
+
 	db, err := database.Create(createOptions.database)
 	if err != nil {
 		return errors.Wrap(err, "failed to create database")
 	}
 
+	err = db.SetHashAlgorithm(algorithm)
+	if err != nil {
+		return errors.Wrap(err, "failed to set hash algorithm")
+	}
+
+	err = db.SetRoot(createOptions.root)
+	if err != nil {
+		return errors.Wrap(err, "failed to set library root")
+	}
+
 	err = db.Close()
 	if err != nil {
 		return errors.Wrap(err, "failed to close database")
@@ -55,3 +55,44 @@ func TestCreate(t *testing.T) {
 		t.Fatalf("Expected database file to have been created")
 	}
 }
+
+func TestCreateHashAlgorithm(t *testing.T) {
+	tempDir := t.TempDir()
+	createOptions.database = filepath.Join(tempDir, "goamt.db")
+	createOptions.hashAlgorithm = string(utils.HashAlgorithmCastagnoli)
+
+	defer func() { createOptions.hashAlgorithm = string(utils.HashAlgorithmIEEE) }()
+
+	err := create(nil, nil)
+	if err != nil {
+		t.Fatalf("Expected to be able to create database: %v", err)
+	}
+
+	db, err := database.Open(createOptions.database)
+	if err != nil {
+		t.Fatalf("Expected to be able to open database: %v", err)
+	}
+	defer db.Close()
+
+	if db.HashAlgorithm() != utils.HashAlgorithmCastagnoli {
+		t.Fatalf("Expected database to use the '%s' algorithm but got '%s'", utils.HashAlgorithmCastagnoli,
+			db.HashAlgorithm())
+	}
+}
+
+func TestCreateUnsupportedHashAlgorithm(t *testing.T) {
+	tempDir := t.TempDir()
+	createOptions.database = filepath.Join(tempDir, "goamt.db")
+	createOptions.hashAlgorithm = "koopman"
+
+	defer func() { createOptions.hashAlgorithm = string(utils.HashAlgorithmIEEE) }()
+
+	err := create(nil, nil)
+	if err == nil {
+		t.Fatalf("Expected an error for an unsupported hash algorithm")
+	}
+
+	if utils.PathExists(createOptions.database) {
+		t.Fatalf("Expected database file not to have been created")
+	}
+}
@@ -0,0 +1,302 @@
+// Copyright 2020 James Lee <jamesl33info@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"sort"
+	"sync"
+
+	"github.com/jamesl33/goamt/database"
+	"github.com/jamesl33/goamt/utils"
+	"github.com/jamesl33/goamt/utils/sqlite"
+
+	"github.com/apex/log"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+// dedupeOptions - Encapsulates the options for the dedupe sub-command.
+var dedupeOptions = struct {
+	database, path string
+	threads        int
+	delete         bool
+}{}
+
+// dedupeCommand - The dedupe sub-command, used to find (and optionally remove) duplicate media files.
+var dedupeCommand = &cobra.Command{
+	RunE:  dedupe,
+	Short: "Find duplicate media files by hash",
+	Use:   "dedupe",
+}
+
+// init - Initialize the flags/arguments for the dedupe sub-command.
+func init() {
+	dedupeCommand.Flags().StringVarP(
+		&dedupeOptions.database,
+		"database",
+		"d",
+		"",
+		"path to a goamt SQLite database",
+	)
+
+	dedupeCommand.Flags().StringVarP(
+		&dedupeOptions.path,
+		"path",
+		"p",
+		"",
+		"path to a media library",
+	)
+
+	dedupeCommand.Flags().IntVarP(
+		&dedupeOptions.threads,
+		"threads",
+		"t",
+		runtime.NumCPU(),
+		"the number of threads to use, defaults to the number of vCPUs",
+	)
+
+	dedupeCommand.Flags().BoolVar(
+		&dedupeOptions.delete,
+		"delete",
+		false,
+		"remove all but one file from each group of duplicates, preferring the file recorded in the database",
+	)
+
+	markDatabaseRequired(dedupeCommand)
+	markFlagRequired(dedupeCommand, "path")
+}
+
+// dedupe - Run the dedupe sub-command, this will walk the provided path hashing media files, then report groups of
+// files which are identical (confirmed by comparing their contents). The library is walked rather than grouping the
+// entries in the database, since duplicates may not have entries (or their entries may be stale) and the hash only
+// samples each file.
+func dedupe(_ *cobra.Command, _ []string) error {
+	ctx := signalHandler()
+
+	// Removed duplicates may still have entries (e.g. recorded before the file was modified), which must be pruned
+	open := database.OpenReadOnly
+	if dedupeOptions.delete {
+		open = database.Open
+	}
+
+	db, err := open(dedupeOptions.database)
+	if err != nil {
+		return errors.Wrap(err, "failed to open SQLite database")
+	}
+
+	var (
+		groups                   = &hashGroups{groups: make(map[uint32][]string)}
+		pool                     = NewDedupePool(groups, utils.HashOptions{Algorithm: db.HashAlgorithm()})
+		entryStream, errorStream = pool.Start(ctx, dedupeOptions.threads)
+	)
+
+	err = queueMediaFiles(ctx, entryStream, errorStream, dedupeOptions.path, newDiscoveredClock(false), 0,
+		pathFilter{})
+	if err != nil {
+		return pool.failure(err) // Purposefully not wrapped
+	}
+
+	err = pool.Stop()
+	if err != nil {
+		return errors.Wrap(err, "failed to stop worker pool")
+	}
+
+	// We were interrupted, we won't have a complete picture of the duplicates so shouldn't report/remove anything
+	if ctx.Err() != nil {
+		return db.Close()
+	}
+
+	duplicates, err := groups.duplicates()
+	if err != nil {
+		return errors.Wrap(err, "failed to confirm duplicates")
+	}
+
+	var remove []string
+
+	for _, group := range duplicates {
+		keep, err := keepDuplicate(db, group)
+		if err != nil {
+			return err // Purposefully not wrapped
+		}
+
+		fmt.Printf("%d\n", group.hash)
+
+		for _, path := range group.paths {
+			if path == keep {
+				fmt.Printf("  keep      %s\n", path)
+				continue
+			}
+
+			fmt.Printf("  duplicate %s\n", path)
+
+			remove = append(remove, path)
+		}
+	}
+
+	if dedupeOptions.delete && len(remove) != 0 {
+		proceed, err := confirm(fmt.Sprintf("%d duplicate file(s) will be removed, continue?", len(remove)))
+		if err != nil {
+			return errors.Wrap(err, "failed to confirm removal")
+		}
+
+		for i := 0; proceed && i < len(remove); i++ {
+			log.WithField("path", remove[i]).Info("Removing duplicate file")
+
+			err = os.Remove(remove[i])
+			if err != nil {
+				return errors.Wrap(err, "failed to remove duplicate file")
+			}
+
+			err = removeEntryAt(db, remove[i])
+			if err != nil {
+				return err // Purposefully not wrapped
+			}
+		}
+	}
+
+	err = db.Close()
+	if err != nil {
+		return errors.Wrap(err, "failed to close database")
+	}
+
+	return nil
+}
+
+// keepDuplicate - Returns the path of the file which should be kept from the provided group of duplicates, preferring a
+// file whose entry is up-to-date, then any file with an entry, falling back to the first file.
+func keepDuplicate(db *database.Database, group duplicateGroup) (string, error) {
+	var recorded string
+
+	for _, path := range group.paths {
+		entry, err := db.FindByPath(path)
+		if errors.Is(err, sqlite.ErrQueryReturnedNoRows) {
+			continue
+		}
+
+		if err != nil {
+			return "", errors.Wrap(err, "failed to find entry for duplicate file")
+		}
+
+		if entry.Hash == group.hash {
+			return path, nil
+		}
+
+		if recorded == "" {
+			recorded = path
+		}
+	}
+
+	if recorded != "" {
+		return recorded, nil
+	}
+
+	return group.paths[0], nil
+}
+
+// removeEntryAt - Remove the entry recorded at the provided path (if any), used once its file has been removed.
+func removeEntryAt(db *database.Database, path string) error {
+	entry, err := db.FindByPath(path)
+	if errors.Is(err, sqlite.ErrQueryReturnedNoRows) {
+		return nil
+	}
+
+	if err != nil {
+		return errors.Wrap(err, "failed to find entry for duplicate file")
+	}
+
+	log.WithFields(entry).Info("Removing entry for duplicate file")
+
+	_, err = db.Remove(entry)
+	if err != nil {
+		return errors.Wrap(err, "failed to remove entry for duplicate file")
+	}
+
+	return nil
+}
+
+// hashGroups - Thread safe grouping of file paths by their hash.
+type hashGroups struct {
+	lock   sync.Mutex
+	groups map[uint32][]string
+}
+
+// duplicateGroup - Represents a group of files which have identical contents.
+type duplicateGroup struct {
+	hash  uint32
+	paths []string
+}
+
+// add - Add the provided path to the group for the given hash.
+func (h *hashGroups) add(hash uint32, path string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.groups[hash] = append(h.groups[hash], path)
+}
+
+// duplicates - Returns the groups of files which are duplicates, since 'HashFile' only samples the file (and CRC32
+// collisions are possible) candidate groups are confirmed by comparing the contents of the files.
+func (h *hashGroups) duplicates() ([]duplicateGroup, error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	duplicates := make([]duplicateGroup, 0)
+
+	for hash, paths := range h.groups {
+		if len(paths) < 2 {
+			continue
+		}
+
+		// Each path is compared against the first path of each group of identical files found so far
+		confirmed := make([][]string, 0, 1)
+
+		for _, path := range paths {
+			var found bool
+
+			for index, group := range confirmed {
+				identical, err := utils.IdenticalFiles(group[0], path)
+				if err != nil {
+					return nil, err
+				}
+
+				if identical {
+					confirmed[index], found = append(group, path), true
+					break
+				}
+			}
+
+			if !found {
+				confirmed = append(confirmed, []string{path})
+			}
+		}
+
+		for _, group := range confirmed {
+			if len(group) < 2 {
+				continue
+			}
+
+			sort.Strings(group)
+
+			duplicates = append(duplicates, duplicateGroup{hash: hash, paths: group})
+		}
+	}
+
+	sort.Slice(duplicates, func(i, j int) bool { return duplicates[i].paths[0] < duplicates[j].paths[0] })
+
+	return duplicates, nil
+}
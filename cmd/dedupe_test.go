@@ -0,0 +1,107 @@
+// Copyright 2020 James Lee <jamesl33info@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"hash/crc32"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/jamesl33/goamt/utils"
+	"github.com/jamesl33/goamt/value"
+)
+
+func TestDedupe(t *testing.T) {
+	type test struct {
+		name     string
+		delete   bool
+		expected []string
+	}
+
+	tests := []*test{
+		{
+			name:     "ReportOnly",
+			expected: []string{"a.mp4", "b.mp4", "c.mp4", "d.mp4"},
+		},
+		{
+			name:     "Delete",
+			delete:   true,
+			expected: []string{"b.mp4", "d.mp4"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tempDir := t.TempDir()
+
+			dedupeOptions.database = filepath.Join(tempDir, "goamt.db")
+			dedupeOptions.path = tempDir
+			dedupeOptions.delete = test.delete
+			assumeYes(t)
+
+			files := map[string]string{"a.mp4": "0", "b.mp4": "0", "c.mp4": "1", "d.mp4": "1"}
+
+			for name, contents := range files {
+				err := ioutil.WriteFile(filepath.Join(tempDir, name), []byte(contents), 0o755)
+				if err != nil {
+					t.Fatalf("Expected to be able to create test file: %v", err)
+				}
+			}
+
+			// The database contains an up-to-date entry for 'b.mp4' so it should be preferred over 'a.mp4' when removing
+			// duplicates, 'a.mp4' has a stale entry (recorded before it was modified) which should be removed along with
+			// the file. Only 'd.mp4' has an entry, so it should be preferred over 'c.mp4' despite being sorted later.
+			initial := []value.Entry{
+				{
+					Path:       filepath.Join(tempDir, "b.mp4"),
+					Discovered: 8,
+					Hash:       crc32.Checksum([]byte("0"), crc32.MakeTable(crc32.IEEE)),
+				},
+				{
+					Path:       filepath.Join(tempDir, "d.mp4"),
+					Discovered: 12,
+					Hash:       crc32.Checksum([]byte("1"), crc32.MakeTable(crc32.IEEE)),
+				},
+				{
+					Path:       filepath.Join(tempDir, "a.mp4"),
+					Discovered: 16,
+					Hash:       crc32.Checksum([]byte("stale"), crc32.MakeTable(crc32.IEEE)),
+				},
+			}
+
+			createDatabaseAndPopulate(t, dedupeOptions.database, initial)
+
+			err := dedupe(nil, nil)
+			if err != nil {
+				t.Fatalf("Expected to be able to dedupe: %v", err)
+			}
+
+			for name := range files {
+				exists := utils.PathExists(filepath.Join(tempDir, name))
+				if exists != utils.ContainsString(test.expected, name) {
+					t.Fatalf("Expected file '%s' existence to be %t", name, !exists)
+				}
+			}
+
+			expected := initial
+			if test.delete {
+				expected = initial[:2]
+			}
+
+			assertDatabaseContains(t, dedupeOptions.database, expected)
+		})
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright 2020 James Lee <jamesl33info@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jamesl33/goamt/value"
+
+	"github.com/apex/log"
+)
+
+// etaEstimator - Thread safe estimate of the time remaining for a transcode run, based on the durations of the entries
+// which are yet to be transcoded and the observed encode speed (seconds of media transcoded per second). Note that a
+// nil '*etaEstimator' is valid and won't estimate anything.
+type etaEstimator struct {
+	lock       sync.Mutex
+	start      time.Time
+	remaining  map[int]*float64
+	average    float64
+	transcoded float64
+}
+
+// newETAEstimator - Create a new estimator for a run which will transcode the provided entries, beginning now. Entries
+// whose duration is unknown are assumed to be as long as the average of those which are known.
+func newETAEstimator(entries []value.Entry) *etaEstimator {
+	estimator := &etaEstimator{start: time.Now(), remaining: make(map[int]*float64, len(entries))}
+
+	var (
+		total float64
+		known int
+	)
+
+	for _, entry := range entries {
+		estimator.remaining[entry.ID] = entry.Duration
+
+		if entry.Duration != nil {
+			total += *entry.Duration
+			known++
+		}
+	}
+
+	if known != 0 {
+		estimator.average = total / float64(known)
+	}
+
+	return estimator
+}
+
+// end - Record that we've finished with the provided entry then log the updated estimate; only successfully transcoded
+// entries contribute towards the encode speed.
+func (e *etaEstimator) end(entry value.Entry, err error) {
+	if e == nil {
+		return
+	}
+
+	eta, speed, ok := e.complete(entry, err, time.Now())
+	if !ok {
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"remaining": e.count(),
+		"speed":     fmt.Sprintf("%.2fx", speed),
+		"eta":       eta.Round(time.Second).String(),
+	}).Info("Estimated time remaining")
+}
+
+// complete - Remove the provided entry from those remaining, then return the estimated time remaining and encode speed
+// at the given time. Returns false if there's not enough information to make an estimate.
+func (e *etaEstimator) complete(entry value.Entry, err error, now time.Time) (time.Duration, float64, bool) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	duration, ok := e.remaining[entry.ID]
+	if !ok {
+		return 0, 0, false
+	}
+
+	delete(e.remaining, entry.ID)
+
+	if err == nil && duration != nil {
+		e.transcoded += *duration
+	}
+
+	elapsed := now.Sub(e.start).Seconds()
+	if e.transcoded == 0 || elapsed <= 0 {
+		return 0, 0, false
+	}
+
+	var remaining float64
+
+	for _, duration := range e.remaining {
+		if duration == nil {
+			remaining += e.average
+			continue
+		}
+
+		remaining += *duration
+	}
+
+	speed := e.transcoded / elapsed
+
+	return time.Duration(remaining / speed * float64(time.Second)), speed, true
+}
+
+// count - Returns the number of entries which are yet to be transcoded.
+func (e *etaEstimator) count() int {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	return len(e.remaining)
+}
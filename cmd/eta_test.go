@@ -0,0 +1,74 @@
+// Copyright 2020 James Lee <jamesl33info@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/jamesl33/goamt/utils"
+	"github.com/jamesl33/goamt/value"
+)
+
+func TestETAEstimator(t *testing.T) {
+	entries := []value.Entry{
+		{ID: 1, Duration: utils.Float64P(600)},
+		{ID: 2, Duration: utils.Float64P(1200)},
+		{ID: 3},
+		{ID: 4, Duration: utils.Float64P(600)},
+	}
+
+	estimator := newETAEstimator(entries)
+
+	// No entries have been transcoded, so the speed is unknown
+	_, _, ok := estimator.complete(entries[3], fmt.Errorf("failed"), estimator.start.Add(time.Minute))
+	if ok {
+		t.Fatalf("Expected no estimate before any entries have been transcoded")
+	}
+
+	// Ten minutes of media in one minute, leaving 1200s plus the 800s average for the entry with an unknown duration
+	eta, speed, ok := estimator.complete(entries[0], nil, estimator.start.Add(time.Minute))
+	if !ok {
+		t.Fatalf("Expected an estimate once an entry has been transcoded")
+	}
+
+	if speed != 10 || eta != 200*time.Second {
+		t.Fatalf("Expected an estimate of 200s at 10x but got %s at %gx", eta, speed)
+	}
+
+	// Failed entries no longer count as remaining, but don't contribute to the speed
+	eta, speed, ok = estimator.complete(entries[1], fmt.Errorf("failed"), estimator.start.Add(2*time.Minute))
+	if !ok || speed != 5 || eta != 160*time.Second {
+		t.Fatalf("Expected an estimate of 160s at 5x but got %s at %gx", eta, speed)
+	}
+
+	// Entries which weren't part of the run are ignored
+	_, _, ok = estimator.complete(value.Entry{ID: 42}, nil, estimator.start.Add(2*time.Minute))
+	if ok {
+		t.Fatalf("Expected no estimate for an unknown entry")
+	}
+
+	if count := estimator.count(); count != 1 {
+		t.Fatalf("Expected 1 remaining entry but got %d", count)
+	}
+}
+
+func TestETAEstimatorNil(t *testing.T) {
+	var estimator *etaEstimator
+
+	// Shouldn't panic, transcode runs without '--eta' use a nil estimator
+	estimator.end(value.Entry{ID: 1}, nil)
+}
@@ -0,0 +1,104 @@
+// Copyright 2020 James Lee <jamesl33info@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/jamesl33/goamt/value"
+	"github.com/pkg/errors"
+)
+
+// entryFormats - The named formats which the list/search sub-commands may write entries in.
+var entryFormats = map[string]func(writer io.Writer, entries []value.Entry) error{
+	"table": writeList,
+	"paths": writePaths,
+	"json":  writeJSON,
+}
+
+// templateEscapes - Escape sequences which are expanded in user provided templates, since they're awkward to pass
+// through a shell.
+var templateEscapes = strings.NewReplacer(`\t`, "\t", `\n`, "\n")
+
+// entryFormatNames - Returns the named formats in a stable order, for use in help/error messages.
+func entryFormatNames() []string {
+	names := make([]string, 0, len(entryFormats))
+	for name := range entryFormats {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// entryWriter - Returns a function which writes entries using the provided Go template (executed once per entry), or
+// the named format if no template is provided.
+func entryWriter(format, text string) (func(writer io.Writer, entries []value.Entry) error, error) {
+	if text == "" {
+		write, ok := entryFormats[format]
+		if !ok {
+			return nil, fmt.Errorf("format '%s' is not supported, expected one of '%s'", format,
+				strings.Join(entryFormatNames(), "', '"))
+		}
+
+		return write, nil
+	}
+
+	tmpl, err := template.New("entry").
+		Funcs(template.FuncMap{"state": entryState}).
+		Parse(templateEscapes.Replace(text))
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid template")
+	}
+
+	return func(writer io.Writer, entries []value.Entry) error {
+		for _, entry := range entries {
+			err := tmpl.Execute(writer, entry)
+			if err != nil {
+				return errors.Wrap(err, "failed to execute template")
+			}
+
+			_, err = fmt.Fprintln(writer)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}, nil
+}
+
+// writePaths - Write the paths of the provided entries to the given writer, one per line.
+func writePaths(writer io.Writer, entries []value.Entry) error {
+	for _, entry := range entries {
+		_, err := fmt.Fprintln(writer, entry.Path)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writeJSON - Write the provided entries to the given writer as a JSON array.
+func writeJSON(writer io.Writer, entries []value.Entry) error {
+	return json.NewEncoder(writer).Encode(entries)
+}
@@ -0,0 +1,102 @@
+// Copyright 2020 James Lee <jamesl33info@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/jamesl33/goamt/utils"
+	"github.com/jamesl33/goamt/value"
+)
+
+func TestEntryWriter(t *testing.T) {
+	type test struct {
+		name, format, template, expected string
+	}
+
+	entries := []value.Entry{
+		{ID: 1, Path: "transcoded.mp4", Transcoded: utils.Int64P(8), Hash: 16},
+		{ID: 2, Path: "untranscoded.mp4", Hash: 32, Duration: utils.Float64P(1325.48)},
+	}
+
+	tests := []*test{
+		{
+			name:     "Table",
+			format:   "table",
+			expected: "1 transcoded   transcoded.mp4\n2 untranscoded untranscoded.mp4\n",
+		},
+		{
+			name:     "Paths",
+			format:   "paths",
+			expected: "transcoded.mp4\nuntranscoded.mp4\n",
+		},
+		{
+			name:   "JSON",
+			format: "json",
+			expected: `[{"id":1,"path":"transcoded.mp4","discovered":0,"transcoded":8,"hash":16,"priority":0,` +
+				`"failures":0,"quarantined":null},{"id":2,"path":"untranscoded.mp4","discovered":0,` +
+				`"transcoded":null,"hash":32,"priority":0,"duration":1325.48,"failures":0,"quarantined":null}]` + "\n",
+		},
+		{
+			name:     "Template",
+			format:   "table",
+			template: `{{.Path}}\t{{.Hash}}\t{{state .}}`,
+			expected: "transcoded.mp4\t16\ttranscoded\nuntranscoded.mp4\t32\tuntranscoded\n",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			write, err := entryWriter(test.format, test.template)
+			if err != nil {
+				t.Fatalf("Expected to be able to create entry writer: %v", err)
+			}
+
+			var buffer bytes.Buffer
+
+			err = write(&buffer, entries)
+			if err != nil {
+				t.Fatalf("Expected to be able to write entries: %v", err)
+			}
+
+			if buffer.String() != test.expected {
+				t.Fatalf("Expected output:\n%s\nbut got:\n%s", test.expected, buffer.String())
+			}
+		})
+	}
+}
+
+func TestEntryWriterInvalid(t *testing.T) {
+	_, err := entryWriter("csv", "")
+	if err == nil {
+		t.Fatalf("Expected an error for an unsupported format")
+	}
+
+	_, err = entryWriter("table", "{{.Path")
+	if err == nil {
+		t.Fatalf("Expected an error for an invalid template")
+	}
+
+	write, err := entryWriter("table", "{{.Size}}")
+	if err != nil {
+		t.Fatalf("Expected to be able to create entry writer: %v", err)
+	}
+
+	err = write(&bytes.Buffer{}, []value.Entry{{Path: "test.mp4"}})
+	if err == nil {
+		t.Fatalf("Expected an error for a template referencing an unknown field")
+	}
+}
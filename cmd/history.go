@@ -0,0 +1,121 @@
+// Copyright 2020 James Lee <jamesl33info@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jamesl33/goamt/database"
+	"github.com/jamesl33/goamt/value"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+// historyOptions - Encapsulates the options for the history sub-command.
+var historyOptions = struct {
+	database string
+	limit    int
+}{}
+
+// historyCommand - The history sub-command, used to list the update/transcode runs recorded in a goamt database.
+var historyCommand = &cobra.Command{
+	RunE:  history,
+	Short: "List the update/transcode runs recorded in a goamt SQLite database",
+	Use:   "history",
+}
+
+// init - Initialize the flags/arguments for the history sub-command.
+func init() {
+	historyCommand.Flags().StringVarP(
+		&historyOptions.database,
+		"database",
+		"d",
+		"",
+		"path to a goamt SQLite database",
+	)
+
+	historyCommand.Flags().IntVar(
+		&historyOptions.limit,
+		"limit",
+		20,
+		"the maximum number of runs to list, zero lists every run",
+	)
+
+	markDatabaseRequired(historyCommand)
+}
+
+// history - Run the history sub-command, this will open the database read-only and print the most recent runs; this is
+// safe to run whilst the database is being used by another goamt process.
+func history(_ *cobra.Command, _ []string) error {
+	if historyOptions.limit < 0 {
+		return fmt.Errorf("limit %d must not be negative", historyOptions.limit)
+	}
+
+	db, err := database.OpenReadOnly(historyOptions.database)
+	if err != nil {
+		return errors.Wrap(err, "failed to open SQLite database")
+	}
+
+	runs, err := db.Runs(historyOptions.limit)
+	if err != nil {
+		return errors.Wrap(err, "failed to get runs")
+	}
+
+	err = writeRuns(os.Stdout, runs)
+	if err != nil {
+		return errors.Wrap(err, "failed to write runs")
+	}
+
+	err = db.Close()
+	if err != nil {
+		return errors.Wrap(err, "failed to close database")
+	}
+
+	return nil
+}
+
+// writeRuns - Write the provided runs to the given writer, one per line. Only the first line of the error is written
+// for failed runs, since the error may list every entry which failed.
+func writeRuns(writer io.Writer, runs []value.Run) error {
+	for _, run := range runs {
+		result := "succeeded"
+		if run.Error != "" {
+			result = "failed: " + strings.SplitN(run.Error, "\n", 2)[0]
+		}
+
+		_, err := fmt.Fprintf(
+			writer,
+			"%d %s %-9s %s processed: %d failed: %d cancelled: %d %s\n",
+			run.ID,
+			time.Unix(run.Start, 0).UTC().Format(time.RFC3339),
+			run.Command,
+			time.Duration(run.End-run.Start)*time.Second,
+			run.Processed,
+			run.Failed,
+			run.Cancelled,
+			result,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,79 @@
+// Copyright 2020 James Lee <jamesl33info@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+
+	"github.com/jamesl33/goamt/database"
+	"github.com/jamesl33/goamt/value"
+)
+
+func TestHistory(t *testing.T) {
+	tempDir := t.TempDir()
+
+	updateOptions.database = filepath.Join(tempDir, "goamt.db")
+	updateOptions.paths = []string{tempDir}
+	historyOptions.database = updateOptions.database
+
+	createDatabaseAndPopulate(t, updateOptions.database, nil)
+
+	err := update(nil, nil)
+	if err != nil {
+		t.Fatalf("Expected to be able to update database: %v", err)
+	}
+
+	db, err := database.Open(updateOptions.database)
+	if err != nil {
+		t.Fatalf("Expected to be able to open database: %v", err)
+	}
+	defer db.Close()
+
+	runs, err := db.Runs(0)
+	if err != nil {
+		t.Fatalf("Expected to be able to get runs: %v", err)
+	}
+
+	if len(runs) != 1 || runs[0].Command != "update" || runs[0].Error != "" {
+		t.Fatalf("Expected the update to be recorded, got %+v", runs)
+	}
+
+	err = history(nil, nil)
+	if err != nil {
+		t.Fatalf("Expected to be able to list runs: %v", err)
+	}
+}
+
+func TestWriteRuns(t *testing.T) {
+	var buffer bytes.Buffer
+
+	err := writeRuns(&buffer, []value.Run{
+		{ID: 2, Command: "transcode", Start: 3600, End: 7290, Processed: 3, Failed: 2, Error: "2 failed:\n  'a.mp4'"},
+		{ID: 1, Command: "update", Start: 0, End: 90, Processed: 8},
+	})
+	if err != nil {
+		t.Fatalf("Expected to be able to write runs: %v", err)
+	}
+
+	expected := `2 1970-01-01T01:00:00Z transcode 1h1m30s processed: 3 failed: 2 cancelled: 0 failed: 2 failed:
+1 1970-01-01T00:00:00Z update    1m30s processed: 8 failed: 0 cancelled: 0 succeeded
+`
+
+	if buffer.String() != expected {
+		t.Fatalf("Expected output:\n%s\nbut got:\n%s", expected, buffer.String())
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright 2020 James Lee <jamesl33info@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/apex/log"
+	"golang.org/x/sys/unix"
+)
+
+// hookPlaceholder - The placeholder in a hook command template which is replaced with the path of the transcoded file.
+const hookPlaceholder = "{path}"
+
+// runCompleteHook - Run the '--on-complete' hook (if one was provided) for the transcoded file at the provided path.
+// The hook is purely informational, so failures are logged rather than returned.
+func runCompleteHook(path string) {
+	if transcodeOptions.onComplete == "" {
+		return
+	}
+
+	fields := log.Fields{"path": path, "hook": transcodeOptions.onComplete}
+
+	output, err := runHook(transcodeOptions.onComplete, path, transcodeOptions.onCompleteTimeout)
+	if len(output) != 0 {
+		fields["output"] = strings.TrimSpace(string(output))
+	}
+
+	if err != nil {
+		log.WithFields(fields).WithError(err).Warn("Failed to run completion hook")
+		return
+	}
+
+	log.WithFields(fields).Info("Ran completion hook")
+}
+
+// runHook - Run the provided hook command template using the shell, substituting the (quoted) path. The path is also
+// made available using the 'GOAMT_PATH' environment variable. The hook, and any processes it starts, will be killed if
+// it doesn't complete within the given timeout.
+func runHook(template, path string, timeout time.Duration) ([]byte, error) {
+	command := exec.Command("sh", "-c", strings.ReplaceAll(template, hookPlaceholder, shellQuote(path)))
+	command.Env = append(os.Environ(), "GOAMT_PATH="+path)
+	command.SysProcAttr = &unix.SysProcAttr{Setpgid: true}
+
+	var output bytes.Buffer
+
+	command.Stdout = &output
+	command.Stderr = &output
+
+	err := command.Start()
+	if err != nil {
+		return nil, err
+	}
+
+	timer := time.AfterFunc(timeout, func() { _ = unix.Kill(-command.Process.Pid, unix.SIGKILL) })
+
+	err = command.Wait()
+	if !timer.Stop() {
+		return output.Bytes(), fmt.Errorf("hook timed out after %s", timeout)
+	}
+
+	return output.Bytes(), err
+}
+
+// shellQuote - Quote the provided string so that it's interpreted literally by the shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
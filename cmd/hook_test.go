@@ -0,0 +1,57 @@
+// Copyright 2020 James Lee <jamesl33info@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRunHook(t *testing.T) {
+	path := "/media/it's a \"test\" $(echo movie).mp4"
+
+	output, err := runHook(`printf '%s|%s' {path} "$GOAMT_PATH"`, path, time.Minute)
+	if err != nil {
+		t.Fatalf("Expected to be able to run hook: %v", err)
+	}
+
+	if expected := path + "|" + path; string(output) != expected {
+		t.Fatalf("Expected '%s' but got '%s'", expected, output)
+	}
+}
+
+func TestRunHookFailure(t *testing.T) {
+	output, err := runHook("echo failed; exit 1", "test.mp4", time.Minute)
+	if err == nil {
+		t.Fatalf("Expected an error for a failing hook")
+	}
+
+	if string(output) != "failed\n" {
+		t.Fatalf("Expected the hook output to be returned but got '%s'", output)
+	}
+}
+
+func TestRunHookTimeout(t *testing.T) {
+	start := time.Now()
+
+	_, err := runHook("sleep 10 & wait", "test.mp4", 100*time.Millisecond)
+	if err == nil {
+		t.Fatalf("Expected an error for a hook which timed out")
+	}
+
+	if time.Since(start) > 5*time.Second {
+		t.Fatalf("Expected the hook to have been killed after the timeout")
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright 2020 James Lee <jamesl33info@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/jamesl33/goamt/database"
+	"github.com/jamesl33/goamt/value"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+// infoOptions - Encapsulates the options for the info sub-command.
+var infoOptions = struct {
+	database string
+}{}
+
+// infoCommand - The info sub-command, used to inspect the metadata of a goamt database.
+var infoCommand = &cobra.Command{
+	RunE:  info,
+	Short: "Display a summary of a goamt SQLite database",
+	Use:   "info",
+}
+
+// init - Initialize the flags/arguments for the info sub-command.
+func init() {
+	infoCommand.Flags().StringVarP(
+		&infoOptions.database,
+		"database",
+		"d",
+		"",
+		"path to a goamt SQLite database",
+	)
+
+	markDatabaseRequired(infoCommand)
+}
+
+// info - Run the info sub-command, this will open the database read-only and print a summary of it; this is safe to
+// run whilst the database is being used by another goamt process.
+func info(_ *cobra.Command, _ []string) error {
+	db, err := database.OpenReadOnly(infoOptions.database)
+	if err != nil {
+		return errors.Wrap(err, "failed to open SQLite database")
+	}
+
+	summary, err := db.Info()
+	if err != nil {
+		return errors.Wrap(err, "failed to get database information")
+	}
+
+	err = writeInfo(os.Stdout, summary)
+	if err != nil {
+		return errors.Wrap(err, "failed to write database information")
+	}
+
+	err = db.Close()
+	if err != nil {
+		return errors.Wrap(err, "failed to close database")
+	}
+
+	return nil
+}
+
+// writeInfo - Write the provided database summary to the given writer in a human readable format.
+func writeInfo(writer io.Writer, info value.Info) error {
+	created := "unknown"
+	if info.Created != nil {
+		created = time.Unix(*info.Created, 0).UTC().Format(time.RFC3339)
+	}
+
+	root := "none (paths are stored as provided)"
+	if info.Root != "" {
+		root = info.Root
+	}
+
+	_, err := fmt.Fprintf(writer, `user_version:   %d
+schema_version: %d
+created:        %s
+hash_algorithm: %s
+root:           %s
+entries:        %d
+  transcoded:   %d
+  untranscoded: %d
+  unhashed:     %d
+  quarantined:  %d
+jobs:           %d
+`, info.UserVersion, info.SchemaVersion, created, info.HashAlgorithm, root, info.Entries, info.Transcoded,
+		info.Untranscoded, info.Unhashed, info.Quarantined, info.Jobs)
+
+	return err
+}
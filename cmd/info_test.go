@@ -0,0 +1,61 @@
+// Copyright 2020 James Lee <jamesl33info@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jamesl33/goamt/utils"
+	"github.com/jamesl33/goamt/value"
+)
+
+func TestInfo(t *testing.T) {
+	tempDir := t.TempDir()
+	infoOptions.database = filepath.Join(tempDir, "goamt.db")
+
+	createDatabaseAndPopulate(t, infoOptions.database, []value.Entry{{Path: "test.mp4", Discovered: 8, Hash: 16}})
+
+	err := info(nil, nil)
+	if err != nil {
+		t.Fatalf("Expected to be able to get database information: %v", err)
+	}
+}
+
+func TestWriteInfo(t *testing.T) {
+	var buffer bytes.Buffer
+
+	err := writeInfo(&buffer, value.Info{
+		UserVersion:   8,
+		SchemaVersion: 12,
+		HashAlgorithm: string(utils.HashAlgorithmIEEE),
+		Root:          "/mnt/media",
+		Entries:       3,
+		Transcoded:    1,
+		Untranscoded:  2,
+	})
+	if err != nil {
+		t.Fatalf("Expected to be able to write database information: %v", err)
+	}
+
+	for _, expected := range []string{"user_version:   8", "created:        unknown", "root:           /mnt/media",
+		"entries:        3", "  untranscoded: 2"} {
+		if !strings.Contains(buffer.String(), expected) {
+			t.Fatalf("Expected output to contain '%s' but got:\n%s", expected, buffer.String())
+		}
+	}
+}
@@ -0,0 +1,174 @@
+// Copyright 2020 James Lee <jamesl33info@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/jamesl33/goamt/database"
+	"github.com/jamesl33/goamt/value"
+
+	"github.com/apex/log"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+// jobsOptions - Encapsulates the options for the jobs sub-commands.
+var jobsOptions = struct {
+	database string
+	dryRun   bool
+}{}
+
+// jobsCommand - The jobs sub-command, groups the sub-commands used to manage transcode jobs.
+var jobsCommand = &cobra.Command{
+	Short: "Manage the transcode jobs in a goamt database",
+	Use:   "jobs",
+}
+
+// jobsListCommand - The jobs list sub-command, used to list the entries which are currently locked by jobs and how long
+// they've been running; this helps diagnose stuck transcodes.
+var jobsListCommand = &cobra.Command{
+	RunE:  jobsList,
+	Short: "List the transcode jobs in a goamt database, and how long they've been running",
+	Use:   "list",
+}
+
+// jobsResetCommand - The jobs reset sub-command, used to remove jobs which were left behind (e.g. if goamt was killed)
+// without the heuristics used to recover incomplete jobs.
+var jobsResetCommand = &cobra.Command{
+	RunE:  jobsReset,
+	Short: "List and remove the transcode jobs in a goamt database, without recovering them",
+	Use:   "reset",
+}
+
+// init - Initialize the flags/arguments for the jobs sub-commands.
+func init() {
+	jobsListCommand.Flags().StringVarP(
+		&jobsOptions.database,
+		"database",
+		"d",
+		"",
+		"path to a goamt SQLite database",
+	)
+
+	markDatabaseRequired(jobsListCommand)
+
+	jobsResetCommand.Flags().StringVarP(
+		&jobsOptions.database,
+		"database",
+		"d",
+		"",
+		"path to a goamt SQLite database",
+	)
+
+	jobsResetCommand.Flags().BoolVar(
+		&jobsOptions.dryRun,
+		"dry-run",
+		false,
+		"list the jobs which would be reset without removing them",
+	)
+
+	markDatabaseRequired(jobsResetCommand)
+
+	jobsCommand.AddCommand(jobsListCommand, jobsResetCommand)
+}
+
+// jobsList - Run the jobs list sub-command, this will open the database read-only and print the current jobs; this is
+// safe to run whilst the database is being used by another goamt process.
+func jobsList(_ *cobra.Command, _ []string) error {
+	db, err := database.OpenReadOnly(jobsOptions.database)
+	if err != nil {
+		return errors.Wrap(err, "failed to open SQLite database")
+	}
+
+	jobs, err := db.Jobs()
+	if err != nil {
+		return errors.Wrap(err, "failed to get jobs")
+	}
+
+	err = writeJobs(os.Stdout, jobs, time.Now())
+	if err != nil {
+		return errors.Wrap(err, "failed to write jobs")
+	}
+
+	err = db.Close()
+	if err != nil {
+		return errors.Wrap(err, "failed to close database")
+	}
+
+	return nil
+}
+
+// writeJobs - Write the provided jobs to the given writer, one per line, including how long they've been running as of
+// the given time.
+func writeJobs(writer io.Writer, jobs []value.Job, now time.Time) error {
+	for _, job := range jobs {
+		age := now.Sub(time.Unix(job.Started, 0)).Truncate(time.Second)
+
+		_, err := fmt.Fprintf(writer, "%d %-10s %s\n", job.Entry.ID, age, job.Entry.Path)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// jobsReset - Run the jobs reset sub-command, this will list the current jobs then remove them so that the
+// corresponding entries are selected for transcoding again. This should only be used when it's known that the
+// transcodes didn't start, since partially transcoded files aren't removed.
+func jobsReset(_ *cobra.Command, _ []string) error {
+	db, err := database.Open(jobsOptions.database)
+	if err != nil {
+		return errors.Wrap(err, "failed to open SQLite database")
+	}
+
+	jobs, err := db.Jobs()
+	if err != nil {
+		return errors.Wrap(err, "failed to get jobs")
+	}
+
+	for _, job := range jobs {
+		fmt.Printf("%d %s %s\n", job.Entry.ID, time.Unix(job.Started, 0).UTC().Format(time.RFC3339), job.Entry.Path)
+	}
+
+	if jobsOptions.dryRun || len(jobs) == 0 {
+		return db.Close()
+	}
+
+	proceed, err := confirm(fmt.Sprintf("%d job(s) will be reset, continue?", len(jobs)))
+	if err != nil {
+		return errors.Wrap(err, "failed to confirm reset")
+	}
+
+	if proceed {
+		removed, err := db.ResetJobs(jobs)
+		if err != nil {
+			return errors.Wrap(err, "failed to reset jobs")
+		}
+
+		log.WithField("removed", removed).Info("Reset jobs")
+	}
+
+	err = db.Close()
+	if err != nil {
+		return errors.Wrap(err, "failed to close database")
+	}
+
+	return nil
+}
@@ -0,0 +1,135 @@
+// Copyright 2020 James Lee <jamesl33info@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jamesl33/goamt/database"
+	"github.com/jamesl33/goamt/value"
+)
+
+func TestJobsReset(t *testing.T) {
+	tempDir := t.TempDir()
+
+	jobsOptions.database = filepath.Join(tempDir, "goamt.db")
+	jobsOptions.dryRun = true
+	assumeYes(t)
+
+	defer func() { jobsOptions.dryRun = false }()
+
+	initial := []value.Entry{
+		{Path: filepath.Join(tempDir, "a.mp4"), Discovered: 8, Hash: 16},
+		{Path: filepath.Join(tempDir, "b.mp4"), Discovered: 16, Hash: 32},
+	}
+
+	createDatabaseAndPopulate(t, jobsOptions.database, initial)
+
+	db, err := database.Open(jobsOptions.database)
+	if err != nil {
+		t.Fatalf("Expected to be able to open database: %v", err)
+	}
+
+	for range initial {
+		_, err := db.BeginTranscoding(database.SelectOptions{})
+		if err != nil {
+			t.Fatalf("Expected to be able to begin transcoding: %v", err)
+		}
+	}
+
+	err = db.Close()
+	if err != nil {
+		t.Fatalf("Expected to be able to close database: %v", err)
+	}
+
+	err = jobsReset(nil, nil)
+	if err != nil {
+		t.Fatalf("Expected to be able to list jobs: %v", err)
+	}
+
+	if jobs := countJobs(t, jobsOptions.database); jobs != 2 {
+		t.Fatalf("Expected a dry run to leave the jobs intact, but got %d", jobs)
+	}
+
+	jobsOptions.dryRun = false
+
+	err = jobsReset(nil, nil)
+	if err != nil {
+		t.Fatalf("Expected to be able to reset jobs: %v", err)
+	}
+
+	if jobs := countJobs(t, jobsOptions.database); jobs != 0 {
+		t.Fatalf("Expected all the jobs to have been reset, but got %d", jobs)
+	}
+
+	// The entries themselves should be left untouched
+	assertDatabaseContains(t, jobsOptions.database, initial)
+}
+
+func TestJobsList(t *testing.T) {
+	tempDir := t.TempDir()
+
+	jobsOptions.database = filepath.Join(tempDir, "goamt.db")
+
+	createDatabaseAndPopulate(t, jobsOptions.database, []value.Entry{
+		{Path: filepath.Join(tempDir, "a.mp4"), Discovered: 8, Hash: 16},
+	})
+
+	db, err := database.Open(jobsOptions.database)
+	if err != nil {
+		t.Fatalf("Expected to be able to open database: %v", err)
+	}
+	defer db.Close()
+
+	_, err = db.BeginTranscoding(database.SelectOptions{})
+	if err != nil {
+		t.Fatalf("Expected to be able to begin transcoding: %v", err)
+	}
+
+	// Listing opens the database read-only, so should be possible whilst it's in use
+	err = jobsList(nil, nil)
+	if err != nil {
+		t.Fatalf("Expected to be able to list jobs: %v", err)
+	}
+
+	if jobs := countJobs(t, jobsOptions.database); jobs != 1 {
+		t.Fatalf("Expected listing to leave the jobs intact, but got %d", jobs)
+	}
+}
+
+func TestWriteJobs(t *testing.T) {
+	var buffer bytes.Buffer
+
+	jobs := []value.Job{
+		{Entry: value.Entry{ID: 1, Path: "movie.mkv"}, Started: 0},
+		{Entry: value.Entry{ID: 3, Path: "episode.mkv"}, Started: 7000},
+	}
+
+	err := writeJobs(&buffer, jobs, time.Unix(7290, 0))
+	if err != nil {
+		t.Fatalf("Expected to be able to write jobs: %v", err)
+	}
+
+	expected := `1 2h1m30s    movie.mkv
+3 4m50s      episode.mkv
+`
+
+	if buffer.String() != expected {
+		t.Fatalf("Expected output:\n%s\nbut got:\n%s", expected, buffer.String())
+	}
+}
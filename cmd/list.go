@@ -0,0 +1,237 @@
+// Copyright 2020 James Lee <jamesl33info@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/jamesl33/goamt/database"
+	"github.com/jamesl33/goamt/value"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+// sizeSort - Lists entries by the size of their file, sizes aren't recorded in the database so this sort is performed
+// after listing the entries (by stating each file) rather than by 'List'.
+const sizeSort = "size"
+
+// listOptions - Encapsulates the options for the list sub-command.
+var listOptions = struct {
+	database, prefix, sort string
+	format, template       string
+	limit, offset          int
+}{}
+
+// listCommand - The list sub-command, used to list the entries in a goamt database.
+var listCommand = &cobra.Command{
+	RunE:  list,
+	Short: "List the entries in a goamt SQLite database",
+	Use:   "list",
+}
+
+// init - Initialize the flags/arguments for the list sub-command.
+func init() {
+	listCommand.Flags().StringVarP(
+		&listOptions.database,
+		"database",
+		"d",
+		"",
+		"path to a goamt SQLite database",
+	)
+
+	listCommand.Flags().StringVar(
+		&listOptions.prefix,
+		"prefix",
+		"",
+		"only list entries whose path is equal to (or is within the directory) this prefix",
+	)
+
+	listCommand.Flags().StringVar(
+		&listOptions.sort,
+		"sort",
+		"id",
+		"the order in which entries are listed, one of '"+strings.Join(listSorts(), "', '")+"'",
+	)
+
+	listCommand.Flags().IntVar(
+		&listOptions.limit,
+		"limit",
+		0,
+		"the maximum number of entries to list, defaults to listing every entry",
+	)
+
+	listCommand.Flags().IntVar(
+		&listOptions.offset,
+		"offset",
+		0,
+		"the number of entries to skip before listing, may be used alongside --limit to page through the entries",
+	)
+
+	listCommand.Flags().StringVar(
+		&listOptions.format,
+		"format",
+		"table",
+		"the format entries are written in, one of '"+strings.Join(entryFormatNames(), "', '")+"'",
+	)
+
+	listCommand.Flags().StringVar(
+		&listOptions.template,
+		"template",
+		"",
+		"write each entry using this Go template (e.g. '{{.Path}}\\t{{.Hash}}') instead of a named format",
+	)
+
+	markDatabaseRequired(listCommand)
+}
+
+// list - Run the list sub-command, this will open the database read-only and print the entries which match the
+// provided options; this is safe to run whilst the database is being used by another goamt process.
+func list(_ *cobra.Command, _ []string) error {
+	if _, ok := database.ListSorts[listOptions.sort]; !ok && listOptions.sort != sizeSort {
+		return fmt.Errorf("sort '%s' is not supported, expected one of '%s'", listOptions.sort,
+			strings.Join(listSorts(), "', '"))
+	}
+
+	if listOptions.limit < 0 || listOptions.offset < 0 {
+		return fmt.Errorf("limit %d and offset %d must not be negative", listOptions.limit, listOptions.offset)
+	}
+
+	write, err := entryWriter(listOptions.format, listOptions.template)
+	if err != nil {
+		return err // Purposefully not wrapped
+	}
+
+	db, err := database.OpenReadOnly(listOptions.database)
+	if err != nil {
+		return errors.Wrap(err, "failed to open SQLite database")
+	}
+
+	options := database.ListOptions{
+		Prefix: listOptions.prefix,
+		Sort:   listOptions.sort,
+		Limit:  listOptions.limit,
+		Offset: listOptions.offset,
+	}
+
+	// Every entry must be sorted by size before the page can be selected
+	if listOptions.sort == sizeSort {
+		options.Sort, options.Limit, options.Offset = "id", 0, 0
+	}
+
+	entries, err := db.List(options)
+	if err != nil {
+		return errors.Wrap(err, "failed to list entries")
+	}
+
+	if listOptions.sort == sizeSort {
+		entries = sortBySize(entries, listOptions.limit, listOptions.offset)
+	}
+
+	err = write(os.Stdout, entries)
+	if err != nil {
+		return errors.Wrap(err, "failed to write entries")
+	}
+
+	err = db.Close()
+	if err != nil {
+		return errors.Wrap(err, "failed to close database")
+	}
+
+	return nil
+}
+
+// listSorts - Returns the supported sorts in a stable order, for use in help/error messages.
+func listSorts() []string {
+	sorts := make([]string, 0, len(database.ListSorts))
+	for name := range database.ListSorts {
+		sorts = append(sorts, name)
+	}
+
+	sorts = append(sorts, sizeSort)
+
+	sort.Strings(sorts)
+
+	return sorts
+}
+
+// sortBySize - Sort the provided entries (which must be sorted by id) by the size of their files, then return the page
+// described by the given limit/offset. Entries whose files can't be stated (e.g. because they've been removed) are
+// listed last.
+func sortBySize(entries []value.Entry, limit, offset int) []value.Entry {
+	sizes := make(map[int]int64, len(entries))
+
+	for _, entry := range entries {
+		info, err := os.Stat(entry.Path)
+		if err != nil {
+			sizes[entry.ID] = -1
+			continue
+		}
+
+		sizes[entry.ID] = info.Size()
+	}
+
+	// Sorting is stable, so ties remain ordered by id
+	sort.SliceStable(entries, func(i, j int) bool {
+		a, b := sizes[entries[i].ID], sizes[entries[j].ID]
+		if a == -1 || b == -1 {
+			return b == -1 && a != -1
+		}
+
+		return a < b
+	})
+
+	if offset >= len(entries) {
+		return entries[:0]
+	}
+
+	entries = entries[offset:]
+
+	if limit != 0 && limit < len(entries) {
+		entries = entries[:limit]
+	}
+
+	return entries
+}
+
+// writeList - Write the provided entries to the given writer, one per line.
+func writeList(writer io.Writer, entries []value.Entry) error {
+	for _, entry := range entries {
+		_, err := fmt.Fprintf(writer, "%d %-12s %s\n", entry.ID, entryState(entry), entry.Path)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// entryState - Returns a short description of the state of the provided entry.
+func entryState(entry value.Entry) string {
+	switch {
+	case entry.Transcoded != nil:
+		return "transcoded"
+	case entry.Quarantined != nil:
+		return "quarantined"
+	case entry.Hash == 0:
+		return "unhashed"
+	default:
+		return "untranscoded"
+	}
+}
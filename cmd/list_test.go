@@ -0,0 +1,117 @@
+// Copyright 2020 James Lee <jamesl33info@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/jamesl33/goamt/utils"
+	"github.com/jamesl33/goamt/value"
+)
+
+func TestList(t *testing.T) {
+	tempDir := t.TempDir()
+	listOptions.database = filepath.Join(tempDir, "goamt.db")
+
+	createDatabaseAndPopulate(t, listOptions.database, []value.Entry{{Path: "test.mp4", Discovered: 8, Hash: 16}})
+
+	err := list(nil, nil)
+	if err != nil {
+		t.Fatalf("Expected to be able to list entries: %v", err)
+	}
+
+	listOptions.sort = "unknown"
+	defer func() { listOptions.sort = "id" }()
+
+	err = list(nil, nil)
+	if err == nil {
+		t.Fatalf("Expected an error for an unsupported sort")
+	}
+}
+
+func TestSortBySize(t *testing.T) {
+	tempDir := t.TempDir()
+
+	entries := []value.Entry{
+		{ID: 1, Path: filepath.Join(tempDir, "large.mp4")},
+		{ID: 2, Path: filepath.Join(tempDir, "missing.mp4")},
+		{ID: 3, Path: filepath.Join(tempDir, "small.mp4")},
+		{ID: 4, Path: filepath.Join(tempDir, "medium.mp4")},
+		{ID: 5, Path: filepath.Join(tempDir, "small2.mp4")},
+	}
+
+	for path, size := range map[string]int{"large.mp4": 32, "small.mp4": 8, "medium.mp4": 16, "small2.mp4": 8} {
+		err := ioutil.WriteFile(filepath.Join(tempDir, path), make([]byte, size), 0o755)
+		if err != nil {
+			t.Fatalf("Expected to be able to create test file: %v", err)
+		}
+	}
+
+	type test struct {
+		name          string
+		limit, offset int
+		expected      []int
+	}
+
+	tests := []test{
+		{name: "All", expected: []int{3, 5, 4, 1, 2}},
+		{name: "Limit", limit: 2, expected: []int{3, 5}},
+		{name: "Offset", limit: 2, offset: 2, expected: []int{4, 1}},
+		{name: "OffsetPastEnd", offset: 5, expected: []int{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sorted := sortBySize(append([]value.Entry(nil), entries...), test.limit, test.offset)
+
+			actual := make([]int, 0, len(sorted))
+			for _, entry := range sorted {
+				actual = append(actual, entry.ID)
+			}
+
+			if !reflect.DeepEqual(actual, test.expected) {
+				t.Fatalf("Expected %v but got %v", test.expected, actual)
+			}
+		})
+	}
+}
+
+func TestWriteList(t *testing.T) {
+	var buffer bytes.Buffer
+
+	err := writeList(&buffer, []value.Entry{
+		{ID: 1, Path: "transcoded.mp4", Transcoded: utils.Int64P(8), Hash: 16},
+		{ID: 2, Path: "untranscoded.mp4", Hash: 32},
+		{ID: 3, Path: "quarantined.mp4", Hash: 64, Quarantined: utils.Int64P(8)},
+		{ID: 4, Path: "unhashed.mp4"},
+	})
+	if err != nil {
+		t.Fatalf("Expected to be able to write entries: %v", err)
+	}
+
+	expected := `1 transcoded   transcoded.mp4
+2 untranscoded untranscoded.mp4
+3 quarantined  quarantined.mp4
+4 unhashed     unhashed.mp4
+`
+
+	if buffer.String() != expected {
+		t.Fatalf("Expected output:\n%s\nbut got:\n%s", expected, buffer.String())
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright 2020 James Lee <jamesl33info@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"github.com/jamesl33/goamt/database"
+
+	"github.com/apex/log"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+// maintenanceOptions - Encapsulates the options for the maintenance sub-commands.
+var maintenanceOptions = struct {
+	database string
+}{}
+
+// maintenanceCommand - The maintenance sub-command, groups the sub-commands used to maintain a goamt database.
+var maintenanceCommand = &cobra.Command{
+	Short: "Maintain a goamt database",
+	Use:   "maintenance",
+}
+
+// maintenanceCompactCommand - The maintenance compact sub-command, used to rebuild the database file to reclaim the
+// space left behind by removed rows (e.g. due to the churn of the jobs table).
+var maintenanceCompactCommand = &cobra.Command{
+	RunE:  maintenanceCompact,
+	Short: "Rebuild a goamt database to reclaim unused space",
+	Use:   "compact",
+}
+
+// init - Initialize the flags/arguments for the maintenance sub-commands.
+func init() {
+	maintenanceCompactCommand.Flags().StringVarP(
+		&maintenanceOptions.database,
+		"database",
+		"d",
+		"",
+		"path to a goamt SQLite database",
+	)
+
+	markDatabaseRequired(maintenanceCompactCommand)
+
+	maintenanceCommand.AddCommand(maintenanceCompactCommand)
+}
+
+// maintenanceCompact - Run the maintenance compact sub-command, this will vacuum the database. The entries and jobs
+// themselves (and their ids) are left untouched.
+func maintenanceCompact(_ *cobra.Command, _ []string) error {
+	db, err := database.Open(maintenanceOptions.database)
+	if err != nil {
+		return errors.Wrap(err, "failed to open SQLite database")
+	}
+
+	err = db.Compact()
+	if err != nil {
+		return errors.Wrap(err, "failed to compact database")
+	}
+
+	log.Info("Compacted database")
+
+	err = db.Close()
+	if err != nil {
+		return errors.Wrap(err, "failed to close database")
+	}
+
+	return nil
+}
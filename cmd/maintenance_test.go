@@ -0,0 +1,75 @@
+// Copyright 2020 James Lee <jamesl33info@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/jamesl33/goamt/database"
+	"github.com/jamesl33/goamt/value"
+)
+
+func TestMaintenanceCompact(t *testing.T) {
+	tempDir := t.TempDir()
+
+	maintenanceOptions.database = filepath.Join(tempDir, "goamt.db")
+
+	initial := []value.Entry{
+		{Path: filepath.Join(tempDir, "a.mp4"), Discovered: 8, Hash: 16},
+		{Path: filepath.Join(tempDir, "b.mp4"), Discovered: 16, Hash: 32},
+	}
+
+	createDatabaseAndPopulate(t, maintenanceOptions.database, initial)
+
+	db, err := database.Open(maintenanceOptions.database)
+	if err != nil {
+		t.Fatalf("Expected to be able to open database: %v", err)
+	}
+
+	// Churn the jobs table, leaving a single job behind
+	for range initial {
+		entry, err := db.BeginTranscoding(database.SelectOptions{})
+		if err != nil {
+			t.Fatalf("Expected to be able to begin transcoding: %v", err)
+		}
+
+		err = db.CancelTranscoding(entry)
+		if err != nil {
+			t.Fatalf("Expected to be able to cancel transcoding: %v", err)
+		}
+	}
+
+	_, err = db.BeginTranscoding(database.SelectOptions{})
+	if err != nil {
+		t.Fatalf("Expected to be able to begin transcoding: %v", err)
+	}
+
+	err = db.Close()
+	if err != nil {
+		t.Fatalf("Expected to be able to close database: %v", err)
+	}
+
+	err = maintenanceCompact(nil, nil)
+	if err != nil {
+		t.Fatalf("Expected to be able to compact database: %v", err)
+	}
+
+	if jobs := countJobs(t, maintenanceOptions.database); jobs != 1 {
+		t.Fatalf("Expected the job to be left intact, but got %d", jobs)
+	}
+
+	assertDatabaseContains(t, maintenanceOptions.database, initial)
+}
@@ -0,0 +1,242 @@
+// Copyright 2020 James Lee <jamesl33info@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jamesl33/goamt/value"
+
+	"github.com/apex/log"
+	"github.com/pkg/errors"
+)
+
+// metricsShutdownTimeout - The maximum amount of time to wait for in-flight scrapes when stopping the metrics server.
+const metricsShutdownTimeout = 5 * time.Second
+
+// durationBuckets - The upper bounds (in seconds) of the buckets for the transcode duration histogram, transcoding a
+// file may take anywhere between seconds and several hours.
+var durationBuckets = []float64{30, 60, 300, 600, 1800, 3600, 7200, 14400}
+
+// transcodeMetrics - Thread safe metrics describing a transcode run, exposed in the Prometheus text format. Note that a
+// nil '*transcodeMetrics' is valid and won't record anything.
+type transcodeMetrics struct {
+	lock      sync.Mutex
+	processed int64
+	failed    int64
+	bytesIn   int64
+	bytesOut  int64
+	current   map[string]struct{}
+	buckets   []int64
+	count     int64
+	sum       float64
+}
+
+// newTranscodeMetrics - Create a new set of transcode metrics.
+func newTranscodeMetrics() *transcodeMetrics {
+	return &transcodeMetrics{
+		current: make(map[string]struct{}),
+		buckets: make([]int64, len(durationBuckets)),
+	}
+}
+
+// begin - Record that we've started transcoding the provided entry.
+func (m *transcodeMetrics) begin(entry value.Entry) {
+	if m == nil {
+		return
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.current[entry.Path] = struct{}{}
+}
+
+// end - Record that we've finished transcoding the provided entry, the sizes should be zero if they're unknown.
+func (m *transcodeMetrics) end(entry value.Entry, duration time.Duration, in, out int64, err error) {
+	if m == nil {
+		return
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	delete(m.current, entry.Path)
+
+	if errors.Is(err, errCancelled) {
+		return
+	}
+
+	if err != nil {
+		m.failed++
+		return
+	}
+
+	m.processed++
+	m.bytesIn += in
+	m.bytesOut += out
+	m.count++
+	m.sum += duration.Seconds()
+
+	for index, bound := range durationBuckets {
+		if duration.Seconds() <= bound {
+			m.buckets[index]++
+		}
+	}
+}
+
+// write - Write the metrics to the provided writer using the Prometheus text exposition format.
+func (m *transcodeMetrics) write(w io.Writer) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	var b strings.Builder
+
+	counter := func(name, help string, value int64) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, value)
+	}
+
+	counter("goamt_entries_processed_total", "Number of entries which have been transcoded.", m.processed)
+	counter("goamt_entries_failed_total", "Number of entries which failed to transcode.", m.failed)
+	counter("goamt_bytes_in_total", "Total size of the source files which have been transcoded.", m.bytesIn)
+	counter("goamt_bytes_out_total", "Total size of the transcoded files.", m.bytesOut)
+
+	paths := make([]string, 0, len(m.current))
+	for path := range m.current {
+		paths = append(paths, path)
+	}
+
+	sort.Strings(paths)
+
+	b.WriteString("# HELP goamt_current_jobs Number of entries currently being transcoded.\n")
+	fmt.Fprintf(&b, "# TYPE goamt_current_jobs gauge\ngoamt_current_jobs %d\n", len(paths))
+
+	b.WriteString("# HELP goamt_current_job Entries currently being transcoded.\n# TYPE goamt_current_job gauge\n")
+
+	for _, path := range paths {
+		fmt.Fprintf(&b, "goamt_current_job{path=%s} 1\n", quoteLabel(path))
+	}
+
+	b.WriteString("# HELP goamt_transcode_duration_seconds Time taken to transcode an entry, dominated by ffmpeg.\n")
+	b.WriteString("# TYPE goamt_transcode_duration_seconds histogram\n")
+
+	for index, bound := range durationBuckets {
+		fmt.Fprintf(&b, "goamt_transcode_duration_seconds_bucket{le=\"%s\"} %d\n",
+			strconv.FormatFloat(bound, 'g', -1, 64), m.buckets[index])
+	}
+
+	fmt.Fprintf(&b, "goamt_transcode_duration_seconds_bucket{le=\"+Inf\"} %d\n", m.count)
+	fmt.Fprintf(&b, "goamt_transcode_duration_seconds_sum %s\n", strconv.FormatFloat(m.sum, 'g', -1, 64))
+	fmt.Fprintf(&b, "goamt_transcode_duration_seconds_count %d\n", m.count)
+
+	_, err := io.WriteString(w, b.String())
+
+	return err
+}
+
+// ServeHTTP - Implement the 'http.Handler' interface, serving the metrics.
+func (m *transcodeMetrics) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	err := m.write(w)
+	if err != nil {
+		log.WithError(err).Warn("Failed to write metrics")
+	}
+}
+
+// quoteLabel - Quote the provided label value, escaping it as required by the Prometheus text format.
+func quoteLabel(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s) + `"`
+}
+
+// fileSize - Returns the size of the file at the provided path, or zero if it can't be determined.
+func fileSize(path string) int64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+
+	return info.Size()
+}
+
+// metricsServer - HTTP server which exposes metrics at '/metrics'.
+type metricsServer struct {
+	server   *http.Server
+	listener net.Listener
+	once     sync.Once
+	done     chan struct{}
+}
+
+// startMetricsServer - Start serving the provided metrics on the given address, the server will be stopped when the
+// provided context is cancelled or 'stop' is called (whichever happens first).
+func startMetricsServer(ctx context.Context, addr string, metrics *transcodeMetrics) (*metricsServer, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics)
+
+	server := &metricsServer{
+		server:   &http.Server{Handler: mux},
+		listener: listener,
+		done:     make(chan struct{}),
+	}
+
+	go func() {
+		err := server.server.Serve(listener)
+		if err != nil && err != http.ErrServerClosed {
+			log.WithError(err).Error("Metrics server failed")
+		}
+	}()
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			server.stop()
+		case <-server.done:
+		}
+	}()
+
+	log.WithField("addr", listener.Addr().String()).Info("Serving metrics")
+
+	return server, nil
+}
+
+// stop - Gracefully stop the metrics server, it's safe to call this multiple times.
+func (s *metricsServer) stop() {
+	s.once.Do(func() {
+		close(s.done)
+
+		ctx, cancel := context.WithTimeout(context.Background(), metricsShutdownTimeout)
+		defer cancel()
+
+		err := s.server.Shutdown(ctx)
+		if err != nil {
+			log.WithError(err).Warn("Failed to gracefully stop metrics server")
+		}
+	})
+}
@@ -0,0 +1,113 @@
+// Copyright 2020 James Lee <jamesl33info@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jamesl33/goamt/value"
+)
+
+func TestTranscodeMetrics(t *testing.T) {
+	metrics := newTranscodeMetrics()
+
+	metrics.begin(value.Entry{Path: "a.mkv"})
+	metrics.end(value.Entry{Path: "a.mkv"}, 45*time.Second, 100, 50, nil)
+
+	metrics.begin(value.Entry{Path: "b.mkv"})
+	metrics.end(value.Entry{Path: "b.mkv"}, time.Second, 100, 0, fmt.Errorf("failed"))
+
+	metrics.begin(value.Entry{Path: `c "1".mkv`})
+
+	var b strings.Builder
+
+	err := metrics.write(&b)
+	if err != nil {
+		t.Fatalf("Expected to be able to write metrics: %v", err)
+	}
+
+	expected := []string{
+		"goamt_entries_processed_total 1\n",
+		"goamt_entries_failed_total 1\n",
+		"goamt_bytes_in_total 100\n",
+		"goamt_bytes_out_total 50\n",
+		"goamt_current_jobs 1\n",
+		`goamt_current_job{path="c \"1\".mkv"} 1` + "\n",
+		`goamt_transcode_duration_seconds_bucket{le="30"} 0` + "\n",
+		`goamt_transcode_duration_seconds_bucket{le="60"} 1` + "\n",
+		`goamt_transcode_duration_seconds_bucket{le="+Inf"} 1` + "\n",
+		"goamt_transcode_duration_seconds_sum 45\n",
+		"goamt_transcode_duration_seconds_count 1\n",
+	}
+
+	for _, line := range expected {
+		if !strings.Contains(b.String(), line) {
+			t.Fatalf("Expected metrics to contain '%s' but got:\n%s", strings.TrimSpace(line), b.String())
+		}
+	}
+}
+
+func TestMetricsServer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	metrics := newTranscodeMetrics()
+	metrics.end(value.Entry{Path: "a.mkv"}, time.Second, 100, 50, nil)
+
+	server, err := startMetricsServer(ctx, "127.0.0.1:0", metrics)
+	if err != nil {
+		t.Fatalf("Expected to be able to start metrics server: %v", err)
+	}
+
+	url := fmt.Sprintf("http://%s/metrics", server.listener.Addr())
+
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("Expected to be able to scrape metrics: %v", err)
+	}
+
+	data, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if err != nil {
+		t.Fatalf("Expected to be able to read metrics: %v", err)
+	}
+
+	if !strings.Contains(string(data), "goamt_entries_processed_total 1\n") {
+		t.Fatalf("Expected metrics to contain the processed entries, got:\n%s", data)
+	}
+
+	// Cancelling the context should stop the server, stopping it again should be a no-op
+	cancel()
+
+	<-server.done
+	server.stop()
+
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		resp, err = http.Get(url)
+		if err != nil {
+			return
+		}
+
+		resp.Body.Close()
+	}
+
+	t.Fatalf("Expected the metrics server to have been stopped")
+}
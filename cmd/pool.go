@@ -16,42 +16,263 @@ package cmd
 
 import (
 	"context"
+	"fmt"
+	"io"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/jamesl33/goamt/database"
 	"github.com/jamesl33/goamt/utils"
 	"github.com/jamesl33/goamt/value"
+
+	"github.com/apex/log"
+	"github.com/pkg/errors"
 )
 
-// transcodeFunc - The function used by the worker pool when transcoding entries, used to allow unit testing of the
-// worker pool.
-var transcodeFunc = utils.TranscodeFile
+// transcoderFunc - The function used to select the backend used by the worker pool when transcoding entries, used to
+// allow unit testing of the worker pool.
+var transcoderFunc = utils.NewTranscoder
+
+// physicalCoresFunc - The function used to determine the number of physical cores, used to allow unit testing without
+// depending on the topology of the machine running the tests.
+var physicalCoresFunc = utils.PhysicalCores
+
+// probeFunc - The function used when determining the codec/dimensions of source files, used to allow unit testing
+// without ffprobe.
+var probeFunc = utils.ProbeVideo
+
+// bitRateFunc - The function used when determining the video bit rate of source files, used to allow unit testing
+// without ffprobe.
+var bitRateFunc = utils.ProbeBitRate
+
+// colorFunc - The function used when determining the pixel format/color properties of source files, used to allow unit
+// testing without ffprobe.
+var colorFunc = utils.ProbeColor
+
+// verifyDecodeFunc - The function used to verify transcoded files decode without errors, used to allow unit testing
+// without ffmpeg.
+var verifyDecodeFunc = utils.VerifyDecode
+
+// checkToolsFunc - The function used to check ffmpeg/ffprobe are installed before transcoding, used to allow unit
+// testing without ffmpeg.
+var checkToolsFunc = utils.CheckTools
+
+// deviceFunc - The function used to determine which device an entry is stored on when scheduling per-device, used to
+// allow unit testing without multiple disks.
+var deviceFunc = utils.Device
+
+// errCancelled - Returned by a consume function when processing an entry was cancelled, the entry is counted as having
+// been cancelled rather than failed.
+var errCancelled = errors.New("cancelled")
+
+// ErrEntry - Returned by a worker when it fails to process an entry.
+type ErrEntry struct {
+	// Path - The path of the entry which couldn't be processed.
+	Path string
+
+	err error
+}
+
+func (e *ErrEntry) Error() string {
+	return fmt.Sprintf("'%s': %s", e.Path, e.err)
+}
+
+func (e *ErrEntry) Unwrap() error {
+	return e.err
+}
+
+// ErrPool - Returned when one or more workers in a pool failed; since multiple workers may fail before the pool is
+// stopped, every failure is reported rather than just the first.
+type ErrPool struct {
+	// Entries - The errors for each entry which couldn't be processed, in the order they occurred.
+	Entries []*ErrEntry
+}
+
+func (e *ErrPool) Error() string {
+	if len(e.Entries) == 1 {
+		return fmt.Sprintf("failed to process 1 entry: %s", e.Entries[0])
+	}
+
+	lines := make([]string, 0, len(e.Entries)+1)
+	lines = append(lines, fmt.Sprintf("failed to process %d entries:", len(e.Entries)))
+
+	for _, entry := range e.Entries {
+		lines = append(lines, "  "+entry.Error())
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// Unwrap - Returns the first error, allowing callers to inspect why the pool initially failed.
+func (e *ErrPool) Unwrap() error {
+	return e.Entries[0]
+}
+
+// PoolMetrics - Counters describing the entries handled by a worker pool.
+type PoolMetrics struct {
+	Processed int64
+	Failed    int64
+	Cancelled int64
+}
 
 // Pool - Worker pool which concurrently updates/transcodes entries (depending on which constructor is used).
 type Pool struct {
+	metrics     PoolMetrics
 	entryStream chan value.Entry
 	errorStream chan error
+	queues      []chan value.Entry
 	wg          sync.WaitGroup
 	db          *database.Database
 	consume     func(db *database.Database, entry value.Entry) error
 	drain       func(db *database.Database, entry value.Entry) error
+
+	failures     []*ErrEntry
+	failuresLock sync.Mutex
+
+	// finish is optional, and is run once the workers have stopped to complete any work handed off by them
+	finish func() error
+
+	// progress is optional, and is advanced each time a worker finishes processing an entry
+	progress *progressBar
+
+	// gate is non-nil whilst the pool is paused, and is closed to resume the workers blocked on it
+	gate     chan struct{}
+	gateLock sync.Mutex
+}
+
+// NewUpdatePool - Create a new worker pool which will hash (using the provided options) and upsert entries into the
+// provided database, the outcome of each upsert is recorded in the given outcomes (which may be nil).
+func NewUpdatePool(db *database.Database, options utils.HashOptions, outcomes *upsertOutcomes) *Pool {
+	return &Pool{
+		db: db,
+		consume: func(db *database.Database, entry value.Entry) error {
+			outcome, err := upsertEntry(db, entry, options)
+			if err != nil {
+				return err
+			}
+
+			outcomes.record(outcome)
+
+			return nil
+		},
+		drain: func(_ *database.Database, _ value.Entry) error { return nil },
+	}
+}
+
+// NewPipelinedUpdatePool - Create a new worker pool which will hash (using the provided options) entries concurrently,
+// handing them off to a single writer which upserts them into the provided database. This decouples the number of files
+// read concurrently from the serialized database writes. The outcome of each upsert is recorded in the given outcomes
+// (which may be nil).
+func NewPipelinedUpdatePool(db *database.Database, options utils.HashOptions, outcomes *upsertOutcomes) *Pool {
+	writer := newUpsertWriter(db, outcomes)
+
+	return &Pool{
+		db: db,
+		consume: func(db *database.Database, entry value.Entry) error {
+			var err error
+			entry.Hash, err = utils.HashFileWithOptions(entry.Path, options)
+			if err != nil {
+				return err
+			}
+
+			probeEntry(db, &entry)
+
+			if belowMinDuration(entry) {
+				outcomes.record(database.UpsertSkipped)
+				return nil
+			}
+
+			return writer.write(entry)
+		},
+		drain:  func(_ *database.Database, _ value.Entry) error { return nil },
+		finish: writer.stop,
+	}
 }
 
-// NewUpdatePool - Create a new worker pool which will hash and upsert entries into the provided database.
-func NewUpdatePool(db *database.Database) *Pool {
+// NewProbeOnlyPool - Create a new worker pool which will insert entries into the provided database without hashing
+// them, they'll be hashed by a later update. The outcome of each insert is recorded in the given outcomes (which may be
+// nil).
+func NewProbeOnlyPool(db *database.Database, outcomes *upsertOutcomes) *Pool {
 	return &Pool{
-		db:      db,
-		consume: upsertEntry,
-		drain:   func(_ *database.Database, _ value.Entry) error { return nil },
+		db: db,
+		consume: func(db *database.Database, entry value.Entry) error {
+			outcome, err := db.InsertUnhashed(entry)
+			if err != nil {
+				return err
+			}
+
+			outcomes.record(outcome)
+
+			return nil
+		},
+		drain: func(_ *database.Database, _ value.Entry) error { return nil },
 	}
 }
 
-// NewTranscodePool - Create a new worker pool which will transcode entries from the provided database.
-func NewTranscodePool(db *database.Database) *Pool {
+// NewListPool - Create a new worker pool which will write the path of each entry to the provided writer, allowing the
+// files which would be processed to be listed without processing them.
+func NewListPool(writer io.Writer) *Pool {
 	return &Pool{
-		db:      db,
-		consume: transcodeEntry,
-		drain:   cancelTranscoding,
+		consume: func(_ *database.Database, entry value.Entry) error {
+			_, err := fmt.Fprintln(writer, entry.Path)
+			return err
+		},
+		drain: func(_ *database.Database, _ value.Entry) error { return nil },
+	}
+}
+
+// NewDedupePool - Create a new worker pool which will hash entries (using the provided options), grouping them by their
+// hash.
+func NewDedupePool(groups *hashGroups, options utils.HashOptions) *Pool {
+	return &Pool{
+		consume: func(_ *database.Database, entry value.Entry) error {
+			hash, err := utils.HashFileWithOptions(entry.Path, options)
+			if err != nil {
+				return err
+			}
+
+			groups.add(hash, entry.Path)
+
+			return nil
+		},
+		drain: func(_ *database.Database, _ value.Entry) error { return nil },
+	}
+}
+
+// NewTranscodePool - Create a new worker pool which will transcode entries from the provided database using the given
+// backend, failures will be sent to the given notifier, progress recorded in the given metrics/estimator and first
+// passes taken from the given analyser (all of which may be nil). In-progress transcodes are cancelled if the context
+// is cancelled.
+func NewTranscodePool(ctx context.Context, db *database.Database, transcoder utils.Transcoder,
+	notifier *webhookNotifier, metrics *transcodeMetrics, eta *etaEstimator, analyser *loudnormAnalyser) *Pool {
+	return &Pool{
+		db: db,
+		consume: func(db *database.Database, entry value.Entry) error {
+			var (
+				start = time.Now()
+				in    = fileSize(entry.Path)
+			)
+
+			metrics.begin(entry)
+
+			err := transcodeEntry(ctx, db, transcoder, entry, analyser)
+			if err != nil && !errors.Is(err, errCancelled) {
+				notifier.notifyFailed(entry.Path, time.Since(start), err)
+			}
+
+			var out int64
+			if target, targetErr := transcodeTarget(entry); err == nil && targetErr == nil {
+				out = fileSize(target)
+			}
+
+			metrics.end(entry, time.Since(start), in, out, err)
+			eta.end(entry, err)
+
+			return err
+		},
+		drain: cancelTranscoding,
 	}
 }
 
@@ -61,44 +282,249 @@ func (p *Pool) Start(ctx context.Context, threads int) (chan<- value.Entry, <-ch
 	p.errorStream = make(chan error, threads)
 
 	for w := 0; w < threads; w++ {
-		p.wg.Add(1)
+		p.spawn(ctx, p.entryStream)
+	}
 
-		go func() {
-			defer p.wg.Done()
+	return p.entryStream, p.errorStream
+}
 
-			for entry := range p.entryStream {
-				err := p.consume(p.db, entry)
-				if err != nil {
-					p.errorStream <- err
-					return
+// StartPerDevice - Process entries queued in the returned entry channel using 'perDevice' number of workers for each
+// device which entries are stored on, rather than a global number of workers. This avoids multiple concurrent jobs
+// thrashing a single disk, whilst still making use of every disk.
+func (p *Pool) StartPerDevice(ctx context.Context, perDevice int) (chan<- value.Entry, <-chan error) {
+	p.entryStream = make(chan value.Entry, 1024)
+
+	// Each worker sends at most one error, however, we don't know how many workers there will be up front
+	p.errorStream = make(chan error, 1)
+
+	p.wg.Add(1)
+
+	go func() {
+		defer p.wg.Done()
+
+		queues := make(map[uint64]chan value.Entry)
+
+		for entry := range p.entryStream {
+			device, err := deviceFunc(entry.Path)
+			if err != nil {
+				log.WithError(err).WithFields(entry).Warn("Failed to determine device for entry, using shared queue")
+			}
+
+			queue, ok := queues[device]
+			if !ok {
+				// Each queue can hold as many entries as the entry stream, so dispatching won't block on a busy device
+				queue = make(chan value.Entry, cap(p.entryStream))
+				queues[device] = queue
+				p.queues = append(p.queues, queue)
+
+				for w := 0; w < perDevice; w++ {
+					p.spawn(ctx, queue)
 				}
+			}
+
+			queue <- entry
+		}
+
+		for _, queue := range p.queues {
+			close(queue)
+		}
+	}()
+
+	return p.entryStream, p.errorStream
+}
+
+// spawn - Spawn a worker which will process entries from the provided stream until it's closed, processing an entry
+// fails or the provided context is cancelled.
+func (p *Pool) spawn(ctx context.Context, stream <-chan value.Entry) {
+	p.wg.Add(1)
+
+	go func() {
+		defer p.wg.Done()
+
+		for p.waitUntilResumed(ctx) {
+			entry, ok := <-stream
+			if !ok {
+				return
+			}
 
-				if ctx.Err() != nil {
-					return
+			// The pool may have been paused whilst this worker was idle waiting for an entry, in which case it must not
+			// begin processing it until the pool is resumed
+			if !p.waitUntilResumed(ctx) {
+				err := p.cancel(entry)
+				if err != nil {
+					p.fail(entry, err)
 				}
+
+				return
+			}
+
+			err := p.consume(p.db, entry)
+			if errors.Is(err, errCancelled) {
+				atomic.AddInt64(&p.metrics.Cancelled, 1)
+				return
+			}
+
+			if err != nil {
+				p.fail(entry, err)
+				return
 			}
-		}()
+
+			atomic.AddInt64(&p.metrics.Processed, 1)
+			p.progress.increment()
+
+			if ctx.Err() != nil {
+				return
+			}
+		}
+	}()
+}
+
+// fail - Record that a worker failed to process the provided entry, signalling the failure via the error stream.
+func (p *Pool) fail(entry value.Entry, err error) {
+	atomic.AddInt64(&p.metrics.Failed, 1)
+	p.progress.increment()
+
+	failure := &ErrEntry{Path: entry.Path, err: err}
+
+	p.failuresLock.Lock()
+	p.failures = append(p.failures, failure)
+	p.failuresLock.Unlock()
+
+	// The error stream only signals that a worker failed, every failure is returned by 'Stop'; so avoid blocking when
+	// scheduling per-device since the error stream may be full
+	select {
+	case p.errorStream <- failure:
+	default:
 	}
+}
 
-	return p.entryStream, p.errorStream
+// Pause - Pause the worker pool, workers will finish processing their current entry then block until the pool is
+// resumed (or the context passed when starting the pool is cancelled). Returns a boolean indicating whether the pool
+// was previously running.
+func (p *Pool) Pause() bool {
+	p.gateLock.Lock()
+	defer p.gateLock.Unlock()
+
+	if p.gate != nil {
+		return false
+	}
+
+	p.gate = make(chan struct{})
+
+	return true
+}
+
+// Resume - Resume a paused worker pool, unblocking any waiting workers. Returns a boolean indicating whether the pool
+// was previously paused.
+func (p *Pool) Resume() bool {
+	p.gateLock.Lock()
+	defer p.gateLock.Unlock()
+
+	if p.gate == nil {
+		return false
+	}
+
+	close(p.gate)
+	p.gate = nil
+
+	return true
+}
+
+// waitUntilResumed - Block whilst the worker pool is paused, returning false if the provided context was cancelled
+// whilst waiting; in which case the worker should stop.
+func (p *Pool) waitUntilResumed(ctx context.Context) bool {
+	p.gateLock.Lock()
+	gate := p.gate
+	p.gateLock.Unlock()
+
+	if gate == nil {
+		return true
+	}
+
+	select {
+	case <-gate:
+		return true
+	case <-ctx.Done():
+		return false
+	}
 }
 
 // Stop - Gracefully stop the worker pool, draining 'entryStream' in the event that the user interrupted goamt during
-// the convert/update/transcode sub-command.
+// the convert/update/transcode sub-command, or a worker failed. An 'ErrPool' is returned if any of the workers failed.
 func (p *Pool) Stop() error {
 	close(p.entryStream)
 	p.wg.Wait()
 
-	if len(p.errorStream) != 0 {
-		return <-p.errorStream
+	var finishErr error
+	if p.finish != nil {
+		finishErr = p.finish()
+	}
+
+	// Entries are drained even if a worker failed, otherwise they'd be left half processed (e.g. with a queued job)
+	var drainErr error
+
+	for _, stream := range append([]chan value.Entry{p.entryStream}, p.queues...) {
+		for entry := range stream {
+			if drainErr == nil {
+				drainErr = p.cancel(entry)
+			}
+		}
+	}
+
+	if err := p.Err(); err != nil {
+		return err
 	}
 
-	for entry := range p.entryStream {
+	if finishErr != nil {
+		atomic.AddInt64(&p.metrics.Failed, 1)
+		return finishErr
+	}
+
+	return drainErr
+}
+
+// cancel - Drain the provided entries, which won't be processed by the workers, counting them as cancelled.
+func (p *Pool) cancel(entries ...value.Entry) error {
+	for _, entry := range entries {
 		err := p.drain(p.db, entry)
 		if err != nil {
 			return err
 		}
+
+		atomic.AddInt64(&p.metrics.Cancelled, 1)
 	}
 
 	return nil
 }
+
+// Err - Returns an 'ErrPool' describing every entry which the workers have failed to process so far, or nil if none
+// have failed.
+func (p *Pool) Err() error {
+	p.failuresLock.Lock()
+	defer p.failuresLock.Unlock()
+
+	if len(p.failures) == 0 {
+		return nil
+	}
+
+	return &ErrPool{Entries: append([]*ErrEntry(nil), p.failures...)}
+}
+
+// failure - Returns the errors encountered by the workers if any have failed, otherwise the provided error. Used when
+// queueing entries stops early due to a failure, so that every failed entry is reported rather than just the first.
+func (p *Pool) failure(err error) error {
+	if poolErr := p.Err(); poolErr != nil {
+		return poolErr
+	}
+
+	return err
+}
+
+// Metrics - Returns a snapshot of the metrics for the entries handled by the worker pool.
+func (p *Pool) Metrics() PoolMetrics {
+	return PoolMetrics{
+		Processed: atomic.LoadInt64(&p.metrics.Processed),
+		Failed:    atomic.LoadInt64(&p.metrics.Failed),
+		Cancelled: atomic.LoadInt64(&p.metrics.Cancelled),
+	}
+}
@@ -0,0 +1,282 @@
+// Copyright 2020 James Lee <jamesl33info@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jamesl33/goamt/database"
+	"github.com/jamesl33/goamt/utils"
+	"github.com/jamesl33/goamt/value"
+
+	"github.com/pkg/errors"
+)
+
+// newCountingPool - Create a worker pool which counts the entries it processes.
+func newCountingPool(processed *int64) *Pool {
+	return &Pool{
+		consume: func(_ *database.Database, _ value.Entry) error {
+			atomic.AddInt64(processed, 1)
+			return nil
+		},
+		drain: func(_ *database.Database, _ value.Entry) error { return nil },
+	}
+}
+
+func TestPoolPauseResume(t *testing.T) {
+	var (
+		processed int64
+		pool      = newCountingPool(&processed)
+	)
+
+	if !pool.Pause() {
+		t.Fatalf("Expected pausing a running pool to succeed")
+	}
+
+	if pool.Pause() {
+		t.Fatalf("Expected pausing a paused pool to be a no-op")
+	}
+
+	entryStream, _ := pool.Start(context.Background(), 2)
+
+	for i := 0; i < 4; i++ {
+		entryStream <- value.Entry{ID: i}
+	}
+
+	time.Sleep(50 * time.Millisecond)
+
+	if atomic.LoadInt64(&processed) != 0 {
+		t.Fatalf("Expected no entries to be processed whilst paused, got %d", atomic.LoadInt64(&processed))
+	}
+
+	if !pool.Resume() {
+		t.Fatalf("Expected resuming a paused pool to succeed")
+	}
+
+	if pool.Resume() {
+		t.Fatalf("Expected resuming a running pool to be a no-op")
+	}
+
+	err := pool.Stop()
+	if err != nil {
+		t.Fatalf("Expected to be able to stop the pool: %v", err)
+	}
+
+	if metrics := pool.Metrics(); metrics.Processed != 4 || metrics.Cancelled != 0 {
+		t.Fatalf("Expected all entries to be processed after resuming, got %+v", metrics)
+	}
+}
+
+func TestPoolPauseIdle(t *testing.T) {
+	var (
+		processed int64
+		pool      = newCountingPool(&processed)
+	)
+
+	entryStream, _ := pool.Start(context.Background(), 2)
+
+	// Give the workers time to block waiting for an entry before pausing
+	time.Sleep(50 * time.Millisecond)
+
+	pool.Pause()
+
+	for i := 0; i < 2; i++ {
+		entryStream <- value.Entry{ID: i}
+	}
+
+	time.Sleep(50 * time.Millisecond)
+
+	if atomic.LoadInt64(&processed) != 0 {
+		t.Fatalf("Expected idle workers not to process entries whilst paused, got %d", atomic.LoadInt64(&processed))
+	}
+
+	pool.Resume()
+
+	err := pool.Stop()
+	if err != nil {
+		t.Fatalf("Expected to be able to stop the pool: %v", err)
+	}
+
+	if metrics := pool.Metrics(); metrics.Processed != 2 || metrics.Cancelled != 0 {
+		t.Fatalf("Expected all entries to be processed after resuming, got %+v", metrics)
+	}
+}
+
+func TestPoolPausedCancelled(t *testing.T) {
+	var (
+		processed   int64
+		pool        = newCountingPool(&processed)
+		ctx, cancel = context.WithCancel(context.Background())
+	)
+
+	pool.Pause()
+
+	entryStream, _ := pool.Start(ctx, 2)
+
+	for i := 0; i < 4; i++ {
+		entryStream <- value.Entry{ID: i}
+	}
+
+	cancel()
+
+	err := pool.Stop()
+	if err != nil {
+		t.Fatalf("Expected to be able to stop the pool: %v", err)
+	}
+
+	if metrics := pool.Metrics(); metrics.Processed != 0 || metrics.Cancelled != 4 {
+		t.Fatalf("Expected paused entries to be drained when cancelled, got %+v", metrics)
+	}
+}
+
+func TestPipelinedUpdatePoolWriteFailure(t *testing.T) {
+	tempDir := t.TempDir()
+
+	path := filepath.Join(tempDir, "test.mp4")
+
+	err := ioutil.WriteFile(path, []byte("test"), 0o755)
+	if err != nil {
+		t.Fatalf("Expected to be able to create test file: %v", err)
+	}
+
+	createDatabaseAndPopulate(t, filepath.Join(tempDir, "goamt.db"), nil)
+
+	db, err := database.Open(filepath.Join(tempDir, "goamt.db"))
+	if err != nil {
+		t.Fatalf("Expected to be able to open database: %v", err)
+	}
+	defer db.Close()
+
+	// Dropping the library table causes the writer to fail to upsert the entry
+	raw, err := sql.Open("sqlite3", filepath.Join(tempDir, "goamt.db"))
+	if err != nil {
+		t.Fatalf("Expected to be able to open database: %v", err)
+	}
+	defer raw.Close()
+
+	_, err = raw.Exec("drop table jobs; drop table library;")
+	if err != nil {
+		t.Fatalf("Expected to be able to drop tables: %v", err)
+	}
+
+	var (
+		outcomes       upsertOutcomes
+		pool           = NewPipelinedUpdatePool(db, utils.HashOptions{Algorithm: utils.HashAlgorithmIEEE}, &outcomes)
+		entryStream, _ = pool.Start(context.Background(), 2)
+	)
+
+	// Transcoded entries aren't probed, so the database is only used by the writer
+	entryStream <- value.Entry{Path: path, Transcoded: utils.Int64P(0)}
+
+	err = pool.Stop()
+	if err == nil {
+		t.Fatalf("Expected an error when the writer fails to upsert an entry")
+	}
+
+	if metrics := pool.Metrics(); metrics.Failed != 1 {
+		t.Fatalf("Expected the writer failure to be counted, got %+v", metrics)
+	}
+
+	if outcomes.inserted != 0 {
+		t.Fatalf("Expected no entries to be inserted, got %d", outcomes.inserted)
+	}
+}
+
+func TestPoolStopDrainsAfterFailure(t *testing.T) {
+	var (
+		errFailed = errors.New("failed")
+		drained   int64
+	)
+
+	pool := &Pool{
+		consume: func(_ *database.Database, _ value.Entry) error { return errFailed },
+		drain: func(_ *database.Database, _ value.Entry) error {
+			atomic.AddInt64(&drained, 1)
+			return nil
+		},
+	}
+
+	entryStream, _ := pool.Start(context.Background(), 1)
+
+	for i := 0; i < 4; i++ {
+		entryStream <- value.Entry{ID: i}
+	}
+
+	err := pool.Stop()
+	if !errors.Is(err, errFailed) {
+		t.Fatalf("Expected the failure to be returned but got %v", err)
+	}
+
+	// The worker stops after failing, so the remaining entries must be drained rather than left queued
+	if metrics := pool.Metrics(); drained != 3 || metrics.Failed != 1 || metrics.Cancelled != 3 {
+		t.Fatalf("Expected the remaining entries to be drained, got %d drained and %+v", drained, metrics)
+	}
+}
+
+func TestPoolStopReturnsEveryFailure(t *testing.T) {
+	errFailed := errors.New("failed")
+
+	pool := &Pool{
+		consume: func(_ *database.Database, _ value.Entry) error { return errFailed },
+		drain:   func(_ *database.Database, _ value.Entry) error { return nil },
+	}
+
+	entryStream, _ := pool.Start(context.Background(), 2)
+
+	for _, path := range []string{"a.mp4", "b.mp4"} {
+		entryStream <- value.Entry{Path: path}
+	}
+
+	err := pool.Stop()
+
+	var poolErr *ErrPool
+	if !errors.As(err, &poolErr) {
+		t.Fatalf("Expected an 'ErrPool' but got '%#v'", err)
+	}
+
+	if len(poolErr.Entries) != 2 {
+		t.Fatalf("Expected 2 failed entries but got %d", len(poolErr.Entries))
+	}
+
+	paths := []string{poolErr.Entries[0].Path, poolErr.Entries[1].Path}
+	sort.Strings(paths)
+
+	if !reflect.DeepEqual(paths, []string{"a.mp4", "b.mp4"}) {
+		t.Fatalf("Expected both entries to be reported but got %v", paths)
+	}
+
+	if !errors.Is(err, errFailed) {
+		t.Fatalf("Expected the cause of the failure to be preserved")
+	}
+
+	expected := fmt.Sprintf(
+		"failed to process 2 entries:\n  '%s': failed\n  '%s': failed",
+		poolErr.Entries[0].Path,
+		poolErr.Entries[1].Path,
+	)
+
+	if poolErr.Error() != expected {
+		t.Fatalf("Expected '%s' but got '%s'", expected, poolErr.Error())
+	}
+}
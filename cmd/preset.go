@@ -0,0 +1,114 @@
+// Copyright 2020 James Lee <jamesl33info@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/jamesl33/goamt/utils"
+)
+
+// transcodePreset - A named set of options controlling how the video stream is encoded, see 'utils.TranscodeOptions'
+// for the meaning of each value.
+type transcodePreset struct {
+	codec, encoderPreset, profile, level string
+	crf                                  int
+}
+
+// defaultPreset - The preset used when none is provided, this matches the output of older versions of goamt.
+const defaultPreset = "default"
+
+// transcodePresets - The presets which may be chosen using '--preset'.
+var transcodePresets = map[string]transcodePreset{
+	defaultPreset: {
+		codec:   utils.VideoCodecH264,
+		profile: "high",
+		level:   "4.0",
+	},
+	"fast": {
+		codec:         utils.VideoCodecH264,
+		encoderPreset: "veryfast",
+		profile:       "high",
+		level:         "4.0",
+		crf:           23,
+	},
+	"archive": {
+		codec:         utils.VideoCodecH265,
+		encoderPreset: "slow",
+		profile:       "main",
+		crf:           22,
+	},
+}
+
+// presetNames - Returns the sorted names of the available presets.
+func presetNames() []string {
+	names := make([]string, 0, len(transcodePresets))
+	for name := range transcodePresets {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// resolvePreset - Expand the preset chosen using '--preset', then apply any of the individual video flags which were
+// provided (as reported by 'changed'); these always take precedence over the preset. Since profiles/levels are codec
+// specific, those from the preset are discarded when the codec is overridden.
+func resolvePreset(changed func(name string) bool) (transcodePreset, error) {
+	preset, ok := transcodePresets[transcodeOptions.preset]
+	if !ok {
+		return transcodePreset{}, fmt.Errorf("preset '%s' is not supported, expected one of '%s'",
+			transcodeOptions.preset, strings.Join(presetNames(), "', '"))
+	}
+
+	if changed("video-codec") && transcodeOptions.videoCodec != preset.codec {
+		preset.codec, preset.profile, preset.level = transcodeOptions.videoCodec, "", ""
+	}
+
+	if changed("crf") {
+		preset.crf = transcodeOptions.crf
+	}
+
+	if changed("encoder-preset") {
+		preset.encoderPreset = transcodeOptions.encoderPreset
+	}
+
+	if changed("profile") {
+		preset.profile = transcodeOptions.profile
+	}
+
+	if changed("level") {
+		preset.level = transcodeOptions.level
+	}
+
+	if preset.codec != utils.VideoCodecH264 && preset.codec != utils.VideoCodecH265 {
+		return transcodePreset{}, fmt.Errorf("video codec '%s' is not supported, expected '%s' or '%s'", preset.codec,
+			utils.VideoCodecH264, utils.VideoCodecH265)
+	}
+
+	if preset.encoderPreset != "" && !utils.ContainsString(utils.EncoderPresets, preset.encoderPreset) {
+		return transcodePreset{}, fmt.Errorf("encoder preset '%s' is not supported, expected one of '%s'",
+			preset.encoderPreset, strings.Join(utils.EncoderPresets, "', '"))
+	}
+
+	if preset.crf < 0 || preset.crf > 51 {
+		return transcodePreset{}, fmt.Errorf("crf %d is not in the range 0 to 51", preset.crf)
+	}
+
+	return preset, nil
+}
@@ -0,0 +1,137 @@
+// Copyright 2020 James Lee <jamesl33info@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/jamesl33/goamt/utils"
+)
+
+func TestResolvePreset(t *testing.T) {
+	type test struct {
+		name     string
+		preset   string
+		flags    map[string]string
+		expected transcodePreset
+		err      bool
+	}
+
+	tests := []*test{
+		{
+			name:     "Default",
+			preset:   defaultPreset,
+			expected: transcodePreset{codec: utils.VideoCodecH264, profile: "high", level: "4.0"},
+		},
+		{
+			name:     "Archive",
+			preset:   "archive",
+			expected: transcodePreset{codec: utils.VideoCodecH265, encoderPreset: "slow", profile: "main", crf: 22},
+		},
+		{
+			name:   "OverrideCRF",
+			preset: "fast",
+			flags:  map[string]string{"crf": "18"},
+			expected: transcodePreset{
+				codec:         utils.VideoCodecH264,
+				encoderPreset: "veryfast",
+				profile:       "high",
+				level:         "4.0",
+				crf:           18,
+			},
+		},
+		{
+			name:     "OverrideCodec",
+			preset:   "archive",
+			flags:    map[string]string{"video-codec": utils.VideoCodecH264},
+			expected: transcodePreset{codec: utils.VideoCodecH264, encoderPreset: "slow", crf: 22},
+		},
+		{
+			name:     "OverrideCodecAndProfile",
+			preset:   "archive",
+			flags:    map[string]string{"video-codec": utils.VideoCodecH264, "profile": "main"},
+			expected: transcodePreset{codec: utils.VideoCodecH264, encoderPreset: "slow", profile: "main", crf: 22},
+		},
+		{
+			name:   "UnknownPreset",
+			preset: "unknown",
+			err:    true,
+		},
+		{
+			name:   "UnknownCodec",
+			preset: defaultPreset,
+			flags:  map[string]string{"video-codec": "vp9"},
+			err:    true,
+		},
+		{
+			name:     "OverrideEncoderPreset",
+			preset:   "archive",
+			flags:    map[string]string{"encoder-preset": "veryslow"},
+			expected: transcodePreset{codec: utils.VideoCodecH265, encoderPreset: "veryslow", profile: "main", crf: 22},
+		},
+		{
+			name:   "UnknownEncoderPreset",
+			preset: defaultPreset,
+			flags:  map[string]string{"encoder-preset": "quick"},
+			err:    true,
+		},
+		{
+			name:   "InvalidCRF",
+			preset: defaultPreset,
+			flags:  map[string]string{"crf": "52"},
+			err:    true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			defer func() {
+				for name := range test.flags {
+					_ = transcodeCommand.Flags().Set(name, transcodeCommand.Flags().Lookup(name).DefValue)
+					transcodeCommand.Flags().Lookup(name).Changed = false
+				}
+
+				transcodeOptions.preset = defaultPreset
+			}()
+
+			transcodeOptions.preset = test.preset
+
+			for name, value := range test.flags {
+				err := transcodeCommand.Flags().Set(name, value)
+				if err != nil {
+					t.Fatalf("Expected to be able to set flag: %v", err)
+				}
+			}
+
+			preset, err := resolvePreset(transcodeCommand.Flags().Changed)
+			if test.err {
+				if err == nil {
+					t.Fatalf("Expected an error")
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Expected to be able to resolve preset: %v", err)
+			}
+
+			if !reflect.DeepEqual(preset, test.expected) {
+				t.Fatalf("Expected %+v but got %+v", test.expected, preset)
+			}
+		})
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright 2020 James Lee <jamesl33info@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"path/filepath"
+
+	"github.com/jamesl33/goamt/database"
+
+	"github.com/apex/log"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+// priorityOptions - Encapsulates the options for the priority sub-command.
+var priorityOptions = struct {
+	database, path string
+	priority       int
+}{}
+
+// priorityCommand - The priority sub-command, used to control the order in which entries are transcoded.
+var priorityCommand = &cobra.Command{
+	RunE:  priority,
+	Short: "Set the transcode priority of entries in the goamt database",
+	Use:   "priority",
+}
+
+// init - Initialize the flags/arguments for the priority sub-command.
+func init() {
+	priorityCommand.Flags().StringVarP(
+		&priorityOptions.database,
+		"database",
+		"d",
+		"",
+		"path to a goamt SQLite database",
+	)
+
+	priorityCommand.Flags().StringVarP(
+		&priorityOptions.path,
+		"path",
+		"p",
+		"",
+		"path to a media file (or a directory containing media files), as stored in the database",
+	)
+
+	priorityCommand.Flags().IntVar(
+		&priorityOptions.priority,
+		"priority",
+		0,
+		"the priority to set, entries with a higher priority are transcoded first",
+	)
+
+	markDatabaseRequired(priorityCommand)
+	markFlagRequired(priorityCommand, "path")
+	markFlagRequired(priorityCommand, "priority")
+}
+
+// priority - Run the priority sub-command, this will set the priority of all the entries which match the provided path.
+func priority(_ *cobra.Command, _ []string) error {
+	db, err := database.Open(priorityOptions.database)
+	if err != nil {
+		return errors.Wrap(err, "failed to open SQLite database")
+	}
+
+	updated, err := db.SetPriority(filepath.Clean(priorityOptions.path), priorityOptions.priority)
+	if err != nil {
+		return errors.Wrap(err, "failed to set priority")
+	}
+
+	if updated == 0 {
+		log.WithField("path", priorityOptions.path).Warn("No entries matched the provided path")
+	}
+
+	err = db.Close()
+	if err != nil {
+		return errors.Wrap(err, "failed to close database")
+	}
+
+	return nil
+}
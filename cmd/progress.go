@@ -0,0 +1,191 @@
+// Copyright 2020 James Lee <jamesl33info@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/apex/log"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// progressWidth - The number of characters used to draw the bar itself.
+	progressWidth = 30
+
+	// progressRedrawInterval - How often the progress bar is redrawn when writing to a terminal.
+	progressRedrawInterval = 200 * time.Millisecond
+
+	// progressLogInterval - How often progress is logged when standard error isn't a terminal.
+	progressLogInterval = 30 * time.Second
+)
+
+// isTerminalFunc - Determines whether the provided file is a terminal, may be overridden by the unit tests.
+var isTerminalFunc = isTerminal
+
+// isTerminal - Returns a boolean indicating whether the provided file is a terminal.
+func isTerminal(file *os.File) bool {
+	_, err := unix.IoctlGetTermios(int(file.Fd()), unix.TCGETS)
+	return err == nil
+}
+
+// progressBar - Thread safe report of the number of entries completed by a worker pool, which is redrawn in place when
+// writing to a terminal and otherwise periodically logged. Note that a nil '*progressBar' is valid and won't report
+// anything.
+type progressBar struct {
+	label     string
+	total     int64
+	completed int64
+	writer    io.Writer
+	terminal  bool
+	interval  time.Duration
+	logged    int64
+	done      chan struct{}
+	wg        sync.WaitGroup
+	once      sync.Once
+}
+
+// startProgressBar - Create and start a progress bar with the provided label, which is drawn on standard error if it's
+// a terminal. The total may be zero if it isn't known up front, in which case only the number completed is reported.
+// Returns nil if progress isn't enabled.
+func startProgressBar(enabled bool, label string, total int64) *progressBar {
+	if !enabled {
+		return nil
+	}
+
+	bar := newProgressBar(label, total, os.Stderr, isTerminalFunc(os.Stderr))
+	bar.start()
+
+	return bar
+}
+
+// newProgressBar - Create a new progress bar which is drawn to the provided writer when it's a terminal, otherwise
+// progress is logged instead.
+func newProgressBar(label string, total int64, writer io.Writer, terminal bool) *progressBar {
+	interval := progressLogInterval
+	if terminal {
+		interval = progressRedrawInterval
+	}
+
+	return &progressBar{
+		label:    label,
+		total:    total,
+		writer:   writer,
+		terminal: terminal,
+		interval: interval,
+		logged:   -1,
+		done:     make(chan struct{}),
+	}
+}
+
+// start - Begin periodically reporting progress, until the progress bar is stopped.
+func (p *progressBar) start() {
+	p.wg.Add(1)
+
+	go func() {
+		defer p.wg.Done()
+
+		ticker := time.NewTicker(p.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-p.done:
+				return
+			case <-ticker.C:
+				p.report()
+			}
+		}
+	}()
+}
+
+// increment - Record that another entry has been completed.
+func (p *progressBar) increment() {
+	if p == nil {
+		return
+	}
+
+	atomic.AddInt64(&p.completed, 1)
+}
+
+// stop - Stop periodically reporting progress, reporting the final progress. It's safe to stop a progress bar more
+// than once.
+func (p *progressBar) stop() {
+	if p == nil {
+		return
+	}
+
+	p.once.Do(func() {
+		close(p.done)
+		p.wg.Wait()
+
+		p.report()
+
+		if p.terminal {
+			fmt.Fprintln(p.writer)
+		}
+	})
+}
+
+// report - Redraw the progress bar, or log the progress if it has changed since it was last logged.
+func (p *progressBar) report() {
+	completed := atomic.LoadInt64(&p.completed)
+
+	if p.terminal {
+		// Return to the start of the line, and clear it, so that the bar is drawn over the previous one
+		fmt.Fprintf(p.writer, "\r\x1b[K%s", p.render(completed))
+		return
+	}
+
+	if completed == p.logged {
+		return
+	}
+
+	p.logged = completed
+
+	fields := log.Fields{"completed": completed}
+	if p.total > 0 {
+		fields["total"] = p.total
+	}
+
+	log.WithFields(fields).Info(p.label)
+}
+
+// render - Returns the progress bar for the provided number of completed entries e.g. 'label [=====>    ] 3/10 (30%)',
+// or just the number completed if the total isn't known.
+func (p *progressBar) render(completed int64) string {
+	if p.total <= 0 {
+		return fmt.Sprintf("%s %d", p.label, completed)
+	}
+
+	if completed > p.total {
+		completed = p.total
+	}
+
+	filled := int(completed * progressWidth / p.total)
+
+	bar := strings.Repeat("=", filled)
+	if filled < progressWidth {
+		bar += ">" + strings.Repeat(" ", progressWidth-filled-1)
+	}
+
+	return fmt.Sprintf("%s [%s] %d/%d (%d%%)", p.label, bar, completed, p.total, completed*100/p.total)
+}
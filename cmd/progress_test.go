@@ -0,0 +1,145 @@
+// Copyright 2020 James Lee <jamesl33info@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/jamesl33/goamt/value"
+)
+
+func TestProgressBarRender(t *testing.T) {
+	type test struct {
+		name      string
+		total     int64
+		completed int64
+		expected  string
+	}
+
+	tests := []*test{
+		{
+			name:     "Empty",
+			total:    10,
+			expected: "Label [>                             ] 0/10 (0%)",
+		},
+		{
+			name:      "Partial",
+			total:     10,
+			completed: 3,
+			expected:  "Label [=========>                    ] 3/10 (30%)",
+		},
+		{
+			name:      "Complete",
+			total:     10,
+			completed: 10,
+			expected:  "Label [==============================] 10/10 (100%)",
+		},
+		{
+			name:      "UnknownTotal",
+			completed: 42,
+			expected:  "Label 42",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			bar := newProgressBar("Label", test.total, nil, true)
+
+			rendered := bar.render(test.completed)
+			if rendered != test.expected {
+				t.Fatalf("Expected '%s' but got '%s'", test.expected, rendered)
+			}
+		})
+	}
+}
+
+func TestProgressBarTerminal(t *testing.T) {
+	var (
+		buffer bytes.Buffer
+		bar    = newProgressBar("Label", 4, &buffer, true)
+	)
+
+	bar.start()
+
+	for i := 0; i < 3; i++ {
+		bar.increment()
+	}
+
+	bar.stop()
+	bar.stop()
+
+	expected := "\r\x1b[KLabel [======================>       ] 3/4 (75%)\n"
+	if !strings.HasSuffix(buffer.String(), expected) || strings.Count(buffer.String(), "\n") != 1 {
+		t.Fatalf("Expected the final progress to be drawn once stopped, got %q", buffer.String())
+	}
+}
+
+func TestProgressBarNotTerminal(t *testing.T) {
+	var (
+		buffer bytes.Buffer
+		bar    = newProgressBar("Label", 4, &buffer, false)
+	)
+
+	bar.start()
+	bar.increment()
+	bar.stop()
+
+	if buffer.Len() != 0 {
+		t.Fatalf("Expected progress to be logged rather than drawn, got %q", buffer.String())
+	}
+
+	if bar.logged != 1 {
+		t.Fatalf("Expected the final progress to be logged, got %d", bar.logged)
+	}
+}
+
+func TestProgressBarNil(t *testing.T) {
+	var bar *progressBar
+
+	bar.increment()
+	bar.stop()
+
+	if startProgressBar(false, "Label", 0) != nil {
+		t.Fatalf("Expected no progress bar when progress isn't enabled")
+	}
+}
+
+func TestPoolProgress(t *testing.T) {
+	var (
+		buffer bytes.Buffer
+		pool   = NewListPool(&buffer)
+	)
+
+	pool.progress = newProgressBar("Label", 0, &buffer, false)
+
+	entryStream, _ := pool.Start(context.Background(), 2)
+
+	for i := 0; i < 5; i++ {
+		entryStream <- value.Entry{Path: fmt.Sprintf("/media/%d.mkv", i)}
+	}
+
+	err := pool.Stop()
+	if err != nil {
+		t.Fatalf("Expected to be able to stop pool: %v", err)
+	}
+
+	if pool.progress.completed != 5 {
+		t.Fatalf("Expected the progress to be advanced for each entry, got %d", pool.progress.completed)
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright 2020 James Lee <jamesl33info@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/jamesl33/goamt/database"
+
+	"github.com/apex/log"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+// retranscodeOptions - Encapsulates the options for the retranscode sub-command.
+var retranscodeOptions = struct {
+	database, path string
+}{}
+
+// retranscodeCommand - The retranscode sub-command, used to allow entries which have already been transcoded to be
+// selected again (e.g. after changing the encoding options).
+var retranscodeCommand = &cobra.Command{
+	RunE:  retranscode,
+	Short: "Reset the transcoded status of entries in the goamt database",
+	Use:   "retranscode",
+}
+
+// init - Initialize the flags/arguments for the retranscode sub-command.
+func init() {
+	retranscodeCommand.Flags().StringVarP(
+		&retranscodeOptions.database,
+		"database",
+		"d",
+		"",
+		"path to a goamt SQLite database",
+	)
+
+	retranscodeCommand.Flags().StringVarP(
+		&retranscodeOptions.path,
+		"path",
+		"p",
+		"",
+		"path to a media file (or a directory containing media files) as stored in the database, defaults to all entries",
+	)
+
+	markDatabaseRequired(retranscodeCommand)
+}
+
+// retranscode - Run the retranscode sub-command, this will reset the transcoded status of all the transcoded entries
+// which match the provided path once confirmed; the next transcode will re-encode them, replacing their files.
+func retranscode(_ *cobra.Command, _ []string) error {
+	db, err := database.Open(retranscodeOptions.database)
+	if err != nil {
+		return errors.Wrap(err, "failed to open SQLite database")
+	}
+
+	var prefix string
+	if retranscodeOptions.path != "" {
+		prefix = filepath.Clean(retranscodeOptions.path)
+	}
+
+	transcoded, err := db.List(database.ListOptions{Prefix: prefix, TranscodedOnly: true})
+	if err != nil {
+		return errors.Wrap(err, "failed to list transcoded entries")
+	}
+
+	entries, err := db.List(database.ListOptions{Prefix: prefix, TranscodedOnly: true, ExcludeKeptSources: true})
+	if err != nil {
+		return errors.Wrap(err, "failed to list transcoded entries")
+	}
+
+	if skipped := len(transcoded) - len(entries); skipped != 0 {
+		log.WithField("skipped", skipped).
+			Warn("Entries transcoded to an output directory (whose source was kept) can't be reset, skipping them")
+	}
+
+	if len(entries) == 0 {
+		log.Info("No transcoded entries to reset")
+		return db.Close()
+	}
+
+	proceed, err := confirm(fmt.Sprintf("%d transcoded entries will be re-encoded by the next transcode, replacing "+
+		"their current files, continue?", len(entries)))
+	if err != nil {
+		return errors.Wrap(err, "failed to confirm reset")
+	}
+
+	if proceed {
+		updated, err := db.ResetTranscoded(prefix)
+		if err != nil {
+			return errors.Wrap(err, "failed to reset transcoded status")
+		}
+
+		log.WithField("updated", updated).Info("Reset transcoded status")
+	}
+
+	err = db.Close()
+	if err != nil {
+		return errors.Wrap(err, "failed to close database")
+	}
+
+	return nil
+}
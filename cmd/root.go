@@ -18,6 +18,11 @@ import (
 	"github.com/spf13/cobra"
 )
 
+// rootOptions - Encapsulates the options which are shared by all the sub-commands.
+var rootOptions = struct {
+	yes bool
+}{}
+
 // rootCommand - Represents the root goamt command and encapsulates all the supported sub-commands.
 var rootCommand = &cobra.Command{
 	Short:         "An automatic media transcoder written in Go with an emphasis on ease of management and performance",
@@ -25,9 +30,20 @@ var rootCommand = &cobra.Command{
 	SilenceUsage:  true,
 }
 
-// init - Initialize the root command by adding all the supported sub-commands.
+// init - Initialize the root command by adding the global flags and all the supported sub-commands.
 func init() {
-	rootCommand.AddCommand(versionCommand, convertCommand, createCommand, updateCommand, transcodeCommand)
+	rootCommand.PersistentFlags().BoolVarP(
+		&rootOptions.yes,
+		"yes",
+		"y",
+		false,
+		"assume yes for any confirmation prompts, required when running non-interactively",
+	)
+
+	rootCommand.AddCommand(versionCommand, convertCommand, createCommand, updateCommand, transcodeCommand,
+		dedupeCommand, priorityCommand, unquarantineCommand, jobsCommand, infoCommand, listCommand,
+		searchCommand, retranscodeCommand, cleanupCommand, coordinateCommand, historyCommand, maintenanceCommand,
+		auditCommand)
 }
 
 // Execute - Execute goamt, returning any errors raised during the operation of the chosen sub-command.
@@ -0,0 +1,116 @@
+// Copyright 2020 James Lee <jamesl33info@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"os"
+	"strings"
+
+	"github.com/jamesl33/goamt/database"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+// searchOptions - Encapsulates the options for the search sub-command.
+var searchOptions = struct {
+	database, format, template string
+	glob, transcodedOnly       bool
+}{}
+
+// searchCommand - The search sub-command, used to find entries in a goamt database by their path.
+var searchCommand = &cobra.Command{
+	Args:  cobra.ExactArgs(1),
+	RunE:  search,
+	Short: "Search for entries in a goamt SQLite database by path",
+	Use:   "search <pattern>",
+}
+
+// init - Initialize the flags/arguments for the search sub-command.
+func init() {
+	searchCommand.Flags().StringVarP(
+		&searchOptions.database,
+		"database",
+		"d",
+		"",
+		"path to a goamt SQLite database",
+	)
+
+	searchCommand.Flags().BoolVar(
+		&searchOptions.glob,
+		"glob",
+		false,
+		"treat the pattern as a case sensitive glob which must match the entire path, rather than a substring",
+	)
+
+	searchCommand.Flags().BoolVar(
+		&searchOptions.transcodedOnly,
+		"transcoded-only",
+		false,
+		"only list entries which have been transcoded",
+	)
+
+	searchCommand.Flags().StringVar(
+		&searchOptions.format,
+		"format",
+		"table",
+		"the format entries are written in, one of '"+strings.Join(entryFormatNames(), "', '")+"'",
+	)
+
+	searchCommand.Flags().StringVar(
+		&searchOptions.template,
+		"template",
+		"",
+		"write each entry using this Go template (e.g. '{{.Path}}\\t{{.Hash}}') instead of a named format",
+	)
+
+	markDatabaseRequired(searchCommand)
+}
+
+// search - Run the search sub-command, this will open the database read-only and print the entries whose path matches
+// the provided pattern; by default the pattern is matched as a (case insensitive) substring of the path.
+func search(_ *cobra.Command, args []string) error {
+	write, err := entryWriter(searchOptions.format, searchOptions.template)
+	if err != nil {
+		return err // Purposefully not wrapped
+	}
+
+	db, err := database.OpenReadOnly(searchOptions.database)
+	if err != nil {
+		return errors.Wrap(err, "failed to open SQLite database")
+	}
+
+	entries, err := db.List(database.ListOptions{
+		Pattern:        args[0],
+		Glob:           searchOptions.glob,
+		TranscodedOnly: searchOptions.transcodedOnly,
+		Sort:           "path",
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to search entries")
+	}
+
+	err = write(os.Stdout, entries)
+	if err != nil {
+		return errors.Wrap(err, "failed to write entries")
+	}
+
+	err = db.Close()
+	if err != nil {
+		return errors.Wrap(err, "failed to close database")
+	}
+
+	return nil
+}
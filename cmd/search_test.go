@@ -0,0 +1,34 @@
+// Copyright 2020 James Lee <jamesl33info@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/jamesl33/goamt/value"
+)
+
+func TestSearch(t *testing.T) {
+	tempDir := t.TempDir()
+	searchOptions.database = filepath.Join(tempDir, "goamt.db")
+
+	createDatabaseAndPopulate(t, searchOptions.database, []value.Entry{{Path: "test.mp4", Discovered: 8, Hash: 16}})
+
+	err := search(nil, []string{"test"})
+	if err != nil {
+		t.Fatalf("Expected to be able to search entries: %v", err)
+	}
+}
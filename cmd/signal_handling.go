@@ -23,24 +23,57 @@ import (
 	"github.com/apex/log"
 )
 
-// signalHandler - Spawn a goroutine which gracefully handles SIGINT by cancelling the returned context, this can be
-// used to determine if we need to gracefully terminate.
+// signalHandler - Spawn a goroutine which gracefully handles SIGINT/SIGTERM by cancelling the returned context, this
+// can be used to determine if we need to gracefully terminate. SIGTERM is handled so that stopping goamt using a
+// service manager (e.g. 'systemctl stop') leaves the database consistent, just like interrupting it does.
 func signalHandler() context.Context {
 	ctx, cancelFunc := context.WithCancel(context.Background())
 
 	signalStream := make(chan os.Signal, 1)
-	signal.Notify(signalStream, syscall.SIGINT)
+	signal.Notify(signalStream, syscall.SIGINT, syscall.SIGTERM)
 
 	go func() {
-		<-signalStream
+		sig := <-signalStream
 
 		signal.Stop(signalStream)
 		close(signalStream)
 
-		log.Warn("Received interrupt signal, gracefully terminating")
+		log.WithField("signal", sig).Warn("Received termination signal, gracefully terminating")
 
 		cancelFunc()
 	}()
 
 	return ctx
 }
+
+// pauseHandler - Spawn a goroutine which pauses the provided worker pool upon receiving SIGUSR1 and resumes it upon
+// receiving SIGUSR2, the returned function stops handling the signals.
+func pauseHandler(pool *Pool) func() {
+	var (
+		signalStream = make(chan os.Signal, 1)
+		done         = make(chan struct{})
+	)
+
+	signal.Notify(signalStream, syscall.SIGUSR1, syscall.SIGUSR2)
+
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case sig := <-signalStream:
+				switch {
+				case sig == syscall.SIGUSR1 && pool.Pause():
+					log.Warn("Received SIGUSR1, pausing once in-progress entries complete (send SIGUSR2 to resume)")
+				case sig == syscall.SIGUSR2 && pool.Resume():
+					log.Info("Received SIGUSR2, resuming")
+				}
+			}
+		}
+	}()
+
+	return func() {
+		signal.Stop(signalStream)
+		close(done)
+	}
+}
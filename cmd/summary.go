@@ -0,0 +1,128 @@
+// Copyright 2020 James Lee <jamesl33info@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"time"
+
+	"github.com/jamesl33/goamt/database"
+	"github.com/jamesl33/goamt/value"
+
+	"github.com/apex/log"
+	"github.com/pkg/errors"
+)
+
+// runSummary - Machine readable summary of a sub-command run, intended to be consumed by monitoring when goamt is being
+// run by cron/systemd.
+type runSummary struct {
+	Command   string    `json:"command"`
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"`
+	Duration  float64   `json:"duration"`
+	Processed int64     `json:"processed"`
+	Failed    int64     `json:"failed"`
+	Cancelled int64     `json:"cancelled"`
+	Success   bool      `json:"success"`
+	Error     string    `json:"error,omitempty"`
+
+	pool *Pool
+
+	// database is the path to the database which the run is recorded in, empty if the run shouldn't be recorded (e.g.
+	// because the database couldn't be opened)
+	database string
+}
+
+// newRunSummary - Create a new summary for a run of the provided sub-command, beginning now.
+func newRunSummary(command string) *runSummary {
+	return &runSummary{Command: command, Start: time.Now().UTC()}
+}
+
+// complete - Complete the summary using the provided error (which may be nil) and the metrics from the worker pool (if
+// one was used), then write it to the given path. The original error is returned so this may wrap the sub-command.
+func (r *runSummary) complete(path string, err error) error {
+	r.End = time.Now().UTC()
+	r.Duration = r.End.Sub(r.Start).Seconds()
+	r.Success = err == nil
+
+	if err != nil {
+		r.Error = err.Error()
+	}
+
+	if r.pool != nil {
+		metrics := r.pool.Metrics()
+		r.Processed, r.Failed, r.Cancelled = metrics.Processed, metrics.Failed, metrics.Cancelled
+	}
+
+	if r.database != "" {
+		r.record()
+	}
+
+	if path == "" {
+		return err
+	}
+
+	writeErr := r.write(path)
+	if writeErr == nil {
+		return err
+	}
+
+	if err != nil {
+		log.WithError(writeErr).Error("Failed to write summary file")
+		return err
+	}
+
+	return writeErr
+}
+
+// record - Record the summary in the runs table of the database, failures are logged since they shouldn't cause an
+// otherwise successful run to fail.
+func (r *runSummary) record() {
+	db, err := database.Open(r.database)
+	if err != nil {
+		log.WithError(err).Warn("Failed to open database to record run")
+		return
+	}
+	defer db.Close()
+
+	_, err = db.RecordRun(value.Run{
+		Command:   r.Command,
+		Start:     r.Start.Unix(),
+		End:       r.End.Unix(),
+		Processed: r.Processed,
+		Failed:    r.Failed,
+		Cancelled: r.Cancelled,
+		Error:     r.Error,
+	})
+	if err != nil {
+		log.WithError(err).Warn("Failed to record run")
+	}
+}
+
+// write - Marshal and write the summary to the provided path.
+func (r *runSummary) write(path string) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal summary")
+	}
+
+	err = ioutil.WriteFile(path, append(data, '\n'), 0o644)
+	if err != nil {
+		return errors.Wrap(err, "failed to write summary file")
+	}
+
+	return nil
+}
@@ -15,7 +15,17 @@
 package cmd
 
 import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
 	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/jamesl33/goamt/database"
 	"github.com/jamesl33/goamt/utils"
@@ -27,10 +37,42 @@ import (
 	"github.com/spf13/cobra"
 )
 
+const (
+	// hdrPreserve - Encode HDR sources as 10-bit video tagged with the color properties of the source.
+	hdrPreserve = "preserve"
+
+	// hdrTonemap - Tone map HDR sources to SDR.
+	hdrTonemap = "tonemap"
+
+	// hdrIgnore - Encode HDR sources like any other source, converting them to SDR without tone mapping.
+	hdrIgnore = "ignore"
+)
+
+// hdrModes - The supported ways of handling HDR sources.
+var hdrModes = []string{hdrPreserve, hdrTonemap, hdrIgnore}
+
 // transcodeOptions - Encapsulates the options for the transcode sub-command.
 var transcodeOptions = struct {
-	database, path   string
-	entries, threads int
+	database, path, outputDir, only, audio           string
+	summaryFile, onComplete, webhookURL, metricsAddr string
+	quarantine, preset, videoCodec, encoderPreset    string
+	profile, level, root, ffmpegLogDir, tempDir      string
+	backend, pixelFormat, hdr                        string
+	rename                                           []string
+	entries, threads, nice, maxWidth, maxHeight      int
+	ffmpegThreads, maxFailures, perDisk, crf         int
+	analyzers, minBitRate, audioBitRate              int
+	targetBitRate                                    int
+	spaceMultiplier, minSavings, sample              float64
+	targetI, targetLRA, targetTP                     float64
+	keepSource, noLoudnorm, cancelInFlight           bool
+	onlyIfSmaller, keepFFmpegLogs, remux             bool
+	fixTimestamps, verifyDecode, shuffle, eta        bool
+	printCommand, progress, skipMatchingCodec        bool
+	preserveHDR                                      bool
+	onCompleteTimeout, maxRuntime                    time.Duration
+	video                                            transcodePreset
+	loudnorm                                         utils.LoudnormTarget
 }{}
 
 // transcodeCommand - The transcode sub-command, used to transcode a number of entries in the goamt database.
@@ -58,83 +100,860 @@ func init() {
 		"path to a media library",
 	)
 
+	transcodeCommand.Flags().StringVar(
+		&transcodeOptions.root,
+		"root",
+		"",
+		"resolve the relative paths in the database against this directory instead of the recorded library root",
+	)
+
+	transcodeCommand.Flags().StringVarP(
+		&transcodeOptions.outputDir,
+		"output-dir",
+		"o",
+		"",
+		"write transcoded files to a mirrored path in this directory, leaving the source files intact",
+	)
+
+	transcodeCommand.Flags().StringArrayVar(
+		&transcodeOptions.rename,
+		"rename",
+		nil,
+		"tidy the name of transcoded files using one of "+strings.Join(renameSchemeNames(), ", ")+
+			", may be provided multiple times (applied in order)",
+	)
+
+	transcodeCommand.Flags().BoolVar(
+		&transcodeOptions.keepSource,
+		"keep-source",
+		false,
+		"keep source files by renaming them with the '"+value.OriginalExtension+"' extension, rather than removing them",
+	)
+
+	transcodeCommand.Flags().BoolVar(
+		&transcodeOptions.verifyDecode,
+		"verify-decode",
+		false,
+		"fully decode each transcoded file before replacing the source, failing the job if ffmpeg reports any errors",
+	)
+
+	transcodeCommand.Flags().IntVar(
+		&transcodeOptions.maxFailures,
+		"max-failures",
+		3,
+		"quarantine entries which have failed to transcode this many times, zero disables quarantining",
+	)
+
+	transcodeCommand.Flags().StringVar(
+		&transcodeOptions.quarantine,
+		"quarantine",
+		"",
+		"move the source files of quarantined entries into this directory (mirroring their path relative to --path)",
+	)
+
+	transcodeCommand.Flags().StringVar(
+		&transcodeOptions.only,
+		"only",
+		"",
+		"only transcode the entry with this path (or entries within this directory), as stored in the database",
+	)
+
+	transcodeCommand.Flags().BoolVar(
+		&transcodeOptions.shuffle,
+		"shuffle",
+		false,
+		"transcode a random selection of entries rather than the oldest, useful when comparing encoding options",
+	)
+
+	transcodeCommand.Flags().BoolVar(
+		&transcodeOptions.printCommand,
+		"print-command",
+		false,
+		"print the ffmpeg commands which would be run to transcode each selected entry, without running them",
+	)
+
+	transcodeCommand.Flags().Float64Var(
+		&transcodeOptions.sample,
+		"sample",
+		0,
+		"transcode a random sample of this percentage of the selectable entries (e.g. '5'), useful for tuning encoder "+
+			"settings; '--entries' caps the sample when provided",
+	)
+
 	transcodeCommand.Flags().IntVarP(
 		&transcodeOptions.entries,
 		"entries",
 		"e",
 		runtime.NumCPU(),
-		"the number of entries to transcode, defaults to the number of vCPUs",
+		"the number of entries to transcode, defaults to the number of vCPUs; zero transcodes every untranscoded entry",
 	)
 
-	transcodeCommand.Flags().IntVarP(
-		&transcodeOptions.threads,
+	transcodeOptions.threads = runtime.NumCPU()
+
+	transcodeCommand.Flags().VarP(
+		(*threadsValue)(&transcodeOptions.threads),
 		"threads",
 		"t",
-		runtime.NumCPU(),
-		"the number of threads to use, defaults to the number of vCPUs",
+		"the number of threads to use, defaults to the number of vCPUs; zero (or '"+autoPhysical+"') uses the number "+
+			"of physical cores, which avoids oversubscribing hyper-threaded CPUs",
+	)
+
+	transcodeCommand.Flags().IntVar(
+		&transcodeOptions.perDisk,
+		"per-disk",
+		0,
+		"limit the number of concurrent transcodes per disk (rather than globally using --threads), zero disables this",
+	)
+
+	transcodeCommand.Flags().IntVar(
+		&transcodeOptions.analyzers,
+		"analyzers",
+		0,
+		"run the loudnorm analysis pass for upcoming entries ahead of time using this many extra ffmpeg processes, "+
+			"zero disables this",
+	)
+
+	transcodeCommand.Flags().IntVar(
+		&transcodeOptions.nice,
+		"nice",
+		0,
+		"the niceness (-20 to 19) to run ffmpeg with, defaults to leaving the priority unchanged",
+	)
+
+	transcodeCommand.Flags().IntVar(
+		&transcodeOptions.maxWidth,
+		"max-width",
+		0,
+		"downscale videos which are wider than this (preserving the aspect ratio), defaults to no limit",
+	)
+
+	transcodeCommand.Flags().IntVar(
+		&transcodeOptions.maxHeight,
+		"max-height",
+		0,
+		"downscale videos which are taller than this (preserving the aspect ratio), defaults to no limit",
+	)
+
+	transcodeCommand.Flags().IntVar(
+		&transcodeOptions.ffmpegThreads,
+		"ffmpeg-threads",
+		0,
+		"the number of threads used by each ffmpeg process, defaults to letting ffmpeg decide",
+	)
+
+	transcodeCommand.Flags().StringVar(
+		&transcodeOptions.preset,
+		"preset",
+		defaultPreset,
+		"the preset used to encode the video, one of '"+strings.Join(presetNames(), "', '")+"'",
+	)
+
+	transcodeCommand.Flags().StringVar(
+		&transcodeOptions.videoCodec,
+		"video-codec",
+		"",
+		"the codec used to encode the video, either '"+utils.VideoCodecH264+"' or '"+utils.VideoCodecH265+
+			"', overrides the preset",
+	)
+
+	transcodeCommand.Flags().IntVar(
+		&transcodeOptions.crf,
+		"crf",
+		0,
+		"the constant rate factor used to encode the video (lower is higher quality), overrides the preset",
+	)
+
+	transcodeCommand.Flags().IntVar(
+		&transcodeOptions.targetBitRate,
+		"target-bitrate",
+		0,
+		"encode the video using two passes targeting this average bit rate (in kbit/s) instead of a constant rate "+
+			"factor, allowing the size of the transcoded files to be predicted",
+	)
+
+	transcodeCommand.Flags().StringVar(
+		&transcodeOptions.encoderPreset,
+		"encoder-preset",
+		"",
+		"the ffmpeg encoder preset trading encoding speed against size, one of '"+
+			strings.Join(utils.EncoderPresets, "', '")+"', overrides the preset",
+	)
+
+	transcodeCommand.Flags().StringVar(
+		&transcodeOptions.profile,
+		"profile",
+		"",
+		"the profile of the encoded video, overrides the preset",
+	)
+
+	transcodeCommand.Flags().StringVar(
+		&transcodeOptions.level,
+		"level",
+		"",
+		"the level of the encoded video, overrides the preset",
+	)
+
+	transcodeCommand.Flags().StringVar(
+		&transcodeOptions.pixelFormat,
+		"pix-fmt",
+		utils.PixelFormat8Bit,
+		"the pixel format of the encoded video, one of '"+strings.Join(utils.PixelFormats, "', '")+"'",
+	)
+
+	transcodeCommand.Flags().StringVar(
+		&transcodeOptions.hdr,
+		"hdr",
+		hdrIgnore,
+		fmt.Sprintf("how HDR sources are handled, one of '%s' ('preserve' encodes them as 10-bit HDR video, 'tonemap' "+
+			"converts them to SDR, 'ignore' doesn't probe sources so HDR is converted to SDR without tone mapping or a "+
+			"warning)", strings.Join(hdrModes, "', '")),
+	)
+
+	// Superseded by '--hdr preserve', but kept for existing cron jobs/systemd units
+	transcodeCommand.Flags().BoolVar(
+		&transcodeOptions.preserveHDR,
+		"preserve-hdr",
+		false,
+		"alias for '--hdr preserve'",
+	)
+
+	markFlagDeprecated(transcodeCommand, "preserve-hdr", "use --hdr preserve instead")
+
+	transcodeCommand.Flags().BoolVar(
+		&transcodeOptions.noLoudnorm,
+		"no-loudnorm",
+		false,
+		"don't normalise the audio, this skips the (slow) loudnorm analysis pass",
+	)
+
+	transcodeCommand.Flags().IntVar(
+		&transcodeOptions.minBitRate,
+		"min-bitrate",
+		0,
+		"the minimum video bit rate (in kbit/s) of sources which are transcoded, sources below it are marked as "+
+			"transcoded and left untouched",
+	)
+
+	transcodeCommand.Flags().BoolVar(
+		&transcodeOptions.skipMatchingCodec,
+		"skip-matching-codec",
+		false,
+		"mark entries whose video already uses the target codec as transcoded without transcoding them, sources which "+
+			"weren't probed by update are probed when selected and the result recorded",
+	)
+
+	transcodeCommand.Flags().BoolVar(
+		&transcodeOptions.remux,
+		"remux",
+		false,
+		"copy the audio/video streams into an mp4 container without re-encoding (or normalising) them, files whose "+
+			"streams aren't supported by mp4 are transcoded instead",
+	)
+
+	transcodeCommand.Flags().BoolVar(
+		&transcodeOptions.fixTimestamps,
+		"fix-timestamps",
+		false,
+		"regenerate missing timestamps and shift the output to start at zero, repairing sources which stutter when played",
+	)
+
+	transcodeCommand.Flags().Float64Var(
+		&transcodeOptions.targetI,
+		"target-i",
+		0,
+		"the integrated loudness (in LUFS) targeted when normalising the audio, defaults to ffmpeg's -24",
+	)
+
+	transcodeCommand.Flags().Float64Var(
+		&transcodeOptions.targetLRA,
+		"target-lra",
+		0,
+		"the loudness range (in LU) targeted when normalising the audio, defaults to ffmpeg's 7",
+	)
+
+	transcodeCommand.Flags().Float64Var(
+		&transcodeOptions.targetTP,
+		"target-tp",
+		0,
+		"the maximum true peak (in dBTP) targeted when normalising the audio, defaults to ffmpeg's -2",
+	)
+
+	transcodeCommand.Flags().StringVar(
+		&transcodeOptions.backend,
+		"backend",
+		utils.BackendFFmpeg,
+		fmt.Sprintf("the backend used to transcode files, one of '%s'", strings.Join(utils.TranscoderNames(), "', '")),
+	)
+
+	transcodeCommand.Flags().StringVar(
+		&transcodeOptions.audio,
+		"audio-codec",
+		utils.AudioCodecAAC,
+		fmt.Sprintf("the codec used to re-encode the audio, one of '%s' ('copy' copies it without normalisation)",
+			strings.Join(utils.AudioCodecs, "', '")),
+	)
+
+	// Superseded by '--audio-codec', but kept for existing cron jobs/systemd units
+	transcodeCommand.Flags().StringVar(
+		&transcodeOptions.audio,
+		"audio",
+		utils.AudioCodecAAC,
+		"alias for '--audio-codec'",
+	)
+
+	markFlagDeprecated(transcodeCommand, "audio", "use --audio-codec instead")
+
+	transcodeCommand.Flags().IntVar(
+		&transcodeOptions.audioBitRate,
+		"audio-bitrate",
+		0,
+		"the bit rate (in kbit/s) of the re-encoded audio, defaults to the encoder's choice",
+	)
+
+	transcodeCommand.Flags().DurationVar(
+		&transcodeOptions.maxRuntime,
+		"max-runtime",
+		0,
+		"stop transcoding new entries once this amount of time has elapsed (e.g. '6h'), defaults to no limit",
+	)
+
+	transcodeCommand.Flags().BoolVar(
+		&transcodeOptions.cancelInFlight,
+		"cancel-in-flight",
+		false,
+		"cancel in-progress transcodes when the maximum runtime is reached (or when interrupted) instead of finishing them",
+	)
+
+	transcodeCommand.Flags().Float64Var(
+		&transcodeOptions.spaceMultiplier,
+		"space-multiplier",
+		1,
+		"skip entries unless the free space is at least this multiple of the source size, zero disables the check",
+	)
+
+	transcodeCommand.Flags().BoolVar(
+		&transcodeOptions.onlyIfSmaller,
+		"only-if-smaller",
+		false,
+		"discard transcoded files which aren't smaller than their source, keeping the source and marking it transcoded",
+	)
+
+	transcodeCommand.Flags().Float64Var(
+		&transcodeOptions.minSavings,
+		"min-savings",
+		0,
+		"the percentage by which transcoded files must be smaller than their source when using --only-if-smaller",
+	)
+
+	transcodeCommand.Flags().StringVar(
+		&transcodeOptions.onComplete,
+		"on-complete",
+		"",
+		"shell command to run after each file is transcoded, '{path}' is replaced with the path of the transcoded file",
+	)
+
+	transcodeCommand.Flags().DurationVar(
+		&transcodeOptions.onCompleteTimeout,
+		"on-complete-timeout",
+		time.Minute,
+		"the maximum amount of time the '--on-complete' command may run for before being killed",
+	)
+
+	transcodeCommand.Flags().StringVar(
+		&transcodeOptions.tempDir,
+		"temp-dir",
+		"",
+		"transcode files in this directory (e.g. on a fast scratch disk) before moving them alongside their target, "+
+			"rather than writing the incomplete file alongside the target",
 	)
 
-	markFlagRequired(transcodeCommand, "database")
+	transcodeCommand.Flags().StringVar(
+		&transcodeOptions.ffmpegLogDir,
+		"ffmpeg-log-dir",
+		"",
+		"write the ffmpeg output for each entry to a dedicated log file in this directory, rather than the goamt log",
+	)
+
+	transcodeCommand.Flags().BoolVar(
+		&transcodeOptions.keepFFmpegLogs,
+		"keep-ffmpeg-logs",
+		false,
+		"keep the ffmpeg log files for entries which were transcoded successfully, by default only failures are kept",
+	)
+
+	transcodeCommand.Flags().StringVar(
+		&transcodeOptions.summaryFile,
+		"summary-file",
+		"",
+		"write a JSON summary of the run to this path, even if the run fails",
+	)
+
+	transcodeCommand.Flags().StringVar(
+		&transcodeOptions.webhookURL,
+		"webhook-url",
+		"",
+		"post a JSON notification to this url when transcoding a file fails and when the run completes",
+	)
+
+	transcodeCommand.Flags().StringVar(
+		&transcodeOptions.metricsAddr,
+		"metrics-addr",
+		"",
+		"serve Prometheus metrics at '/metrics' on this address (e.g. ':9090') for the duration of the run",
+	)
+
+	transcodeCommand.Flags().BoolVar(
+		&transcodeOptions.eta,
+		"eta",
+		false,
+		"log an estimate of the time remaining after each entry, based on the durations of the remaining entries and "+
+			"the observed encode speed",
+	)
+
+	transcodeCommand.Flags().BoolVar(
+		&transcodeOptions.progress,
+		"progress",
+		false,
+		"display the number of selected entries which have been transcoded so far, progress is periodically logged "+
+			"instead when standard error isn't a terminal",
+	)
+
+	markDatabaseRequired(transcodeCommand)
 	markFlagRequired(transcodeCommand, "path")
 }
 
 // transcode - Run the transcode sub-command, this will transcode a number of entries in the SQLite database then update
 // the transcoded timestamp (to avoid re-transcoding).
-func transcode(_ *cobra.Command, _ []string) error {
+func transcode(command *cobra.Command, _ []string) error {
+	// The sub-command may be run directly (e.g. by the unit tests), in which case no flags were provided
+	changed := func(_ string) bool { return false }
+	if command != nil {
+		changed = command.Flags().Changed
+	}
+
+	var (
+		summary  = newRunSummary("transcode")
+		notifier = newWebhookNotifier(transcodeOptions.webhookURL)
+		err      = summary.complete(transcodeOptions.summaryFile, runTranscode(summary, notifier, changed))
+	)
+
+	notifier.notifyComplete(summary)
+	notifier.wait()
+
+	return err
+}
+
+// runTranscode - Run the transcode sub-command, recording metrics in the provided summary and sending notifications to
+// the given notifier (which may be nil). The 'changed' function reports whether a flag was provided by the user.
+func runTranscode(summary *runSummary, notifier *webhookNotifier, changed func(name string) bool) error {
+	if transcodeOptions.nice < -20 || transcodeOptions.nice > 19 {
+		return fmt.Errorf("nice value %d is not in the range -20 to 19", transcodeOptions.nice)
+	}
+
+	if transcodeOptions.maxWidth < 0 || transcodeOptions.maxHeight < 0 {
+		return fmt.Errorf("maximum dimensions %dx%d must be positive", transcodeOptions.maxWidth,
+			transcodeOptions.maxHeight)
+	}
+
+	if transcodeOptions.ffmpegThreads < 0 {
+		return fmt.Errorf("ffmpeg threads %d must be positive", transcodeOptions.ffmpegThreads)
+	}
+
+	err := utils.ValidateAudio(transcodeOptions.audio, transcodeOptions.audioBitRate)
+	if err != nil {
+		return err // Purposefully not wrapped
+	}
+
+	if transcodeOptions.audio == utils.AudioCodecOpus {
+		log.Warn("Opus in an mp4 container isn't supported by all players (e.g. older Apple devices/smart TVs)")
+	}
+
+	// Scaling requires re-encoding the video, so can't be done when only the container is changed
+	if transcodeOptions.remux && (transcodeOptions.maxWidth != 0 || transcodeOptions.maxHeight != 0) {
+		return errors.New("maximum dimensions can't be used when remuxing")
+	}
+
+	if transcodeOptions.targetBitRate < 0 {
+		return fmt.Errorf("target bit rate %d must not be negative", transcodeOptions.targetBitRate)
+	}
+
+	// A target bit rate replaces the constant rate factor (including the one from the preset)
+	if transcodeOptions.targetBitRate != 0 && changed("crf") {
+		return errors.New("a constant rate factor can't be used with a target bit rate")
+	}
+
+	if transcodeOptions.targetBitRate != 0 && transcodeOptions.remux {
+		return errors.New("a target bit rate can't be used when remuxing")
+	}
+
+	if !utils.ContainsString(utils.PixelFormats, transcodeOptions.pixelFormat) {
+		return fmt.Errorf("pixel format '%s' is not supported, expected one of '%s'", transcodeOptions.pixelFormat,
+			strings.Join(utils.PixelFormats, "', '"))
+	}
+
+	if transcodeOptions.preserveHDR {
+		if changed("hdr") && transcodeOptions.hdr != hdrPreserve {
+			return fmt.Errorf("'--preserve-hdr' can't be used with '--hdr %s'", transcodeOptions.hdr)
+		}
+
+		transcodeOptions.hdr = hdrPreserve
+	}
+
+	if !utils.ContainsString(hdrModes, transcodeOptions.hdr) {
+		return fmt.Errorf("HDR mode '%s' is not supported, expected one of '%s'", transcodeOptions.hdr,
+			strings.Join(hdrModes, "', '"))
+	}
+
+	// HDR sources are always encoded as 10-bit video when preserving HDR, so an 8-bit pixel format would be ignored
+	if transcodeOptions.hdr == hdrPreserve && changed("pix-fmt") &&
+		transcodeOptions.pixelFormat != utils.PixelFormat10Bit {
+		return fmt.Errorf("HDR can't be preserved using the pixel format '%s'", transcodeOptions.pixelFormat)
+	}
+
+	// Tone mapping requires re-encoding the video, so can't be done when only the container is changed
+	if transcodeOptions.hdr == hdrTonemap && transcodeOptions.remux {
+		return errors.New("HDR can't be tone mapped when remuxing")
+	}
+
+	if transcodeOptions.entries < 0 {
+		return fmt.Errorf("number of entries %d must not be negative", transcodeOptions.entries)
+	}
+
+	// Every entry is selected as it's queued when transcoding them all, so there's no list of upcoming entries to analyse
+	// or estimate the remaining time from
+	if transcodeOptions.entries == 0 && transcodeOptions.analyzers != 0 {
+		return errors.New("upcoming entries can't be analysed ahead of time when transcoding every entry")
+	}
+
+	if transcodeOptions.entries == 0 && transcodeOptions.eta {
+		return errors.New("the time remaining can't be estimated when transcoding every entry")
+	}
+
+	// The video isn't re-encoded when remuxing, so there's no target codec to compare against
+	if transcodeOptions.skipMatchingCodec && transcodeOptions.remux {
+		return errors.New("entries with a matching codec can't be skipped when remuxing")
+	}
+
+	video, err := resolvePreset(changed)
+	if err != nil {
+		return err // Purposefully not wrapped
+	}
+
+	transcodeOptions.video = video
+
+	if transcodeOptions.threads == 0 {
+		transcodeOptions.threads = physicalThreads()
+	}
+
+	transcodeOptions.loudnorm = loudnormTarget(changed)
+
+	err = transcodeOptions.loudnorm.Validate()
+	if err != nil {
+		return err // Purposefully not wrapped
+	}
+
+	if transcodeOptions.perDisk < 0 {
+		return fmt.Errorf("per-disk limit %d must not be negative", transcodeOptions.perDisk)
+	}
+
+	if transcodeOptions.analyzers < 0 {
+		return fmt.Errorf("analyzers %d must not be negative", transcodeOptions.analyzers)
+	}
+
+	if transcodeOptions.minBitRate < 0 {
+		return fmt.Errorf("minimum bit rate %d must not be negative", transcodeOptions.minBitRate)
+	}
+
+	if transcodeOptions.maxFailures < 0 {
+		return fmt.Errorf("max failures %d must not be negative", transcodeOptions.maxFailures)
+	}
+
+	if transcodeOptions.spaceMultiplier < 0 {
+		return fmt.Errorf("space multiplier %g must not be negative", transcodeOptions.spaceMultiplier)
+	}
+
+	if transcodeOptions.minSavings < 0 || transcodeOptions.minSavings >= 100 {
+		return fmt.Errorf("minimum savings %g%% is not in the range 0 to 100", transcodeOptions.minSavings)
+	}
+
+	if transcodeOptions.maxRuntime < 0 {
+		return fmt.Errorf("maximum runtime %s must not be negative", transcodeOptions.maxRuntime)
+	}
+
+	if transcodeOptions.sample < 0 || transcodeOptions.sample > 100 {
+		return fmt.Errorf("sample %g%% is not in the range 0 to 100", transcodeOptions.sample)
+	}
+
+	for _, scheme := range transcodeOptions.rename {
+		if _, ok := renameSchemes[scheme]; !ok {
+			return fmt.Errorf("unknown rename scheme '%s', expected one of %s", scheme,
+				strings.Join(renameSchemeNames(), ", "))
+		}
+	}
+
+	transcoder, err := transcoderFunc(transcodeOptions.backend)
+	if err != nil {
+		return err // Purposefully not wrapped
+	}
+
+	// Other backends don't necessarily run ffmpeg commands which could be printed
+	if transcodeOptions.printCommand && transcodeOptions.backend != utils.BackendFFmpeg {
+		return fmt.Errorf("printing commands isn't supported by the '%s' backend", transcodeOptions.backend)
+	}
+
+	// Check up front, rather than failing part way through the run (after jobs have been created)
+	err = checkToolsFunc(transcoder.RequiredTools()...)
+	if err != nil {
+		return err // Purposefully not wrapped
+	}
+
+	// The temporary path is recorded against each job, so must be absolute to be found by recovery from another directory
+	if transcodeOptions.tempDir != "" {
+		transcodeOptions.tempDir, err = filepath.Abs(transcodeOptions.tempDir)
+		if err != nil {
+			return errors.Wrap(err, "failed to get absolute temporary directory path")
+		}
+	}
+
+	if transcodeOptions.ffmpegLogDir != "" {
+		err = os.MkdirAll(transcodeOptions.ffmpegLogDir, 0o755)
+		if err != nil {
+			return errors.Wrap(err, "failed to create ffmpeg log directory")
+		}
+	}
+
 	ctx := signalHandler()
 
+	if transcodeOptions.maxRuntime != 0 {
+		var cancel context.CancelFunc
+
+		ctx, cancel = context.WithTimeout(ctx, transcodeOptions.maxRuntime)
+		defer cancel()
+	}
+
+	// By default, in-progress transcodes are allowed to complete when stopping
+	encodeCtx := context.Background()
+	if transcodeOptions.cancelInFlight {
+		encodeCtx = ctx
+	}
+
+	var metrics *transcodeMetrics
+
+	if transcodeOptions.metricsAddr != "" {
+		metrics = newTranscodeMetrics()
+
+		server, err := startMetricsServer(ctx, transcodeOptions.metricsAddr, metrics)
+		if err != nil {
+			return errors.Wrap(err, "failed to start metrics server")
+		}
+		defer server.stop()
+	}
+
 	db, err := database.Open(transcodeOptions.database)
 	if err != nil {
 		return errors.Wrap(err, "failed to open SQLite database")
 	}
 
-	entries := make([]value.Entry, 0, transcodeOptions.entries)
+	summary.database = transcodeOptions.database
 
-	for len(entries) != transcodeOptions.entries {
-		entry, err := db.BeginTranscoding()
+	if transcodeOptions.root != "" {
+		err = db.OverrideRoot(transcodeOptions.root)
 		if err != nil {
-			if errors.Is(err, sqlite.ErrQueryReturnedNoRows) {
-				break
-			}
+			return errors.Wrap(err, "failed to override library root")
+		}
+	}
 
-			return errors.Wrap(err, "failed to get transcode entry")
+	// Transcoded/quarantined files are recorded in the database, so they must be stored within the library root
+	for _, directory := range []string{transcodeOptions.outputDir, transcodeOptions.quarantine} {
+		if directory != "" && !db.WithinRoot(directory) {
+			return fmt.Errorf("directory '%s' is not within the library root '%s'", directory, db.Root())
 		}
+	}
 
-		if !utils.PathExists(entry.Path) {
-			log.WithFields(entry).Warn("Found an entry that no longer exists, will remove")
+	// Temporary files are named after the entry rather than mirroring the library, so within the library they'd be
+	// mistaken for orphaned files (e.g. by cleanup) and removed whilst still being written
+	if transcodeOptions.tempDir != "" {
+		library := db.Root()
+		if library == "" {
+			library = transcodeOptions.path
+		}
 
-			err = db.Remove(entry)
-			if err != nil {
-				return errors.Wrap(err, "failed to remove entry")
-			}
+		within, err := utils.WithinDirectory(transcodeOptions.tempDir, library)
+		if err != nil {
+			return errors.Wrap(err, "failed to check temporary directory")
+		}
 
-			continue
+		if within {
+			return fmt.Errorf("temporary directory '%s' must not be within the media library '%s'",
+				transcodeOptions.tempDir, library)
 		}
 
-		entries = append(entries, entry)
+		err = os.MkdirAll(transcodeOptions.tempDir, 0o755)
+		if err != nil {
+			return errors.Wrap(err, "failed to create temporary directory")
+		}
+	}
+
+	err = db.Recover()
+	if err != nil {
+		return errors.Wrap(err, "failed to recover incomplete jobs")
+	}
+
+	options := database.SelectOptions{
+		Target:    transcodeTarget,
+		Temporary: transcodeTemporary,
+		Shuffle:   transcodeOptions.shuffle,
+	}
+	if transcodeOptions.only != "" {
+		options.Prefix = filepath.Clean(transcodeOptions.only)
+	}
+
+	limit := transcodeOptions.entries
+
+	if transcodeOptions.sample != 0 {
+		limit, err = sampleSize(db, options, transcodeOptions.sample, changed("entries"))
+		if err != nil {
+			return err // Purposefully not wrapped
+		}
+
+		options.Shuffle = true
 	}
 
 	var (
-		pool                     = NewTranscodePool(db)
-		entryStream, errorStream = pool.Start(ctx, transcodeOptions.threads)
+		selector = newEntrySelector(db, options)
+		all      = limit == 0 && transcodeOptions.sample == 0
+		entries  = make([]value.Entry, 0, limit)
 	)
 
-	for _, entry := range entries {
-		queued, err := queueEntry(ctx, entryStream, errorStream, entry)
+	// When transcoding every entry, they're selected as they're queued (below) rather than up front; unless we're only
+	// printing the commands, in which case every entry must be selected to stop the same entries being printed again
+	for (all && transcodeOptions.printCommand || len(entries) != limit) && ctx.Err() == nil {
+		entry, ok, err := selector.next(ctx)
 		if err != nil {
-			return errors.Wrap(err, "failed to queue entry")
+			return err // Purposefully not wrapped
 		}
 
-		if !queued {
+		if !ok {
 			break
 		}
+
+		entries = append(entries, entry)
+	}
+
+	if transcodeOptions.printCommand {
+		return printCommands(ctx, db, entries, os.Stdout)
+	}
+
+	total := int64(len(entries))
+
+	if all {
+		total, err = db.CountSelectable(options)
+		if err != nil {
+			return errors.Wrap(err, "failed to count selectable entries")
+		}
+	}
+
+	proceed, err := confirmTranscode(total)
+	if err != nil || !proceed {
+		for _, entry := range entries {
+			if err := cancelTranscoding(db, entry); err != nil {
+				return err
+			}
+		}
+
+		if err != nil {
+			return errors.Wrap(err, "failed to confirm transcoding")
+		}
+
+		log.Info("Transcoding aborted by user")
+
+		entries, all = nil, false
+	}
+
+	var eta *etaEstimator
+	if transcodeOptions.eta {
+		eta = newETAEstimator(entries)
+	}
+
+	var (
+		analyser = startLoudnormAnalyser(ctx, entries, transcodeOptions.analyzers, ffmpegOptions())
+		pool     = NewTranscodePool(encodeCtx, db, transcoder, notifier, metrics, eta, analyser)
+	)
+
+	pool.progress = startProgressBar(transcodeOptions.progress, "Entries transcoded", total)
+	defer pool.progress.stop()
+
+	entryStream, errorStream := startTranscodePool(ctx, pool)
+
+	summary.pool = pool
+
+	stopPauseHandler := pauseHandler(pool)
+	defer stopPauseHandler()
+
+	var (
+		queued              int
+		queueErr, selectErr error
+	)
+
+	for ; queued < len(entries); queued++ {
+		ok, err := queueEntry(ctx, entryStream, errorStream, entries[queued])
+		if err != nil || !ok {
+			queueErr = err
+			break
+		}
+	}
+
+	// Each entry is only selected once there's space for it in the entry stream (i.e. a worker is ready for it), so at
+	// most a handful of entries are held in memory at once
+	for all && ctx.Err() == nil {
+		var (
+			entry value.Entry
+			ok    bool
+		)
+
+		entry, ok, selectErr = selector.next(ctx)
+		if selectErr != nil || !ok {
+			break
+		}
+
+		// Entries which couldn't be queued have their jobs cancelled along with any other unqueued entries (below)
+		ok, queueErr = queueEntry(ctx, entryStream, errorStream, entry)
+		if queueErr != nil || !ok {
+			entries = append(entries, entry)
+			break
+		}
+	}
+
+	// Every selected entry has a job, those which weren't queued (because we're terminating or a worker failed) must
+	// have them cancelled; otherwise they'd linger until the next run recovers them
+	err = pool.cancel(entries[queued:]...)
+	if err != nil {
+		return errors.Wrap(err, "failed to cancel unqueued entries")
 	}
 
 	err = pool.Stop()
+
+	pool.progress.stop()
+
+	// Analysers may still be running for entries which weren't transcoded (e.g. because the pool stopped early)
+	analyser.stop()
+
+	if queueErr != nil {
+		return errors.Wrap(pool.failure(queueErr), "failed to queue entry")
+	}
+
+	if selectErr != nil {
+		return selectErr // Purposefully not wrapped
+	}
+
 	if err != nil {
 		return errors.Wrap(err, "failed to stop worker pool")
 	}
 
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		log.WithField("max_runtime", transcodeOptions.maxRuntime).Info("Maximum runtime reached, stopped transcoding")
+	}
+
 	err = db.Close()
 	if err != nil {
 		return errors.Wrap(err, "failed to close database")
@@ -142,3 +961,301 @@ func transcode(_ *cobra.Command, _ []string) error {
 
 	return nil
 }
+
+// startTranscodePool - Start the provided worker pool, limiting the number of concurrent transcodes per disk when using
+// '--per-disk'.
+func startTranscodePool(ctx context.Context, pool *Pool) (chan<- value.Entry, <-chan error) {
+	if transcodeOptions.perDisk != 0 {
+		return pool.StartPerDevice(ctx, transcodeOptions.perDisk)
+	}
+
+	return pool.Start(ctx, transcodeOptions.threads)
+}
+
+// confirmTranscode - Prompt the user to confirm transcoding the provided number of entries when doing so will remove
+// the source files.
+func confirmTranscode(entries int64) (bool, error) {
+	if entries == 0 || transcodeOptions.outputDir != "" || transcodeOptions.keepSource {
+		return true, nil
+	}
+
+	return confirm(fmt.Sprintf("%d file(s) will be transcoded and their source files removed, continue?", entries))
+}
+
+// printCommands - Write the ffmpeg commands which would be run to transcode each of the provided entries to the given
+// writer, then cancel their jobs and close the database without transcoding them.
+func printCommands(ctx context.Context, db *database.Database, entries []value.Entry, writer io.Writer) error {
+	for index, entry := range entries {
+		err := printEntryCommands(ctx, entry, writer, index == 0)
+		if err != nil {
+			return errors.Wrap(err, "failed to print commands")
+		}
+
+		err = cancelTranscoding(db, entry)
+		if err != nil {
+			return err // Purposefully not wrapped
+		}
+	}
+
+	err := db.Close()
+	if err != nil {
+		return errors.Wrap(err, "failed to close database")
+	}
+
+	return nil
+}
+
+// printEntryCommands - Write the path of the provided entry followed by the ffmpeg commands which would be run to
+// transcode it (to the same path as 'transcodeEntry') to the given writer, separated from any previous entry.
+func printEntryCommands(ctx context.Context, entry value.Entry, writer io.Writer, first bool) error {
+	target, err := transcodeTarget(entry)
+	if err != nil {
+		return errors.Wrap(err, "failed to determine target path")
+	}
+
+	output := utils.ReplaceExtension(target, value.TranscodingExtension)
+	if temporary := transcodeTemporary(entry); temporary != "" {
+		output = temporary
+	}
+
+	header := "# %s\n"
+	if !first {
+		header = "\n" + header
+	}
+
+	_, err = fmt.Fprintf(writer, header, entry.Path)
+	if err != nil {
+		return err
+	}
+
+	options := ffmpegOptions()
+	hdrOptions(ctx, entry, &options)
+
+	for _, command := range utils.TranscodeCommands(ctx, entry.Path, output, options) {
+		_, err = fmt.Fprintln(writer, command)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// sampleSize - Returns the number of entries to transcode when sampling the given percentage of the entries which may
+// be selected using the provided options, rounding up so that a sample of a small library isn't empty. The number of
+// entries is only used to cap the sample when it was provided by the user.
+func sampleSize(db *database.Database, options database.SelectOptions, percentage float64, capped bool) (int, error) {
+	selectable, err := db.CountSelectable(options)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to count selectable entries")
+	}
+
+	size := int(math.Ceil(float64(selectable) * percentage / 100))
+	if capped && transcodeOptions.entries != 0 && size > transcodeOptions.entries {
+		size = transcodeOptions.entries
+	}
+
+	log.WithFields(log.Fields{"sample": size, "selectable": selectable, "percentage": percentage}).
+		Info("Transcoding a random sample of entries")
+
+	return size, nil
+}
+
+// entrySelector - Selects the entries to transcode, skipping (and updating) those which no longer exist or already use
+// the target codec.
+type entrySelector struct {
+	db       *database.Database
+	options  database.SelectOptions
+	selected map[int]struct{}
+}
+
+// newEntrySelector - Create a selector which will select entries from the given database using the provided options.
+func newEntrySelector(db *database.Database, options database.SelectOptions) *entrySelector {
+	return &entrySelector{db: db, options: options, selected: make(map[int]struct{})}
+}
+
+// next - Begin transcoding the next entry, returning false once there are no more entries to select. Entries are only
+// selected once; those which become selectable again (e.g. because they failed to transcode) are excluded from any
+// further selections, so that the same entries aren't retried indefinitely when transcoding every entry.
+func (s *entrySelector) next(ctx context.Context) (value.Entry, bool, error) {
+	for ctx.Err() == nil {
+		entry, err := s.db.BeginTranscoding(s.options)
+		if err != nil {
+			if errors.Is(err, sqlite.ErrQueryReturnedNoRows) {
+				return value.Entry{}, false, nil
+			}
+
+			return value.Entry{}, false, errors.Wrap(err, "failed to get transcode entry")
+		}
+
+		if _, ok := s.selected[entry.ID]; ok {
+			log.WithFields(entry).Debug("Entry has already been selected, excluding it from further selections")
+
+			err = cancelTranscoding(s.db, entry)
+			if err != nil {
+				return value.Entry{}, false, err
+			}
+
+			s.options.Exclude = append(s.options.Exclude, entry.ID)
+
+			continue
+		}
+
+		s.selected[entry.ID] = struct{}{}
+
+		if !utils.PathExists(entry.Path) {
+			log.WithFields(entry).Warn("Found an entry that no longer exists, will remove")
+
+			removed, err := s.db.Remove(entry)
+			if err != nil {
+				return value.Entry{}, false, errors.Wrap(err, "failed to remove entry")
+			}
+
+			if removed == 0 {
+				log.WithFields(entry).Debug("Entry had already been removed")
+			}
+
+			continue
+		}
+
+		if matchingCodec(ctx, s.db, entry) {
+			log.WithFields(entry).Info("Source video already uses the target codec, marking transcoded without transcoding")
+
+			err = s.db.CompleteTranscoding(entry)
+			if err != nil {
+				return value.Entry{}, false, errors.Wrap(err, "failed to mark entry transcoded")
+			}
+
+			continue
+		}
+
+		return entry, true, nil
+	}
+
+	return value.Entry{}, false, nil
+}
+
+// transcodeTarget - Returns the path where the provided entry will be transcoded to; this will be alongside the source
+// file unless an output directory was provided, in which case it will be the mirrored path within that directory.
+func transcodeTarget(entry value.Entry) (string, error) {
+	if transcodeOptions.outputDir == "" {
+		return renameTarget(utils.ReplaceExtension(entry.Path, value.TargetExtension)), nil
+	}
+
+	target, err := mirrorPath(entry.Path, transcodeOptions.outputDir)
+	if err != nil {
+		return "", err
+	}
+
+	return renameTarget(utils.ReplaceExtension(target, value.TargetExtension)), nil
+}
+
+// renameSchemes - The transformations which may be applied to the name of transcoded files using '--rename'.
+var renameSchemes = map[string]func(name string) string{
+	"lowercase":   strings.ToLower,
+	"underscores": func(name string) string { return strings.ReplaceAll(name, " ", "_") },
+	"hyphens":     func(name string) string { return strings.ReplaceAll(name, " ", "-") },
+}
+
+// renameSchemeNames - Returns the sorted names of the supported rename schemes.
+func renameSchemeNames() []string {
+	names := make([]string, 0, len(renameSchemes))
+	for name := range renameSchemes {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// renameTarget - Apply the '--rename' schemes (in the order provided) to the name of the provided target, the
+// directory is left untouched since it may contain other entries.
+func renameTarget(target string) string {
+	name := filepath.Base(target)
+
+	for _, scheme := range transcodeOptions.rename {
+		name = renameSchemes[scheme](name)
+	}
+
+	return filepath.Join(filepath.Dir(target), name)
+}
+
+// transcodeTemporary - Returns the path in '--temp-dir' which the provided entry will be transcoded to before being
+// moved alongside its target, or an empty string when a temporary directory isn't being used. The path is named after
+// the entry id, since entries in different directories may share the same name.
+func transcodeTemporary(entry value.Entry) string {
+	if transcodeOptions.tempDir == "" {
+		return ""
+	}
+
+	return filepath.Join(transcodeOptions.tempDir, strconv.Itoa(entry.ID)+value.TranscodingExtension)
+}
+
+// mirrorPath - Returns the path of the provided file mirrored into the given directory, relative to the media library.
+func mirrorPath(path, directory string) (string, error) {
+	root, err := filepath.Abs(transcodeOptions.path)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to get absolute media library path")
+	}
+
+	absolute, err := filepath.Abs(path)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to get absolute entry path")
+	}
+
+	relative, err := filepath.Rel(root, absolute)
+	if err != nil || relative == ".." || strings.HasPrefix(relative, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("entry '%s' is not within the media library '%s'", path, transcodeOptions.path)
+	}
+
+	return filepath.Join(directory, relative), nil
+}
+
+// autoPhysical - May be provided to '--threads' to use the number of physical cores, this is equivalent to zero.
+const autoPhysical = "auto-physical"
+
+// threadsValue - Flag value for the number of threads used to transcode entries, this is an integer which may also be
+// provided as 'auto-physical'.
+type threadsValue int
+
+// String - Implement the 'pflag.Value' interface, returning the number of threads.
+func (t *threadsValue) String() string {
+	return strconv.Itoa(int(*t))
+}
+
+// Set - Implement the 'pflag.Value' interface, parsing the provided number of threads.
+func (t *threadsValue) Set(value string) error {
+	if value == autoPhysical {
+		*t = 0
+		return nil
+	}
+
+	threads, err := strconv.Atoi(value)
+	if err != nil || threads < 0 {
+		return fmt.Errorf("expected a non-negative number of threads or '%s'", autoPhysical)
+	}
+
+	*t = threadsValue(threads)
+
+	return nil
+}
+
+// Type - Implement the 'pflag.Value' interface, returning the type shown in the help.
+func (t *threadsValue) Type() string {
+	return "int"
+}
+
+// physicalThreads - Returns the number of physical cores, falling back to the number of vCPUs when it can't be
+// determined. Transcoding is CPU bound, so using the logical cores provided by hyper-threading gains little.
+func physicalThreads() int {
+	cores, err := physicalCoresFunc()
+	if err != nil {
+		log.WithError(err).Warn("Failed to determine the number of physical cores, using the number of vCPUs")
+		return runtime.NumCPU()
+	}
+
+	log.WithField("threads", cores).Info("Using a thread for each physical core")
+
+	return cores
+}
@@ -15,15 +15,28 @@
 package cmd
 
 import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
 	"hash/crc32"
 	"io/ioutil"
+	"math"
+	"os"
 	"path/filepath"
 	"reflect"
+	"runtime"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/jamesl33/goamt/database"
 	"github.com/jamesl33/goamt/utils"
+	"github.com/jamesl33/goamt/utils/sqlite"
 	"github.com/jamesl33/goamt/value"
 
 	"github.com/pkg/errors"
@@ -34,6 +47,8 @@ func TestTranscodeDatabaseNotFound(t *testing.T) {
 
 	transcodeOptions.database = filepath.Join(tempDir, "goamt.db")
 	transcodeOptions.path = tempDir
+	transcodeOptions.outputDir = ""
+	assumeYes(t)
 
 	err := transcode(nil, nil)
 
@@ -48,6 +63,8 @@ func TestTranscode(t *testing.T) {
 
 	transcodeOptions.database = filepath.Join(tempDir, "goamt.db")
 	transcodeOptions.path = tempDir
+	transcodeOptions.outputDir = ""
+	assumeYes(t)
 
 	initial := []value.Entry{
 		{
@@ -81,7 +98,7 @@ func TestTranscode(t *testing.T) {
 
 	transcoded := make([]string, 0)
 
-	transcodeFunc = func(path string) error {
+	transcodeFunc = func(_ context.Context, path, target string, _ utils.TranscodeOptions) error {
 		transcoded = append(transcoded, path)
 
 		data, err := ioutil.ReadFile(path)
@@ -91,7 +108,7 @@ func TestTranscode(t *testing.T) {
 
 		// Update the copied data so that we don't end up with a hash collision
 		data = append(data, []byte("transcoded")...)
-		return ioutil.WriteFile(utils.ReplaceExtension(path, value.TranscodingExtension), data, 0o755)
+		return ioutil.WriteFile(target, data, 0o755)
 	}
 
 	err := transcode(nil, nil)
@@ -119,11 +136,128 @@ func TestTranscode(t *testing.T) {
 	assertDatabaseContains(t, transcodeOptions.database, expected)
 }
 
+func TestTranscodeStaleTranscodingFile(t *testing.T) {
+	tempDir := t.TempDir()
+
+	transcodeOptions.database = filepath.Join(tempDir, "goamt.db")
+	transcodeOptions.path = tempDir
+	transcodeOptions.outputDir = ""
+	assumeYes(t)
+
+	entry := value.Entry{
+		Path:       filepath.Join(tempDir, "test.mkv"),
+		Discovered: 8,
+		Hash:       crc32.Checksum([]byte("0"), crc32.MakeTable(crc32.IEEE)),
+	}
+
+	err := ioutil.WriteFile(entry.Path, []byte("0"), 0o755)
+	if err != nil {
+		t.Fatalf("Expected to be able to create test file: %v", err)
+	}
+
+	err = ioutil.WriteFile(filepath.Join(tempDir, "test.transcoding.mp4"), []byte("stale"), 0o755)
+	if err != nil {
+		t.Fatalf("Expected to be able to create stale transcoding file: %v", err)
+	}
+
+	createDatabaseAndPopulate(t, transcodeOptions.database, []value.Entry{entry})
+
+	transcodeFunc = func(_ context.Context, path, target string, _ utils.TranscodeOptions) error {
+		// Mimic ffmpeg, which won't overwrite an existing file when running non-interactively
+		if utils.PathExists(target) {
+			return errors.New("target already exists")
+		}
+
+		return ioutil.WriteFile(target, []byte("transcoded"), 0o755)
+	}
+
+	err = transcode(nil, nil)
+	if err != nil {
+		t.Fatalf("Expected to be able to transcode entries: %v", err)
+	}
+
+	expected := []value.Entry{
+		{Path: filepath.Join(tempDir, "test.mp4"), Discovered: 8, Transcoded: utils.Int64P(0)},
+	}
+
+	assertDatabaseContains(t, transcodeOptions.database, expected)
+}
+
+func TestTranscodeTempDir(t *testing.T) {
+	tempDir := t.TempDir()
+
+	transcodeOptions.database = filepath.Join(tempDir, "goamt.db")
+	transcodeOptions.path = filepath.Join(tempDir, "library")
+	transcodeOptions.outputDir = ""
+	transcodeOptions.tempDir = filepath.Join(tempDir, "scratch")
+	assumeYes(t)
+
+	defer func() { transcodeOptions.tempDir = "" }()
+
+	entry := value.Entry{
+		Path:       filepath.Join(tempDir, "library", "test.mkv"),
+		Discovered: 8,
+		Hash:       crc32.Checksum([]byte("0"), crc32.MakeTable(crc32.IEEE)),
+	}
+
+	err := os.Mkdir(transcodeOptions.path, 0o755)
+	if err != nil {
+		t.Fatalf("Expected to be able to create library directory: %v", err)
+	}
+
+	err = ioutil.WriteFile(entry.Path, []byte("0"), 0o755)
+	if err != nil {
+		t.Fatalf("Expected to be able to create test file: %v", err)
+	}
+
+	createDatabaseAndPopulate(t, transcodeOptions.database, []value.Entry{entry})
+
+	// Temporary files within the media library would be mistaken for orphaned files
+	transcodeOptions.tempDir = filepath.Join(transcodeOptions.path, "scratch")
+
+	err = transcode(nil, nil)
+	if err == nil || !strings.Contains(err.Error(), "must not be within the media library") {
+		t.Fatalf("Expected an error when the temporary directory is within the media library, got %v", err)
+	}
+
+	transcodeOptions.tempDir = filepath.Join(tempDir, "scratch")
+
+	transcodeFunc = func(_ context.Context, path, target string, _ utils.TranscodeOptions) error {
+		if filepath.Dir(target) != transcodeOptions.tempDir {
+			t.Fatalf("Expected to transcode into the temporary directory, got '%s'", target)
+		}
+
+		return ioutil.WriteFile(target, []byte("transcoded"), 0o755)
+	}
+
+	err = transcode(nil, nil)
+	if err != nil {
+		t.Fatalf("Expected to be able to transcode entries: %v", err)
+	}
+
+	expected := []value.Entry{
+		{Path: filepath.Join(tempDir, "library", "test.mp4"), Discovered: 8, Transcoded: utils.Int64P(0)},
+	}
+
+	assertDatabaseContains(t, transcodeOptions.database, expected)
+
+	infos, err := ioutil.ReadDir(transcodeOptions.tempDir)
+	if err != nil {
+		t.Fatalf("Expected to be able to read temporary directory: %v", err)
+	}
+
+	if len(infos) != 0 {
+		t.Fatalf("Expected temporary directory to be empty, got %d file(s)", len(infos))
+	}
+}
+
 func TestTranscodeNoneToTranscode(t *testing.T) {
 	tempDir := t.TempDir()
 
 	transcodeOptions.database = filepath.Join(tempDir, "goamt.db")
 	transcodeOptions.path = tempDir
+	transcodeOptions.outputDir = ""
+	assumeYes(t)
 
 	entries := []value.Entry{
 		{
@@ -158,7 +292,7 @@ func TestTranscodeNoneToTranscode(t *testing.T) {
 
 	transcoded := make([]string, 0)
 
-	transcodeFunc = func(path string) error {
+	transcodeFunc = func(_ context.Context, path, _ string, _ utils.TranscodeOptions) error {
 		transcoded = append(transcoded, path)
 		return nil
 	}
@@ -174,3 +308,2169 @@ func TestTranscodeNoneToTranscode(t *testing.T) {
 
 	assertDatabaseContains(t, transcodeOptions.database, entries)
 }
+
+func TestTranscodeOutputDir(t *testing.T) {
+	var (
+		tempDir   = t.TempDir()
+		outputDir = t.TempDir()
+	)
+
+	transcodeOptions.database = filepath.Join(tempDir, "goamt.db")
+	transcodeOptions.path = tempDir
+	transcodeOptions.outputDir = outputDir
+
+	defer func() { transcodeOptions.outputDir = "" }()
+
+	err := os.Mkdir(filepath.Join(tempDir, "movies"), 0o755)
+	if err != nil {
+		t.Fatalf("Expected to be able to create test directory: %v", err)
+	}
+
+	initial := []value.Entry{
+		{
+			Path:       filepath.Join(tempDir, "movies", "untranscoded1.avi"),
+			Discovered: 16,
+			Hash:       crc32.Checksum([]byte("0"), crc32.MakeTable(crc32.IEEE)),
+		},
+	}
+
+	err = ioutil.WriteFile(initial[0].Path, []byte("0"), 0o755)
+	if err != nil {
+		t.Fatalf("Expected to be able to create test file: %v", err)
+	}
+
+	createDatabaseAndPopulate(t, transcodeOptions.database, initial)
+
+	transcodeFunc = func(_ context.Context, path, target string, _ utils.TranscodeOptions) error {
+		return ioutil.WriteFile(target, []byte("transcoded"), 0o755)
+	}
+
+	err = transcode(nil, nil)
+	if err != nil {
+		t.Fatalf("Expected to be able to transcode entries: %v", err)
+	}
+
+	if !utils.PathExists(initial[0].Path) {
+		t.Fatalf("Expected source file to have been left intact")
+	}
+
+	expected := []value.Entry{
+		{
+			Path:       filepath.Join(outputDir, "movies", "untranscoded1.mp4"),
+			Discovered: 16,
+			Transcoded: utils.Int64P(0),
+		},
+	}
+
+	assertDatabaseContains(t, transcodeOptions.database, expected)
+}
+
+func TestTranscodeOutputDirUpdate(t *testing.T) {
+	tempDir := t.TempDir()
+
+	transcodeOptions.database = filepath.Join(tempDir, "goamt.db")
+	transcodeOptions.path = tempDir
+	transcodeOptions.outputDir = filepath.Join(tempDir, "transcoded")
+
+	defer func() { transcodeOptions.outputDir = "" }()
+
+	updateOptions.database = transcodeOptions.database
+	updateOptions.paths = []string{tempDir}
+
+	source := filepath.Join(tempDir, "untranscoded1.avi")
+
+	err := ioutil.WriteFile(source, []byte("0"), 0o755)
+	if err != nil {
+		t.Fatalf("Expected to be able to create test file: %v", err)
+	}
+
+	createDatabaseAndPopulate(t, transcodeOptions.database, nil)
+
+	var transcoded int
+
+	transcodeFunc = func(_ context.Context, path, target string, _ utils.TranscodeOptions) error {
+		transcoded++
+		return ioutil.WriteFile(target, []byte("transcoded"), 0o755)
+	}
+
+	// The source is left intact, so it must not be added (and transcoded) again by the following update
+	for run := 0; run < 2; run++ {
+		err = update(nil, nil)
+		if err != nil {
+			t.Fatalf("Expected to be able to update database: %v", err)
+		}
+
+		err = transcode(nil, nil)
+		if err != nil {
+			t.Fatalf("Expected to be able to transcode entries: %v", err)
+		}
+	}
+
+	if transcoded != 1 {
+		t.Fatalf("Expected the source to be transcoded once but it was transcoded %d times", transcoded)
+	}
+
+	if !utils.PathExists(source) {
+		t.Fatalf("Expected source file to have been left intact")
+	}
+
+	expected := []value.Entry{
+		{
+			Path:       filepath.Join(transcodeOptions.outputDir, "untranscoded1.mp4"),
+			Transcoded: utils.Int64P(0),
+		},
+	}
+
+	assertDatabaseContains(t, transcodeOptions.database, expected)
+}
+
+func TestTranscodeKeepSource(t *testing.T) {
+	tempDir := t.TempDir()
+
+	transcodeOptions.database = filepath.Join(tempDir, "goamt.db")
+	transcodeOptions.path = tempDir
+	transcodeOptions.outputDir = ""
+	assumeYes(t)
+	transcodeOptions.keepSource = true
+
+	defer func() { transcodeOptions.keepSource = false }()
+
+	initial := []value.Entry{
+		{
+			Path:       filepath.Join(tempDir, "untranscoded1.mp4"),
+			Discovered: 16,
+			Hash:       crc32.Checksum([]byte("0"), crc32.MakeTable(crc32.IEEE)),
+		},
+	}
+
+	err := ioutil.WriteFile(initial[0].Path, []byte("0"), 0o755)
+	if err != nil {
+		t.Fatalf("Expected to be able to create test file: %v", err)
+	}
+
+	createDatabaseAndPopulate(t, transcodeOptions.database, initial)
+
+	transcodeFunc = func(_ context.Context, path, target string, _ utils.TranscodeOptions) error {
+		return ioutil.WriteFile(target, []byte("transcoded"), 0o755)
+	}
+
+	err = transcode(nil, nil)
+	if err != nil {
+		t.Fatalf("Expected to be able to transcode entries: %v", err)
+	}
+
+	data, err := ioutil.ReadFile(initial[0].Path + value.OriginalExtension)
+	if err != nil || string(data) != "0" {
+		t.Fatalf("Expected source file to have been kept: %v", err)
+	}
+
+	expected := []value.Entry{
+		{
+			Path:       filepath.Join(tempDir, "untranscoded1.mp4"),
+			Discovered: 16,
+			Transcoded: utils.Int64P(0),
+		},
+	}
+
+	assertDatabaseContains(t, transcodeOptions.database, expected)
+}
+
+func TestTranscodeRequiresConfirmation(t *testing.T) {
+	tempDir := t.TempDir()
+
+	transcodeOptions.database = filepath.Join(tempDir, "goamt.db")
+	transcodeOptions.path = tempDir
+	transcodeOptions.outputDir = ""
+	rootOptions.yes = false
+
+	file, err := os.Create(filepath.Join(tempDir, "stdin"))
+	if err != nil {
+		t.Fatalf("Expected to be able to create test file: %v", err)
+	}
+	defer file.Close()
+
+	confirmInput = file
+	defer func() { confirmInput = os.Stdin }()
+
+	initial := []value.Entry{
+		{
+			Path:       filepath.Join(tempDir, "untranscoded1.mp4"),
+			Discovered: 16,
+			Hash:       crc32.Checksum([]byte("0"), crc32.MakeTable(crc32.IEEE)),
+		},
+	}
+
+	err = ioutil.WriteFile(initial[0].Path, []byte("0"), 0o755)
+	if err != nil {
+		t.Fatalf("Expected to be able to create test file: %v", err)
+	}
+
+	createDatabaseAndPopulate(t, transcodeOptions.database, initial)
+
+	transcodeFunc = func(_ context.Context, path, _ string, _ utils.TranscodeOptions) error {
+		t.Fatalf("Expected not to transcode '%s' without confirmation", path)
+		return nil
+	}
+
+	err = transcode(nil, nil)
+	if err == nil {
+		t.Fatalf("Expected an error when confirmation is required")
+	}
+
+	assertDatabaseContains(t, transcodeOptions.database, initial)
+
+	// Bounding the amount of work doesn't make the run any less destructive, so still requires confirmation
+	for _, flag := range []string{"entries", "max-runtime"} {
+		changed := func(name string) bool { return name == flag }
+
+		err = runTranscode(newRunSummary("transcode"), nil, changed)
+		if err == nil {
+			t.Fatalf("Expected an error when confirmation is required using '--%s'", flag)
+		}
+	}
+
+	assertDatabaseContains(t, transcodeOptions.database, initial)
+
+	transcodeFunc = func(_ context.Context, path, target string, _ utils.TranscodeOptions) error {
+		return ioutil.WriteFile(target, []byte("transcoded "+path), 0o755)
+	}
+
+	assumeYes(t)
+
+	err = transcode(nil, nil)
+	if err != nil {
+		t.Fatalf("Expected to be able to transcode entries with '--yes': %v", err)
+	}
+
+	assertDatabaseContains(t, transcodeOptions.database, []value.Entry{
+		{Path: filepath.Join(tempDir, "untranscoded1.mp4"), Discovered: 16, Transcoded: utils.Int64P(0)},
+	})
+}
+
+func TestTranscodeInsufficientSpace(t *testing.T) {
+	tempDir := t.TempDir()
+
+	transcodeOptions.database = filepath.Join(tempDir, "goamt.db")
+	transcodeOptions.path = tempDir
+	transcodeOptions.outputDir = ""
+	transcodeOptions.spaceMultiplier = math.MaxFloat64
+	assumeYes(t)
+
+	defer func() { transcodeOptions.spaceMultiplier = 1 }()
+
+	initial := []value.Entry{
+		{
+			Path:       filepath.Join(tempDir, "untranscoded1.mp4"),
+			Discovered: 16,
+			Hash:       crc32.Checksum([]byte("0"), crc32.MakeTable(crc32.IEEE)),
+		},
+	}
+
+	err := ioutil.WriteFile(initial[0].Path, []byte("0"), 0o755)
+	if err != nil {
+		t.Fatalf("Expected to be able to create test file: %v", err)
+	}
+
+	createDatabaseAndPopulate(t, transcodeOptions.database, initial)
+
+	transcodeFunc = func(_ context.Context, path, _ string, _ utils.TranscodeOptions) error {
+		t.Fatalf("Expected not to transcode '%s' without sufficient space", path)
+		return nil
+	}
+
+	err = transcode(nil, nil)
+	if err != nil {
+		t.Fatalf("Expected to be able to run transcode: %v", err)
+	}
+
+	assertDatabaseContains(t, transcodeOptions.database, initial)
+}
+
+func TestTranscodeOnComplete(t *testing.T) {
+	tempDir := t.TempDir()
+
+	transcodeOptions.database = filepath.Join(tempDir, "goamt.db")
+	transcodeOptions.path = tempDir
+	transcodeOptions.outputDir = ""
+	assumeYes(t)
+
+	// The hook failing shouldn't cause the transcode to fail
+	transcodeOptions.onComplete = "echo {path} > " + filepath.Join(tempDir, "hook.txt") + "; exit 1"
+
+	defer func() { transcodeOptions.onComplete = "" }()
+
+	initial := []value.Entry{
+		{
+			Path:       filepath.Join(tempDir, "untranscoded1.mkv"),
+			Discovered: 16,
+			Hash:       crc32.Checksum([]byte("0"), crc32.MakeTable(crc32.IEEE)),
+		},
+	}
+
+	err := ioutil.WriteFile(initial[0].Path, []byte("0"), 0o755)
+	if err != nil {
+		t.Fatalf("Expected to be able to create test file: %v", err)
+	}
+
+	createDatabaseAndPopulate(t, transcodeOptions.database, initial)
+
+	transcodeFunc = func(_ context.Context, path, target string, _ utils.TranscodeOptions) error {
+		return ioutil.WriteFile(target, []byte("transcoded"), 0o755)
+	}
+
+	err = transcode(nil, nil)
+	if err != nil {
+		t.Fatalf("Expected to be able to transcode entries: %v", err)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(tempDir, "hook.txt"))
+	if err != nil {
+		t.Fatalf("Expected the completion hook to have been run: %v", err)
+	}
+
+	if expected := filepath.Join(tempDir, "untranscoded1.mp4") + "\n"; string(data) != expected {
+		t.Fatalf("Expected the hook to be run with '%s' but got '%s'", expected, data)
+	}
+}
+
+func TestTranscodeQuarantine(t *testing.T) {
+	var (
+		tempDir    = t.TempDir()
+		quarantine = t.TempDir()
+	)
+
+	transcodeOptions.database = filepath.Join(tempDir, "goamt.db")
+	transcodeOptions.path = tempDir
+	transcodeOptions.outputDir = ""
+	transcodeOptions.maxFailures = 2
+	transcodeOptions.quarantine = quarantine
+	assumeYes(t)
+
+	defer func() {
+		transcodeOptions.maxFailures = 3
+		transcodeOptions.quarantine = ""
+	}()
+
+	err := os.Mkdir(filepath.Join(tempDir, "movies"), 0o755)
+	if err != nil {
+		t.Fatalf("Expected to be able to create test directory: %v", err)
+	}
+
+	source := filepath.Join(tempDir, "movies", "corrupt.avi")
+
+	err = ioutil.WriteFile(source, []byte("0"), 0o755)
+	if err != nil {
+		t.Fatalf("Expected to be able to create test file: %v", err)
+	}
+
+	createDatabaseAndPopulate(t, transcodeOptions.database, []value.Entry{
+		{
+			Path:       source,
+			Discovered: 16,
+			Hash:       crc32.Checksum([]byte("0"), crc32.MakeTable(crc32.IEEE)),
+		},
+	})
+
+	transcodeFunc = func(_ context.Context, _, target string, _ utils.TranscodeOptions) error {
+		err := ioutil.WriteFile(target, []byte("partial"), 0o755)
+		if err != nil {
+			return err
+		}
+
+		return errors.New("corrupt source")
+	}
+
+	// The first failure should leave the source in place so that it's retried
+	err = transcode(nil, nil)
+	if err == nil {
+		t.Fatalf("Expected an error when transcoding fails")
+	}
+
+	if !utils.PathExists(source) {
+		t.Fatalf("Expected the source file to have been left in place after the first failure")
+	}
+
+	err = transcode(nil, nil)
+	if err == nil {
+		t.Fatalf("Expected an error when transcoding fails")
+	}
+
+	quarantined := filepath.Join(quarantine, "movies", "corrupt.avi")
+
+	if utils.PathExists(source) || !utils.PathExists(quarantined) {
+		t.Fatalf("Expected the source file to have been moved into quarantine")
+	}
+
+	if utils.PathExists(utils.ReplaceExtension(source, value.TranscodingExtension)) {
+		t.Fatalf("Expected the incomplete transcoded file to have been removed")
+	}
+
+	// Quarantined entries shouldn't be selected again
+	err = transcode(nil, nil)
+	if err != nil {
+		t.Fatalf("Expected to be able to transcode entries: %v", err)
+	}
+
+	assertDatabaseContains(t, transcodeOptions.database, []value.Entry{{Path: quarantined}})
+}
+
+func TestTranscodeTargetExists(t *testing.T) {
+	tempDir := t.TempDir()
+
+	transcodeOptions.database = filepath.Join(tempDir, "goamt.db")
+	transcodeOptions.path = tempDir
+	transcodeOptions.outputDir = ""
+	assumeYes(t)
+
+	var (
+		source    = filepath.Join(tempDir, "movie.avi")
+		unrelated = filepath.Join(tempDir, "movie.mp4")
+	)
+
+	for _, path := range []string{source, unrelated} {
+		err := ioutil.WriteFile(path, []byte(filepath.Base(path)), 0o755)
+		if err != nil {
+			t.Fatalf("Expected to be able to create test file: %v", err)
+		}
+	}
+
+	createDatabaseAndPopulate(t, transcodeOptions.database, []value.Entry{
+		{
+			Path:       source,
+			Discovered: 16,
+			Hash:       crc32.Checksum([]byte("movie.avi"), crc32.MakeTable(crc32.IEEE)),
+		},
+	})
+
+	var transcoded bool
+
+	transcodeFunc = func(_ context.Context, _, target string, _ utils.TranscodeOptions) error {
+		transcoded = true
+		return ioutil.WriteFile(target, []byte("transcoded"), 0o755)
+	}
+
+	assertFailed := func(failures int) {
+		contents, err := ioutil.ReadFile(unrelated)
+		if err != nil || string(contents) != "movie.mp4" {
+			t.Fatalf("Expected the unrelated file to have been left intact, got %q (%v)", contents, err)
+		}
+
+		if !utils.PathExists(source) {
+			t.Fatalf("Expected the source file to have been left intact")
+		}
+
+		if utils.PathExists(utils.ReplaceExtension(source, value.TranscodingExtension)) {
+			t.Fatalf("Expected the transcoded file to have been removed")
+		}
+
+		if jobs := countJobs(t, transcodeOptions.database); jobs != 0 {
+			t.Fatalf("Expected the job to have been removed, but got %d", jobs)
+		}
+
+		db, err := database.Open(transcodeOptions.database)
+		if err != nil {
+			t.Fatalf("Expected to be able to open database: %v", err)
+		}
+		defer db.Close()
+
+		entry, err := db.FindByHash(crc32.Checksum([]byte("movie.avi"), crc32.MakeTable(crc32.IEEE)))
+		if err != nil {
+			t.Fatalf("Expected to be able to find entry: %v", err)
+		}
+
+		if entry.Transcoded != nil || entry.Failures != failures {
+			t.Fatalf("Expected an untranscoded entry with %d failure(s), got %+v", failures, entry.Fields())
+		}
+	}
+
+	// The collision is detected before transcoding, to avoid wasting time transcoding a file which can't be used
+	err := transcode(nil, nil)
+	if err == nil || !strings.Contains(err.Error(), fmt.Sprintf("target file '%s' already exists", unrelated)) {
+		t.Fatalf("Expected an error when the target already exists, got %v", err)
+	}
+
+	if transcoded {
+		t.Fatalf("Expected the entry not to have been transcoded")
+	}
+
+	assertFailed(1)
+
+	// The target may also be created whilst transcoding
+	err = os.Remove(unrelated)
+	if err != nil {
+		t.Fatalf("Expected to be able to remove test file: %v", err)
+	}
+
+	transcodeFunc = func(_ context.Context, _, target string, _ utils.TranscodeOptions) error {
+		err := ioutil.WriteFile(unrelated, []byte("movie.mp4"), 0o755)
+		if err != nil {
+			return err
+		}
+
+		return ioutil.WriteFile(target, []byte("transcoded"), 0o755)
+	}
+
+	err = transcode(nil, nil)
+	if err == nil || !strings.Contains(err.Error(), fmt.Sprintf("target file '%s' already exists", unrelated)) {
+		t.Fatalf("Expected an error when the target already exists, got %v", err)
+	}
+
+	assertFailed(2)
+}
+
+func TestTranscodeRename(t *testing.T) {
+	tempDir := t.TempDir()
+
+	transcodeOptions.database = filepath.Join(tempDir, "goamt.db")
+	transcodeOptions.path = tempDir
+	transcodeOptions.outputDir = ""
+	transcodeOptions.entries = 2
+	transcodeOptions.rename = []string{"lowercase", "underscores"}
+	assumeYes(t)
+
+	defer func() {
+		transcodeOptions.entries = runtime.NumCPU()
+		transcodeOptions.rename = nil
+	}()
+
+	var (
+		source = filepath.Join(tempDir, "A Movie.avi")
+		other  = filepath.Join(tempDir, "Other Movie.avi")
+		stale  = filepath.Join(tempDir, "other_movie.mp4")
+	)
+
+	for _, path := range []string{source, other} {
+		err := ioutil.WriteFile(path, []byte(filepath.Base(path)), 0o755)
+		if err != nil {
+			t.Fatalf("Expected to be able to create test file: %v", err)
+		}
+	}
+
+	// The file for an entry may have been removed since it was recorded, its path must still be unique
+	createDatabaseAndPopulate(t, transcodeOptions.database, []value.Entry{
+		{Path: source, Discovered: 8, Hash: crc32.Checksum([]byte("A Movie.avi"), crc32.MakeTable(crc32.IEEE))},
+		{Path: other, Discovered: 8, Hash: crc32.Checksum([]byte("Other Movie.avi"), crc32.MakeTable(crc32.IEEE))},
+		{Path: stale, Discovered: 8, Transcoded: utils.Int64P(8), Hash: 1},
+	})
+
+	transcodeFunc = func(_ context.Context, _, target string, _ utils.TranscodeOptions) error {
+		return ioutil.WriteFile(target, []byte("transcoded"), 0o755)
+	}
+
+	err := transcode(nil, nil)
+	if err == nil || !strings.Contains(err.Error(), fmt.Sprintf("target path '%s' is already recorded", stale)) {
+		t.Fatalf("Expected an error when the target is already recorded, got %v", err)
+	}
+
+	renamed := filepath.Join(tempDir, "a_movie.mp4")
+
+	if utils.PathExists(source) || !utils.PathExists(renamed) {
+		t.Fatalf("Expected the transcoded file to have been renamed")
+	}
+
+	if !utils.PathExists(other) {
+		t.Fatalf("Expected the source file of the colliding entry to have been left intact")
+	}
+
+	assertDatabaseContains(t, transcodeOptions.database, []value.Entry{
+		{Path: renamed, Discovered: 8, Transcoded: utils.Int64P(0)},
+		{Path: other, Discovered: 8},
+		{Path: stale, Discovered: 8, Transcoded: utils.Int64P(0)},
+	})
+
+	transcodeOptions.rename = []string{"uppercase"}
+
+	err = transcode(nil, nil)
+	if err == nil || !strings.HasPrefix(err.Error(), "unknown rename scheme 'uppercase'") {
+		t.Fatalf("Expected an error for an unknown rename scheme, got %v", err)
+	}
+}
+
+func TestTranscodeRenameCaseOnly(t *testing.T) {
+	tempDir := t.TempDir()
+
+	transcodeOptions.database = filepath.Join(tempDir, "goamt.db")
+	transcodeOptions.path = tempDir
+	transcodeOptions.outputDir = ""
+	transcodeOptions.rename = []string{"lowercase"}
+	assumeYes(t)
+
+	defer func() { transcodeOptions.rename = nil }()
+
+	var (
+		source = filepath.Join(tempDir, "Movie.mp4")
+		target = filepath.Join(tempDir, "movie.mp4")
+	)
+
+	err := ioutil.WriteFile(source, []byte("0"), 0o755)
+	if err != nil {
+		t.Fatalf("Expected to be able to create test file: %v", err)
+	}
+
+	// On a case-insensitive filesystem the target refers to the source, which a hard link emulates
+	err = os.Link(source, target)
+	if err != nil {
+		t.Fatalf("Expected to be able to create hard link: %v", err)
+	}
+
+	createDatabaseAndPopulate(t, transcodeOptions.database, []value.Entry{
+		{Path: source, Discovered: 8, Hash: crc32.Checksum([]byte("0"), crc32.MakeTable(crc32.IEEE))},
+	})
+
+	transcodeFunc = func(_ context.Context, _, target string, _ utils.TranscodeOptions) error {
+		return ioutil.WriteFile(target, []byte("transcoded"), 0o755)
+	}
+
+	err = transcode(nil, nil)
+	if err != nil {
+		t.Fatalf("Expected to be able to transcode an entry which is only renamed by case: %v", err)
+	}
+
+	// The source refers to the transcoded file on a case-insensitive filesystem, so mustn't be removed
+	if !utils.PathExists(source) {
+		t.Fatalf("Expected the source not to be removed when it refers to the target")
+	}
+
+	contents, err := ioutil.ReadFile(target)
+	if err != nil || string(contents) != "transcoded" {
+		t.Fatalf("Expected the transcoded file to have been moved into place, got '%s': %v", contents, err)
+	}
+
+	assertDatabaseContains(t, transcodeOptions.database, []value.Entry{
+		{Path: target, Discovered: 8, Transcoded: utils.Int64P(0)},
+	})
+}
+
+func TestTranscodePrintCommand(t *testing.T) {
+	tempDir := t.TempDir()
+
+	transcodeOptions.database = filepath.Join(tempDir, "goamt.db")
+	transcodeOptions.path = tempDir
+	transcodeOptions.outputDir = ""
+	transcodeOptions.printCommand = true
+	rootOptions.yes = false
+
+	defer func() {
+		transcodeOptions.printCommand = false
+		assumeYes(t)
+	}()
+
+	source := filepath.Join(tempDir, "untranscoded.mkv")
+
+	err := ioutil.WriteFile(source, []byte("0"), 0o755)
+	if err != nil {
+		t.Fatalf("Expected to be able to create test file: %v", err)
+	}
+
+	initial := []value.Entry{
+		{Path: source, Discovered: 8, Hash: crc32.Checksum([]byte("0"), crc32.MakeTable(crc32.IEEE))},
+	}
+
+	createDatabaseAndPopulate(t, transcodeOptions.database, initial)
+
+	transcodeFunc = func(_ context.Context, _, _ string, _ utils.TranscodeOptions) error {
+		t.Fatalf("Expected the entry not to be transcoded")
+		return nil
+	}
+
+	// Nothing is transcoded, so confirmation isn't required
+	err = transcode(nil, nil)
+	if err != nil {
+		t.Fatalf("Expected to be able to print commands: %v", err)
+	}
+
+	if !utils.PathExists(source) {
+		t.Fatalf("Expected the source file to have been left intact")
+	}
+
+	if jobs := countJobs(t, transcodeOptions.database); jobs != 0 {
+		t.Fatalf("Expected the jobs to have been cancelled, but got %d", jobs)
+	}
+
+	assertDatabaseContains(t, transcodeOptions.database, initial)
+}
+
+func TestPrintEntryCommands(t *testing.T) {
+	defer func(path string) { os.Setenv("PATH", path) }(os.Getenv("PATH"))
+
+	// Commands are printed using the name of the executable when it's not installed
+	os.Setenv("PATH", t.TempDir())
+
+	transcodeOptions.outputDir = ""
+
+	var (
+		buffer bytes.Buffer
+		paths  = []string{"/movies/first.mkv", "/movies/second.avi"}
+	)
+
+	for index, path := range paths {
+		err := printEntryCommands(context.Background(), value.Entry{Path: path}, &buffer, index == 0)
+		if err != nil {
+			t.Fatalf("Expected to be able to print commands: %v", err)
+		}
+	}
+
+	entries := strings.Split(buffer.String(), "\n\n")
+	if len(entries) != 2 {
+		t.Fatalf("Expected the commands for each entry to be separated by a blank line, got:\n%s", buffer.String())
+	}
+
+	for index, path := range paths {
+		lines := strings.Split(strings.TrimSpace(entries[index]), "\n")
+
+		if lines[0] != "# "+path {
+			t.Fatalf("Expected the commands to be preceded by the path of the entry, got '%s'", lines[0])
+		}
+
+		output := utils.ReplaceExtension(path, value.TranscodingExtension)
+
+		if len(lines) < 2 || !strings.HasSuffix(lines[len(lines)-1], " "+output) {
+			t.Fatalf("Expected the final command to write the transcoded file, got %q", lines)
+		}
+
+		for _, command := range lines[1:] {
+			if !strings.HasPrefix(command, "ffmpeg ") {
+				t.Fatalf("Expected an ffmpeg command, got '%s'", command)
+			}
+		}
+	}
+}
+
+func TestTranscodeVerifyDecode(t *testing.T) {
+	tempDir := t.TempDir()
+
+	transcodeOptions.database = filepath.Join(tempDir, "goamt.db")
+	transcodeOptions.path = tempDir
+	transcodeOptions.outputDir = ""
+	transcodeOptions.verifyDecode = true
+	assumeYes(t)
+
+	defer func() {
+		transcodeOptions.verifyDecode = false
+		verifyDecodeFunc = utils.VerifyDecode
+	}()
+
+	source := filepath.Join(tempDir, "test.avi")
+
+	err := ioutil.WriteFile(source, []byte("0"), 0o755)
+	if err != nil {
+		t.Fatalf("Expected to be able to create test file: %v", err)
+	}
+
+	createDatabaseAndPopulate(t, transcodeOptions.database, []value.Entry{
+		{Path: source, Discovered: 16, Hash: crc32.Checksum([]byte("0"), crc32.MakeTable(crc32.IEEE))},
+	})
+
+	transcodeFunc = func(_ context.Context, _, target string, _ utils.TranscodeOptions) error {
+		return ioutil.WriteFile(target, []byte("corrupt"), 0o755)
+	}
+
+	var verified string
+
+	verifyDecodeFunc = func(_ context.Context, path string, _ utils.TranscodeOptions) error {
+		verified = path
+		return errors.New("error while decoding MB 10 20")
+	}
+
+	err = transcode(nil, nil)
+	if err == nil {
+		t.Fatalf("Expected an error when the transcoded file fails to decode")
+	}
+
+	transcoding := utils.ReplaceExtension(source, value.TranscodingExtension)
+
+	if verified != transcoding {
+		t.Fatalf("Expected '%s' to be verified but got '%s'", transcoding, verified)
+	}
+
+	if !utils.PathExists(source) || utils.PathExists(transcoding) {
+		t.Fatalf("Expected the source to be kept and the corrupt transcoded file to be removed")
+	}
+
+	assertDatabaseContains(t, transcodeOptions.database, []value.Entry{{Path: source}})
+}
+
+func TestTranscodeOnlyIfSmaller(t *testing.T) {
+	tempDir := t.TempDir()
+
+	transcodeOptions.database = filepath.Join(tempDir, "goamt.db")
+	transcodeOptions.path = tempDir
+	transcodeOptions.outputDir = ""
+	transcodeOptions.entries = 2
+	transcodeOptions.onlyIfSmaller = true
+	transcodeOptions.minSavings = 40
+	assumeYes(t)
+
+	defer func() {
+		transcodeOptions.entries = runtime.NumCPU()
+		transcodeOptions.onlyIfSmaller = false
+		transcodeOptions.minSavings = 0
+	}()
+
+	var (
+		smaller = filepath.Join(tempDir, "smaller.avi")
+		larger  = filepath.Join(tempDir, "larger.avi")
+	)
+
+	initial := make([]value.Entry, 0, 2)
+
+	for index, path := range []string{smaller, larger} {
+		contents := []byte(fmt.Sprintf("%d123456789", index))
+
+		err := ioutil.WriteFile(path, contents, 0o755)
+		if err != nil {
+			t.Fatalf("Expected to be able to create test file: %v", err)
+		}
+
+		initial = append(initial, value.Entry{
+			Path:       path,
+			Discovered: int64(index + 8),
+			Hash:       crc32.Checksum(contents, crc32.MakeTable(crc32.IEEE)),
+		})
+	}
+
+	createDatabaseAndPopulate(t, transcodeOptions.database, initial)
+
+	// Only the first transcode is smaller by more than 40%
+	transcodeFunc = func(_ context.Context, path, target string, _ utils.TranscodeOptions) error {
+		if path == smaller {
+			return ioutil.WriteFile(target, []byte("small"), 0o755)
+		}
+
+		return ioutil.WriteFile(target, []byte("larger"), 0o755)
+	}
+
+	err := transcode(nil, nil)
+	if err != nil {
+		t.Fatalf("Expected to be able to transcode entries: %v", err)
+	}
+
+	if utils.PathExists(smaller) || !utils.PathExists(larger) {
+		t.Fatalf("Expected only the source of the smaller transcode to have been removed")
+	}
+
+	if utils.PathExists(utils.ReplaceExtension(larger, value.TargetExtension)) ||
+		utils.PathExists(utils.ReplaceExtension(larger, value.TranscodingExtension)) {
+		t.Fatalf("Expected the larger transcoded file to have been discarded")
+	}
+
+	expected := []value.Entry{
+		{
+			Path:       utils.ReplaceExtension(smaller, value.TargetExtension),
+			Transcoded: utils.Int64P(0),
+		},
+		{
+			Path:       larger,
+			Transcoded: utils.Int64P(0),
+		},
+	}
+
+	assertDatabaseContains(t, transcodeOptions.database, expected)
+}
+
+func countJobs(t *testing.T, path string) int {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatalf("Expected to be able to open test database: %v", err)
+	}
+	defer db.Close()
+
+	var count int
+
+	err = sqlite.QueryRow(db, sqlite.Query{Query: "select count(*) from jobs;"}, &count)
+	if err != nil {
+		t.Fatalf("Expected to be able to count jobs: %v", err)
+	}
+
+	return count
+}
+
+func TestTranscodeMaxRuntime(t *testing.T) {
+	tempDir := t.TempDir()
+
+	transcodeOptions.database = filepath.Join(tempDir, "goamt.db")
+	transcodeOptions.path = tempDir
+	transcodeOptions.outputDir = ""
+	transcodeOptions.summaryFile = filepath.Join(tempDir, "summary.json")
+	transcodeOptions.entries = 3
+	transcodeOptions.threads = 1
+	transcodeOptions.maxRuntime = 300 * time.Millisecond
+	assumeYes(t)
+
+	defer func() {
+		transcodeOptions.summaryFile = ""
+		transcodeOptions.entries = runtime.NumCPU()
+		transcodeOptions.threads = runtime.NumCPU()
+		transcodeOptions.maxRuntime = 0
+	}()
+
+	initial := make([]value.Entry, 0, 3)
+
+	for index := 0; index < 3; index++ {
+		entry := value.Entry{
+			Path:       filepath.Join(tempDir, fmt.Sprintf("untranscoded%d.mkv", index)),
+			Discovered: int64(index + 1),
+			Hash:       crc32.Checksum([]byte(strconv.Itoa(index)), crc32.MakeTable(crc32.IEEE)),
+		}
+
+		err := ioutil.WriteFile(entry.Path, []byte(strconv.Itoa(index)), 0o755)
+		if err != nil {
+			t.Fatalf("Expected to be able to create test file: %v", err)
+		}
+
+		initial = append(initial, entry)
+	}
+
+	createDatabaseAndPopulate(t, transcodeOptions.database, initial)
+
+	// The second entry will still be in progress when the maximum runtime is reached, so should be completed
+	transcodeFunc = func(_ context.Context, path, target string, _ utils.TranscodeOptions) error {
+		time.Sleep(200 * time.Millisecond)
+		return ioutil.WriteFile(target, []byte(filepath.Base(path)), 0o755)
+	}
+
+	err := transcode(nil, nil)
+	if err != nil {
+		t.Fatalf("Expected to be able to transcode entries: %v", err)
+	}
+
+	expected := []value.Entry{
+		{Path: filepath.Join(tempDir, "untranscoded0.mp4"), Discovered: 1, Transcoded: utils.Int64P(0)},
+		{Path: filepath.Join(tempDir, "untranscoded1.mp4"), Discovered: 2, Transcoded: utils.Int64P(0)},
+		{Path: filepath.Join(tempDir, "untranscoded2.mkv"), Discovered: 3},
+	}
+
+	assertDatabaseContains(t, transcodeOptions.database, expected)
+
+	if jobs := countJobs(t, transcodeOptions.database); jobs != 0 {
+		t.Fatalf("Expected all the jobs to have been cleaned up, but got %d", jobs)
+	}
+
+	summary := readSummary(t, transcodeOptions.summaryFile)
+	if summary.Processed != 2 || summary.Cancelled != 1 {
+		t.Fatalf("Expected 2 processed and 1 cancelled entries but got %+v", summary)
+	}
+}
+
+func TestTranscodeMaxRuntimeCancelInFlight(t *testing.T) {
+	tempDir := t.TempDir()
+
+	transcodeOptions.database = filepath.Join(tempDir, "goamt.db")
+	transcodeOptions.path = tempDir
+	transcodeOptions.outputDir = ""
+	transcodeOptions.summaryFile = filepath.Join(tempDir, "summary.json")
+	transcodeOptions.maxRuntime = 100 * time.Millisecond
+	transcodeOptions.cancelInFlight = true
+	assumeYes(t)
+
+	defer func() {
+		transcodeOptions.summaryFile = ""
+		transcodeOptions.maxRuntime = 0
+		transcodeOptions.cancelInFlight = false
+	}()
+
+	initial := []value.Entry{
+		{
+			Path:       filepath.Join(tempDir, "untranscoded1.mkv"),
+			Discovered: 16,
+			Hash:       crc32.Checksum([]byte("0"), crc32.MakeTable(crc32.IEEE)),
+		},
+	}
+
+	err := ioutil.WriteFile(initial[0].Path, []byte("0"), 0o755)
+	if err != nil {
+		t.Fatalf("Expected to be able to create test file: %v", err)
+	}
+
+	createDatabaseAndPopulate(t, transcodeOptions.database, initial)
+
+	transcodeFunc = func(ctx context.Context, _, target string, _ utils.TranscodeOptions) error {
+		err := ioutil.WriteFile(target, []byte("partial"), 0o755)
+		if err != nil {
+			return err
+		}
+
+		<-ctx.Done()
+
+		return ctx.Err()
+	}
+
+	err = transcode(nil, nil)
+	if err != nil {
+		t.Fatalf("Expected the run to stop cleanly: %v", err)
+	}
+
+	if utils.PathExists(filepath.Join(tempDir, "untranscoded1"+value.TranscodingExtension)) {
+		t.Fatalf("Expected the incomplete transcoded file to have been removed")
+	}
+
+	if !utils.PathExists(initial[0].Path) {
+		t.Fatalf("Expected the source file to have been left intact")
+	}
+
+	assertDatabaseContains(t, transcodeOptions.database, []value.Entry{{Path: initial[0].Path, Discovered: 16}})
+
+	if jobs := countJobs(t, transcodeOptions.database); jobs != 0 {
+		t.Fatalf("Expected all the jobs to have been cleaned up, but got %d", jobs)
+	}
+
+	summary := readSummary(t, transcodeOptions.summaryFile)
+	if summary.Processed != 0 || summary.Failed != 0 || summary.Cancelled != 1 {
+		t.Fatalf("Expected a single cancelled entry but got %+v", summary)
+	}
+}
+
+func TestTranscodeSIGTERM(t *testing.T) {
+	tempDir := t.TempDir()
+
+	transcodeOptions.database = filepath.Join(tempDir, "goamt.db")
+	transcodeOptions.path = tempDir
+	transcodeOptions.outputDir = ""
+	transcodeOptions.summaryFile = filepath.Join(tempDir, "summary.json")
+	transcodeOptions.entries = 3
+	transcodeOptions.threads = 1
+	transcodeOptions.cancelInFlight = true
+	assumeYes(t)
+
+	defer func() {
+		transcodeOptions.summaryFile = ""
+		transcodeOptions.entries = runtime.NumCPU()
+		transcodeOptions.threads = runtime.NumCPU()
+		transcodeOptions.cancelInFlight = false
+	}()
+
+	initial := make([]value.Entry, 0, 3)
+
+	for index := 0; index < 3; index++ {
+		path := filepath.Join(tempDir, fmt.Sprintf("untranscoded%d.mkv", index))
+
+		err := ioutil.WriteFile(path, []byte(strconv.Itoa(index)), 0o755)
+		if err != nil {
+			t.Fatalf("Expected to be able to create test file: %v", err)
+		}
+
+		initial = append(initial, value.Entry{Path: path, Discovered: 16, Hash: uint32(index + 1)})
+	}
+
+	createDatabaseAndPopulate(t, transcodeOptions.database, initial)
+
+	// Stopped by a service manager whilst the first entry is being transcoded, the remaining entries are still queued
+	transcodeFunc = func(ctx context.Context, _, target string, _ utils.TranscodeOptions) error {
+		err := ioutil.WriteFile(target, []byte("partial"), 0o755)
+		if err != nil {
+			return err
+		}
+
+		err = syscall.Kill(os.Getpid(), syscall.SIGTERM)
+		if err != nil {
+			return err
+		}
+
+		<-ctx.Done()
+
+		return ctx.Err()
+	}
+
+	err := transcode(nil, nil)
+	if err != nil {
+		t.Fatalf("Expected the run to stop cleanly: %v", err)
+	}
+
+	for _, entry := range initial {
+		if !utils.PathExists(entry.Path) {
+			t.Fatalf("Expected the source file '%s' to have been left intact", entry.Path)
+		}
+
+		if utils.PathExists(utils.ReplaceExtension(entry.Path, value.TranscodingExtension)) {
+			t.Fatalf("Expected the incomplete transcoded file for '%s' to have been removed", entry.Path)
+		}
+	}
+
+	if jobs := countJobs(t, transcodeOptions.database); jobs != 0 {
+		t.Fatalf("Expected no orphaned jobs, but got %d", jobs)
+	}
+
+	assertDatabaseContains(t, transcodeOptions.database, []value.Entry{
+		{Path: initial[0].Path, Discovered: 16},
+		{Path: initial[1].Path, Discovered: 16},
+		{Path: initial[2].Path, Discovered: 16},
+	})
+
+	summary := readSummary(t, transcodeOptions.summaryFile)
+	if summary.Processed != 0 || summary.Failed != 0 || summary.Cancelled != 3 {
+		t.Fatalf("Expected every entry to have been cancelled but got %+v", summary)
+	}
+}
+
+func TestTranscodeInterruptedBatch(t *testing.T) {
+	tempDir := t.TempDir()
+
+	transcodeOptions.database = filepath.Join(tempDir, "goamt.db")
+	transcodeOptions.path = tempDir
+	transcodeOptions.outputDir = ""
+	transcodeOptions.summaryFile = filepath.Join(tempDir, "summary.json")
+	transcodeOptions.entries = 10
+	transcodeOptions.threads = 1
+	transcodeOptions.cancelInFlight = true
+	assumeYes(t)
+
+	defer func() {
+		transcodeOptions.summaryFile = ""
+		transcodeOptions.entries = runtime.NumCPU()
+		transcodeOptions.threads = runtime.NumCPU()
+		transcodeOptions.cancelInFlight = false
+	}()
+
+	initial := make([]value.Entry, 0, 10)
+
+	for index := 0; index < 10; index++ {
+		path := filepath.Join(tempDir, fmt.Sprintf("untranscoded%d.mkv", index))
+
+		err := ioutil.WriteFile(path, []byte(strconv.Itoa(index)), 0o755)
+		if err != nil {
+			t.Fatalf("Expected to be able to create test file: %v", err)
+		}
+
+		initial = append(initial, value.Entry{Path: path, Discovered: int64(index + 1), Hash: uint32(index + 1)})
+	}
+
+	createDatabaseAndPopulate(t, transcodeOptions.database, initial)
+
+	var transcodes int
+
+	// Interrupted whilst transcoding the sixth entry, leaving the remaining entries queued
+	transcodeFunc = func(ctx context.Context, _, target string, _ utils.TranscodeOptions) error {
+		transcodes++
+
+		if transcodes != 6 {
+			return ioutil.WriteFile(target, []byte("transcoded"), 0o755)
+		}
+
+		err := syscall.Kill(os.Getpid(), syscall.SIGINT)
+		if err != nil {
+			return err
+		}
+
+		<-ctx.Done()
+
+		return ctx.Err()
+	}
+
+	err := transcode(nil, nil)
+	if err != nil {
+		t.Fatalf("Expected the run to stop cleanly: %v", err)
+	}
+
+	if jobs := countJobs(t, transcodeOptions.database); jobs != 0 {
+		t.Fatalf("Expected no lingering jobs, but got %d", jobs)
+	}
+
+	summary := readSummary(t, transcodeOptions.summaryFile)
+	if summary.Processed != 5 || summary.Failed != 0 || summary.Cancelled != 5 {
+		t.Fatalf("Expected 5 processed and 5 cancelled entries but got %+v", summary)
+	}
+
+	// Re-running should pick up the remaining entries
+	err = transcode(nil, nil)
+	if err != nil {
+		t.Fatalf("Expected to be able to transcode the remaining entries: %v", err)
+	}
+
+	db, err := database.Open(transcodeOptions.database)
+	if err != nil {
+		t.Fatalf("Expected to be able to open database: %v", err)
+	}
+	defer db.Close()
+
+	info, err := db.Info()
+	if err != nil {
+		t.Fatalf("Expected to be able to get database info: %v", err)
+	}
+
+	if info.Transcoded != 10 || info.Untranscoded != 0 {
+		t.Fatalf("Expected every entry to have been transcoded but got %d (%d untranscoded)", info.Transcoded,
+			info.Untranscoded)
+	}
+}
+
+func TestTranscodePerDisk(t *testing.T) {
+	tempDir := t.TempDir()
+
+	transcodeOptions.database = filepath.Join(tempDir, "goamt.db")
+	transcodeOptions.path = tempDir
+	transcodeOptions.outputDir = ""
+	transcodeOptions.entries = 6
+	transcodeOptions.perDisk = 1
+	assumeYes(t)
+
+	defer func() {
+		transcodeOptions.entries = runtime.NumCPU()
+		transcodeOptions.perDisk = 0
+		deviceFunc = utils.Device
+	}()
+
+	initial := make([]value.Entry, 0)
+
+	for index := 0; index < 6; index++ {
+		var (
+			disk     = filepath.Join(tempDir, fmt.Sprintf("disk%d", index%2))
+			path     = filepath.Join(disk, fmt.Sprintf("untranscoded%d.mkv", index))
+			contents = []byte(strconv.Itoa(index))
+		)
+
+		err := os.MkdirAll(disk, 0o755)
+		if err != nil {
+			t.Fatalf("Expected to be able to create test directory: %v", err)
+		}
+
+		err = ioutil.WriteFile(path, contents, 0o755)
+		if err != nil {
+			t.Fatalf("Expected to be able to create test file: %v", err)
+		}
+
+		initial = append(initial, value.Entry{
+			Path:       path,
+			Discovered: int64(index + 8),
+			Hash:       crc32.Checksum(contents, crc32.MakeTable(crc32.IEEE)),
+		})
+	}
+
+	createDatabaseAndPopulate(t, transcodeOptions.database, initial)
+
+	// Treat each directory as a separate disk
+	deviceFunc = func(path string) (uint64, error) {
+		return uint64(filepath.Base(filepath.Dir(path))[4] - '0'), nil
+	}
+
+	var (
+		lock                  sync.Mutex
+		running               = make(map[string]int)
+		maxPerDisk, maxGlobal int
+		transcoded            int
+	)
+
+	transcodeFunc = func(_ context.Context, path, target string, _ utils.TranscodeOptions) error {
+		disk := filepath.Dir(path)
+
+		lock.Lock()
+		running[disk]++
+
+		if running[disk] > maxPerDisk {
+			maxPerDisk = running[disk]
+		}
+
+		if global := running[filepath.Join(tempDir, "disk0")] + running[filepath.Join(tempDir, "disk1")]; global > maxGlobal {
+			maxGlobal = global
+		}
+
+		lock.Unlock()
+
+		time.Sleep(20 * time.Millisecond)
+
+		lock.Lock()
+		running[disk]--
+		transcoded++
+		lock.Unlock()
+
+		return ioutil.WriteFile(target, []byte(path), 0o755)
+	}
+
+	err := transcode(nil, nil)
+	if err != nil {
+		t.Fatalf("Expected to be able to transcode entries: %v", err)
+	}
+
+	if transcoded != 6 {
+		t.Fatalf("Expected 6 entries to be transcoded but got %d", transcoded)
+	}
+
+	if maxPerDisk != 1 {
+		t.Fatalf("Expected at most one concurrent transcode per disk but got %d", maxPerDisk)
+	}
+
+	if maxGlobal != 2 {
+		t.Fatalf("Expected both disks to be transcoded concurrently but got %d", maxGlobal)
+	}
+}
+
+func TestTranscodeAnalyzers(t *testing.T) {
+	tempDir := t.TempDir()
+
+	transcodeOptions.database = filepath.Join(tempDir, "goamt.db")
+	transcodeOptions.path = tempDir
+	transcodeOptions.outputDir = ""
+	transcodeOptions.entries = 4
+	transcodeOptions.threads = 1
+	transcodeOptions.analyzers = 2
+	assumeYes(t)
+
+	defer func() {
+		transcodeOptions.entries = runtime.NumCPU()
+		transcodeOptions.threads = runtime.NumCPU()
+		transcodeOptions.analyzers = 0
+		analyseFunc = utils.AnalyseLoudness
+	}()
+
+	initial := make([]value.Entry, 0)
+
+	for index := 0; index < 4; index++ {
+		var (
+			path     = filepath.Join(tempDir, fmt.Sprintf("untranscoded%d.mkv", index))
+			contents = []byte(strconv.Itoa(index))
+		)
+
+		err := ioutil.WriteFile(path, contents, 0o755)
+		if err != nil {
+			t.Fatalf("Expected to be able to create test file: %v", err)
+		}
+
+		initial = append(initial, value.Entry{
+			Path:       path,
+			Discovered: int64(index + 8),
+			Hash:       crc32.Checksum(contents, crc32.MakeTable(crc32.IEEE)),
+		})
+	}
+
+	createDatabaseAndPopulate(t, transcodeOptions.database, initial)
+
+	var (
+		lock     sync.Mutex
+		analysed = make(map[string]int)
+	)
+
+	analyseFunc = func(_ context.Context, path string, _ utils.TranscodeOptions) (*utils.LoudnormStats, error) {
+		lock.Lock()
+		analysed[path]++
+		lock.Unlock()
+
+		time.Sleep(10 * time.Millisecond)
+
+		return &utils.LoudnormStats{MeasuredI: path}, nil
+	}
+
+	transcodeFunc = func(_ context.Context, path, target string, options utils.TranscodeOptions) error {
+		if options.LoudnormStats == nil || options.LoudnormStats.MeasuredI != path {
+			return fmt.Errorf("expected the first pass for '%s' to have been run ahead of time", path)
+		}
+
+		time.Sleep(20 * time.Millisecond)
+
+		return ioutil.WriteFile(target, []byte(path), 0o755)
+	}
+
+	err := transcode(nil, nil)
+	if err != nil {
+		t.Fatalf("Expected to be able to transcode entries: %v", err)
+	}
+
+	if len(analysed) != 4 {
+		t.Fatalf("Expected 4 entries to be analysed but got %d", len(analysed))
+	}
+
+	for path, count := range analysed {
+		if count != 1 {
+			t.Fatalf("Expected '%s' to be analysed once but it was analysed %d times", path, count)
+		}
+	}
+}
+
+func TestTranscodeRelativeRoot(t *testing.T) {
+	var (
+		tempDir = t.TempDir()
+		library = filepath.Join(tempDir, "library")
+		moved   = filepath.Join(tempDir, "moved")
+	)
+
+	err := os.MkdirAll(library, 0o755)
+	if err != nil {
+		t.Fatalf("Expected to be able to create test directory: %v", err)
+	}
+
+	err = ioutil.WriteFile(filepath.Join(library, "untranscoded1.mkv"), []byte("0"), 0o755)
+	if err != nil {
+		t.Fatalf("Expected to be able to create test file: %v", err)
+	}
+
+	createOptions.database = filepath.Join(tempDir, "goamt.db")
+	createOptions.root = library
+
+	defer func() { createOptions.root = "" }()
+
+	err = create(nil, nil)
+	if err != nil {
+		t.Fatalf("Expected to be able to create database: %v", err)
+	}
+
+	updateOptions.database = createOptions.database
+	updateOptions.paths = []string{library}
+
+	err = update(nil, nil)
+	if err != nil {
+		t.Fatalf("Expected to be able to update database: %v", err)
+	}
+
+	// The database should be usable after the library has been moved, by overriding the recorded root
+	err = os.Rename(library, moved)
+	if err != nil {
+		t.Fatalf("Expected to be able to move library: %v", err)
+	}
+
+	transcodeOptions.database = createOptions.database
+	transcodeOptions.path = moved
+	transcodeOptions.outputDir = ""
+	transcodeOptions.root = moved
+	assumeYes(t)
+
+	defer func() { transcodeOptions.root = "" }()
+
+	transcodeFunc = func(_ context.Context, path, target string, _ utils.TranscodeOptions) error {
+		return ioutil.WriteFile(target, []byte(path), 0o755)
+	}
+
+	err = transcode(nil, nil)
+	if err != nil {
+		t.Fatalf("Expected to be able to transcode entries: %v", err)
+	}
+
+	if !utils.PathExists(filepath.Join(moved, "untranscoded1.mp4")) {
+		t.Fatalf("Expected the entry to have been transcoded within the moved library")
+	}
+
+	db, err := sql.Open("sqlite3", transcodeOptions.database)
+	if err != nil {
+		t.Fatalf("Expected to be able to open test database: %v", err)
+	}
+	defer db.Close()
+
+	var path string
+
+	err = sqlite.QueryRow(db, sqlite.Query{Query: "select path from library where transcoded is not null;"}, &path)
+	if err != nil || path != "untranscoded1.mp4" {
+		t.Fatalf("Expected the transcoded path to be stored relative to the library root but got '%s': %v", path, err)
+	}
+}
+
+func TestTranscodeToolsNotFound(t *testing.T) {
+	tempDir := t.TempDir()
+
+	transcodeOptions.database = filepath.Join(tempDir, "goamt.db")
+	transcodeOptions.path = tempDir
+	transcodeOptions.outputDir = ""
+	assumeYes(t)
+
+	defer func() { checkToolsFunc = func(_ ...string) error { return nil } }()
+
+	err := ioutil.WriteFile(filepath.Join(tempDir, "untranscoded1.mp4"), []byte("0"), 0o755)
+	if err != nil {
+		t.Fatalf("Expected to be able to create test file: %v", err)
+	}
+
+	createDatabaseAndPopulate(t, transcodeOptions.database, []value.Entry{
+		{Path: filepath.Join(tempDir, "untranscoded1.mp4"), Discovered: 8, Hash: 16},
+	})
+
+	checkToolsFunc = func(_ ...string) error { return &utils.ErrToolNotFound{Tool: "ffmpeg"} }
+
+	transcodeFunc = func(_ context.Context, _, _ string, _ utils.TranscodeOptions) error {
+		t.Fatalf("Expected no entries to be transcoded")
+		return nil
+	}
+
+	err = transcode(nil, nil)
+
+	var notFound *utils.ErrToolNotFound
+	if !errors.As(err, &notFound) {
+		t.Fatalf("Expected an 'ErrToolNotFound' but got '%#v'", err)
+	}
+
+	db, err := sql.Open("sqlite3", transcodeOptions.database)
+	if err != nil {
+		t.Fatalf("Expected to be able to open test database: %v", err)
+	}
+	defer db.Close()
+
+	var jobs int
+
+	err = sqlite.QueryRow(db, sqlite.Query{Query: "select count(*) from jobs;"}, &jobs)
+	if err != nil || jobs != 0 {
+		t.Fatalf("Expected no jobs to have been created but got %d: %v", jobs, err)
+	}
+
+	if !utils.PathExists(filepath.Join(tempDir, "untranscoded1.mp4")) {
+		t.Fatalf("Expected the source file to have been left intact")
+	}
+}
+
+func TestTranscodeFFmpegLogDir(t *testing.T) {
+	type test struct {
+		name   string
+		keep   bool
+		fail   bool
+		exists bool
+	}
+
+	tests := []test{
+		{
+			name: "SuccessRemoved",
+		},
+		{
+			name:   "SuccessKept",
+			keep:   true,
+			exists: true,
+		},
+		{
+			name:   "FailureKept",
+			fail:   true,
+			exists: true,
+		},
+	}
+
+	defer func() {
+		transcodeOptions.ffmpegLogDir = ""
+		transcodeOptions.keepFFmpegLogs = false
+	}()
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tempDir := t.TempDir()
+
+			transcodeOptions.database = filepath.Join(tempDir, "goamt.db")
+			transcodeOptions.path = tempDir
+			transcodeOptions.outputDir = ""
+			transcodeOptions.ffmpegLogDir = filepath.Join(tempDir, "logs")
+			transcodeOptions.keepFFmpegLogs = test.keep
+			assumeYes(t)
+
+			source := filepath.Join(tempDir, "untranscoded1.mkv")
+
+			err := ioutil.WriteFile(source, []byte("0"), 0o755)
+			if err != nil {
+				t.Fatalf("Expected to be able to create test file: %v", err)
+			}
+
+			createDatabaseAndPopulate(t, transcodeOptions.database, []value.Entry{
+				{Path: source, Discovered: 8, Hash: crc32.Checksum([]byte("0"), crc32.MakeTable(crc32.IEEE))},
+			})
+
+			transcodeFunc = func(_ context.Context, path, target string, options utils.TranscodeOptions) error {
+				if options.Log == nil {
+					return errors.New("expected a log to be provided")
+				}
+
+				fmt.Fprintf(options.Log, "output for '%s'\n", path)
+
+				if test.fail {
+					return errors.New("failed")
+				}
+
+				return ioutil.WriteFile(target, []byte(path), 0o755)
+			}
+
+			err = transcode(nil, nil)
+			if (err != nil) != test.fail {
+				t.Fatalf("Expected failure %t but got '%v'", test.fail, err)
+			}
+
+			data, err := ioutil.ReadFile(filepath.Join(transcodeOptions.ffmpegLogDir, "1-untranscoded1.mkv.log"))
+			if (err == nil) != test.exists {
+				t.Fatalf("Expected log file to exist %t but got '%v'", test.exists, err)
+			}
+
+			if test.exists && string(data) != fmt.Sprintf("output for '%s'\n", source) {
+				t.Fatalf("Unexpected log file contents '%s'", data)
+			}
+		})
+	}
+}
+
+func TestTranscodeRemux(t *testing.T) {
+	tempDir := t.TempDir()
+
+	transcodeOptions.database = filepath.Join(tempDir, "goamt.db")
+	transcodeOptions.path = tempDir
+	transcodeOptions.outputDir = ""
+	transcodeOptions.remux = true
+	assumeYes(t)
+
+	defer func() { transcodeOptions.remux, transcodeOptions.maxWidth = false, 0 }()
+
+	err := ioutil.WriteFile(filepath.Join(tempDir, "untranscoded1.mkv"), []byte("0"), 0o755)
+	if err != nil {
+		t.Fatalf("Expected to be able to create test file: %v", err)
+	}
+
+	createDatabaseAndPopulate(t, transcodeOptions.database, []value.Entry{
+		{Path: filepath.Join(tempDir, "untranscoded1.mkv"), Discovered: 8, Hash: 16},
+	})
+
+	transcodeFunc = func(_ context.Context, _, target string, options utils.TranscodeOptions) error {
+		if !options.Remux {
+			t.Fatalf("Expected the entry to be remuxed")
+		}
+
+		return ioutil.WriteFile(target, []byte("remuxed"), 0o755)
+	}
+
+	transcodeOptions.maxWidth = 1280
+
+	err = transcode(nil, nil)
+	if err == nil {
+		t.Fatalf("Expected an error when remuxing with maximum dimensions")
+	}
+
+	transcodeOptions.maxWidth = 0
+
+	err = transcode(nil, nil)
+	if err != nil {
+		t.Fatalf("Expected to be able to remux entries: %v", err)
+	}
+
+	assertDatabaseContains(t, transcodeOptions.database, []value.Entry{
+		{Path: filepath.Join(tempDir, "untranscoded1.mp4"), Discovered: 8, Transcoded: utils.Int64P(0)},
+	})
+}
+
+func TestTranscodeMinBitRate(t *testing.T) {
+	tempDir := t.TempDir()
+
+	transcodeOptions.database = filepath.Join(tempDir, "goamt.db")
+	transcodeOptions.path = tempDir
+	transcodeOptions.outputDir = ""
+	transcodeOptions.minBitRate = 2000
+	transcodeOptions.entries = 3
+	assumeYes(t)
+
+	defer func() {
+		transcodeOptions.minBitRate, bitRateFunc = 0, utils.ProbeBitRate
+		transcodeOptions.entries = runtime.NumCPU()
+	}()
+
+	initial := []value.Entry{
+		{Path: filepath.Join(tempDir, "low.avi"), Discovered: 8},
+		{Path: filepath.Join(tempDir, "high.avi"), Discovered: 16},
+		{Path: filepath.Join(tempDir, "unknown.avi"), Discovered: 32},
+	}
+
+	for index := range initial {
+		contents := []byte(strconv.Itoa(index))
+
+		initial[index].Hash = crc32.Checksum(contents, crc32.MakeTable(crc32.IEEE))
+
+		err := ioutil.WriteFile(initial[index].Path, contents, 0o755)
+		if err != nil {
+			t.Fatalf("Expected to be able to create test file: %v", err)
+		}
+	}
+
+	createDatabaseAndPopulate(t, transcodeOptions.database, initial)
+
+	bitRateFunc = func(_ context.Context, path string) (int64, error) {
+		switch filepath.Base(path) {
+		case "low.avi":
+			return 1500000, nil
+		case "high.avi":
+			return 8000000, nil
+		}
+
+		return 0, errors.New("bit rate not reported")
+	}
+
+	transcoded := make([]string, 0)
+
+	transcodeFunc = func(_ context.Context, path, target string, _ utils.TranscodeOptions) error {
+		transcoded = append(transcoded, filepath.Base(path))
+		return ioutil.WriteFile(target, []byte("transcoded "+path), 0o755)
+	}
+
+	err := transcode(nil, nil)
+	if err != nil {
+		t.Fatalf("Expected to be able to transcode entries: %v", err)
+	}
+
+	sort.Strings(transcoded)
+
+	if !reflect.DeepEqual(transcoded, []string{"high.avi", "unknown.avi"}) {
+		t.Fatalf("Expected only the sources above the minimum bit rate to be transcoded but got %v", transcoded)
+	}
+
+	if !utils.PathExists(filepath.Join(tempDir, "low.avi")) {
+		t.Fatalf("Expected the low bit rate source to be left untouched")
+	}
+
+	expected := []value.Entry{
+		{Path: filepath.Join(tempDir, "low.avi"), Discovered: 8, Transcoded: utils.Int64P(0)},
+		{Path: filepath.Join(tempDir, "high.mp4"), Discovered: 16, Transcoded: utils.Int64P(0)},
+		{Path: filepath.Join(tempDir, "unknown.mp4"), Discovered: 32, Transcoded: utils.Int64P(0)},
+	}
+
+	assertDatabaseContains(t, transcodeOptions.database, expected)
+}
+
+func TestTranscodeSkipMatchingCodec(t *testing.T) {
+	tempDir := t.TempDir()
+
+	transcodeOptions.database = filepath.Join(tempDir, "goamt.db")
+	transcodeOptions.path = tempDir
+	transcodeOptions.outputDir = ""
+	transcodeOptions.preset = "archive"
+	transcodeOptions.skipMatchingCodec = true
+	transcodeOptions.entries = 4
+	assumeYes(t)
+
+	defer func() {
+		transcodeOptions.preset, transcodeOptions.skipMatchingCodec, probeFunc = defaultPreset, false, utils.ProbeVideo
+		transcodeOptions.entries = runtime.NumCPU()
+	}()
+
+	initial := []value.Entry{
+		{Path: filepath.Join(tempDir, "recorded.mkv"), Discovered: 8, SourceCodec: utils.StringP(utils.VideoCodecH265)},
+		{Path: filepath.Join(tempDir, "probed.mkv"), Discovered: 16},
+		{Path: filepath.Join(tempDir, "h264.avi"), Discovered: 32},
+		{Path: filepath.Join(tempDir, "unknown.avi"), Discovered: 64},
+	}
+
+	for index := range initial {
+		contents := []byte(strconv.Itoa(index))
+
+		initial[index].Hash = crc32.Checksum(contents, crc32.MakeTable(crc32.IEEE))
+
+		err := ioutil.WriteFile(initial[index].Path, contents, 0o755)
+		if err != nil {
+			t.Fatalf("Expected to be able to create test file: %v", err)
+		}
+	}
+
+	createDatabaseAndPopulate(t, transcodeOptions.database, initial)
+
+	probed := make([]string, 0)
+
+	probeFunc = func(_ context.Context, path string) (utils.VideoInfo, error) {
+		probed = append(probed, filepath.Base(path))
+
+		switch filepath.Base(path) {
+		case "probed.mkv":
+			return utils.VideoInfo{Codec: utils.VideoCodecH265, Width: 1920, Height: 1080}, nil
+		case "h264.avi":
+			return utils.VideoInfo{Codec: utils.VideoCodecH264, Width: 1920, Height: 1080}, nil
+		}
+
+		return utils.VideoInfo{}, errors.New("no video stream")
+	}
+
+	transcoded := make([]string, 0)
+
+	transcodeFunc = func(_ context.Context, path, target string, _ utils.TranscodeOptions) error {
+		transcoded = append(transcoded, filepath.Base(path))
+		return ioutil.WriteFile(target, []byte("transcoded "+path), 0o755)
+	}
+
+	err := transcode(nil, nil)
+	if err != nil {
+		t.Fatalf("Expected to be able to transcode entries: %v", err)
+	}
+
+	sort.Strings(probed)
+
+	// The codec of the first entry was recorded by update, so it shouldn't be probed again
+	if !reflect.DeepEqual(probed, []string{"h264.avi", "probed.mkv", "unknown.avi"}) {
+		t.Fatalf("Expected only the entries with an unknown codec to be probed but got %v", probed)
+	}
+
+	sort.Strings(transcoded)
+
+	if !reflect.DeepEqual(transcoded, []string{"h264.avi", "unknown.avi"}) {
+		t.Fatalf("Expected only the sources which don't use the target codec to be transcoded but got %v", transcoded)
+	}
+
+	expected := []value.Entry{
+		{Path: filepath.Join(tempDir, "recorded.mkv"), Discovered: 8, Transcoded: utils.Int64P(0)},
+		{Path: filepath.Join(tempDir, "probed.mkv"), Discovered: 16, Transcoded: utils.Int64P(0)},
+		{Path: filepath.Join(tempDir, "h264.mp4"), Discovered: 32, Transcoded: utils.Int64P(0)},
+		{Path: filepath.Join(tempDir, "unknown.mp4"), Discovered: 64, Transcoded: utils.Int64P(0)},
+	}
+
+	assertDatabaseContains(t, transcodeOptions.database, expected)
+
+	db, err := database.OpenReadOnly(transcodeOptions.database)
+	if err != nil {
+		t.Fatalf("Expected to be able to open database: %v", err)
+	}
+	defer db.Close()
+
+	entry, err := db.FindByPath(filepath.Join(tempDir, "probed.mkv"))
+	if err != nil || entry.SourceCodec == nil || *entry.SourceCodec != utils.VideoCodecH265 {
+		t.Fatalf("Expected the probed codec to be recorded but got %+v: %v", entry, err)
+	}
+}
+
+func TestTranscodeSample(t *testing.T) {
+	tempDir := t.TempDir()
+
+	transcodeOptions.database = filepath.Join(tempDir, "goamt.db")
+	transcodeOptions.path = tempDir
+	transcodeOptions.outputDir = ""
+	transcodeOptions.sample = 150
+	assumeYes(t)
+
+	defer func() { transcodeOptions.sample = 0 }()
+
+	entries := make([]value.Entry, 0, 10)
+
+	for index := 0; index < 10; index++ {
+		path := filepath.Join(tempDir, fmt.Sprintf("untranscoded%d.mkv", index))
+
+		err := ioutil.WriteFile(path, []byte(strconv.Itoa(index)), 0o755)
+		if err != nil {
+			t.Fatalf("Expected to be able to create test file: %v", err)
+		}
+
+		entries = append(entries, value.Entry{Path: path, Discovered: 8, Hash: uint32(index + 1)})
+	}
+
+	createDatabaseAndPopulate(t, transcodeOptions.database, entries)
+
+	transcodeFunc = func(_ context.Context, _, target string, _ utils.TranscodeOptions) error {
+		return ioutil.WriteFile(target, []byte("transcoded"), 0o755)
+	}
+
+	err := transcode(nil, nil)
+	if err == nil {
+		t.Fatalf("Expected an error for a sample larger than 100%%")
+	}
+
+	// A sample of 15% of the ten entries is rounded up to two entries
+	transcodeOptions.sample = 15
+
+	err = transcode(nil, nil)
+	if err != nil {
+		t.Fatalf("Expected to be able to transcode entries: %v", err)
+	}
+
+	db, err := database.Open(transcodeOptions.database)
+	if err != nil {
+		t.Fatalf("Expected to be able to open database: %v", err)
+	}
+	defer db.Close()
+
+	info, err := db.Info()
+	if err != nil {
+		t.Fatalf("Expected to be able to get database info: %v", err)
+	}
+
+	if info.Transcoded != 2 || info.Untranscoded != 8 {
+		t.Fatalf("Expected 2 entries to have been transcoded but got %d (%d untranscoded)", info.Transcoded,
+			info.Untranscoded)
+	}
+
+	// An explicitly provided number of entries caps the sample
+	transcodeOptions.entries = 1
+	defer func() { transcodeOptions.entries = runtime.NumCPU() }()
+
+	size, err := sampleSize(db, database.SelectOptions{}, 100, true)
+	if err != nil {
+		t.Fatalf("Expected to be able to determine sample size: %v", err)
+	}
+
+	if size != 1 {
+		t.Fatalf("Expected the sample to be capped at 1 entry but got %d", size)
+	}
+}
+
+func TestTranscodeTargetBitRate(t *testing.T) {
+	tempDir := t.TempDir()
+
+	transcodeOptions.database = filepath.Join(tempDir, "goamt.db")
+	transcodeOptions.path = tempDir
+	transcodeOptions.outputDir = ""
+	transcodeOptions.targetBitRate = 2000
+	assumeYes(t)
+
+	defer func() { transcodeOptions.targetBitRate, transcodeOptions.remux = 0, false }()
+
+	err := ioutil.WriteFile(filepath.Join(tempDir, "untranscoded1.mkv"), []byte("0"), 0o755)
+	if err != nil {
+		t.Fatalf("Expected to be able to create test file: %v", err)
+	}
+
+	createDatabaseAndPopulate(t, transcodeOptions.database, []value.Entry{
+		{Path: filepath.Join(tempDir, "untranscoded1.mkv"), Discovered: 8, Hash: 16},
+	})
+
+	transcodeFunc = func(_ context.Context, _, target string, options utils.TranscodeOptions) error {
+		if options.TargetBitRate != 2000 {
+			t.Fatalf("Expected a target bit rate of 2000 but got %d", options.TargetBitRate)
+		}
+
+		return ioutil.WriteFile(target, []byte("transcoded"), 0o755)
+	}
+
+	transcodeOptions.remux = true
+
+	err = transcode(nil, nil)
+	if err == nil {
+		t.Fatalf("Expected an error when remuxing with a target bit rate")
+	}
+
+	transcodeOptions.remux = false
+
+	err = transcode(nil, nil)
+	if err != nil {
+		t.Fatalf("Expected to be able to transcode entries: %v", err)
+	}
+
+	assertDatabaseContains(t, transcodeOptions.database, []value.Entry{
+		{Path: filepath.Join(tempDir, "untranscoded1.mp4"), Discovered: 8, Transcoded: utils.Int64P(0)},
+	})
+}
+
+func TestThreadsValue(t *testing.T) {
+	type test struct {
+		name     string
+		value    string
+		expected int
+		err      bool
+	}
+
+	tests := []*test{
+		{
+			name:     "Number",
+			value:    "4",
+			expected: 4,
+		},
+		{
+			name:  "Zero",
+			value: "0",
+		},
+		{
+			name:  "AutoPhysical",
+			value: autoPhysical,
+		},
+		{
+			name:  "Negative",
+			value: "-1",
+			err:   true,
+		},
+		{
+			name:  "Invalid",
+			value: "auto",
+			err:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			threads := threadsValue(8)
+
+			err := threads.Set(test.value)
+			if test.err {
+				if err == nil {
+					t.Fatalf("Expected an error for '%s'", test.value)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Expected to be able to set threads: %v", err)
+			}
+
+			if int(threads) != test.expected {
+				t.Fatalf("Expected %d threads but got %d", test.expected, threads)
+			}
+		})
+	}
+}
+
+func TestPhysicalThreads(t *testing.T) {
+	defer func() { physicalCoresFunc = utils.PhysicalCores }()
+
+	physicalCoresFunc = func() (int, error) { return 6, nil }
+
+	if threads := physicalThreads(); threads != 6 {
+		t.Fatalf("Expected a thread for each physical core but got %d", threads)
+	}
+
+	physicalCoresFunc = func() (int, error) { return 0, errors.New("unknown topology") }
+
+	if threads := physicalThreads(); threads != runtime.NumCPU() {
+		t.Fatalf("Expected to fall back to the number of vCPUs but got %d", threads)
+	}
+}
+
+func TestHDROptions(t *testing.T) {
+	defer func() { colorFunc, transcodeOptions.hdr = utils.ProbeColor, hdrIgnore }()
+
+	hdr := utils.ColorInfo{
+		PixelFormat: utils.PixelFormat10Bit,
+		Primaries:   "bt2020",
+		Transfer:    "smpte2084",
+		Space:       "bt2020nc",
+	}
+
+	var probed bool
+
+	colorFunc = func(_ context.Context, path string) (utils.ColorInfo, error) {
+		probed = true
+
+		switch filepath.Base(path) {
+		case "hdr.mkv":
+			return hdr, nil
+		case "sdr.mkv":
+			return utils.ColorInfo{PixelFormat: utils.PixelFormat8Bit, Transfer: "bt709"}, nil
+		}
+
+		return utils.ColorInfo{}, errors.New("no video stream")
+	}
+
+	sdr := utils.ColorInfo{Primaries: "bt709", Transfer: "bt709", Space: "bt709"}
+
+	type test struct {
+		name            string
+		path, mode      string
+		remux           bool
+		expectedFormat  string
+		expectedColor   *utils.ColorInfo
+		expectedTonemap bool
+	}
+
+	tests := []test{
+		{name: "HDRIgnored", path: "/movies/hdr.mkv", mode: hdrIgnore, expectedFormat: utils.PixelFormat8Bit},
+		{
+			name:           "HDRPreserved",
+			path:           "/movies/hdr.mkv",
+			mode:           hdrPreserve,
+			expectedFormat: utils.PixelFormat10Bit,
+			expectedColor:  &hdr,
+		},
+		{
+			name:            "HDRTonemapped",
+			path:            "/movies/hdr.mkv",
+			mode:            hdrTonemap,
+			expectedFormat:  utils.PixelFormat8Bit,
+			expectedColor:   &sdr,
+			expectedTonemap: true,
+		},
+		{name: "SDRPreserved", path: "/movies/sdr.mkv", mode: hdrPreserve, expectedFormat: utils.PixelFormat8Bit},
+		{name: "SDRTonemapped", path: "/movies/sdr.mkv", mode: hdrTonemap, expectedFormat: utils.PixelFormat8Bit},
+		{name: "ProbeFailed", path: "/movies/unknown.mkv", mode: hdrPreserve, expectedFormat: utils.PixelFormat8Bit},
+		{
+			name:           "Remux",
+			path:           "/movies/hdr.mkv",
+			mode:           hdrIgnore,
+			remux:          true,
+			expectedFormat: utils.PixelFormat8Bit,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			transcodeOptions.hdr, probed = test.mode, false
+
+			options := utils.TranscodeOptions{PixelFormat: utils.PixelFormat8Bit, Remux: test.remux}
+
+			hdrOptions(context.Background(), value.Entry{Path: test.path}, &options)
+
+			// Ignoring HDR doesn't require any changes to the options, so the source shouldn't be probed
+			if expected := test.mode != hdrIgnore && !test.remux; probed != expected {
+				t.Fatalf("Expected the source to be probed: %t", expected)
+			}
+
+			if options.PixelFormat != test.expectedFormat {
+				t.Fatalf("Expected pixel format '%s' but got '%s'", test.expectedFormat, options.PixelFormat)
+			}
+
+			if !reflect.DeepEqual(options.Color, test.expectedColor) {
+				t.Fatalf("Expected color properties %+v but got %+v", test.expectedColor, options.Color)
+			}
+
+			if options.Tonemap != test.expectedTonemap {
+				t.Fatalf("Expected tone mapping to be %t", test.expectedTonemap)
+			}
+		})
+	}
+}
+
+func TestTranscodeAllEntries(t *testing.T) {
+	tempDir := t.TempDir()
+
+	transcodeOptions.database = filepath.Join(tempDir, "goamt.db")
+	transcodeOptions.path = tempDir
+	transcodeOptions.outputDir = ""
+	transcodeOptions.entries = 0
+	assumeYes(t)
+
+	defer func() { transcodeOptions.entries, transcodeOptions.spaceMultiplier = runtime.NumCPU(), 1 }()
+
+	initial := make([]value.Entry, 0, 8)
+
+	for index := 0; index < 8; index++ {
+		contents := []byte(strconv.Itoa(index))
+
+		entry := value.Entry{
+			Path:       filepath.Join(tempDir, fmt.Sprintf("untranscoded%d.mkv", index)),
+			Discovered: int64(index + 1),
+			Hash:       crc32.Checksum(contents, crc32.MakeTable(crc32.IEEE)),
+		}
+
+		err := ioutil.WriteFile(entry.Path, contents, 0o755)
+		if err != nil {
+			t.Fatalf("Expected to be able to create test file: %v", err)
+		}
+
+		initial = append(initial, entry)
+	}
+
+	createDatabaseAndPopulate(t, transcodeOptions.database, initial)
+
+	transcodeFunc = func(_ context.Context, path, _ string, _ utils.TranscodeOptions) error {
+		t.Fatalf("Expected not to transcode '%s' without sufficient space", path)
+		return nil
+	}
+
+	// Entries skipped due to insufficient space become selectable again, they mustn't be selected indefinitely
+	transcodeOptions.spaceMultiplier = math.MaxFloat64
+
+	err := transcode(nil, nil)
+	if err != nil {
+		t.Fatalf("Expected to be able to run transcode: %v", err)
+	}
+
+	assertDatabaseContains(t, transcodeOptions.database, initial)
+
+	transcodeOptions.spaceMultiplier = 1
+
+	transcoded := make([]string, 0, len(initial))
+
+	transcodeFunc = func(_ context.Context, path, target string, _ utils.TranscodeOptions) error {
+		transcoded = append(transcoded, filepath.Base(path))
+		return ioutil.WriteFile(target, []byte("transcoded "+path), 0o755)
+	}
+
+	err = transcode(nil, nil)
+	if err != nil {
+		t.Fatalf("Expected to be able to transcode entries: %v", err)
+	}
+
+	if len(transcoded) != len(initial) {
+		t.Fatalf("Expected every entry to be transcoded exactly once, got %v", transcoded)
+	}
+
+	expected := make([]value.Entry, 0, len(initial))
+	for index := range initial {
+		expected = append(expected, value.Entry{
+			Path:       filepath.Join(tempDir, fmt.Sprintf("untranscoded%d.mp4", index)),
+			Discovered: int64(index + 1),
+			Transcoded: utils.Int64P(0),
+		})
+	}
+
+	assertDatabaseContains(t, transcodeOptions.database, expected)
+
+	transcodeOptions.eta = true
+	defer func() { transcodeOptions.eta = false }()
+
+	err = transcode(nil, nil)
+	if err == nil {
+		t.Fatalf("Expected an error when estimating the time remaining whilst transcoding every entry")
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright 2020 James Lee <jamesl33info@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"path/filepath"
+
+	"github.com/jamesl33/goamt/database"
+
+	"github.com/apex/log"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+// unquarantineOptions - Encapsulates the options for the unquarantine sub-command.
+var unquarantineOptions = struct {
+	database, path string
+}{}
+
+// unquarantineCommand - The unquarantine sub-command, used to allow entries which were quarantined after repeatedly
+// failing to transcode to be selected again.
+var unquarantineCommand = &cobra.Command{
+	RunE:  unquarantine,
+	Short: "Reset the quarantine status of entries in the goamt database",
+	Use:   "unquarantine",
+}
+
+// init - Initialize the flags/arguments for the unquarantine sub-command.
+func init() {
+	unquarantineCommand.Flags().StringVarP(
+		&unquarantineOptions.database,
+		"database",
+		"d",
+		"",
+		"path to a goamt SQLite database",
+	)
+
+	unquarantineCommand.Flags().StringVarP(
+		&unquarantineOptions.path,
+		"path",
+		"p",
+		"",
+		"path to a media file (or a directory containing media files) as stored in the database, defaults to all entries",
+	)
+
+	markDatabaseRequired(unquarantineCommand)
+}
+
+// unquarantine - Run the unquarantine sub-command, this will reset the failure count and quarantine status of all the
+// entries which match the provided path.
+func unquarantine(_ *cobra.Command, _ []string) error {
+	db, err := database.Open(unquarantineOptions.database)
+	if err != nil {
+		return errors.Wrap(err, "failed to open SQLite database")
+	}
+
+	var prefix string
+	if unquarantineOptions.path != "" {
+		prefix = filepath.Clean(unquarantineOptions.path)
+	}
+
+	updated, err := db.ResetQuarantine(prefix)
+	if err != nil {
+		return errors.Wrap(err, "failed to reset quarantine status")
+	}
+
+	log.WithField("updated", updated).Info("Reset quarantine status")
+
+	err = db.Close()
+	if err != nil {
+		return errors.Wrap(err, "failed to close database")
+	}
+
+	return nil
+}
@@ -0,0 +1,84 @@
+// Copyright 2020 James Lee <jamesl33info@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/jamesl33/goamt/database"
+	"github.com/jamesl33/goamt/value"
+)
+
+func TestUnquarantine(t *testing.T) {
+	tempDir := t.TempDir()
+
+	unquarantineOptions.database = filepath.Join(tempDir, "goamt.db")
+	unquarantineOptions.path = "movies/"
+
+	initial := []value.Entry{
+		{Path: "tv/a.mp4", Discovered: 8, Hash: 16},
+		{Path: "movies/b.mp4", Discovered: 16, Hash: 32},
+	}
+
+	createDatabaseAndPopulate(t, unquarantineOptions.database, initial)
+
+	db, err := database.Open(unquarantineOptions.database)
+	if err != nil {
+		t.Fatalf("Expected to be able to open database: %v", err)
+	}
+
+	for range initial {
+		entry, err := db.BeginTranscoding(database.SelectOptions{})
+		if err != nil {
+			t.Fatalf("Expected to be able to begin transcoding: %v", err)
+		}
+
+		err = db.FailTranscoding(entry, true)
+		if err != nil {
+			t.Fatalf("Expected to be able to fail transcoding: %v", err)
+		}
+	}
+
+	err = db.Close()
+	if err != nil {
+		t.Fatalf("Expected to be able to close database: %v", err)
+	}
+
+	err = unquarantine(nil, nil)
+	if err != nil {
+		t.Fatalf("Expected to be able to reset quarantine status: %v", err)
+	}
+
+	db, err = database.Open(unquarantineOptions.database)
+	if err != nil {
+		t.Fatalf("Expected to be able to open database: %v", err)
+	}
+	defer db.Close()
+
+	entry, err := db.BeginTranscoding(database.SelectOptions{})
+	if err != nil {
+		t.Fatalf("Expected to be able to begin transcoding: %v", err)
+	}
+
+	if entry.Path != "movies/b.mp4" {
+		t.Fatalf("Expected only the matching entry to have been reset but got '%s'", entry.Path)
+	}
+
+	_, err = db.BeginTranscoding(database.SelectOptions{})
+	if err == nil {
+		t.Fatalf("Expected the remaining entry to still be quarantined")
+	}
+}
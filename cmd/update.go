@@ -15,24 +15,36 @@
 package cmd
 
 import (
+	"context"
+	"fmt"
 	"io"
 	"os"
-	"path/filepath"
 	"runtime"
-	"strings"
 	"time"
 
 	"github.com/jamesl33/goamt/database"
 	"github.com/jamesl33/goamt/utils"
 	"github.com/jamesl33/goamt/value"
+
+	"github.com/apex/log"
 	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
 )
 
 // updateOptions - Encapsulates the options for the update sub-command.
 var updateOptions = struct {
-	database, path string
-	threads        int
+	database, summaryFile string
+	hashAlgorithm, root   string
+	paths                 []string
+	include, exclude      []string
+	threads, hashWorkers  int
+	ioLimit               int64
+	settleTime            time.Duration
+	minDuration           time.Duration
+	sorted, probeOnly     bool
+	dryRun, summary       bool
+	fastImport, mmap      bool
+	progress              bool
 }{}
 
 // updateCommand - The update sub-command, used to update the goamt SQLite database by walking the provided path and
@@ -53,12 +65,28 @@ func init() {
 		"path to a goamt SQLite database",
 	)
 
-	updateCommand.Flags().StringVarP(
-		&updateOptions.path,
+	updateCommand.Flags().StringArrayVarP(
+		&updateOptions.paths,
 		"path",
 		"p",
-		"",
-		"path to a media library",
+		nil,
+		"path to a media library, may be provided multiple times",
+	)
+
+	updateCommand.Flags().StringArrayVar(
+		&updateOptions.include,
+		"include",
+		nil,
+		"only queue media files whose path (relative to the media library) matches this glob, may be provided multiple "+
+			"times",
+	)
+
+	updateCommand.Flags().StringArrayVar(
+		&updateOptions.exclude,
+		"exclude",
+		nil,
+		"skip media files whose path (relative to the media library) matches this glob, applied after '--include'; may "+
+			"be provided multiple times",
 	)
 
 	updateCommand.Flags().IntVarP(
@@ -69,61 +97,248 @@ func init() {
 		"the number of threads to use, defaults to the number of vCPUs",
 	)
 
-	markFlagRequired(updateCommand, "database")
+	updateCommand.Flags().IntVar(
+		&updateOptions.hashWorkers,
+		"hash-workers",
+		0,
+		"hash files using this many workers, upserting them into the database from a single writer; by default each "+
+			"of the '--threads' workers hashes and upserts its own files",
+	)
+
+	updateCommand.Flags().Int64Var(
+		&updateOptions.ioLimit,
+		"io-limit",
+		0,
+		"limit the rate (in bytes per second) at which files are read when hashing, defaults to unlimited",
+	)
+
+	updateCommand.Flags().BoolVar(
+		&updateOptions.mmap,
+		"mmap",
+		false,
+		"hash files using a read-only memory mapping rather than reading them (Linux only), which may be faster for very "+
+			"large files",
+	)
+
+	updateCommand.Flags().BoolVar(
+		&updateOptions.sorted,
+		"sorted",
+		false,
+		"assign strictly increasing discovered timestamps in path order, making the transcode order deterministic",
+	)
+
+	updateCommand.Flags().BoolVar(
+		&updateOptions.probeOnly,
+		"probe-only",
+		false,
+		"record media files without hashing them, allowing a large library to be inventoried quickly; they won't be "+
+			"transcoded until a later update has hashed them",
+	)
+
+	updateCommand.Flags().BoolVar(
+		&updateOptions.dryRun,
+		"dry-run",
+		false,
+		"list the media files which would be queued without hashing them or opening the database",
+	)
+
+	updateCommand.Flags().DurationVar(
+		&updateOptions.settleTime,
+		"settle-time",
+		0,
+		"skip files modified within this duration (e.g. '10m'), since they may still be being written",
+	)
+
+	updateCommand.Flags().DurationVar(
+		&updateOptions.minDuration,
+		"min-duration",
+		0,
+		"skip media files shorter than this duration (e.g. '5m' to skip trailers/samples), determined using ffprobe",
+	)
+
+	updateCommand.Flags().StringVar(
+		&updateOptions.root,
+		"root",
+		"",
+		"resolve the relative paths in the database against this directory instead of the recorded library root",
+	)
+
+	updateCommand.Flags().StringVar(
+		&updateOptions.hashAlgorithm,
+		"hash-algorithm",
+		"",
+		"fail unless the database was hashed using this algorithm, defaults to using whichever the database was hashed with",
+	)
+
+	updateCommand.Flags().StringVar(
+		&updateOptions.summaryFile,
+		"summary-file",
+		"",
+		"write a JSON summary of the run to this path, even if the run fails",
+	)
+
+	updateCommand.Flags().BoolVar(
+		&updateOptions.summary,
+		"summary",
+		false,
+		"print the number of entries which were inserted, updated and skipped once complete",
+	)
+
+	updateCommand.Flags().BoolVar(
+		&updateOptions.fastImport,
+		"fast-import",
+		false,
+		"disable syncing database writes to disk, speeding up a bulk import at the cost of durability; a power loss or "+
+			"crash during the import may corrupt the database",
+	)
+
+	updateCommand.Flags().BoolVar(
+		&updateOptions.progress,
+		"progress",
+		false,
+		"display the number of files scanned so far, progress is periodically logged instead when standard error isn't "+
+			"a terminal",
+	)
+
+	markDatabaseRequired(updateCommand)
 	markFlagRequired(updateCommand, "path")
 }
 
 // update - Run the update sub-command, this will walk the provided path hashing and inserting media files as
 // untranscoded entries in the provided goamt SQLite database.
 func update(_ *cobra.Command, _ []string) error {
+	summary := newRunSummary("update")
+	return summary.complete(updateOptions.summaryFile, runUpdate(summary))
+}
+
+// queueMediaLibraries - Queue the media files from each of the provided media libraries, returning the number which
+// couldn't be walked. A failure to walk one library doesn't prevent the others from being updated, however, a failure
+// in the worker pool is returned immediately.
+func queueMediaLibraries(ctx context.Context, pool *Pool, entryStream chan<- value.Entry,
+	errorStream <-chan error) (int, error) {
+	var (
+		clock  = newDiscoveredClock(updateOptions.sorted)
+		filter = pathFilter{include: updateOptions.include, exclude: updateOptions.exclude}
+		failed int
+	)
+
+	for _, root := range updateOptions.paths {
+		if ctx.Err() != nil {
+			break
+		}
+
+		err := queueMediaFiles(ctx, entryStream, errorStream, root, clock, updateOptions.settleTime, filter)
+		if err == nil {
+			continue
+		}
+
+		if pool.Metrics().Failed != 0 {
+			return failed, err
+		}
+
+		log.WithError(err).WithField("path", root).Error("Failed to walk media library")
+
+		failed++
+	}
+
+	return failed, nil
+}
+
+// runUpdate - Run the update sub-command, recording metrics in the provided summary.
+func runUpdate(summary *runSummary) error {
+	err := pathFilter{include: updateOptions.include, exclude: updateOptions.exclude}.validate()
+	if err != nil {
+		return err // Purposefully not wrapped
+	}
+
+	// Files aren't probed until they've been hashed, so their duration isn't known when only inventorying them
+	if updateOptions.minDuration != 0 && updateOptions.probeOnly {
+		return errors.New("a minimum duration can't be used when only probing")
+	}
+
 	ctx := signalHandler()
 
-	db, err := database.Open(updateOptions.database)
+	if updateOptions.dryRun {
+		return runUpdateDryRun(ctx, summary, os.Stdout)
+	}
+
+	db, err := database.OpenWithOptions(updateOptions.database, databaseOptions(updateOptions.fastImport))
 	if err != nil {
 		return errors.Wrap(err, "failed to open SQLite database")
 	}
 
-	var (
-		pool                     = NewUpdatePool(db)
-		entryStream, errorStream = pool.Start(ctx, updateOptions.threads)
-	)
+	summary.database = updateOptions.database
 
-	err = filepath.Walk(updateOptions.path, func(path string, _ os.FileInfo, err error) error {
-		if err != nil ||
-			strings.HasSuffix(path, value.TranscodingExtension) ||
-			!utils.ContainsString(value.SupportedExtensions, filepath.Ext(path)) {
-			return err
+	if updateOptions.root != "" {
+		err = db.OverrideRoot(updateOptions.root)
+		if err != nil {
+			return errors.Wrap(err, "failed to override library root")
 		}
+	}
 
-		if len(errorStream) != 0 {
-			return <-errorStream
-		}
+	err = db.Recover()
+	if err != nil {
+		return errors.Wrap(err, "failed to recover incomplete jobs")
+	}
 
-		queued, err := queueEntry(
-			ctx,
-			entryStream,
-			errorStream,
-			value.Entry{Path: path, Discovered: time.Now().Unix()},
-		)
+	if updateOptions.hashAlgorithm != "" {
+		err = db.VerifyHashAlgorithm(utils.HashAlgorithm(updateOptions.hashAlgorithm))
 		if err != nil {
-			return errors.Wrap(err, "failed to queue entry")
+			return err // Purposefully not wrapped
 		}
+	}
 
-		if !queued {
-			return io.EOF
-		}
+	options := utils.HashOptions{Algorithm: db.HashAlgorithm(), MemoryMap: updateOptions.mmap}
+	if updateOptions.ioLimit > 0 {
+		options.Limiter = utils.NewRateLimiter(updateOptions.ioLimit)
+	}
 
-		return nil
-	})
-	if err != nil && err != io.EOF {
-		return errors.Wrap(err, "unexpected error during file walk")
+	var outcomes upsertOutcomes
+
+	var (
+		pool    = NewUpdatePool(db, options, &outcomes)
+		threads = updateOptions.threads
+	)
+
+	switch {
+	case updateOptions.probeOnly:
+		pool = NewProbeOnlyPool(db, &outcomes)
+	case updateOptions.hashWorkers > 0:
+		pool, threads = NewPipelinedUpdatePool(db, options, &outcomes), updateOptions.hashWorkers
+	}
+
+	// The number of files isn't known until the media libraries have been walked, so only the number scanned is shown
+	pool.progress = startProgressBar(updateOptions.progress, "Files scanned", 0)
+	defer pool.progress.stop()
+
+	entryStream, errorStream := pool.Start(ctx, threads)
+
+	summary.pool = pool
+
+	failed, err := queueMediaLibraries(ctx, pool, entryStream, errorStream)
+	if err != nil {
+		return pool.failure(err) // Purposefully not wrapped
 	}
 
 	err = pool.Stop()
+
+	pool.progress.stop()
+
 	if err != nil {
 		return errors.Wrap(err, "failed to stop worker pool")
 	}
 
+	if updateOptions.summary {
+		err = outcomes.write(os.Stdout)
+		if err != nil {
+			return errors.Wrap(err, "failed to write summary")
+		}
+	}
+
+	if failed != 0 {
+		return fmt.Errorf("failed to walk %d of %d media libraries", failed, len(updateOptions.paths))
+	}
+
 	err = db.Close()
 	if err != nil {
 		return errors.Wrap(err, "failed to close database")
@@ -131,3 +346,35 @@ func update(_ *cobra.Command, _ []string) error {
 
 	return nil
 }
+
+// runUpdateDryRun - Walk the media libraries writing the path of each media file which would be queued to the provided
+// writer, followed by the number of files. Files aren't hashed and the database isn't opened.
+func runUpdateDryRun(ctx context.Context, summary *runSummary, writer io.Writer) error {
+	var (
+		pool                     = NewListPool(writer)
+		entryStream, errorStream = pool.Start(ctx, 1) // A single worker lists the files in walk order
+	)
+
+	summary.pool = pool
+
+	failed, err := queueMediaLibraries(ctx, pool, entryStream, errorStream)
+	if err != nil {
+		return pool.failure(err) // Purposefully not wrapped
+	}
+
+	err = pool.Stop()
+	if err != nil {
+		return errors.Wrap(err, "failed to stop worker pool")
+	}
+
+	_, err = fmt.Fprintf(writer, "%d file(s) would be queued\n", pool.Metrics().Processed)
+	if err != nil {
+		return errors.Wrap(err, "failed to write file count")
+	}
+
+	if failed != 0 {
+		return fmt.Errorf("failed to walk %d of %d media libraries", failed, len(updateOptions.paths))
+	}
+
+	return nil
+}
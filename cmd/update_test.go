@@ -15,16 +15,26 @@
 package cmd
 
 import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
 	"hash/crc32"
 	"io/ioutil"
+	"os"
 	"path/filepath"
+	"reflect"
+	"runtime"
 	"strconv"
 	"testing"
+	"time"
 
 	"github.com/jamesl33/goamt/database"
 	"github.com/jamesl33/goamt/utils"
+	"github.com/jamesl33/goamt/utils/sqlite"
 	"github.com/jamesl33/goamt/value"
 
+	"github.com/apex/log"
 	"github.com/pkg/errors"
 )
 
@@ -32,7 +42,7 @@ func TestUpdateDatabaseNotFound(t *testing.T) {
 	tempDir := t.TempDir()
 
 	updateOptions.database = filepath.Join(tempDir, "goamt.db")
-	updateOptions.path = tempDir
+	updateOptions.paths = []string{tempDir}
 
 	err := update(nil, nil)
 
@@ -46,7 +56,7 @@ func TestUpdate(t *testing.T) {
 	tempDir := t.TempDir()
 
 	updateOptions.database = filepath.Join(tempDir, "goamt.db")
-	updateOptions.path = tempDir
+	updateOptions.paths = []string{tempDir}
 
 	expected := []value.Entry{
 		{
@@ -88,3 +98,738 @@ func TestUpdate(t *testing.T) {
 
 	assertDatabaseContains(t, updateOptions.database, expected)
 }
+
+func TestUpdateHashAlgorithm(t *testing.T) {
+	tempDir := t.TempDir()
+
+	updateOptions.database = filepath.Join(tempDir, "goamt.db")
+	updateOptions.paths = []string{tempDir}
+
+	contents := []byte("0")
+	path := filepath.Join(tempDir, "untranscoded1.mp4")
+
+	err := ioutil.WriteFile(path, contents, 0o755)
+	if err != nil {
+		t.Fatalf("Expected to be able to create test file: %v", err)
+	}
+
+	db, err := database.Create(updateOptions.database)
+	if err != nil {
+		t.Fatalf("Expected to be able to create database: %v", err)
+	}
+
+	err = db.SetHashAlgorithm(utils.HashAlgorithmCastagnoli)
+	if err != nil {
+		t.Fatalf("Expected to be able to set hash algorithm: %v", err)
+	}
+
+	db.Close()
+
+	err = update(nil, nil)
+	if err != nil {
+		t.Fatalf("Expected to be able to update database: %v", err)
+	}
+
+	db, err = database.OpenReadOnly(updateOptions.database)
+	if err != nil {
+		t.Fatalf("Expected to be able to open database: %v", err)
+	}
+	defer db.Close()
+
+	entry, err := db.FindByHash(crc32.Checksum(contents, crc32.MakeTable(crc32.Castagnoli)))
+	if err != nil {
+		t.Fatalf("Expected file to have been hashed using the Castagnoli polynomial: %v", err)
+	}
+
+	if entry.Path != path {
+		t.Fatalf("Expected entry for '%s' but got '%s'", path, entry.Path)
+	}
+}
+
+func TestUpdateHashAlgorithmMismatch(t *testing.T) {
+	tempDir := t.TempDir()
+
+	updateOptions.database = filepath.Join(tempDir, "goamt.db")
+	updateOptions.paths = []string{tempDir}
+	updateOptions.hashAlgorithm = string(utils.HashAlgorithmCastagnoli)
+
+	defer func() { updateOptions.hashAlgorithm = "" }()
+
+	createDatabaseAndPopulate(t, updateOptions.database, nil)
+
+	err := update(nil, nil)
+
+	var mismatch *database.ErrHashAlgorithmMismatch
+	if !errors.As(err, &mismatch) {
+		t.Fatalf("Expected an 'ErrHashAlgorithmMismatch' but got '%#v'", err)
+	}
+}
+
+func TestUpdateSummaryFile(t *testing.T) {
+	tempDir := t.TempDir()
+
+	updateOptions.database = filepath.Join(tempDir, "goamt.db")
+	updateOptions.paths = []string{tempDir}
+	updateOptions.summaryFile = filepath.Join(tempDir, "summary.json")
+
+	defer func() { updateOptions.summaryFile = "" }()
+
+	err := ioutil.WriteFile(filepath.Join(tempDir, "untranscoded1.mp4"), []byte("0"), 0o755)
+	if err != nil {
+		t.Fatalf("Expected to be able to create test file: %v", err)
+	}
+
+	createDatabaseAndPopulate(t, updateOptions.database, nil)
+
+	err = update(nil, nil)
+	if err != nil {
+		t.Fatalf("Expected to be able to update database: %v", err)
+	}
+
+	summary := readSummary(t, updateOptions.summaryFile)
+
+	if summary.Command != "update" || !summary.Success || summary.Processed != 1 || summary.Failed != 0 {
+		t.Fatalf("Summary contained unexpected values: %+v", summary)
+	}
+}
+
+func TestUpdateSummaryFileOnError(t *testing.T) {
+	tempDir := t.TempDir()
+
+	updateOptions.database = filepath.Join(tempDir, "goamt.db")
+	updateOptions.paths = []string{tempDir}
+	updateOptions.summaryFile = filepath.Join(tempDir, "summary.json")
+
+	defer func() { updateOptions.summaryFile = "" }()
+
+	err := update(nil, nil)
+	if err == nil {
+		t.Fatalf("Expected an error when the database doesn't exist")
+	}
+
+	summary := readSummary(t, updateOptions.summaryFile)
+
+	if summary.Success || summary.Error == "" {
+		t.Fatalf("Expected the summary to contain the error: %+v", summary)
+	}
+}
+
+func TestUpdateProbe(t *testing.T) {
+	tempDir := t.TempDir()
+
+	updateOptions.database = filepath.Join(tempDir, "goamt.db")
+	updateOptions.paths = []string{tempDir}
+
+	probed := make(chan string, 2)
+
+	probeFunc = func(_ context.Context, path string) (utils.VideoInfo, error) {
+		probed <- path
+		return utils.VideoInfo{Codec: "mpeg4", Width: 720, Height: 480, Duration: 1325.48}, nil
+	}
+
+	defer func() { probeFunc = utils.ProbeVideo }()
+
+	var (
+		transcoded   = filepath.Join(tempDir, "transcoded.mp4")
+		untranscoded = filepath.Join(tempDir, "untranscoded.avi")
+	)
+
+	for index, path := range []string{transcoded, untranscoded} {
+		err := ioutil.WriteFile(path, []byte(strconv.Itoa(index)), 0o755)
+		if err != nil {
+			t.Fatalf("Expected to be able to create test file: %v", err)
+		}
+	}
+
+	createDatabaseAndPopulate(t, updateOptions.database, []value.Entry{
+		{
+			Path:       transcoded,
+			Discovered: 8,
+			Transcoded: utils.Int64P(16),
+			Hash:       crc32.Checksum([]byte("0"), crc32.MakeTable(crc32.IEEE)),
+		},
+	})
+
+	// Updating a second time shouldn't re-probe the entry which has already been probed
+	for run := 0; run < 2; run++ {
+		err := update(nil, nil)
+		if err != nil {
+			t.Fatalf("Expected to be able to update database: %v", err)
+		}
+	}
+
+	close(probed)
+
+	paths := make([]string, 0)
+	for path := range probed {
+		paths = append(paths, path)
+	}
+
+	if !reflect.DeepEqual(paths, []string{untranscoded}) {
+		t.Fatalf("Expected only %s to be probed, got %v", untranscoded, paths)
+	}
+
+	db, err := database.Open(updateOptions.database)
+	if err != nil {
+		t.Fatalf("Expected to be able to open database: %v", err)
+	}
+	defer db.Close()
+
+	entry, err := db.FindByHash(crc32.Checksum([]byte("1"), crc32.MakeTable(crc32.IEEE)))
+	if err != nil {
+		t.Fatalf("Expected to be able to find entry: %v", err)
+	}
+
+	if entry.SourceCodec == nil || *entry.SourceCodec != "mpeg4" || *entry.SourceWidth != 720 ||
+		*entry.SourceHeight != 480 {
+		t.Fatalf("Expected the source codec/dimensions to be recorded, got %+v", entry.Fields())
+	}
+
+	if entry.Duration == nil || *entry.Duration != 1325.48 {
+		t.Fatalf("Expected the duration to be recorded, got %+v", entry.Fields())
+	}
+
+	entry, err = db.FindByHash(crc32.Checksum([]byte("0"), crc32.MakeTable(crc32.IEEE)))
+	if err != nil {
+		t.Fatalf("Expected to be able to find entry: %v", err)
+	}
+
+	if entry.SourceCodec != nil {
+		t.Fatalf("Expected the source codec of a transcoded entry to be unknown")
+	}
+}
+
+func TestUpdateMultiplePaths(t *testing.T) {
+	var (
+		tempDir = t.TempDir()
+		movies  = t.TempDir()
+		tv      = t.TempDir()
+	)
+
+	updateOptions.database = filepath.Join(tempDir, "goamt.db")
+	updateOptions.paths = []string{movies, filepath.Join(tempDir, "missing"), tv}
+
+	expected := []value.Entry{{Path: filepath.Join(movies, "movie.mkv")}, {Path: filepath.Join(tv, "episode.mkv")}}
+
+	for index, entry := range expected {
+		err := ioutil.WriteFile(entry.Path, []byte(strconv.Itoa(index)), 0o755)
+		if err != nil {
+			t.Fatalf("Expected to be able to create test file: %v", err)
+		}
+	}
+
+	createDatabaseAndPopulate(t, updateOptions.database, nil)
+
+	// The missing media library shouldn't prevent the others from being updated, but should still be reported
+	err := update(nil, nil)
+	if err == nil || err.Error() != "failed to walk 1 of 3 media libraries" {
+		t.Fatalf("Expected an error for the missing media library but got %v", err)
+	}
+
+	assertDatabaseContains(t, updateOptions.database, expected)
+}
+
+func TestUpdateMixedCaseExtensions(t *testing.T) {
+	tempDir := t.TempDir()
+
+	updateOptions.database = filepath.Join(tempDir, "goamt.db")
+	updateOptions.paths = []string{tempDir}
+
+	expected := []value.Entry{
+		{Path: filepath.Join(tempDir, "movie.MP4")},
+		{Path: filepath.Join(tempDir, "episode.Mkv")},
+		{Path: filepath.Join(tempDir, "home.AVI")},
+	}
+
+	for index := range expected {
+		contents := []byte(strconv.Itoa(index))
+
+		expected[index].Hash = crc32.Checksum(contents, crc32.MakeTable(crc32.IEEE))
+
+		err := ioutil.WriteFile(expected[index].Path, contents, 0o755)
+		if err != nil {
+			t.Fatalf("Expected to be able to create test file: %v", err)
+		}
+	}
+
+	// Files which are being transcoded/aren't media files should still be ignored regardless of case
+	for _, name := range []string{"movie.TRANSCODING.MP4", "notes.TXT"} {
+		err := ioutil.WriteFile(filepath.Join(tempDir, name), []byte(name), 0o755)
+		if err != nil {
+			t.Fatalf("Expected to be able to create test file: %v", err)
+		}
+	}
+
+	createDatabaseAndPopulate(t, updateOptions.database, nil)
+
+	err := update(nil, nil)
+	if err != nil {
+		t.Fatalf("Expected to be able to update database: %v", err)
+	}
+
+	assertDatabaseContains(t, updateOptions.database, expected)
+}
+
+func TestUpdateProbeOnly(t *testing.T) {
+	tempDir := t.TempDir()
+
+	updateOptions.database = filepath.Join(tempDir, "goamt.db")
+	updateOptions.paths = []string{tempDir}
+	updateOptions.probeOnly = true
+
+	defer func() { updateOptions.probeOnly = false }()
+
+	expected := []value.Entry{{Path: filepath.Join(tempDir, "test.mp4")}}
+
+	contents := []byte("test")
+
+	err := ioutil.WriteFile(expected[0].Path, contents, 0o755)
+	if err != nil {
+		t.Fatalf("Expected to be able to create test file: %v", err)
+	}
+
+	createDatabaseAndPopulate(t, updateOptions.database, nil)
+
+	err = update(nil, nil)
+	if err != nil {
+		t.Fatalf("Expected to be able to update database: %v", err)
+	}
+
+	db, err := sql.Open("sqlite3", updateOptions.database)
+	if err != nil {
+		t.Fatalf("Expected to be able to open database: %v", err)
+	}
+	defer db.Close()
+
+	var count int
+
+	err = db.QueryRow("select count(*) from library where hash is null;").Scan(&count)
+	if err != nil {
+		t.Fatalf("Expected to be able to query database: %v", err)
+	}
+
+	if count != 1 {
+		t.Fatalf("Expected 1 unhashed entry but got %d", count)
+	}
+
+	// A full update should hash the entry
+	updateOptions.probeOnly = false
+
+	err = update(nil, nil)
+	if err != nil {
+		t.Fatalf("Expected to be able to update database: %v", err)
+	}
+
+	expected[0].Hash = crc32.Checksum(contents, crc32.MakeTable(crc32.IEEE))
+
+	assertDatabaseContains(t, updateOptions.database, expected)
+}
+
+func TestUpdateHashWorkers(t *testing.T) {
+	tempDir := t.TempDir()
+
+	updateOptions.database = filepath.Join(tempDir, "goamt.db")
+	updateOptions.paths = []string{tempDir}
+	updateOptions.hashWorkers = 2
+
+	defer func() { updateOptions.hashWorkers = 0 }()
+
+	expected := make([]value.Entry, 0, 8)
+
+	for i := 0; i < 8; i++ {
+		contents := []byte(strconv.Itoa(i))
+
+		entry := value.Entry{
+			Path: filepath.Join(tempDir, fmt.Sprintf("test%d.mp4", i)),
+			Hash: crc32.Checksum(contents, crc32.MakeTable(crc32.IEEE)),
+		}
+
+		err := ioutil.WriteFile(entry.Path, contents, 0o755)
+		if err != nil {
+			t.Fatalf("Expected to be able to create test file: %v", err)
+		}
+
+		expected = append(expected, entry)
+	}
+
+	createDatabaseAndPopulate(t, updateOptions.database, nil)
+
+	err := update(nil, nil)
+	if err != nil {
+		t.Fatalf("Expected to be able to update database: %v", err)
+	}
+
+	assertDatabaseContains(t, updateOptions.database, expected)
+}
+
+func TestUpdateSettleTime(t *testing.T) {
+	tempDir := t.TempDir()
+
+	updateOptions.database = filepath.Join(tempDir, "goamt.db")
+	updateOptions.paths = []string{tempDir}
+	updateOptions.settleTime = time.Hour
+
+	defer func() { updateOptions.settleTime = 0 }()
+
+	var (
+		contents = []byte("test")
+		settled  = filepath.Join(tempDir, "settled.mp4")
+		writing  = filepath.Join(tempDir, "writing.mp4")
+	)
+
+	for _, path := range []string{settled, writing} {
+		err := ioutil.WriteFile(path, contents, 0o755)
+		if err != nil {
+			t.Fatalf("Expected to be able to create test file: %v", err)
+		}
+	}
+
+	old := time.Now().Add(-2 * time.Hour)
+
+	err := os.Chtimes(settled, old, old)
+	if err != nil {
+		t.Fatalf("Expected to be able to set modification time: %v", err)
+	}
+
+	createDatabaseAndPopulate(t, updateOptions.database, nil)
+
+	err = update(nil, nil)
+	if err != nil {
+		t.Fatalf("Expected to be able to update database: %v", err)
+	}
+
+	// The file which was written just before the walk should be skipped
+	expected := []value.Entry{{Path: settled, Hash: crc32.Checksum(contents, crc32.MakeTable(crc32.IEEE))}}
+
+	assertDatabaseContains(t, updateOptions.database, expected)
+}
+
+func TestUpdateMinDuration(t *testing.T) {
+	durations := map[string]float64{"trailer.mp4": 90, "movie.mp4": 6000}
+
+	probeFunc = func(_ context.Context, path string) (utils.VideoInfo, error) {
+		duration, ok := durations[filepath.Base(path)]
+		if !ok {
+			return utils.VideoInfo{}, errors.New("failed to probe")
+		}
+
+		return utils.VideoInfo{Codec: "mpeg4", Width: 720, Height: 480, Duration: duration}, nil
+	}
+
+	defer func() { probeFunc = utils.ProbeVideo }()
+
+	updateOptions.minDuration = 5 * time.Minute
+
+	defer func() { updateOptions.minDuration = 0 }()
+
+	// Skipped regardless of whether the files are hashed by the workers or handed off to a single writer
+	for _, hashWorkers := range []int{0, 2} {
+		tempDir := t.TempDir()
+
+		updateOptions.database = filepath.Join(tempDir, "goamt.db")
+		updateOptions.paths = []string{tempDir}
+		updateOptions.hashWorkers = hashWorkers
+
+		expected := make([]value.Entry, 0, 2)
+
+		for index, name := range []string{"trailer.mp4", "movie.mp4", "unknown.mp4"} {
+			var (
+				path     = filepath.Join(tempDir, name)
+				contents = []byte(strconv.Itoa(index))
+			)
+
+			err := ioutil.WriteFile(path, contents, 0o755)
+			if err != nil {
+				t.Fatalf("Expected to be able to create test file: %v", err)
+			}
+
+			// Files whose duration can't be determined are still recorded
+			if name != "trailer.mp4" {
+				expected = append(expected, value.Entry{
+					Path: path,
+					Hash: crc32.Checksum(contents, crc32.MakeTable(crc32.IEEE)),
+				})
+			}
+		}
+
+		createDatabaseAndPopulate(t, updateOptions.database, nil)
+
+		err := update(nil, nil)
+		if err != nil {
+			t.Fatalf("Expected to be able to update database: %v", err)
+		}
+
+		assertDatabaseContains(t, updateOptions.database, expected)
+	}
+
+	updateOptions.hashWorkers = 0
+	updateOptions.probeOnly = true
+
+	defer func() { updateOptions.probeOnly = false }()
+
+	err := update(nil, nil)
+	if err == nil || err.Error() != "a minimum duration can't be used when only probing" {
+		t.Fatalf("Expected an error when using a minimum duration with --probe-only, got %v", err)
+	}
+}
+
+func TestUpdateFastImport(t *testing.T) {
+	tempDir := t.TempDir()
+
+	updateOptions.database = filepath.Join(tempDir, "goamt.db")
+	updateOptions.paths = []string{tempDir}
+	updateOptions.fastImport = true
+
+	defer func() { updateOptions.fastImport = false }()
+
+	var (
+		contents = []byte("test")
+		path     = filepath.Join(tempDir, "test.mp4")
+	)
+
+	err := ioutil.WriteFile(path, contents, 0o755)
+	if err != nil {
+		t.Fatalf("Expected to be able to create test file: %v", err)
+	}
+
+	createDatabaseAndPopulate(t, updateOptions.database, nil)
+
+	err = update(nil, nil)
+	if err != nil {
+		t.Fatalf("Expected to be able to update database: %v", err)
+	}
+
+	expected := []value.Entry{{Path: path, Hash: crc32.Checksum(contents, crc32.MakeTable(crc32.IEEE))}}
+
+	assertDatabaseContains(t, updateOptions.database, expected)
+}
+
+func TestUpdateIncludeExclude(t *testing.T) {
+	tempDir := t.TempDir()
+
+	updateOptions.database = filepath.Join(tempDir, "goamt.db")
+	updateOptions.paths = []string{tempDir}
+	updateOptions.include = []string{"tv", "*.mp4"}
+	updateOptions.exclude = []string{"extras"}
+
+	defer func() {
+		updateOptions.include = nil
+		updateOptions.exclude = nil
+	}()
+
+	var (
+		episode = filepath.Join(tempDir, "tv", "show", "episode.mkv")
+		trailer = filepath.Join(tempDir, "tv", "show", "extras", "trailer.mkv")
+		movie   = filepath.Join(tempDir, "movies", "movie.mkv")
+		clip    = filepath.Join(tempDir, "movies", "clip.mp4")
+	)
+
+	for _, path := range []string{episode, trailer, movie, clip} {
+		err := os.MkdirAll(filepath.Dir(path), 0o755)
+		if err != nil {
+			t.Fatalf("Expected to be able to create test directory: %v", err)
+		}
+
+		err = ioutil.WriteFile(path, []byte(path), 0o755)
+		if err != nil {
+			t.Fatalf("Expected to be able to create test file: %v", err)
+		}
+	}
+
+	createDatabaseAndPopulate(t, updateOptions.database, nil)
+
+	err := update(nil, nil)
+	if err != nil {
+		t.Fatalf("Expected to be able to update database: %v", err)
+	}
+
+	// Only included files are queued, then those which are excluded are removed (even if they were also included)
+	expected := []value.Entry{
+		{Path: episode, Hash: crc32.Checksum([]byte(episode), crc32.MakeTable(crc32.IEEE))},
+		{Path: clip, Hash: crc32.Checksum([]byte(clip), crc32.MakeTable(crc32.IEEE))},
+	}
+
+	assertDatabaseContains(t, updateOptions.database, expected)
+
+	updateOptions.exclude = []string{"["}
+
+	err = update(nil, nil)
+	if err == nil {
+		t.Fatalf("Expected an error for a malformed pattern")
+	}
+}
+
+func TestUpdateSorted(t *testing.T) {
+	tempDir := t.TempDir()
+
+	updateOptions.database = filepath.Join(tempDir, "goamt.db")
+	updateOptions.paths = []string{tempDir}
+	updateOptions.threads = 4
+	updateOptions.sorted = true
+
+	defer func() {
+		updateOptions.threads = runtime.NumCPU()
+		updateOptions.sorted = false
+	}()
+
+	paths := make([]string, 0)
+
+	for index := 0; index < 16; index++ {
+		path := filepath.Join(tempDir, fmt.Sprintf("file%02d.mp4", index))
+
+		err := ioutil.WriteFile(path, []byte(strconv.Itoa(index)), 0o755)
+		if err != nil {
+			t.Fatalf("Expected to be able to create test file: %v", err)
+		}
+
+		paths = append(paths, path)
+	}
+
+	createDatabaseAndPopulate(t, updateOptions.database, nil)
+
+	err := update(nil, nil)
+	if err != nil {
+		t.Fatalf("Expected to be able to update database: %v", err)
+	}
+
+	db, err := sql.Open("sqlite3", updateOptions.database)
+	if err != nil {
+		t.Fatalf("Expected to be able to open database: %v", err)
+	}
+	defer db.Close()
+
+	var (
+		actual   = make([]string, 0, len(paths))
+		previous int64
+	)
+
+	callback := func(scan sqlite.ScanCallback) error {
+		var (
+			path       string
+			discovered int64
+		)
+
+		err := scan(&path, &discovered)
+		if err != nil {
+			return err
+		}
+
+		if discovered == previous {
+			t.Fatalf("Expected strictly increasing discovered timestamps")
+		}
+
+		actual = append(actual, path)
+		previous = discovered
+
+		return nil
+	}
+
+	err = sqlite.QueryRows(db, sqlite.Query{Query: "select path, discovered from library order by discovered;"}, callback)
+	if err != nil {
+		t.Fatalf("Expected to be able to query entries: %v", err)
+	}
+
+	if !reflect.DeepEqual(actual, paths) {
+		t.Fatalf("Expected entries to have been discovered in order %v but got %v", paths, actual)
+	}
+}
+
+func TestUpdateDryRun(t *testing.T) {
+	tempDir := t.TempDir()
+
+	// The database purposefully doesn't exist, a dry run shouldn't open it
+	updateOptions.database = filepath.Join(tempDir, "goamt.db")
+	updateOptions.paths = []string{tempDir}
+	updateOptions.dryRun = true
+
+	defer func() { updateOptions.dryRun = false }()
+
+	for _, name := range []string{"b.mkv", "a.mp4", "notes.txt", "c.transcoding.mp4"} {
+		err := ioutil.WriteFile(filepath.Join(tempDir, name), []byte(name), 0o755)
+		if err != nil {
+			t.Fatalf("Expected to be able to create test file: %v", err)
+		}
+	}
+
+	var buffer bytes.Buffer
+
+	err := runUpdateDryRun(context.Background(), newRunSummary("update"), &buffer)
+	if err != nil {
+		t.Fatalf("Expected to be able to run update dry run: %v", err)
+	}
+
+	expected := fmt.Sprintf("%s\n%s\n2 file(s) would be queued\n", filepath.Join(tempDir, "a.mp4"),
+		filepath.Join(tempDir, "b.mkv"))
+
+	if buffer.String() != expected {
+		t.Fatalf("Expected output '%s' but got '%s'", expected, buffer.String())
+	}
+
+	err = update(nil, nil)
+	if err != nil {
+		t.Fatalf("Expected to be able to run update dry run: %v", err)
+	}
+
+	if utils.PathExists(updateOptions.database) {
+		t.Fatalf("Expected the database not to have been created")
+	}
+}
+
+func BenchmarkUpdate(b *testing.B) {
+	const files = 256
+
+	oldProbeFunc := probeFunc
+	defer func() { probeFunc = oldProbeFunc }()
+
+	probeFunc = func(_ context.Context, _ string) (utils.VideoInfo, error) {
+		return utils.VideoInfo{Codec: "h264", Width: 1920, Height: 1080}, nil
+	}
+
+	// Each entry is logged when it's added, which would otherwise dominate the benchmark
+	log.SetLevel(log.WarnLevel)
+	defer log.SetLevel(log.InfoLevel)
+
+	library := b.TempDir()
+
+	for i := 0; i < files; i++ {
+		err := ioutil.WriteFile(filepath.Join(library, fmt.Sprintf("%d.mp4", i)), make([]byte, 64<<10), 0o755)
+		if err != nil {
+			b.Fatalf("Expected to be able to create test file: %v", err)
+		}
+	}
+
+	updateOptions.paths = []string{library}
+
+	updateOptions.threads = 4
+
+	defer func() {
+		updateOptions.threads = runtime.NumCPU()
+		updateOptions.hashWorkers = 0
+	}()
+
+	// Compare each of the four workers upserting their own entries against four workers feeding a single writer
+	for _, hashWorkers := range []int{0, 4} {
+		b.Run(fmt.Sprintf("HashWorkers=%d", hashWorkers), func(b *testing.B) {
+			updateOptions.hashWorkers = hashWorkers
+
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+
+				updateOptions.database = filepath.Join(b.TempDir(), "goamt.db")
+
+				db, err := database.Create(updateOptions.database)
+				if err != nil {
+					b.Fatalf("Expected to be able to create database: %v", err)
+				}
+				db.Close()
+
+				b.StartTimer()
+
+				err = update(nil, nil)
+				if err != nil {
+					b.Fatalf("Expected to be able to update database: %v", err)
+				}
+			}
+		})
+	}
+}
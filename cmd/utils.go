@@ -15,11 +15,20 @@
 package cmd
 
 import (
+	"bufio"
 	"context"
+	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/jamesl33/goamt/database"
 	"github.com/jamesl33/goamt/utils"
+	"github.com/jamesl33/goamt/utils/sqlite"
 	"github.com/jamesl33/goamt/value"
 
 	"github.com/apex/log"
@@ -27,6 +36,14 @@ import (
 	"github.com/spf13/cobra"
 )
 
+// markFlagDeprecated - Mark the provided flag as deprecated (hiding it from the help) panicking if it was not found.
+func markFlagDeprecated(command *cobra.Command, flag, message string) {
+	err := command.Flags().MarkDeprecated(flag, message)
+	if err != nil {
+		panic(err)
+	}
+}
+
 // markFlagRequired - Mark the provided flag as required panicking if it was not found.
 func markFlagRequired(command *cobra.Command, flag string) {
 	err := command.MarkFlagRequired(flag)
@@ -35,10 +52,84 @@ func markFlagRequired(command *cobra.Command, flag string) {
 	}
 }
 
+// databaseEnv - The environment variable which may be used to provide the path to the database, rather than passing
+// '--database' to every sub-command.
+const databaseEnv = "GOAMT_DATABASE"
+
+// markDatabaseRequired - Mark the '--database' flag as required, unless the path to the database is provided by the
+// 'GOAMT_DATABASE' environment variable in which case it's used as the default; the flag still takes precedence.
+func markDatabaseRequired(command *cobra.Command) {
+	path := os.Getenv(databaseEnv)
+	if path == "" {
+		markFlagRequired(command, "database")
+		return
+	}
+
+	flag := command.Flags().Lookup("database")
+	if flag == nil {
+		panic(fmt.Sprintf("no such flag 'database' for command '%s'", command.Name()))
+	}
+
+	err := flag.Value.Set(path)
+	if err != nil {
+		panic(err)
+	}
+
+	flag.DefValue = path
+}
+
+// confirmInput - The file used to read responses to confirmation prompts, used to allow unit testing of 'confirm'.
+var confirmInput = os.Stdin
+
+// databaseOptions - Returns the options used to open a database for writing, syncing is disabled for a fast import.
+func databaseOptions(fastImport bool) database.Options {
+	if !fastImport {
+		return database.Options{}
+	}
+
+	log.Warn("Database writes won't be synced to disk, a power loss or crash during the import may corrupt the database")
+
+	return database.Options{Sync: "off"}
+}
+
+// confirm - Prompt the user to confirm a destructive action, returning a boolean indicating whether to proceed. Note
+// that an error is returned when not running interactively and '--yes' wasn't provided, so that scripts don't hang.
+func confirm(prompt string) (bool, error) {
+	if rootOptions.yes {
+		return true, nil
+	}
+
+	info, err := confirmInput.Stat()
+	if err != nil {
+		return false, errors.Wrap(err, "failed to stat stdin")
+	}
+
+	if info.Mode()&os.ModeCharDevice == 0 {
+		return false, errors.New("confirmation required but stdin is not a terminal, use '--yes' to proceed")
+	}
+
+	fmt.Printf("%s [y/N]: ", prompt)
+
+	answer, err := bufio.NewReader(confirmInput).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return false, errors.Wrap(err, "failed to read confirmation")
+	}
+
+	answer = strings.ToLower(strings.TrimSpace(answer))
+
+	return answer == "y" || answer == "yes", nil
+}
+
 // queueEntry - Queue the provided entry, returns a boolean indicating whether the entry was successfully queued; the
 // calling function should begin gracefully terminating in the event of a queue failure.
 func queueEntry(ctx context.Context, entryStream chan<- value.Entry, errorStream <-chan error,
 	entry value.Entry) (bool, error) {
+	// A select chooses randomly between ready cases, so without checking first entries could still be queued (and
+	// processed) after the context is cancelled whilst there's space in the entry stream
+	if ctx.Err() != nil {
+		return false, nil
+	}
+
 	select {
 	case <-ctx.Done():
 		return false, nil
@@ -49,39 +140,836 @@ func queueEntry(ctx context.Context, entryStream chan<- value.Entry, errorStream
 	}
 }
 
-// upsertEntry - Update the hash for the provided entry then upsert it into the SQLite database.
-func upsertEntry(db *database.Database, entry value.Entry) error {
+// discoveredClock - Returns the discovered timestamp for the next media file found whilst walking a media library.
+type discoveredClock func() int64
+
+// newDiscoveredClock - Create a clock which returns the current time or, when 'sorted' is true, strictly increasing
+// timestamps in walk (lexical) order; this makes the transcode order deterministic regardless of the order entries are
+// upserted. A single clock should be shared when walking multiple media libraries.
+func newDiscoveredClock(sorted bool) discoveredClock {
+	if !sorted {
+		return func() int64 { return time.Now().Unix() }
+	}
+
+	var (
+		start    = time.Now().Unix()
+		sequence int64
+	)
+
+	return func() int64 {
+		sequence++
+		return start + sequence - 1
+	}
+}
+
+// pathFilter - Determines which media files are queued using glob patterns (see 'utils.MatchPath') which are matched
+// against paths relative to the media library. When any include patterns are provided a file must match one of them,
+// the exclude patterns are then subtracted from the included files.
+type pathFilter struct {
+	include, exclude []string
+}
+
+// validate - Returns an error if any of the patterns are malformed.
+func (f pathFilter) validate() error {
+	for _, pattern := range append(append([]string{}, f.include...), f.exclude...) {
+		_, err := utils.MatchPath(pattern, "")
+		if err != nil {
+			return errors.Wrapf(err, "invalid pattern '%s'", pattern)
+		}
+	}
+
+	return nil
+}
+
+// included - Returns a boolean indicating whether the file at the provided relative path should be queued.
+func (f pathFilter) included(path string) bool {
+	if len(f.include) != 0 && !matchesAny(f.include, path) {
+		return false
+	}
+
+	return !f.excluded(path)
+}
+
+// excluded - Returns a boolean indicating whether the provided relative path matches an exclude pattern, since patterns
+// also match parent directories, nothing within an excluded directory will be queued.
+func (f pathFilter) excluded(path string) bool {
+	return matchesAny(f.exclude, path)
+}
+
+// matchesAny - Returns a boolean indicating whether the provided relative path matches any of the given patterns, which
+// should already have been validated.
+func matchesAny(patterns []string, path string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := utils.MatchPath(pattern, path); matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// walkMediaFiles - Walk the provided path running the given callback for each supported media file allowed by the
+// filter, incomplete transcoded files are always skipped. Any error returned by the callback stops the walk.
+func walkMediaFiles(root string, filter pathFilter, callback func(path string, info os.FileInfo) error) error {
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		relative, relErr := filepath.Rel(root, path)
+		if relErr != nil {
+			return relErr
+		}
+
+		// There's no need to walk excluded directories, since nothing within them would be queued
+		if err == nil && info.IsDir() && relative != "." && filter.excluded(relative) {
+			log.WithField("path", path).Debug("Skipping excluded directory")
+			return filepath.SkipDir
+		}
+
+		// Extensions are matched case-insensitively, libraries imported from Windows commonly contain e.g. '.MP4' files
+		lower := strings.ToLower(path)
+
+		if err != nil ||
+			strings.HasSuffix(lower, value.TranscodingExtension) ||
+			!utils.ContainsString(value.SupportedExtensions, filepath.Ext(lower)) ||
+			!filter.included(relative) {
+			return err
+		}
+
+		return callback(path, info)
+	})
+}
+
+// queueMediaFiles - Walk the provided path queueing any supported media files allowed by the given filter for
+// processing by the worker pool, the discovered timestamps are assigned using the provided clock. Files modified within
+// the settle time (when non-zero) are skipped, since they may still be being written.
+func queueMediaFiles(ctx context.Context, entryStream chan<- value.Entry, errorStream <-chan error, root string,
+	clock discoveredClock, settle time.Duration, filter pathFilter) error {
+	err := walkMediaFiles(root, filter, func(path string, info os.FileInfo) error {
+		if settle != 0 && time.Since(info.ModTime()) < settle {
+			log.WithField("path", path).Info("Skipping recently modified file, it may still be being written")
+			return nil
+		}
+
+		if len(errorStream) != 0 {
+			return <-errorStream
+		}
+
+		queued, err := queueEntry(
+			ctx,
+			entryStream,
+			errorStream,
+			value.Entry{Path: path, Discovered: clock()},
+		)
+		if err != nil {
+			return errors.Wrap(err, "failed to queue entry")
+		}
+
+		if !queued {
+			return io.EOF
+		}
+
+		return nil
+	})
+	if err != nil && err != io.EOF {
+		return errors.Wrap(err, "unexpected error during file walk")
+	}
+
+	return nil
+}
+
+// upsertEntry - Update the hash (and source codec/dimensions) for the provided entry then upsert it into the SQLite
+// database.
+func upsertEntry(db *database.Database, entry value.Entry,
+	options utils.HashOptions) (database.UpsertOutcome, error) {
 	var err error
-	entry.Hash, err = utils.HashFile(entry.Path)
+	entry.Hash, err = utils.HashFileWithOptions(entry.Path, options)
 	if err != nil {
-		return err
+		return database.UpsertSkipped, err
+	}
+
+	probeEntry(db, &entry)
+
+	if belowMinDuration(entry) {
+		return database.UpsertSkipped, nil
 	}
 
 	return db.Upsert(entry)
 }
 
-// transcodeEntry - Transcode the provided entry, note that this entry should already exist in the provided database.
-func transcodeEntry(db *database.Database, entry value.Entry) error {
+// belowMinDuration - Returns a boolean indicating whether the provided (probed) entry is shorter than '--min-duration'
+// and therefore shouldn't be recorded. Entries whose duration couldn't be determined are always recorded.
+func belowMinDuration(entry value.Entry) bool {
+	if updateOptions.minDuration == 0 || entry.Duration == nil ||
+		*entry.Duration >= updateOptions.minDuration.Seconds() {
+		return false
+	}
+
+	log.WithFields(entry).Info("Skipping media file shorter than the minimum duration")
+
+	return true
+}
+
+// upsertOutcomes - Counts the outcome of each entry upserted by an update pool, allowing a run to be summarised.
+type upsertOutcomes struct {
+	inserted, updated, skipped int64
+}
+
+// record - Count the provided outcome, this is a no-op for a nil receiver so outcomes may be optionally recorded.
+func (u *upsertOutcomes) record(outcome database.UpsertOutcome) {
+	if u == nil {
+		return
+	}
+
+	switch outcome {
+	case database.UpsertInserted:
+		atomic.AddInt64(&u.inserted, 1)
+	case database.UpsertUpdated:
+		atomic.AddInt64(&u.updated, 1)
+	case database.UpsertSkipped:
+		atomic.AddInt64(&u.skipped, 1)
+	}
+}
+
+// write - Write the number of entries inserted/updated/skipped to the provided writer.
+func (u *upsertOutcomes) write(writer io.Writer) error {
+	_, err := fmt.Fprintf(
+		writer,
+		"inserted: %d\nupdated:  %d\nskipped:  %d\n",
+		atomic.LoadInt64(&u.inserted),
+		atomic.LoadInt64(&u.updated),
+		atomic.LoadInt64(&u.skipped),
+	)
+
+	return err
+}
+
+// upsertWriter - Upserts entries into a database from a single goroutine, allowing entries to be hashed concurrently
+// without each worker contending for the database lock.
+type upsertWriter struct {
+	db       *database.Database
+	outcomes *upsertOutcomes
+	entries  chan value.Entry
+	done     chan struct{}
+	err      error
+	lock     sync.Mutex
+}
+
+// newUpsertWriter - Create a new writer which will upsert entries into the provided database, recording the outcome of
+// each upsert in the given outcomes (which may be nil).
+func newUpsertWriter(db *database.Database, outcomes *upsertOutcomes) *upsertWriter {
+	writer := &upsertWriter{
+		db:       db,
+		outcomes: outcomes,
+		entries:  make(chan value.Entry, 1024),
+		done:     make(chan struct{}),
+	}
+
+	go writer.run()
+
+	return writer
+}
+
+// run - Upsert queued entries until the writer is stopped, once an upsert fails the remaining entries are discarded.
+func (w *upsertWriter) run() {
+	defer close(w.done)
+
+	for entry := range w.entries {
+		if w.error() != nil {
+			continue
+		}
+
+		outcome, err := w.db.Upsert(entry)
+		if err != nil {
+			w.lock.Lock()
+			w.err = err
+			w.lock.Unlock()
+
+			continue
+		}
+
+		w.outcomes.record(outcome)
+	}
+}
+
+// error - Returns the error which caused the writer to fail, if any.
+func (w *upsertWriter) error() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	return w.err
+}
+
+// write - Queue the provided entry to be upserted, returning an error if a previous upsert failed.
+func (w *upsertWriter) write(entry value.Entry) error {
+	if err := w.error(); err != nil {
+		return err
+	}
+
+	w.entries <- entry
+
+	return nil
+}
+
+// stop - Wait for the queued entries to be upserted, returning the error which caused the writer to fail (if any). The
+// writer may not be used once stopped.
+func (w *upsertWriter) stop() error {
+	close(w.entries)
+	<-w.done
+
+	return w.error()
+}
+
+// probeEntry - Populate the source codec/dimensions/duration of the provided entry using ffprobe. Entries which have
+// already been probed are skipped (using their recorded duration), as are transcoded entries since ffprobe would
+// describe the transcoded file rather than the source. Failures are logged but otherwise ignored, they shouldn't
+// prevent the entry from being recorded.
+func probeEntry(db *database.Database, entry *value.Entry) {
+	if entry.Transcoded != nil {
+		return
+	}
+
+	existing, err := db.FindByHash(entry.Hash)
+	if err == nil && (existing.Transcoded != nil || (existing.SourceCodec != nil && existing.Duration != nil)) {
+		entry.Duration = existing.Duration
+		return
+	}
+
+	info, err := probeFunc(context.Background(), entry.Path)
+	if err != nil {
+		log.WithError(err).WithFields(entry).Warn("Failed to probe source file")
+		return
+	}
+
+	entry.SourceCodec = utils.StringP(info.Codec)
+	entry.SourceWidth = utils.Int64P(info.Width)
+	entry.SourceHeight = utils.Int64P(info.Height)
+
+	if info.Duration > 0 {
+		entry.Duration = utils.Float64P(info.Duration)
+	}
+}
+
+// transcodeEntry - Transcode the provided entry using the given backend, note that this entry should already exist in
+// the provided database. The first pass is taken from the provided analyser when it has been run ahead of time. If the
+// provided context is cancelled, the transcode is aborted and 'errCancelled' returned.
+func transcodeEntry(ctx context.Context, db *database.Database, transcoder utils.Transcoder, entry value.Entry,
+	analyser *loudnormAnalyser) error {
 	log.WithFields(entry).Info("Beginning job to transcode entry")
 
-	err := transcodeFunc(entry.Path)
+	if lowBitRate(ctx, entry) {
+		log.WithFields(entry).Info("Source video bit rate is below the minimum, marking transcoded without transcoding")
+		return db.CompleteTranscoding(entry) // Purposefully not wrapped
+	}
+
+	target, err := transcodeTarget(entry)
+	if err != nil {
+		return errors.Wrap(err, "failed to determine target path")
+	}
+
+	err = os.MkdirAll(filepath.Dir(target), 0o755)
+	if err != nil {
+		return errors.Wrap(err, "failed to create target directory")
+	}
+
+	var (
+		transcoding = utils.ReplaceExtension(target, value.TranscodingExtension)
+		temporary   = transcodeTemporary(entry)
+		output      = transcoding
+	)
+
+	// When using a temporary directory, ffmpeg writes there and the transcoded file is moved alongside the target once
+	// complete; the file then follows the same steps as if it had been transcoded in place
+	if temporary != "" {
+		output = temporary
+	}
+
+	err = targetCollision(db, entry, target)
+	if err != nil {
+		return failTranscoding(db, entry, output, err)
+	}
+
+	for _, directory := range []string{filepath.Dir(target), filepath.Dir(output)} {
+		sufficient, err := sufficientSpace(entry.Path, directory)
+		if err != nil {
+			return errors.Wrap(err, "failed to check free space")
+		}
+
+		if !sufficient {
+			log.WithFields(entry).WithField("directory", directory).
+				Warn("Insufficient free space to transcode entry, skipping")
+
+			return cancelTranscoding(db, entry)
+		}
+	}
+
+	// We hold the job for this entry, so any existing transcode file was left behind by a previous run (e.g. one which
+	// crashed whilst rolling back its job) and would otherwise cause ffmpeg to fail
+	for _, path := range []string{transcoding, temporary} {
+		if path == "" {
+			continue
+		}
+
+		err = os.Remove(path)
+		if err == nil {
+			log.WithFields(entry).WithField("path", path).Warn("Removed stale incomplete transcoded file")
+		} else if !os.IsNotExist(err) {
+			return errors.Wrap(err, "failed to remove stale incomplete transcoded file")
+		}
+	}
+
+	options := ffmpegOptions()
+	options.LoudnormStats = analyser.stats(ctx, entry)
+
+	hdrOptions(ctx, entry, &options)
+
+	logFile, err := createFFmpegLog(entry)
+	if err != nil {
+		return errors.Wrap(err, "failed to create ffmpeg log file")
+	}
+
+	if logFile != nil {
+		options.Log = logFile
+	}
+
+	err = transcoder.Transcode(ctx, entry.Path, output, options)
+	closeFFmpegLog(logFile, err != nil && ctx.Err() == nil)
+	if err != nil && ctx.Err() != nil {
+		return abortTranscoding(db, entry, output)
+	}
+
+	if err != nil {
+		return failTranscoding(db, entry, output, errors.Wrap(err, "failed to transcode file"))
+	}
+
+	smaller, err := sufficientSavings(entry.Path, output)
+	if err != nil {
+		return errors.Wrap(err, "failed to compare file sizes")
+	}
+
+	if !smaller {
+		return discardTranscoded(db, entry, output)
+	}
+
+	// Verified before anything is moved/removed, so a corrupt file never replaces the source
+	if transcodeOptions.verifyDecode {
+		err = verifyDecodeFunc(ctx, output, ffmpegOptions())
+		if err != nil && ctx.Err() != nil {
+			return abortTranscoding(db, entry, output)
+		}
+
+		if err != nil {
+			return failTranscoding(db, entry, output, errors.Wrap(err, "failed to verify transcoded file"))
+		}
+	}
+
+	if temporary != "" {
+		err = utils.DurableMove(temporary, transcoding)
+		if err != nil {
+			return errors.Wrap(err, "failed to move transcoded file from temporary directory")
+		}
+	}
+
+	// The target may have been created whilst transcoding
+	err = targetCollision(db, entry, target)
 	if err != nil {
-		return errors.Wrap(err, "failed to transcode file")
+		return failTranscoding(db, entry, transcoding, err)
 	}
 
-	err = os.Remove(entry.Path)
+	// When writing to an output directory the source is purposefully left intact
+	inPlace := transcodeOptions.outputDir == ""
+
+	err = finishTranscoding(db, entry, target, inPlace && transcodeOptions.keepSource, inPlace)
 	if err != nil {
-		return errors.Wrap(err, "failed to remove source file")
+		return err // Purposefully not wrapped
+	}
+
+	runCompleteHook(target)
+
+	return nil
+}
+
+// targetCollision - Returns an error if a file other than the source of the provided entry already exists at the given
+// target, since renaming the transcoded file into place would overwrite it (e.g. an unrelated '.mp4' file alongside an
+// '.avi' source), or if another entry is recorded at the target since paths must be unique.
+func targetCollision(db *database.Database, entry value.Entry, target string) error {
+	// The target may only differ from the source by case (e.g. when renaming to lowercase), in which case it refers to
+	// the source on a case-insensitive filesystem
+	if utils.SamePath(target, entry.Path) {
+		return nil
+	}
+
+	if utils.PathExists(target) {
+		return fmt.Errorf("target file '%s' already exists", target)
+	}
+
+	// Another entry may be recorded at the target even though its file has since been removed
+	existing, err := db.FindByPath(target)
+	if errors.Is(err, sqlite.ErrQueryReturnedNoRows) {
+		return nil
 	}
 
-	err = os.Rename(utils.ReplaceExtension(entry.Path, value.TranscodingExtension),
-		utils.ReplaceExtension(entry.Path, value.TargetExtension))
+	if err != nil {
+		return errors.Wrap(err, "failed to find entry recorded at target")
+	}
+
+	return fmt.Errorf("target path '%s' is already recorded for entry %d", target, existing.ID)
+}
+
+// abortTranscoding - Remove the incomplete transcoded file for the provided entry and cancel its job, used when the
+// transcode is interrupted. Returns 'errCancelled' unless cancelling fails.
+func abortTranscoding(db *database.Database, entry value.Entry, output string) error {
+	log.WithFields(entry).Warn("Transcoding cancelled, removing incomplete transcoded file")
+
+	err := os.Remove(output)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "failed to remove incomplete transcoded file")
+	}
+
+	err = cancelTranscoding(db, entry)
+	if err != nil {
+		return err
+	}
+
+	return errCancelled
+}
+
+// finishTranscoding - Move the transcoded file for the provided entry into place at the given target, then complete
+// its job. The source is renamed with the '.original' extension when 'keepSource' is set, otherwise it's removed when
+// 'removeSource' is set.
+func finishTranscoding(db *database.Database, entry value.Entry, target string, keepSource, removeSource bool) error {
+	// The transcoded file is durably renamed into place before the source is removed, so that at any point at least one
+	// of them exists on disk; recovery handles a crash between any of these steps.
+	//
+	// This must be checked before the rename, since the source would be replaced by it when the target refers to the
+	// same file (e.g. a case-only rename on a case-insensitive filesystem)
+	inPlace := utils.SamePath(target, entry.Path)
+
+	err := db.FinishedTranscoding(entry)
+	if err != nil {
+		return errors.Wrap(err, "failed to mark transcoding finished")
+	}
+
+	if keepSource {
+		err = utils.DurableRename(entry.Path, entry.Path+value.OriginalExtension)
+		if err != nil {
+			return errors.Wrap(err, "failed to rename source file")
+		}
+	}
+
+	err = utils.DurableRename(utils.ReplaceExtension(target, value.TranscodingExtension), target)
 	if err != nil {
 		return errors.Wrap(err, "failed to rename transcoded file")
 	}
 
-	entry.Path = utils.ReplaceExtension(entry.Path, value.TargetExtension)
-	return db.CompleteTranscoding(entry)
+	// If the source had the target extension, it has already been replaced by the rename above
+	if removeSource && !keepSource && !inPlace {
+		err = utils.DurableRemove(entry.Path)
+		if err != nil {
+			return errors.Wrap(err, "failed to remove source file")
+		}
+	}
+
+	source := entry.Path
+	entry.Path = target
+
+	// The source is left in place (e.g. when using '--output-dir') so must be recorded, otherwise the next update would
+	// add it as a new entry which would then be transcoded again
+	if !removeSource && !keepSource && !inPlace {
+		return db.CompleteTranscodingKeepingSource(entry, source) // Purposefully not wrapped
+	}
+
+	return db.CompleteTranscoding(entry) // Purposefully not wrapped
+}
+
+// createFFmpegLog - Create the file which the ffmpeg output for the provided entry will be written to, named after the
+// entry; returns nil when '--ffmpeg-log-dir' wasn't provided.
+func createFFmpegLog(entry value.Entry) (*os.File, error) {
+	if transcodeOptions.ffmpegLogDir == "" {
+		return nil, nil
+	}
+
+	name := fmt.Sprintf("%d-%s.log", entry.ID, filepath.Base(entry.Path))
+
+	return os.Create(filepath.Join(transcodeOptions.ffmpegLogDir, name))
+}
+
+// closeFFmpegLog - Close the provided ffmpeg log file (which may be nil), removing it unless the transcode failed or
+// '--keep-ffmpeg-logs' was provided.
+func closeFFmpegLog(file *os.File, failed bool) {
+	if file == nil {
+		return
+	}
+
+	fields := log.Fields{"path": file.Name()}
+
+	if closeErr := file.Close(); closeErr != nil {
+		log.WithError(closeErr).WithFields(fields).Warn("Failed to close ffmpeg log file")
+	}
+
+	if failed {
+		log.WithFields(fields).Error("Transcode failed, the ffmpeg output was written to the log file")
+		return
+	}
+
+	if transcodeOptions.keepFFmpegLogs {
+		return
+	}
+
+	if removeErr := os.Remove(file.Name()); removeErr != nil {
+		log.WithError(removeErr).WithFields(fields).Warn("Failed to remove ffmpeg log file")
+	}
+}
+
+// failTranscoding - Record a failed attempt to transcode the provided entry, removing the incomplete transcoded file.
+// Entries which have failed '--max-failures' times are quarantined, moving their source file into the '--quarantine'
+// directory (if provided). The provided error is returned once the failure has been recorded.
+func failTranscoding(db *database.Database, entry value.Entry, transcoding string, cause error) error {
+	err := os.Remove(transcoding)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "failed to remove incomplete transcoded file")
+	}
+
+	quarantine := transcodeOptions.maxFailures != 0 && entry.Failures+1 >= transcodeOptions.maxFailures
+	if !quarantine {
+		return recordFailure(db, entry, false, cause)
+	}
+
+	log.WithFields(entry).Warn("Entry has repeatedly failed to transcode, quarantining")
+
+	if transcodeOptions.quarantine == "" {
+		return recordFailure(db, entry, true, cause)
+	}
+
+	path, err := mirrorPath(entry.Path, transcodeOptions.quarantine)
+	if err != nil {
+		return errors.Wrap(err, "failed to determine quarantine path")
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0o755)
+	if err != nil {
+		return errors.Wrap(err, "failed to create quarantine directory")
+	}
+
+	// The quarantine directory may be on a different filesystem to the media library
+	err = utils.DurableMove(entry.Path, path)
+	if err != nil {
+		return errors.Wrap(err, "failed to move source file into quarantine")
+	}
+
+	entry.Path = path
+
+	return recordFailure(db, entry, true, cause)
+}
+
+// recordFailure - Record the failed attempt to transcode the provided entry in the database, returning the original
+// error unless doing so fails.
+func recordFailure(db *database.Database, entry value.Entry, quarantine bool, cause error) error {
+	err := db.FailTranscoding(entry, quarantine)
+	if err != nil {
+		return errors.Wrap(err, "failed to record failure")
+	}
+
+	return cause
+}
+
+// ffmpegOptions - Returns the options which control how ffmpeg is run, as provided to the transcode sub-command.
+func ffmpegOptions() utils.TranscodeOptions {
+	return utils.TranscodeOptions{
+		Nice:            transcodeOptions.nice,
+		DisableLoudnorm: transcodeOptions.noLoudnorm,
+		AudioCodec:      transcodeOptions.audio,
+		AudioBitRate:    transcodeOptions.audioBitRate,
+		MaxWidth:        transcodeOptions.maxWidth,
+		MaxHeight:       transcodeOptions.maxHeight,
+		Threads:         transcodeOptions.ffmpegThreads,
+		VideoCodec:      transcodeOptions.video.codec,
+		CRF:             transcodeOptions.video.crf,
+		EncoderPreset:   transcodeOptions.video.encoderPreset,
+		Profile:         transcodeOptions.video.profile,
+		Level:           transcodeOptions.video.level,
+		PixelFormat:     transcodeOptions.pixelFormat,
+		Remux:           transcodeOptions.remux,
+		FixTimestamps:   transcodeOptions.fixTimestamps,
+		TargetBitRate:   transcodeOptions.targetBitRate,
+		LoudnormTarget:  transcodeOptions.loudnorm,
+	}
+}
+
+// loudnormTarget - Returns the loudness targeted when normalising the audio, only the targets which were explicitly
+// provided are set so that ffmpeg's defaults are used for the others.
+func loudnormTarget(changed func(name string) bool) utils.LoudnormTarget {
+	var target utils.LoudnormTarget
+
+	if changed("target-i") {
+		target.I = &transcodeOptions.targetI
+	}
+
+	if changed("target-lra") {
+		target.LRA = &transcodeOptions.targetLRA
+	}
+
+	if changed("target-tp") {
+		target.TP = &transcodeOptions.targetTP
+	}
+
+	return target
+}
+
+// lowBitRate - Returns a boolean indicating whether the video bit rate of the provided entry is below '--min-bitrate',
+// re-encoding such sources gains little and risks further losing quality. Failing to determine the bit rate is logged,
+// and the entry is transcoded as usual.
+func lowBitRate(ctx context.Context, entry value.Entry) bool {
+	if transcodeOptions.minBitRate == 0 {
+		return false
+	}
+
+	bitRate, err := bitRateFunc(ctx, entry.Path)
+	if err != nil {
+		log.WithError(err).WithFields(entry).Warn("Failed to determine source video bit rate")
+		return false
+	}
+
+	return bitRate < int64(transcodeOptions.minBitRate)*1000
+}
+
+// matchingCodec - Returns a boolean indicating whether the video of the provided entry already uses the target codec
+// and '--skip-matching-codec' was provided, re-encoding such sources gains little and risks losing quality. Failing to
+// determine the codec is logged, and the entry is transcoded as usual.
+func matchingCodec(ctx context.Context, db *database.Database, entry value.Entry) bool {
+	if !transcodeOptions.skipMatchingCodec {
+		return false
+	}
+
+	codec, err := sourceCodec(ctx, db, entry)
+	if err != nil {
+		log.WithError(err).WithFields(entry).Warn("Failed to determine source video codec")
+		return false
+	}
+
+	return codec == transcodeOptions.video.codec
+}
+
+// sourceCodec - Returns the codec of the video stream of the provided entry. Entries which weren't probed by update are
+// probed now, and the result recorded so that they're not probed again by later runs.
+func sourceCodec(ctx context.Context, db *database.Database, entry value.Entry) (string, error) {
+	if entry.SourceCodec != nil {
+		return *entry.SourceCodec, nil
+	}
+
+	info, err := probeFunc(ctx, entry.Path)
+	if err != nil {
+		return "", err
+	}
+
+	entry.SourceCodec = utils.StringP(info.Codec)
+	entry.SourceWidth = utils.Int64P(info.Width)
+	entry.SourceHeight = utils.Int64P(info.Height)
+
+	if info.Duration > 0 {
+		entry.Duration = utils.Float64P(info.Duration)
+	}
+
+	// Failing to record the codec only means the entry will be probed again, so isn't fatal
+	err = db.RecordSource(entry)
+	if err != nil {
+		log.WithError(err).WithFields(entry).Warn("Failed to record source video codec")
+	}
+
+	return info.Codec, nil
+}
+
+// hdrOptions - Determine whether the video of the provided entry is HDR, in which case the options are updated to
+// either encode it as 10-bit video tagged with the color properties of the source ('--hdr preserve') or tone map it to
+// SDR ('--hdr tonemap'). Sources aren't probed when HDR is ignored, since there's nothing to change. Remuxed files keep
+// their video stream so aren't checked, unless HDR is being preserved in case they must be transcoded instead.
+func hdrOptions(ctx context.Context, entry value.Entry, options *utils.TranscodeOptions) {
+	if transcodeOptions.hdr == hdrIgnore || options.Remux && transcodeOptions.hdr != hdrPreserve {
+		return
+	}
+
+	color, err := colorFunc(ctx, entry.Path)
+	if err != nil {
+		log.WithError(err).WithFields(entry).Warn("Failed to determine whether source video is HDR")
+		return
+	}
+
+	if !color.HDR() {
+		return
+	}
+
+	if transcodeOptions.hdr == hdrTonemap {
+		options.Tonemap = true
+		options.Color = &utils.ColorInfo{Primaries: "bt709", Transfer: "bt709", Space: "bt709"}
+
+		return
+	}
+
+	options.PixelFormat = utils.PixelFormat10Bit
+	options.Color = &color
+}
+
+// sufficientSpace - Returns a boolean indicating whether there's enough free space in the provided directory to
+// transcode the given source file.
+func sufficientSpace(source, directory string) (bool, error) {
+	if transcodeOptions.spaceMultiplier == 0 {
+		return true, nil
+	}
+
+	info, err := os.Stat(source)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to stat source file")
+	}
+
+	free, err := utils.FreeSpace(directory)
+	if err != nil {
+		return false, err
+	}
+
+	return float64(free) >= float64(info.Size())*transcodeOptions.spaceMultiplier, nil
+}
+
+// sufficientSavings - Returns a boolean indicating whether the provided transcoded file is sufficiently smaller than
+// its source, this is always the case unless '--only-if-smaller' was provided.
+func sufficientSavings(source, transcoded string) (bool, error) {
+	if !transcodeOptions.onlyIfSmaller {
+		return true, nil
+	}
+
+	return smallerBy(source, transcoded, transcodeOptions.minSavings)
+}
+
+// smallerBy - Returns a boolean indicating whether the transcoded file is smaller than the source by at least the
+// provided percentage.
+func smallerBy(source, transcoded string, percent float64) (bool, error) {
+	sourceInfo, err := os.Stat(source)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to stat source file")
+	}
+
+	transcodedInfo, err := os.Stat(transcoded)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to stat transcoded file")
+	}
+
+	limit := float64(sourceInfo.Size()) * (1 - percent/100)
+
+	return float64(transcodedInfo.Size()) < limit, nil
+}
+
+// discardTranscoded - Remove the provided transcoded file, leaving the source intact but marking the entry as
+// transcoded so that it's not retried.
+func discardTranscoded(db *database.Database, entry value.Entry, transcoding string) error {
+	log.WithFields(entry).Info("Transcoded file is not sufficiently smaller than the source, keeping the source")
+
+	err := utils.DurableRemove(transcoding)
+	if err != nil {
+		return errors.Wrap(err, "failed to remove transcoded file")
+	}
+
+	err = db.CompleteTranscoding(entry)
+	if err != nil {
+		return err // Purposefully not wrapped
+	}
+
+	return nil
 }
 
 // cancelTranscoding - Cancel the queued job to transcode an entry.
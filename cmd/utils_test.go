@@ -15,18 +15,42 @@
 package cmd
 
 import (
+	"bytes"
+	"context"
 	"database/sql"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"reflect"
 	"sort"
 	"testing"
 
 	"github.com/jamesl33/goamt/database"
+	"github.com/jamesl33/goamt/utils"
 	"github.com/jamesl33/goamt/utils/sqlite"
 	"github.com/jamesl33/goamt/value"
 
-	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
 )
 
+// transcodeFunc - The function used by the test backend when transcoding entries, replaced by tests which transcode.
+var transcodeFunc = utils.TranscodeFile
+
+func TestMain(m *testing.M) {
+	// ffmpeg isn't required by the unit tests, since transcoding/probing is replaced by test functions
+	checkToolsFunc = func(_ ...string) error { return nil }
+
+	transcoderFunc = func(_ string) (utils.Transcoder, error) {
+		return utils.TranscoderFunc(func(ctx context.Context, path, target string,
+			options utils.TranscodeOptions) error {
+			return transcodeFunc(ctx, path, target, options)
+		}), nil
+	}
+
+	os.Exit(m.Run())
+}
+
 func createDatabaseAndPopulate(t *testing.T, path string, entries []value.Entry) {
 	db, err := database.Create(path)
 	if err != nil {
@@ -35,24 +59,46 @@ func createDatabaseAndPopulate(t *testing.T, path string, entries []value.Entry)
 	defer db.Close()
 
 	for _, entry := range entries {
-		err = db.Upsert(entry)
+		_, err = db.Upsert(entry)
 		if err != nil {
 			t.Fatalf("Expected to be able to upsert entry: %v", err)
 		}
 	}
 }
 
+func readSummary(t *testing.T, path string) runSummary {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Expected to be able to read summary file: %v", err)
+	}
+
+	var summary runSummary
+
+	err = json.Unmarshal(data, &summary)
+	if err != nil {
+		t.Fatalf("Expected to be able to unmarshal summary: %v", err)
+	}
+
+	return summary
+}
+
 func assertDatabaseContains(t *testing.T, path string, expected []value.Entry) {
 	actual := make([]value.Entry, 0, len(expected))
 
+	// Only the columns which are populated when updating are compared
 	callback := func(scan sqlite.ScanCallback) error {
 		var entry value.Entry
-		err := scan(&entry.Path, &entry.Discovered, &entry.Transcoded, &entry.Hash)
+		err := entry.Scan(scan)
 		if err != nil {
 			return err
 		}
 
-		actual = append(actual, entry)
+		actual = append(actual, value.Entry{
+			Path:       entry.Path,
+			Discovered: entry.Discovered,
+			Transcoded: entry.Transcoded,
+			Hash:       entry.Hash,
+		})
 		return nil
 	}
 
@@ -62,10 +108,10 @@ func assertDatabaseContains(t *testing.T, path string, expected []value.Entry) {
 	}
 	defer db.Close()
 
-	query := sqlite.Query{Query: "select path, discovered, transcoded, hash from library;"}
+	query := sqlite.Query{Query: "select " + value.EntryColumns + " from library;"}
 
-	err = sqlite.QueryRows(db, query, callback)
-	if err != nil && !errors.Is(err, sqlite.ErrQueryReturnedNoRows) {
+	err = sqlite.QueryRowsAllowEmpty(db, query, callback)
+	if err != nil {
 		t.Fatalf("Expected to be able to query entries: %v", err)
 	}
 
@@ -103,3 +149,144 @@ func assertDatabaseContains(t *testing.T, path string, expected []value.Entry) {
 		}
 	}
 }
+
+// assumeYes - Skip confirmation prompts until the provided test completes, since the option is global it must be reset
+// to avoid hiding prompts from the remaining tests.
+func assumeYes(t *testing.T) {
+	rootOptions.yes = true
+	t.Cleanup(func() { rootOptions.yes = false })
+}
+
+func TestConfirmAssumeYes(t *testing.T) {
+	assumeYes(t)
+
+	proceed, err := confirm("continue?")
+	if err != nil {
+		t.Fatalf("Expected to be able to confirm: %v", err)
+	}
+
+	if !proceed {
+		t.Fatalf("Expected true but got false")
+	}
+}
+
+func TestConfirmNonInteractive(t *testing.T) {
+	rootOptions.yes = false
+
+	file, err := os.Create(filepath.Join(t.TempDir(), "stdin"))
+	if err != nil {
+		t.Fatalf("Expected to be able to create test file: %v", err)
+	}
+	defer file.Close()
+
+	confirmInput = file
+	defer func() { confirmInput = os.Stdin }()
+
+	proceed, err := confirm("continue?")
+	if err == nil || proceed {
+		t.Fatalf("Expected an error when stdin is not a terminal")
+	}
+}
+
+func TestMarkDatabaseRequired(t *testing.T) {
+	type test struct {
+		name     string
+		env      string
+		args     []string
+		expected string
+		err      bool
+	}
+
+	tests := []*test{
+		{
+			name: "Missing",
+			err:  true,
+		},
+		{
+			name:     "Flag",
+			args:     []string{"--database", "flag.db"},
+			expected: "flag.db",
+		},
+		{
+			name:     "Environment",
+			env:      "env.db",
+			expected: "env.db",
+		},
+		{
+			name:     "FlagOverridesEnvironment",
+			env:      "env.db",
+			args:     []string{"--database", "flag.db"},
+			expected: "flag.db",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			defer os.Unsetenv(databaseEnv)
+
+			if test.env != "" {
+				os.Setenv(databaseEnv, test.env)
+			}
+
+			var actual string
+
+			command := &cobra.Command{
+				RunE:          func(_ *cobra.Command, _ []string) error { return nil },
+				SilenceErrors: true,
+				SilenceUsage:  true,
+			}
+
+			command.Flags().StringVarP(&actual, "database", "d", "", "path to a goamt SQLite database")
+			markDatabaseRequired(command)
+
+			command.SetArgs(test.args)
+
+			err := command.Execute()
+			if test.err {
+				if err == nil {
+					t.Fatalf("Expected an error when no database is provided")
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Expected to be able to execute command: %v", err)
+			}
+
+			if actual != test.expected {
+				t.Fatalf("Expected database '%s' but got '%s'", test.expected, actual)
+			}
+		})
+	}
+}
+
+func TestUpsertOutcomes(t *testing.T) {
+	var outcomes upsertOutcomes
+
+	for _, outcome := range []database.UpsertOutcome{
+		database.UpsertInserted,
+		database.UpsertInserted,
+		database.UpsertUpdated,
+		database.UpsertSkipped,
+		database.UpsertInserted,
+	} {
+		outcomes.record(outcome)
+	}
+
+	var buffer bytes.Buffer
+
+	err := outcomes.write(&buffer)
+	if err != nil {
+		t.Fatalf("Expected to be able to write outcomes: %v", err)
+	}
+
+	expected := "inserted: 3\nupdated:  1\nskipped:  1\n"
+	if buffer.String() != expected {
+		t.Fatalf("Expected '%s' but got '%s'", expected, buffer.String())
+	}
+
+	// Recording outcomes is optional, so a nil receiver should be ignored
+	var none *upsertOutcomes
+	none.record(database.UpsertInserted)
+}
@@ -15,18 +15,95 @@
 package cmd
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"runtime/debug"
 
 	"github.com/jamesl33/goamt/version"
 
+	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
 )
 
+// versionOptions - Encapsulates the options for the version sub-command.
+var versionOptions = struct {
+	json bool
+}{}
+
 // versionCommand - The version sub-command, used to determine the current version of goamt.
 var versionCommand = &cobra.Command{
-	Use:   "version",
+	RunE:  versionRun,
 	Short: "Display version information",
-	Run: func(cmd *cobra.Command, args []string) {
-		fmt.Printf("goamt - %s\n", version.Version)
-	},
+	Use:   "version",
+}
+
+// init - Initialize the flags/arguments for the version sub-command.
+func init() {
+	versionCommand.Flags().BoolVar(
+		&versionOptions.json,
+		"json",
+		false,
+		"output machine readable version information, including the supported database versions",
+	)
+}
+
+// versionInfo - Machine readable version information, intended to be consumed by tooling which must check whether a
+// database is compatible before opening it.
+type versionInfo struct {
+	Version  string `json:"version"`
+	Database struct {
+		Minimum version.DatabaseVersion `json:"minimum"`
+		Maximum version.DatabaseVersion `json:"maximum"`
+	} `json:"database"`
+	Build struct {
+		Go     string `json:"go"`
+		OS     string `json:"os"`
+		Arch   string `json:"arch"`
+		Module string `json:"module,omitempty"`
+		Sum    string `json:"sum,omitempty"`
+	} `json:"build"`
+}
+
+// newVersionInfo - Gather the version information for the running binary, note that the module version/checksum are
+// only available when goamt was built as a module (e.g. using 'go install').
+func newVersionInfo() versionInfo {
+	info := versionInfo{Version: version.Version}
+
+	info.Database.Minimum = version.DatabaseVersionOne
+	info.Database.Maximum = version.DatabaseVersionCurrent
+
+	info.Build.Go = runtime.Version()
+	info.Build.OS = runtime.GOOS
+	info.Build.Arch = runtime.GOARCH
+
+	if build, ok := debug.ReadBuildInfo(); ok {
+		info.Build.Module, info.Build.Sum = build.Main.Version, build.Main.Sum
+	}
+
+	return info
+}
+
+// versionRun - Run the version sub-command, printing the version information to stdout.
+func versionRun(_ *cobra.Command, _ []string) error {
+	return writeVersion(os.Stdout, versionOptions.json)
+}
+
+// writeVersion - Write the version information to the provided writer, optionally as JSON.
+func writeVersion(writer io.Writer, asJSON bool) error {
+	if !asJSON {
+		_, err := fmt.Fprintf(writer, "goamt - %s\n", version.Version)
+		return err
+	}
+
+	data, err := json.Marshal(newVersionInfo())
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal version information")
+	}
+
+	_, err = writer.Write(append(data, '\n'))
+
+	return err
 }
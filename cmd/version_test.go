@@ -0,0 +1,65 @@
+// Copyright 2020 James Lee <jamesl33info@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"runtime"
+	"testing"
+
+	"github.com/jamesl33/goamt/version"
+)
+
+func TestWriteVersion(t *testing.T) {
+	var buffer bytes.Buffer
+
+	err := writeVersion(&buffer, false)
+	if err != nil {
+		t.Fatalf("Expected to be able to write version: %v", err)
+	}
+
+	if buffer.String() != "goamt - "+version.Version+"\n" {
+		t.Fatalf("Unexpected version output '%s'", buffer.String())
+	}
+}
+
+func TestWriteVersionJSON(t *testing.T) {
+	var buffer bytes.Buffer
+
+	err := writeVersion(&buffer, true)
+	if err != nil {
+		t.Fatalf("Expected to be able to write version: %v", err)
+	}
+
+	var info versionInfo
+
+	err = json.Unmarshal(buffer.Bytes(), &info)
+	if err != nil {
+		t.Fatalf("Expected to be able to unmarshal version information: %v", err)
+	}
+
+	if info.Version != version.Version {
+		t.Fatalf("Expected version '%s' but got '%s'", version.Version, info.Version)
+	}
+
+	if info.Database.Minimum != version.DatabaseVersionOne || info.Database.Maximum != version.DatabaseVersionCurrent {
+		t.Fatalf("Unexpected database versions %+v", info.Database)
+	}
+
+	if info.Build.Go != runtime.Version() || info.Build.OS != runtime.GOOS || info.Build.Arch != runtime.GOARCH {
+		t.Fatalf("Unexpected build information %+v", info.Build)
+	}
+}
@@ -0,0 +1,140 @@
+// Copyright 2020 James Lee <jamesl33info@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/pkg/errors"
+)
+
+// webhookTimeout - The maximum amount of time we'll wait for the webhook to respond, we don't want a slow/unreachable
+// webhook to prevent goamt from exiting.
+const webhookTimeout = 10 * time.Second
+
+const (
+	// webhookEventFailed - Sent when transcoding a file fails.
+	webhookEventFailed = "transcode_failed"
+
+	// webhookEventComplete - Sent when a run completes, regardless of whether it was successful.
+	webhookEventComplete = "run_complete"
+)
+
+// webhookPayload - The JSON payload which is posted to the webhook.
+type webhookPayload struct {
+	Event    string      `json:"event"`
+	Path     string      `json:"path,omitempty"`
+	Status   string      `json:"status"`
+	Duration float64     `json:"duration"`
+	Error    string      `json:"error,omitempty"`
+	Summary  *runSummary `json:"summary,omitempty"`
+}
+
+// webhookNotifier - Asynchronously posts notifications to a webhook, note that a nil notifier is valid and won't send
+// any notifications.
+type webhookNotifier struct {
+	url    string
+	client *http.Client
+	wg     sync.WaitGroup
+}
+
+// newWebhookNotifier - Create a new notifier which will post to the provided url, returns nil if the url is empty.
+func newWebhookNotifier(url string) *webhookNotifier {
+	if url == "" {
+		return nil
+	}
+
+	return &webhookNotifier{url: url, client: &http.Client{Timeout: webhookTimeout}}
+}
+
+// notifyFailed - Notify the webhook that transcoding the file at the provided path failed.
+func (w *webhookNotifier) notifyFailed(path string, duration time.Duration, err error) {
+	w.send(webhookPayload{
+		Event:    webhookEventFailed,
+		Path:     path,
+		Status:   "failed",
+		Duration: duration.Seconds(),
+		Error:    err.Error(),
+	})
+}
+
+// notifyComplete - Notify the webhook that the run has completed, the provided summary should already be complete.
+func (w *webhookNotifier) notifyComplete(summary *runSummary) {
+	status := "success"
+	if !summary.Success {
+		status = "failed"
+	}
+
+	w.send(webhookPayload{
+		Event:    webhookEventComplete,
+		Status:   status,
+		Duration: summary.Duration,
+		Error:    summary.Error,
+		Summary:  summary,
+	})
+}
+
+// send - Post the provided payload to the webhook in the background, failures are logged but otherwise ignored.
+func (w *webhookNotifier) send(payload webhookPayload) {
+	if w == nil {
+		return
+	}
+
+	w.wg.Add(1)
+
+	go func() {
+		defer w.wg.Done()
+
+		err := w.post(payload)
+		if err != nil {
+			log.WithError(err).WithField("event", payload.Event).Warn("Failed to send webhook notification")
+		}
+	}()
+}
+
+// post - Synchronously post the provided payload to the webhook.
+func (w *webhookNotifier) post(payload webhookPayload) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal payload")
+	}
+
+	resp, err := w.client.Post(w.url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook responded with status '%s'", resp.Status)
+	}
+
+	return nil
+}
+
+// wait - Wait for any in-flight notifications to be sent.
+func (w *webhookNotifier) wait() {
+	if w == nil {
+		return
+	}
+
+	w.wg.Wait()
+}
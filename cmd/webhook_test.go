@@ -0,0 +1,128 @@
+// Copyright 2020 James Lee <jamesl33info@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/jamesl33/goamt/utils"
+	"github.com/jamesl33/goamt/value"
+)
+
+func TestTranscodeWebhook(t *testing.T) {
+	var (
+		lock     sync.Mutex
+		payloads = make([]webhookPayload, 0)
+	)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload webhookPayload
+
+		err := json.NewDecoder(r.Body).Decode(&payload)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		lock.Lock()
+		payloads = append(payloads, payload)
+		lock.Unlock()
+	}))
+	defer server.Close()
+
+	tempDir := t.TempDir()
+
+	transcodeOptions.database = filepath.Join(tempDir, "goamt.db")
+	transcodeOptions.path = tempDir
+	transcodeOptions.outputDir = ""
+	transcodeOptions.webhookURL = server.URL
+	assumeYes(t)
+
+	defer func() { transcodeOptions.webhookURL = "" }()
+
+	initial := []value.Entry{
+		{
+			Path:       filepath.Join(tempDir, "untranscoded1.mkv"),
+			Discovered: 16,
+			Hash:       crc32.Checksum([]byte("0"), crc32.MakeTable(crc32.IEEE)),
+		},
+	}
+
+	err := ioutil.WriteFile(initial[0].Path, []byte("0"), 0o755)
+	if err != nil {
+		t.Fatalf("Expected to be able to create test file: %v", err)
+	}
+
+	createDatabaseAndPopulate(t, transcodeOptions.database, initial)
+
+	transcodeFunc = func(_ context.Context, _, _ string, _ utils.TranscodeOptions) error {
+		return fmt.Errorf("failed to run 'ffmpeg'")
+	}
+
+	err = transcode(nil, nil)
+	if err == nil {
+		t.Fatalf("Expected transcoding to fail")
+	}
+
+	if len(payloads) != 2 {
+		t.Fatalf("Expected 2 notifications but got %d", len(payloads))
+	}
+
+	// Notifications are sent asynchronously, so may arrive in any order
+	failed, complete := payloads[0], payloads[1]
+	if failed.Event == webhookEventComplete {
+		failed, complete = complete, failed
+	}
+
+	if failed.Event != webhookEventFailed || failed.Path != initial[0].Path || failed.Status != "failed" {
+		t.Fatalf("Expected a failure notification for '%s' but got %+v", initial[0].Path, failed)
+	}
+
+	if complete.Event != webhookEventComplete || complete.Status != "failed" || complete.Summary == nil {
+		t.Fatalf("Expected a failed run notification but got %+v", complete)
+	}
+
+	if complete.Summary.Failed != 1 {
+		t.Fatalf("Expected the summary to contain 1 failure but got %d", complete.Summary.Failed)
+	}
+}
+
+func TestWebhookNotifierUnreachable(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.Close()
+
+	notifier := newWebhookNotifier(server.URL)
+	notifier.notifyComplete(&runSummary{Command: "transcode", Success: true})
+	notifier.wait()
+}
+
+func TestWebhookNotifierNil(t *testing.T) {
+	notifier := newWebhookNotifier("")
+	if notifier != nil {
+		t.Fatalf("Expected a nil notifier when no url is provided")
+	}
+
+	notifier.notifyComplete(&runSummary{Command: "transcode", Success: true})
+	notifier.wait()
+}
@@ -16,8 +16,10 @@ package database
 
 import (
 	"database/sql"
+	"fmt"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -34,23 +36,154 @@ import (
 
 // Database - Represents a connection to a goamt SQLite database and exposes a thread safe interface.
 type Database struct {
-	db   *sql.DB
-	txns int
-	lock sync.Mutex
+	db        *sql.DB
+	txns      int
+	lock      sync.Mutex
+	algorithm utils.HashAlgorithm
+	root      string
+	readOnly  bool
 }
 
-// Create - Create a new database, returning an error if an existing database already exists.
+const (
+	// metadataHashAlgorithm - The metadata key used to record the algorithm used to hash entries.
+	metadataHashAlgorithm = "hash_algorithm"
+
+	// metadataRoot - The metadata key used to record the library root which paths are stored relative to, absent when
+	// paths are stored as provided (the default).
+	metadataRoot = "root"
+
+	// metadataCreated - The metadata key used to record when the database was created (as a unix timestamp), absent for
+	// databases created before it was recorded.
+	metadataCreated = "created"
+)
+
+// SelectOptions - Encapsulates the options which control how entries are selected/scheduled by 'BeginTranscoding'.
+type SelectOptions struct {
+	// Target - Returns the path where the provided entry will be transcoded to, this is recorded against the job so
+	// that it can be recovered. When nil, entries will be transcoded alongside the source file.
+	Target func(entry value.Entry) (string, error)
+
+	// Prefix - When non-empty, only entries whose path is equal to (or is within the directory) 'Prefix' are selected.
+	Prefix string
+
+	// Temporary - Returns the (absolute) path where the provided entry will be transcoded to before being moved
+	// alongside its target, this is recorded against the job so that it can be removed during recovery. When nil, or
+	// when an empty path is returned, entries will be transcoded alongside the target.
+	Temporary func(entry value.Entry) string
+
+	// Shuffle - Select a random entry (amongst those with the highest priority) rather than the oldest, allowing a varied
+	// sample of the library to be transcoded e.g. when comparing encoding options.
+	Shuffle bool
+
+	// Exclude - The ids of entries which won't be selected, even if they're otherwise selectable.
+	Exclude []int
+}
+
+// ListSorts - The orders in which entries may be listed by 'List', mapped to the 'order by' clause used; ties are
+// broken by the entry id so that paging through the entries is stable.
+var ListSorts = map[string]string{
+	"id":         "id asc",
+	"path":       "path asc, id asc",
+	"discovered": "discovered asc, id asc",
+}
+
+// ListOptions - Encapsulates the options which control which entries are returned by 'List', and in which order.
+type ListOptions struct {
+	// Prefix - When non-empty, only entries whose path is equal to (or is within the directory) 'Prefix' are listed.
+	Prefix string
+
+	// Pattern - When non-empty, only entries whose path contains 'Pattern' (ignoring the case of ASCII characters) are
+	// listed. When 'Glob' is set the pattern is instead a case sensitive glob, which must match the entire path.
+	Pattern string
+	Glob    bool
+
+	// TranscodedOnly - Only list entries which have been transcoded.
+	TranscodedOnly bool
+
+	// ExcludeKeptSources - Don't list entries whose source was kept when they were transcoded (e.g. to an output
+	// directory), these can't be reset by 'ResetTranscoded'.
+	ExcludeKeptSources bool
+
+	// Sort - The order (one of 'ListSorts') in which entries are listed, defaults to 'id' when empty.
+	Sort string
+
+	// Limit/Offset - The maximum number of entries to list (zero means no limit), after skipping 'Offset' entries.
+	Limit, Offset int
+}
+
+// JournalModes - The SQLite journal modes which may be used by 'Options'.
+var JournalModes = []string{"wal", "delete", "truncate", "persist", "memory", "off"}
+
+// SyncModes - The SQLite synchronous modes which may be used by 'Options', ordered from least to most durable.
+var SyncModes = []string{"off", "normal", "full", "extra"}
+
+// Options - Encapsulates the options which control how a database is opened for writing, the zero value uses the safe
+// defaults.
+type Options struct {
+	// Journal - The journal mode (one of 'JournalModes'), defaults to 'wal' when empty. Note that readers are only
+	// able to inspect the database whilst it's being written to when using 'wal'.
+	Journal string
+
+	// Sync - The synchronous mode (one of 'SyncModes'), defaults to 'extra' when empty. Relaxing this makes writes
+	// faster at the cost of durability; transactions committed just before a power loss/operating system crash may be
+	// lost, and using 'off' may leave the database corrupted.
+	Sync string
+}
+
+// validate - Returns an error if the options contain an unsupported journal/synchronous mode.
+func (o Options) validate() error {
+	if o.Journal != "" && !utils.ContainsString(JournalModes, o.Journal) {
+		return errors.Errorf("journal mode '%s' is not supported", o.Journal)
+	}
+
+	if o.Sync != "" && !utils.ContainsString(SyncModes, o.Sync) {
+		return errors.Errorf("synchronous mode '%s' is not supported", o.Sync)
+	}
+
+	return nil
+}
+
+// connection - Returns the connection options used to open the database using the provided access mode. Transactions
+// are started using 'begin immediate' so that concurrent goamt processes are serialized, rather than failing when
+// attempting to upgrade to a write lock (or selecting the same entry).
+func (o Options) connection(mode string) string {
+	journal := o.Journal
+	if journal == "" {
+		journal = "wal"
+	}
+
+	sync := o.Sync
+	if sync == "" {
+		sync = "extra"
+	}
+
+	return fmt.Sprintf("?_journal=%s&_mutex=full&_sync=%s&_txlock=immediate&mode=%s", journal, sync, mode)
+}
+
+// Create - Create a new database using the default options, returning an error if an existing database already
+// exists.
 func Create(path string) (*Database, error) {
+	return CreateWithOptions(path, Options{})
+}
+
+// CreateWithOptions - Create a new database using the provided options, returning an error if an existing database
+// already exists.
+func CreateWithOptions(path string, options Options) (*Database, error) {
+	err := options.validate()
+	if err != nil {
+		return nil, err
+	}
+
 	if utils.PathExists(path) {
 		return nil, &ErrAlreadyExists{what: "database", where: path}
 	}
 
-	db, err := sql.Open("sqlite3", path+"?_journal=wal&_mutex=full&_sync=extra&mode=rwc")
+	db, err := sql.Open("sqlite3", path+options.connection("rwc"))
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to open SQLite database")
 	}
 
-	err = sqlite.SetPragma(db, sqlite.PragmaUserVersion, version.DatabaseVersionCurrent)
+	err = sqlite.SetPragma(db, sqlite.PragmaUserVersion, version.DatabaseVersionOne)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to set 'user_version'")
 	}
@@ -91,261 +224,1559 @@ func Create(path string) (*Database, error) {
 		return nil, errors.Wrap(err, "failed to create jobs table")
 	}
 
+	// The tables above represent the initial schema, bring them up-to-date by running all the migrations
+	err = migrate(db, version.DatabaseVersionOne)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to migrate database")
+	}
+
+	query = sqlite.Query{
+		Query:     "insert into metadata (key, value) values (?, ?);",
+		Arguments: []interface{}{metadataCreated, strconv.FormatInt(time.Now().Unix(), 10)},
+	}
+
+	_, err = sqlite.ExecuteQuery(db, query)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to record creation time")
+	}
+
 	log.WithField("version", version.DatabaseVersionCurrent).Info("Created new database")
 
-	return &Database{db: db}, nil
+	return load(db)
+}
+
+// Open - Open an existing database using the default options, returning an error if the provided database is missing or
+// an unsupported version. Note that incomplete jobs aren't recovered, 'Recover' should be used by commands which
+// update/transcode entries.
+func Open(path string) (*Database, error) {
+	return OpenWithOptions(path, Options{})
+}
+
+// OpenWithOptions - Open an existing database using the provided options, see 'Open'.
+func OpenWithOptions(path string, options Options) (*Database, error) {
+	err := options.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	db, userVersion, err := open(path, options.connection("rw"))
+	if err != nil {
+		return nil, err
+	}
+
+	err = sqlite.SetPragma(db, sqlite.PragmaForiegnKeys, "on")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to set 'foreign_keys'")
+	}
+
+	if version.DatabaseVersion(userVersion) < version.DatabaseVersionCurrent {
+		fields := log.Fields{"from": userVersion, "to": version.DatabaseVersionCurrent}
+		log.WithFields(fields).Info("Migrating database")
+
+		err = migrate(db, version.DatabaseVersion(userVersion))
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to migrate database")
+		}
+	}
+
+	return load(db)
+}
+
+// OpenReadOnly - Open an existing database without modifying it, allowing it to be safely inspected (even whilst it's
+// being written to by another process). Unlike 'Open', the database isn't migrated; an error is returned if the
+// database must first be migrated.
+func OpenReadOnly(path string) (*Database, error) {
+	// Note that the 'mode' parameter is only honoured for 'file:' URIs, so 'query_only' is used to prevent writes
+	db, userVersion, err := open(path, "?_mutex=full&_query_only=true")
+	if err != nil {
+		return nil, err
+	}
+
+	if version.DatabaseVersion(userVersion) < version.DatabaseVersionCurrent {
+		db.Close()
+		return nil, &ErrRequiresMigration{what: "database", where: path, found: version.DatabaseVersion(userVersion)}
+	}
+
+	database, err := load(db)
+	if err != nil {
+		return nil, err
+	}
+
+	database.readOnly = true
+
+	return database, nil
+}
+
+// load - Load the metadata for the provided (up-to-date) database, closing it in the event of an error.
+func load(db *sql.DB) (*Database, error) {
+	query := sqlite.Query{
+		Query:     "select value from metadata where key = ?;",
+		Arguments: []interface{}{metadataHashAlgorithm},
+	}
+
+	var algorithm utils.HashAlgorithm
+
+	err := sqlite.QueryRow(db, query, &algorithm)
+	if err != nil {
+		db.Close()
+		return nil, errors.Wrap(err, "failed to get hash algorithm")
+	}
+
+	if !algorithm.Supported() {
+		db.Close()
+		return nil, errors.Errorf("hash algorithm '%s' is not supported", algorithm)
+	}
+
+	var root string
+
+	query.Arguments = []interface{}{metadataRoot}
+
+	err = sqlite.QueryRow(db, query, &root)
+	if err != nil && !errors.Is(err, sqlite.ErrQueryReturnedNoRows) {
+		db.Close()
+		return nil, errors.Wrap(err, "failed to get library root")
+	}
+
+	return &Database{db: db, algorithm: algorithm, root: root}, nil
+}
+
+// HashAlgorithm - Returns the algorithm used to hash the entries in the database, files must be hashed using this
+// algorithm when upserting entries.
+func (d *Database) HashAlgorithm() utils.HashAlgorithm {
+	return d.algorithm
+}
+
+// VerifyHashAlgorithm - Returns an 'ErrHashAlgorithmMismatch' error if the provided algorithm differs from the one used
+// to hash the entries in the database.
+func (d *Database) VerifyHashAlgorithm(algorithm utils.HashAlgorithm) error {
+	if algorithm != d.algorithm {
+		return &ErrHashAlgorithmMismatch{expected: d.algorithm, actual: algorithm}
+	}
+
+	return nil
+}
+
+// SetHashAlgorithm - Set the algorithm used to hash entries, this may only be changed whilst the database is empty
+// since it would invalidate the hashes of any existing entries.
+func (d *Database) SetHashAlgorithm(algorithm utils.HashAlgorithm) error {
+	if !algorithm.Supported() {
+		return errors.Errorf("hash algorithm '%s' is not supported", algorithm)
+	}
+
+	return d.wrapTransaction(func(tx *sql.Tx) error {
+		var entries int
+
+		err := sqlite.QueryRow(tx, sqlite.Query{Query: "select count(*) from library;"}, &entries)
+		if err != nil {
+			return errors.Wrap(err, "failed to count entries")
+		}
+
+		if entries != 0 && algorithm != d.algorithm {
+			return &ErrHashAlgorithmMismatch{expected: d.algorithm, actual: algorithm}
+		}
+
+		query := sqlite.Query{
+			Query:     "update metadata set value = ? where key = ?;",
+			Arguments: []interface{}{algorithm, metadataHashAlgorithm},
+		}
+
+		_, err = sqlite.ExecuteQuery(tx, query)
+		if err != nil {
+			return errors.Wrap(err, "failed to update metadata")
+		}
+
+		d.algorithm = algorithm
+
+		return nil
+	})
+}
+
+// Info - Returns a summary of the database, including its versions, metadata and the number of entries/jobs.
+func (d *Database) Info() (value.Info, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	info := value.Info{HashAlgorithm: string(d.algorithm), Root: d.root}
+
+	err := sqlite.GetPragma(d.db, sqlite.PragmaUserVersion, &info.UserVersion)
+	if err != nil {
+		return value.Info{}, errors.Wrap(err, "failed to get 'user_version'")
+	}
+
+	err = sqlite.GetPragma(d.db, sqlite.PragmaSchemaVersion, &info.SchemaVersion)
+	if err != nil {
+		return value.Info{}, errors.Wrap(err, "failed to get 'schema_version'")
+	}
+
+	query := sqlite.Query{
+		Query:     "select cast(value as integer) from metadata where key = ?;",
+		Arguments: []interface{}{metadataCreated},
+	}
+
+	err = sqlite.QueryRow(d.db, query, &info.Created)
+	if err != nil && !errors.Is(err, sqlite.ErrQueryReturnedNoRows) {
+		return value.Info{}, errors.Wrap(err, "failed to get creation time")
+	}
+
+	query = sqlite.Query{
+		Query: `select
+				count(*),
+				count(transcoded),
+				coalesce(sum(transcoded is null and hash is not null and quarantined is null), 0),
+				coalesce(sum(hash is null), 0),
+				count(quarantined),
+				(select count(*) from jobs)
+			from library;`,
+	}
+
+	err = sqlite.QueryRow(d.db, query, &info.Entries, &info.Transcoded, &info.Untranscoded, &info.Unhashed,
+		&info.Quarantined, &info.Jobs)
+	if err != nil {
+		return value.Info{}, errors.Wrap(err, "failed to count entries")
+	}
+
+	return info, nil
+}
+
+// Root - Returns the library root which paths are stored relative to, empty when paths are stored as provided.
+func (d *Database) Root() string {
+	return d.root
+}
+
+// SetRoot - Store paths relative to the provided library root (rather than as provided), recording it in the database.
+// This may only be changed whilst the database is empty since existing paths would be stored differently; an empty
+// root stores paths as provided.
+func (d *Database) SetRoot(root string) error {
+	if root != "" {
+		absolute, err := filepath.Abs(root)
+		if err != nil {
+			return errors.Wrap(err, "failed to get absolute library root")
+		}
+
+		root = absolute
+	}
+
+	return d.wrapTransaction(func(tx *sql.Tx) error {
+		var entries int
+
+		err := sqlite.QueryRow(tx, sqlite.Query{Query: "select count(*) from library;"}, &entries)
+		if err != nil {
+			return errors.Wrap(err, "failed to count entries")
+		}
+
+		if entries != 0 && root != d.root {
+			return errors.New("library root can't be changed once the database contains entries")
+		}
+
+		query := sqlite.Query{Query: "delete from metadata where key = ?;", Arguments: []interface{}{metadataRoot}}
+
+		if root != "" {
+			query = sqlite.Query{
+				Query:     "insert or replace into metadata (key, value) values (?, ?);",
+				Arguments: []interface{}{metadataRoot, root},
+			}
+		}
+
+		_, err = sqlite.ExecuteQuery(tx, query)
+		if err != nil {
+			return errors.Wrap(err, "failed to update metadata")
+		}
+
+		d.root = root
+
+		return nil
+	})
+}
+
+// OverrideRoot - Resolve the relative paths in the database against the provided root for the lifetime of this
+// connection without modifying the recorded root, for example when the library is mounted elsewhere. Returns an error
+// if paths in the database aren't stored relative to a root.
+func (d *Database) OverrideRoot(root string) error {
+	if d.root == "" {
+		return errors.New("database doesn't store paths relative to a library root")
+	}
+
+	absolute, err := filepath.Abs(root)
+	if err != nil {
+		return errors.Wrap(err, "failed to get absolute library root")
+	}
+
+	log.WithFields(log.Fields{"recorded": d.root, "root": absolute}).Info("Overriding library root")
+
+	d.root = absolute
+
+	return nil
+}
+
+// WithinRoot - Returns a boolean indicating whether the provided path may be stored in the database, this is always the
+// case unless paths are stored relative to a library root.
+func (d *Database) WithinRoot(path string) bool {
+	_, err := d.relative(path)
+	return err == nil
+}
+
+// relative - Returns the provided path as it should be stored in the database; when paths are stored relative to a
+// library root, the path is made relative to it (relative paths are first made absolute using the working directory).
+func (d *Database) relative(path string) (string, error) {
+	if d.root == "" {
+		return path, nil
+	}
+
+	absolute, err := filepath.Abs(path)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to get absolute path")
+	}
+
+	relative, err := filepath.Rel(d.root, absolute)
+	if err != nil || relative == ".." || strings.HasPrefix(relative, ".."+string(filepath.Separator)) {
+		return "", &ErrOutsideRoot{path: path, root: d.root}
+	}
+
+	return relative, nil
+}
+
+// resolve - Returns the provided path (as stored in the database) resolved against the library root, if any.
+func (d *Database) resolve(path string) string {
+	if d.root == "" || filepath.IsAbs(path) {
+		return path
+	}
+
+	return filepath.Join(d.root, path)
+}
+
+// prefixCondition - Returns a condition (and its arguments) which matches entries whose path is equal to (or is within
+// the directory) 'prefix'. Absolute prefixes are made relative when paths are stored relative to a library root,
+// otherwise the prefix should be as stored in the database.
+func (d *Database) prefixCondition(prefix string) (string, []interface{}, error) {
+	if d.root == "" || !filepath.IsAbs(prefix) {
+		condition, arguments := prefixCondition(prefix)
+		return condition, arguments, nil
+	}
+
+	relative, err := d.relative(prefix)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// The prefix is the library root itself, which contains every entry
+	if relative == "." {
+		return "1 = 1", nil, nil
+	}
+
+	condition, arguments := prefixCondition(relative)
+
+	return condition, arguments, nil
+}
+
+// open - Open the existing database at the provided path using the given connection options, returning its version
+// once it has been validated.
+func open(path, options string) (*sql.DB, uint32, error) {
+	if !utils.PathExists(path) {
+		return nil, 0, &ErrNotFound{what: "database", where: path}
+	}
+
+	db, err := sql.Open("sqlite3", path+options)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "failed to open SQLite database")
+	}
+
+	var userVersion uint32
+	err = sqlite.GetPragma(db, sqlite.PragmaUserVersion, &userVersion)
+	if err != nil {
+		db.Close()
+		return nil, 0, errors.Wrap(err, "failed to get 'user_version'")
+	}
+
+	log.WithField("version", userVersion).Info("Opened existing database")
+
+	if !version.DatabaseVersion(userVersion).Supported() {
+		db.Close()
+		return nil, 0, &ErrUnknownVersion{what: "database", where: path, found: version.DatabaseVersion(userVersion)}
+	}
+
+	return db, userVersion, nil
+}
+
+// Recover - Scan then handle any in-progress transcode jobs left behind by an interrupted run; this will revert or
+// complete jobs depending on their status, renaming/removing files as required. This should be called after opening
+// the database by commands which update/transcode entries.
+func (d *Database) Recover() error {
+	callback := func(scan sqlite.ScanCallback) error {
+		var (
+			entry             value.Entry
+			target, temporary *string
+			finished          *int64
+		)
+
+		err := entry.Scan(scan, &target, &temporary, &finished)
+		if err != nil {
+			return errors.Wrap(err, "failed to scan incomplete job information")
+		}
+
+		entry.Path = d.resolve(entry.Path)
+
+		if target != nil {
+			target = utils.StringP(d.resolve(*target))
+		}
+
+		log.WithFields(entry).Warn("Found incomplete job")
+
+		// Jobs created by older versions of goamt won't have a target, they will always have been transcoded alongside
+		// the source file.
+		if target == nil {
+			target = utils.StringP(utils.ReplaceExtension(entry.Path, value.TargetExtension))
+		}
+
+		if incompleteJobTranscoded(*target, finished != nil) {
+			err = d.completeIncompleteJob(entry, *target)
+		} else {
+			err = d.rollbackIncompleteJob(entry, *target)
+		}
+
+		if err != nil || temporary == nil {
+			return err
+		}
+
+		// Transcoded files are moved alongside the target before the job is completed, so a file left in the temporary
+		// directory is either incomplete or a copy which wasn't removed (and has been handled above)
+		err = os.Remove(*temporary)
+		if err != nil && !os.IsNotExist(err) {
+			log.WithError(err).WithFields(entry).Warn("Failed to remove temporary transcode file")
+		}
+
+		return nil
+	}
+
+	query := sqlite.Query{
+		Query: `select ` + value.EntryColumns + `, target, temporary, finished from jobs
+				inner join library on jobs.library_id = library.id`,
+	}
+
+	err := sqlite.QueryRowsAllowEmpty(d.db, query, callback)
+	if err != nil {
+		return errors.Wrap(err, "failed to query incomplete jobs")
+	}
+
+	return nil
+}
+
+// incompleteJobTranscoded - Returns a boolean indicating whether the incomplete job had finished transcoding to the
+// given target. Files are only moved/removed once the job has been marked as finished (see 'FinishedTranscoding'), so
+// an unfinished job always has its source intact and is rolled back; a file at the target can't be assumed to have been
+// written by the job (e.g. it may have existed beforehand, or be the output of an earlier run).
+func incompleteJobTranscoded(target string, finished bool) bool {
+	return finished && (utils.PathExists(utils.ReplaceExtension(target, value.TranscodingExtension)) ||
+		utils.PathExists(target))
+}
+
+// completeIncompleteJob - Complete the incomplete transcode job for the provided entry. The job is only removed once
+// the files are in place, each step leaves the files in a state which 'incompleteJobTranscoded' recognizes as complete
+// so a crash part way through will result in the job being completed by the next recovery.
+func (d *Database) completeIncompleteJob(entry value.Entry, target string) error {
+	log.WithFields(entry).Info("Completing incomplete job")
+
+	err := utils.DurableMove(utils.ReplaceExtension(target, value.TranscodingExtension), target)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "failed to rename incomplete transcode file")
+	}
+
+	// The transcoded file is moved into place before the source file is removed, so we may have crashed before it was
+	// removed. We don't know whether the source was meant to be kept, so err on the side of caution and keep it using
+	// the same extension as '--keep-source' (which is ignored by the update sub-command).
+	if target != entry.Path && filepath.Dir(target) == filepath.Dir(entry.Path) && utils.PathExists(entry.Path) {
+		log.WithFields(entry).Warn("Found source file for completed job, renaming it")
+
+		err = utils.DurableMove(entry.Path, entry.Path+value.OriginalExtension)
+		if err != nil {
+			return errors.Wrap(err, "failed to rename source file")
+		}
+	}
+
+	// The source is left in place when transcoding to an output directory, it must be recorded so that it's not added
+	// again by the next update
+	var source string
+	if filepath.Dir(target) != filepath.Dir(entry.Path) && utils.PathExists(entry.Path) {
+		source = entry.Path
+	}
+
+	entry.Path = target
+
+	err = d.completeTranscoding(entry, source)
+	if err != nil {
+		return errors.Wrap(err, "failed to mark transcoding complete")
+	}
+
+	return nil
+}
+
+// rollbackIncompleteJob - Rollback the incomplete transcode job for the provided entry. The job is removed before the
+// incomplete transcode file, since removing the file first and crashing (when a file already exists at the target)
+// would result in the job being completed by the next recovery. A leftover transcode file is harmless, it's removed
+// before the entry is next transcoded.
+func (d *Database) rollbackIncompleteJob(entry value.Entry, target string) error {
+	log.WithFields(entry).Info("Rolling back incomplete job")
+
+	err := d.cancelTranscoding(entry, false)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(utils.ReplaceExtension(target, value.TranscodingExtension))
+	if err != nil && !os.IsNotExist(err) {
+		log.WithError(err).WithFields(entry).Warn("Failed to remove incomplete transcode file")
+	}
+
+	return nil
+}
+
+// addJob - Add a new job to the jobs table indicating the provided entry is going to be transcoded to the given target
+// path; an empty target indicates the entry will be transcoded alongside the source file. The temporary path is empty
+// unless a temporary directory is being used, it's outside of the library so is always stored as provided.
+func (d *Database) addJob(db sqlite.Executable, entry value.Entry, target, temporary string) error {
+	log.WithFields(entry).Debug("Added job for entry")
+
+	var targetP *string
+	if target != "" {
+		relative, err := d.relative(target)
+		if err != nil {
+			return err
+		}
+
+		targetP = &relative
+	}
+
+	var temporaryP *string
+	if temporary != "" {
+		temporaryP = &temporary
+	}
+
+	query := sqlite.Query{
+		Query:     "insert into jobs (library_id, start_time, target, temporary) values (?, ?, ?, ?);",
+		Arguments: []interface{}{entry.ID, time.Now().Unix(), targetP, temporaryP},
+	}
+
+	_, err := sqlite.ExecuteQuery(db, query)
+	return err
+}
+
+// removeJob - Remove the job corresponding to the provided entry from the jobs table.
+func (d *Database) removeJob(db sqlite.Executable, entry value.Entry) error {
+	log.WithFields(entry).Debug("Removing job for entry")
+
+	query := sqlite.Query{
+		Query:     "delete from jobs where library_id = ?;",
+		Arguments: []interface{}{entry.ID},
+	}
+
+	_, err := sqlite.ExecuteQuery(db, query)
+	return err
+}
+
+// Checkpoint - Copy the contents of the write-ahead log into the database file then truncate it, this waits for any
+// other connections (e.g. concurrent goamt processes) to finish writing.
+func (d *Database) Checkpoint() error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	return d.checkpointLOCKED()
+}
+
+// checkpointLOCKED - See 'Checkpoint'.
+func (d *Database) checkpointLOCKED() error {
+	busy, err := sqlite.Checkpoint(d.db, sqlite.CheckpointTruncate)
+	if err != nil {
+		return errors.Wrap(err, "failed to checkpoint write-ahead log")
+	}
+
+	if busy {
+		return errors.New("checkpoint was blocked by another connection")
+	}
+
+	return nil
+}
+
+// Close - Close the database, the database should not be used after it has been closed. The write-ahead log is
+// checkpointed first so that it doesn't remain large after a long run, failing to do so is logged but isn't fatal;
+// read-only databases aren't checkpointed since they won't have written anything.
+func (d *Database) Close() error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	log.Info("Closing database")
+
+	if !d.readOnly {
+		err := d.checkpointLOCKED()
+		if err != nil {
+			log.WithError(err).Warn("Failed to checkpoint database")
+		}
+	}
+
+	defer func() {
+		d.db = nil
+		d.txns = 0
+	}()
+
+	return d.db.Close()
+}
+
+// UpsertOutcome - Describes the effect that upserting an entry had on the database.
+type UpsertOutcome int
+
+const (
+	// UpsertSkipped - An entry already existed for the file and was left unchanged.
+	UpsertSkipped UpsertOutcome = iota
+
+	// UpsertInserted - A new entry was added for the file.
+	UpsertInserted
+
+	// UpsertUpdated - An existing entry was modified; either it was renamed, replaced because the file at its path had
+	// changed or had its source codec/dimensions/duration populated.
+	UpsertUpdated
+)
+
+// Upsert - Update or insert the provided entry into the database. An existing entry with the same hash whose file no
+// longer exists is treated as having been renamed, otherwise files with identical contents are recorded as separate
+// entries. The source codec/dimensions/duration of an existing entry are only populated if they were previously
+// unknown.
+func (d *Database) Upsert(entry value.Entry) (UpsertOutcome, error) {
+	path, err := d.relative(entry.Path)
+	if err != nil {
+		return UpsertSkipped, err
+	}
+
+	entry.Path = path
+
+	var outcome UpsertOutcome
+
+	err = d.wrapTransaction(func(tx *sql.Tx) error {
+		var transcoded bool
+
+		err := sqlite.QueryRow(tx, sqlite.Query{
+			Query:     "select exists(select 1 from library where source_path = ? and source_hash = ?);",
+			Arguments: []interface{}{entry.Path, entry.Hash},
+		}, &transcoded)
+		if err != nil {
+			return errors.Wrap(err, "failed to check for transcoded source")
+		}
+
+		// The file is the source of an entry which was transcoded to an output directory, it has already been handled
+		if transcoded {
+			log.WithFields(entry).Debug("Skipping source file which has already been transcoded")
+
+			outcome = UpsertSkipped
+
+			return nil
+		}
+
+		log.WithFields(entry).Info("Adding entry")
+
+		var existing bool
+
+		err = sqlite.QueryRow(tx, sqlite.Query{
+			Query:     "select exists(select 1 from library where path = ?);",
+			Arguments: []interface{}{entry.Path},
+		}, &existing)
+		if err != nil {
+			return errors.Wrap(err, "failed to check for existing entry")
+		}
+
+		err = d.replaceUnhashed(tx, &entry)
+		if err != nil {
+			return errors.Wrap(err, "failed to replace unhashed entry")
+		}
+
+		renamed, err := d.findRenamed(tx, entry)
+		if err != nil {
+			return errors.Wrap(err, "failed to find renamed entry")
+		}
+
+		// The file at this path has changed (or been replaced by a renamed file) so any existing entry is stale
+		query := sqlite.Query{
+			Query:     "delete from library where path = ? and hash != ?;",
+			Arguments: []interface{}{entry.Path, entry.Hash},
+		}
+
+		if renamed != nil {
+			query = sqlite.Query{Query: "delete from library where path = ?;", Arguments: []interface{}{entry.Path}}
+		}
+
+		_, err = sqlite.ExecuteQuery(tx, query)
+		if err != nil {
+			return errors.Wrap(err, "failed to remove stale entry")
+		}
+
+		query = sqlite.Query{
+			Query: `insert into library
+				(path, discovered, transcoded, hash, source_codec, source_width, source_height, duration)
+				values (?, ?, ?, ?, ?, ?, ?, ?)
+				on conflict(path) do update set
+					source_codec=coalesce(source_codec, excluded.source_codec),
+					source_width=coalesce(source_width, excluded.source_width),
+					source_height=coalesce(source_height, excluded.source_height),
+					duration=coalesce(duration, excluded.duration)
+				where (source_codec is null and excluded.source_codec is not null) or
+					(duration is null and excluded.duration is not null);`,
+			Arguments: []interface{}{
+				entry.Path,
+				entry.Discovered,
+				entry.Transcoded,
+				entry.Hash,
+				entry.SourceCodec,
+				entry.SourceWidth,
+				entry.SourceHeight,
+				entry.Duration,
+			},
+		}
+
+		if renamed != nil {
+			query = sqlite.Query{
+				Query: `update library set
+					path = :path,
+					source_codec=coalesce(source_codec, :source_codec),
+					source_width=coalesce(source_width, :source_width),
+					source_height=coalesce(source_height, :source_height),
+					duration=coalesce(duration, :duration)
+				where id = :id;`,
+				Arguments: []interface{}{
+					sql.Named("path", entry.Path),
+					sql.Named("source_codec", entry.SourceCodec),
+					sql.Named("source_width", entry.SourceWidth),
+					sql.Named("source_height", entry.SourceHeight),
+					sql.Named("duration", entry.Duration),
+					sql.Named("id", *renamed),
+				},
+			}
+		}
+
+		affected, err := sqlite.ExecuteQuery(tx, query)
+		if err != nil {
+			return errors.Wrap(err, "failed to execute query")
+		}
+
+		// The insert is ignored (affecting no rows) when the existing entry is already up-to-date
+		switch {
+		case affected == 0:
+			outcome = UpsertSkipped
+		case existing || renamed != nil:
+			outcome = UpsertUpdated
+		default:
+			outcome = UpsertInserted
+		}
+
+		return nil
+	})
+
+	return outcome, err
+}
+
+// findRenamed - Returns the id of the entry which the provided entry (whose path is as stored) was renamed from (if
+// any), this is the first entry with the same hash whose file no longer exists. Returns nil if an entry already exists
+// for the same file.
+func (d *Database) findRenamed(tx *sql.Tx, entry value.Entry) (*int64, error) {
+	var (
+		renamed  *int64
+		existing bool
+	)
+
+	callback := func(scan sqlite.ScanCallback) error {
+		var (
+			id   int64
+			path string
+		)
+
+		err := scan(&id, &path)
+		if err != nil {
+			return errors.Wrap(err, "failed to scan entry")
+		}
+
+		existing = existing || path == entry.Path
+
+		if renamed == nil && path != entry.Path && !utils.PathExists(d.resolve(path)) {
+			renamed = &id
+		}
+
+		return nil
+	}
+
+	query := sqlite.Query{
+		Query:     "select id, path from library where hash = ? order by id asc;",
+		Arguments: []interface{}{entry.Hash},
+	}
+
+	err := sqlite.QueryRowsAllowEmpty(tx, query, callback)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to query database")
+	}
+
+	if existing {
+		return nil, nil
+	}
+
+	return renamed, nil
+}
+
+// InsertUnhashed - Insert the provided entry without a hash, this allows a library to be quickly inventoried. Existing
+// entries are left untouched and unhashed entries won't be selected for transcoding until they've been upserted (i.e.
+// hashed by an update).
+func (d *Database) InsertUnhashed(entry value.Entry) (UpsertOutcome, error) {
+	path, err := d.relative(entry.Path)
+	if err != nil {
+		return UpsertSkipped, err
+	}
+
+	entry.Path = path
+
+	var outcome UpsertOutcome
+
+	err = d.wrapTransaction(func(tx *sql.Tx) error {
+		log.WithFields(entry).Info("Adding unhashed entry")
+
+		// Source files which were transcoded to an output directory are skipped, they can't be compared by hash here
+		query := sqlite.Query{
+			Query: `insert or ignore into library (path, discovered)
+				select ?, ? where not exists (select 1 from library where source_path = ?);`,
+			Arguments: []interface{}{entry.Path, entry.Discovered, entry.Path},
+		}
+
+		affected, err := sqlite.ExecuteQuery(tx, query)
+		if err != nil {
+			return errors.Wrap(err, "failed to execute query")
+		}
+
+		outcome = UpsertSkipped
+		if affected != 0 {
+			outcome = UpsertInserted
+		}
+
+		return nil
+	})
+
+	return outcome, err
+}
+
+// replaceUnhashed - Remove the unhashed entry (if any) with the same path as the provided entry so that it may be
+// replaced when upserting; the provided entry inherits the time the unhashed entry was discovered.
+func (d *Database) replaceUnhashed(tx *sql.Tx, entry *value.Entry) error {
+	query := sqlite.Query{
+		Query:     "select discovered from library where path = ? and hash is null;",
+		Arguments: []interface{}{entry.Path},
+	}
+
+	err := sqlite.QueryRow(tx, query, &entry.Discovered)
+	if errors.Is(err, sqlite.ErrQueryReturnedNoRows) {
+		return nil
+	}
+
+	if err != nil {
+		return errors.Wrap(err, "failed to query database")
+	}
+
+	query.Query = "delete from library where path = ? and hash is null;"
+
+	_, err = sqlite.ExecuteQuery(tx, query)
+	if err != nil {
+		return errors.Wrap(err, "failed to execute query")
+	}
+
+	return nil
+}
+
+// Remove - Remove the provided entry from the database returning the number of entries which were removed (zero if it
+// had already been removed); this will also remove any incomplete jobs for the provided entry.
+func (d *Database) Remove(entry value.Entry) (int64, error) {
+	var removed int64
+
+	return removed, d.wrapTransaction(func(tx *sql.Tx) error {
+		log.WithFields(entry).Info("Removing entry")
+
+		err := d.removeJob(tx, entry)
+		if err != nil {
+			return errors.Wrap(err, "failed to remove job")
+		}
+
+		query := sqlite.Query{
+			Query:     "delete from library where id = ?;",
+			Arguments: []interface{}{entry.ID},
+		}
+
+		removed, err = sqlite.ExecuteQuery(tx, query)
+		if err != nil {
+			return errors.Wrap(err, "failed to execute query")
+		}
+
+		return nil
+	})
+}
+
+// FindByHash - Retrieve the entry with the provided hash, returns an 'ErrQueryReturnedNoRows' error if there's none.
+// Files with identical contents may be recorded as separate entries, in which case the oldest entry is returned.
+func (d *Database) FindByHash(hash uint32) (value.Entry, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	query := sqlite.Query{
+		Query:     "select " + value.EntryColumns + " from library where hash = ? order by id asc limit 1;",
+		Arguments: []interface{}{hash},
+	}
+
+	var entry value.Entry
+
+	err := sqlite.QueryRows(d.db, query, func(scan sqlite.ScanCallback) error { return entry.Scan(scan) })
+	if err != nil {
+		return value.Entry{}, errors.Wrap(err, "failed to query database")
+	}
+
+	entry.Path = d.resolve(entry.Path)
+
+	return entry, nil
+}
+
+// FindByPath - Retrieve the entry recorded at the provided path, returns an 'ErrQueryReturnedNoRows' error if there's
+// none.
+func (d *Database) FindByPath(path string) (value.Entry, error) {
+	relative, err := d.relative(path)
+	if err != nil {
+		return value.Entry{}, err
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	query := sqlite.Query{
+		Query:     "select " + value.EntryColumns + " from library where path = ?;",
+		Arguments: []interface{}{relative},
+	}
+
+	var entry value.Entry
+
+	err = sqlite.QueryRows(d.db, query, func(scan sqlite.ScanCallback) error { return entry.Scan(scan) })
+	if err != nil {
+		return value.Entry{}, errors.Wrap(err, "failed to query database")
+	}
+
+	entry.Path = d.resolve(entry.Path)
+
+	return entry, nil
+}
+
+// List - Returns the entries in the database which match the provided options.
+func (d *Database) List(options ListOptions) ([]value.Entry, error) {
+	sort := options.Sort
+	if sort == "" {
+		sort = "id"
+	}
+
+	order, ok := ListSorts[sort]
+	if !ok {
+		return nil, errors.Errorf("unknown sort '%s'", sort)
+	}
+
+	if options.Limit < 0 || options.Offset < 0 {
+		return nil, errors.Errorf("limit %d and offset %d must not be negative", options.Limit, options.Offset)
+	}
+
+	conditions := []string{"1 = 1"}
+
+	var arguments []interface{}
+
+	if options.Prefix != "" {
+		condition, args, err := d.prefixCondition(options.Prefix)
+		if err != nil {
+			return nil, err
+		}
+
+		conditions = append(conditions, condition)
+		arguments = append(arguments, args...)
+	}
+
+	if options.Pattern != "" && options.Glob {
+		conditions = append(conditions, "path glob ?")
+		arguments = append(arguments, options.Pattern)
+	}
+
+	if options.Pattern != "" && !options.Glob {
+		conditions = append(conditions, `path like ? escape '\'`)
+		arguments = append(arguments, "%"+escapeLike(options.Pattern)+"%")
+	}
+
+	if options.TranscodedOnly {
+		conditions = append(conditions, "transcoded is not null")
+	}
+
+	if options.ExcludeKeptSources {
+		conditions = append(conditions, "source_path is null")
+	}
+
+	// SQLite treats a negative limit as no limit, and an offset may only be provided alongside a limit
+	limit := options.Limit
+	if limit == 0 {
+		limit = -1
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	entries := make([]value.Entry, 0)
+
+	callback := func(scan sqlite.ScanCallback) error {
+		var entry value.Entry
+
+		err := entry.Scan(scan)
+		if err != nil {
+			return errors.Wrap(err, "failed to scan entry")
+		}
+
+		entry.Path = d.resolve(entry.Path)
+
+		entries = append(entries, entry)
+
+		return nil
+	}
+
+	query := sqlite.Query{
+		Query: fmt.Sprintf(`select %s from library where %s order by %s limit ? offset ?;`, value.EntryColumns,
+			strings.Join(conditions, " and "), order),
+		Arguments: append(arguments, limit, options.Offset),
+	}
+
+	err := sqlite.QueryRowsAllowEmpty(d.db, query, callback)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to query entries")
+	}
+
+	return entries, nil
+}
+
+// SetPriority - Set the priority of all the entries whose path is equal to (or is within the directory) 'prefix',
+// returning the number of entries which were updated. Entries with a higher priority will be transcoded first.
+func (d *Database) SetPriority(prefix string, priority int) (int64, error) {
+	var updated int64
+
+	condition, arguments, err := d.prefixCondition(prefix)
+	if err != nil {
+		return 0, err
+	}
+
+	return updated, d.wrapTransaction(func(tx *sql.Tx) error {
+		query := sqlite.Query{
+			Query:     "update library set priority = ? where " + condition + ";",
+			Arguments: append([]interface{}{priority}, arguments...),
+		}
+
+		var err error
+
+		updated, err = sqlite.ExecuteQuery(tx, query)
+		if err != nil {
+			return errors.Wrap(err, "failed to update database")
+		}
+
+		log.WithFields(log.Fields{"prefix": prefix, "priority": priority, "updated": updated}).
+			Info("Updated entry priority")
+
+		return nil
+	})
 }
 
-// Open - Open an existing database returning an error if the provided database is missing or an unsupported version.
-func Open(path string) (*Database, error) {
-	if !utils.PathExists(path) {
-		return nil, &ErrNotFound{what: "database", where: path}
-	}
+// BeginTranscoding - Retrieve an untranscoded entry from the database, note that a job will be created for the provided
+// entry which should be completed/cancelled (in the event of a failure, this will happen when the database is next
+// recovered). The entry is selected and its job created in the same transaction, so concurrent callers (including
+// other processes) will never be handed the same entry.
+func (d *Database) BeginTranscoding(options SelectOptions) (value.Entry, error) {
+	var entry value.Entry
 
-	db, err := sql.Open("sqlite3", path+"?_journal=wal&_mutex=full&_sync=extra&mode=rw")
+	conditions, arguments, err := d.selectConditions(options)
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to open SQLite database")
+		return entry, err
 	}
 
-	var userVersion uint32
-	err = sqlite.GetPragma(db, sqlite.PragmaUserVersion, &userVersion)
-	if err != nil {
-		return nil, errors.Wrap(err, "failed to get 'user_version'")
+	order := "priority desc, discovered asc"
+	if options.Shuffle {
+		order = "priority desc, random()"
 	}
 
-	log.WithField("version", userVersion).Info("Opened existing database")
+	// The entry is selected and its job added in a single transaction, so concurrent callers can't select the same entry
+	return entry, d.wrapTransaction(func(tx *sql.Tx) error {
+		query := sqlite.Query{
+			Query: fmt.Sprintf(`select %s from library
+				left join jobs on jobs.library_id = library.id where %s
+				order by %s limit 1;`, value.EntryColumns, conditions, order),
+			Arguments: arguments,
+		}
 
-	if !version.DatabaseVersion(userVersion).Supported() {
-		return nil, &ErrUnknownVersion{what: "database", where: path}
-	}
+		err := sqlite.QueryRows(tx, query, func(scan sqlite.ScanCallback) error { return entry.Scan(scan) })
+		if err != nil {
+			return errors.Wrap(err, "failed to query database")
+		}
 
-	err = sqlite.SetPragma(db, sqlite.PragmaForiegnKeys, "on")
-	if err != nil {
-		return nil, errors.Wrap(err, "failed to set 'foreign_keys'")
-	}
+		entry.Path = d.resolve(entry.Path)
 
-	database := &Database{db: db}
+		log.WithFields(entry).Info("Scheduling job to transcode entry")
 
-	err = database.recoverIncompleteJobs()
-	if err != nil {
-		return nil, errors.Wrap(err, "failed to recover incomplete jobs")
-	}
+		var target string
+		if options.Target != nil {
+			target, err = options.Target(entry)
+			if err != nil {
+				return errors.Wrap(err, "failed to determine target path")
+			}
+		}
 
-	return database, nil
-}
+		var temporary string
+		if options.Temporary != nil {
+			temporary = options.Temporary(entry)
+		}
 
-// recoverIncompleteJobs - Scan then handle any in-progress transcode jobs; this will revert or complete jobs depending
-// on their status.
-func (d *Database) recoverIncompleteJobs() error {
-	callback := func(scan sqlite.ScanCallback) error {
-		var entry value.Entry
-		err := scan(&entry.ID, &entry.Path, &entry.Discovered, &entry.Transcoded, &entry.Hash)
+		err = d.addJob(tx, entry, target, temporary)
 		if err != nil {
-			return errors.Wrap(err, "failed to scan incomplete job information")
+			return errors.Wrap(err, "failed to add job")
 		}
 
-		log.WithFields(entry).Warn("Found incomplete job")
-
-		hash, err := utils.HashFile(entry.Path)
-		if (err == nil && hash != entry.Hash) || (!utils.PathExists(entry.Path) &&
-			utils.PathExists(utils.ReplaceExtension(entry.Path, value.TranscodingExtension))) {
-			return d.completeIncompleteJob(entry)
-		}
+		return nil
+	})
+}
 
-		return d.rollbackIncompleteJob(entry)
+// CountSelectable - Returns the number of entries which could currently be selected by 'BeginTranscoding' using the
+// provided options i.e. hashed, untranscoded and unquarantined entries which don't already have a job.
+func (d *Database) CountSelectable(options SelectOptions) (int64, error) {
+	conditions, arguments, err := d.selectConditions(options)
+	if err != nil {
+		return 0, err
 	}
 
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
 	query := sqlite.Query{
-		Query: `select library.id, path,discovered,transcoded,hash from jobs
-				inner join library on jobs.library_id = library.id`,
+		Query: fmt.Sprintf(`select count(*) from library left join jobs on jobs.library_id = library.id
+			where %s;`, conditions),
+		Arguments: arguments,
 	}
 
-	err := sqlite.QueryRows(d.db, query, callback)
-	if err != nil && !errors.Is(err, sqlite.ErrQueryReturnedNoRows) {
-		return errors.Wrap(err, "failed to query incomplete jobs")
+	var count int64
+
+	err = sqlite.QueryRow(d.db, query, &count)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to count entries")
 	}
 
-	return nil
+	return count, nil
 }
 
-// completeIncompleteJob - Complete the incomplete transcode job for the provided entry.
-func (d *Database) completeIncompleteJob(entry value.Entry) error {
-	log.WithFields(entry).Info("Completing incomplete job")
+// selectConditions - Returns the 'where' clause (and its arguments) matching the entries which may be selected for
+// transcoding using the provided options, the library table must be left joined with the jobs table.
+func (d *Database) selectConditions(options SelectOptions) (string, []interface{}, error) {
+	conditions := []string{"jobs.library_id is null", "transcoded is null", "quarantined is null", "hash is not null"}
 
-	err := os.Rename(
-		utils.ReplaceExtension(entry.Path, value.TranscodingExtension),
-		utils.ReplaceExtension(entry.Path, value.TargetExtension),
-	)
-	if err != nil && !os.IsNotExist(err) {
-		return errors.Wrap(err, "failed to rename incomplete transcode file")
+	var arguments []interface{}
+
+	if options.Prefix != "" {
+		condition, args, err := d.prefixCondition(options.Prefix)
+		if err != nil {
+			return "", nil, err
+		}
+
+		conditions = append(conditions, condition)
+		arguments = append(arguments, args...)
 	}
 
-	entry.Path = utils.ReplaceExtension(entry.Path, value.TargetExtension)
+	if len(options.Exclude) != 0 {
+		placeholders := make([]string, 0, len(options.Exclude))
 
-	err = d.CompleteTranscoding(entry)
-	if err != nil {
-		return errors.Wrap(err, "failed to mark transcoding complete")
+		for _, id := range options.Exclude {
+			placeholders = append(placeholders, "?")
+			arguments = append(arguments, id)
+		}
+
+		conditions = append(conditions, fmt.Sprintf("library.id not in (%s)", strings.Join(placeholders, ", ")))
 	}
 
-	return nil
+	return strings.Join(conditions, " and "), arguments, nil
 }
 
-// rollbackIncompleteJob - Rollback the incomplete transcode job for the provided entry.
-func (d *Database) rollbackIncompleteJob(entry value.Entry) error {
-	log.WithFields(entry).Info("Rolling back incomplete job")
+// RecordSource - Record the source codec/dimensions/duration of the provided entry, allowing entries which weren't
+// probed when they were inserted to avoid being probed again. Like 'Upsert', only values which were previously unknown
+// are populated.
+func (d *Database) RecordSource(entry value.Entry) error {
+	return d.wrapTransaction(func(tx *sql.Tx) error {
+		query := sqlite.Query{
+			Query: `update library set
+					source_codec=coalesce(source_codec, ?),
+					source_width=coalesce(source_width, ?),
+					source_height=coalesce(source_height, ?),
+					duration=coalesce(duration, ?)
+				where id = ?;`,
+			Arguments: []interface{}{entry.SourceCodec, entry.SourceWidth, entry.SourceHeight, entry.Duration, entry.ID},
+		}
 
-	err := os.Remove(strings.TrimSuffix(entry.Path, filepath.Ext(entry.Path)) + value.TranscodingExtension)
-	if err != nil && !os.IsNotExist(err) {
-		return errors.Wrap(err, "failed to remove incomplete transcode file")
-	}
+		_, err := sqlite.ExecuteQuery(tx, query)
+		if err != nil {
+			return errors.Wrap(err, "failed to update database")
+		}
 
-	return d.cancelTranscoding(entry, false)
+		return nil
+	})
 }
 
-// addJob - Add a new job to the jobs table indicating the provided entry is going to be transcoded.
-func (d *Database) addJob(db sqlite.Executable, entry value.Entry) error {
-	log.WithFields(entry).Debug("Added job for entry")
+// FinishedTranscoding - Record that the provided entry has finished transcoding, i.e. the transcoded file is complete
+// and is about to replace the source. This must be called before any files are moved/removed, recovery only completes
+// jobs which have finished.
+func (d *Database) FinishedTranscoding(entry value.Entry) error {
+	return d.wrapTransaction(func(tx *sql.Tx) error {
+		query := sqlite.Query{
+			Query:     "update jobs set finished = ? where library_id = ?;",
+			Arguments: []interface{}{time.Now().Unix(), entry.ID},
+		}
 
-	query := sqlite.Query{
-		Query:     "insert into jobs (library_id, start_time) values (?, ?);",
-		Arguments: []interface{}{entry.ID, time.Now().Unix()},
-	}
+		affected, err := sqlite.ExecuteQuery(tx, query)
+		if err != nil {
+			return errors.Wrap(err, "failed to update job")
+		}
 
-	_, err := sqlite.ExecuteQuery(db, query)
-	return err
+		if affected == 0 {
+			return fmt.Errorf("job for entry %d not found", entry.ID)
+		}
+
+		return nil
+	})
 }
 
-// removeJob - Remove the job corresponding to the provided entry from the jobs table.
-func (d *Database) removeJob(db sqlite.Executable, entry value.Entry) error {
-	log.WithFields(entry).Debug("Removing job for entry")
+// CompleteTranscoding - Rehash and mark the provided entry as having been transcoded.
+func (d *Database) CompleteTranscoding(entry value.Entry) error {
+	return d.completeTranscoding(entry, "")
+}
 
-	query := sqlite.Query{
-		Query:     "delete from jobs where library_id = ?;",
-		Arguments: []interface{}{entry.ID},
+// CompleteTranscodingKeepingSource - Rehash and mark the provided entry as having been transcoded, recording that its
+// source file was left in place at the given path (e.g. when transcoding to an output directory). The entry must
+// still have the hash of the source file; the source won't be added again by 'Upsert' unless it's modified.
+func (d *Database) CompleteTranscodingKeepingSource(entry value.Entry, source string) error {
+	return d.completeTranscoding(entry, source)
+}
+
+// completeTranscoding - See 'CompleteTranscodingKeepingSource', the source path is empty if the source wasn't kept.
+func (d *Database) completeTranscoding(entry value.Entry, source string) error {
+	hash, err := utils.HashFileWithOptions(entry.Path, utils.HashOptions{Algorithm: d.algorithm})
+	if err != nil {
+		return errors.Wrap(err, "failed to hash file")
 	}
 
-	_, err := sqlite.ExecuteQuery(db, query)
-	return err
-}
+	path, err := d.relative(entry.Path)
+	if err != nil {
+		return err
+	}
 
-// Close - Close the database, the database should not be used after it has been closed.
-func (d *Database) Close() error {
-	d.lock.Lock()
-	defer d.lock.Unlock()
+	var (
+		sourcePath *string
+		sourceHash *uint32
+	)
 
-	log.Info("Closing database")
+	if source != "" {
+		relative, err := d.relative(source)
+		if err != nil {
+			return err
+		}
 
-	defer func() {
-		d.db = nil
-		d.txns = 0
-	}()
+		sourcePath, sourceHash = &relative, &entry.Hash
+	}
 
-	return d.db.Close()
+	return d.wrapTransaction(func(tx *sql.Tx) error {
+		query := sqlite.Query{
+			Query: `update library set path = ?, transcoded = ?, hash = ?, source_path = ?, source_hash = ?
+				where id = ?;`,
+			Arguments: []interface{}{path, utils.Int64P(time.Now().Unix()), hash, sourcePath, sourceHash, entry.ID},
+		}
+
+		_, err = sqlite.ExecuteQuery(tx, query)
+		if err != nil {
+			return errors.Wrap(err, "failed to update database")
+		}
+
+		log.WithFields(entry).Info("Completing job to transcode entry")
+
+		err = d.removeJob(tx, entry)
+		if err != nil {
+			return errors.Wrapf(err, "failed to remove job %d", entry.ID)
+		}
+
+		return nil
+	})
 }
 
-// Upsert - Update or insert the provided entry into the database; the entry will be updated in the event of a hash
-// conflict.
-func (d *Database) Upsert(entry value.Entry) error {
+// FailTranscoding - Record a failed attempt to transcode the provided entry and remove its job; the path of the entry
+// is also updated since the source may have been moved. Quarantined entries won't be selected by 'BeginTranscoding'
+// until 'ResetQuarantine' is used.
+func (d *Database) FailTranscoding(entry value.Entry, quarantine bool) error {
+	path, err := d.relative(entry.Path)
+	if err != nil {
+		return err
+	}
+
 	return d.wrapTransaction(func(tx *sql.Tx) error {
-		log.WithFields(entry).Info("Adding entry")
+		var quarantined *int64
+		if quarantine {
+			quarantined = utils.Int64P(time.Now().Unix())
+		}
 
 		query := sqlite.Query{
-			Query: `insert or replace into library (path, discovered, transcoded, hash) values (?, ?, ?, ?)
-				on conflict(hash) do update set path=excluded.path where path != excluded.path;`,
-			Arguments: []interface{}{entry.Path, entry.Discovered, entry.Transcoded, entry.Hash},
+			Query:     "update library set path = ?, failures = failures + 1, quarantined = ? where id = ?;",
+			Arguments: []interface{}{path, quarantined, entry.ID},
 		}
 
 		_, err := sqlite.ExecuteQuery(tx, query)
 		if err != nil {
-			return errors.Wrap(err, "failed to execute query")
+			return errors.Wrap(err, "failed to update database")
+		}
+
+		log.WithFields(entry).WithField("quarantine", quarantine).Info("Failing job to transcode entry")
+
+		err = d.removeJob(tx, entry)
+		if err != nil {
+			return errors.Wrapf(err, "failed to remove job %d", entry.ID)
 		}
 
 		return nil
 	})
 }
 
-// Remove - Remove the provided entry from the database; this will also remove any incomplete jobs for the provided
-// entry.
-func (d *Database) Remove(entry value.Entry) error {
-	return d.wrapTransaction(func(tx *sql.Tx) error {
-		log.WithFields(entry).Info("Removing entry")
+// ResetQuarantine - Reset the failure count and quarantine status of all the entries whose path is equal to (or is
+// within the directory) 'prefix', or of every entry when 'prefix' is empty. Returns the number of entries which were
+// updated.
+func (d *Database) ResetQuarantine(prefix string) (int64, error) {
+	var updated int64
+
+	return updated, d.wrapTransaction(func(tx *sql.Tx) error {
+		var (
+			conditions = []string{"(failures != 0 or quarantined is not null)"}
+			arguments  []interface{}
+		)
+
+		if prefix != "" {
+			condition, args, err := d.prefixCondition(prefix)
+			if err != nil {
+				return err
+			}
+
+			conditions = append(conditions, condition)
+			arguments = append(arguments, args...)
+		}
 
-		err := d.removeJob(tx, entry)
+		query := sqlite.Query{
+			Query: fmt.Sprintf("update library set failures = 0, quarantined = null where %s;",
+				strings.Join(conditions, " and ")),
+			Arguments: arguments,
+		}
+
+		var err error
+
+		updated, err = sqlite.ExecuteQuery(tx, query)
 		if err != nil {
-			return errors.Wrap(err, "failed to remove job")
+			return errors.Wrap(err, "failed to update database")
+		}
+
+		log.WithFields(log.Fields{"prefix": prefix, "updated": updated}).Info("Reset entry quarantine status")
+
+		return nil
+	})
+}
+
+// ResetTranscoded - Reset the transcoded status of all the transcoded entries whose path is equal to (or is within the
+// directory) 'prefix', returning the number of entries which were updated. An empty prefix matches every entry. The
+// entries will be selected by 'BeginTranscoding' again, which will replace their (already transcoded) files.
+//
+// Entries whose source was kept (e.g. when transcoding to an output directory) aren't reset, since their file would be
+// re-encoded from the already transcoded output rather than from the source, which would remain hidden from 'Upsert'.
+func (d *Database) ResetTranscoded(prefix string) (int64, error) {
+	var updated int64
+
+	return updated, d.wrapTransaction(func(tx *sql.Tx) error {
+		var (
+			conditions = []string{"transcoded is not null", "source_path is null"}
+			arguments  []interface{}
+		)
+
+		if prefix != "" {
+			condition, args, err := d.prefixCondition(prefix)
+			if err != nil {
+				return err
+			}
+
+			conditions = append(conditions, condition)
+			arguments = append(arguments, args...)
 		}
 
 		query := sqlite.Query{
-			Query:     "delete from library where id = ?;",
-			Arguments: []interface{}{entry.ID},
+			Query:     fmt.Sprintf("update library set transcoded = null where %s;", strings.Join(conditions, " and ")),
+			Arguments: arguments,
 		}
 
-		_, err = sqlite.ExecuteQuery(tx, query)
+		var err error
+
+		updated, err = sqlite.ExecuteQuery(tx, query)
 		if err != nil {
-			return errors.Wrap(err, "failed to execute query")
+			return errors.Wrap(err, "failed to update database")
 		}
 
+		log.WithFields(log.Fields{"prefix": prefix, "updated": updated}).Info("Reset entry transcoded status")
+
 		return nil
 	})
 }
 
-// BeginTranscoding - Retrieve an untranscoded entry from the database, note that a job will be created for the provided
-// entry which should be completed/cancelled (in the event of a failure, this will happen the next time the database is
-// opened).
-func (d *Database) BeginTranscoding() (value.Entry, error) {
-	var entry value.Entry
+// RecordRun - Record the provided summary of an update/transcode run, returning it with the id it was assigned.
+func (d *Database) RecordRun(run value.Run) (value.Run, error) {
+	var errorP *string
+	if run.Error != "" {
+		errorP = &run.Error
+	}
 
-	return entry, d.wrapTransaction(func(tx *sql.Tx) error {
+	return run, d.wrapTransaction(func(tx *sql.Tx) error {
 		query := sqlite.Query{
-			Query: "select library.id, path, hash from library where transcoded is null and " +
-				"id not in (select library_id from jobs) order by discovered asc limit 1;",
+			Query: `insert into runs (command, start_time, end_time, processed, failed, cancelled, error)
+				values (?, ?, ?, ?, ?, ?, ?);`,
+			Arguments: []interface{}{run.Command, run.Start, run.End, run.Processed, run.Failed, run.Cancelled, errorP},
 		}
 
-		err := sqlite.QueryRow(tx, query, &entry.ID, &entry.Path, &entry.Hash)
+		_, err := sqlite.ExecuteQuery(tx, query)
 		if err != nil {
-			return errors.Wrap(err, "failed to query database")
+			return errors.Wrap(err, "failed to insert run")
 		}
 
-		log.WithFields(entry).Info("Scheduling job to transcode entry")
-
-		err = d.addJob(tx, entry)
+		err = sqlite.QueryRow(tx, sqlite.Query{Query: "select last_insert_rowid();"}, &run.ID)
 		if err != nil {
-			return errors.Wrap(err, "failed to add job")
+			return errors.Wrap(err, "failed to get run id")
 		}
 
 		return nil
 	})
 }
 
-// CompleteTranscoding - Rehash and mark the provided entry as having been transcoded.
-func (d *Database) CompleteTranscoding(entry value.Entry) error {
-	hash, err := utils.HashFile(entry.Path)
+// Runs - Returns the most recent runs (at most 'limit', where zero means unlimited), ordered from newest to oldest.
+func (d *Database) Runs(limit int) ([]value.Run, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	runs := make([]value.Run, 0)
+
+	callback := func(scan sqlite.ScanCallback) error {
+		var (
+			run    value.Run
+			errorP *string
+		)
+
+		err := scan(&run.ID, &run.Command, &run.Start, &run.End, &run.Processed, &run.Failed, &run.Cancelled, &errorP)
+		if err != nil {
+			return errors.Wrap(err, "failed to scan run")
+		}
+
+		if errorP != nil {
+			run.Error = *errorP
+		}
+
+		runs = append(runs, run)
+
+		return nil
+	}
+
+	// A negative limit is treated as unlimited by SQLite
+	if limit == 0 {
+		limit = -1
+	}
+
+	query := sqlite.Query{
+		Query: `select id, command, start_time, end_time, processed, failed, cancelled, error from runs
+				order by start_time desc, id desc limit ?;`,
+		Arguments: []interface{}{limit},
+	}
+
+	err := sqlite.QueryRowsAllowEmpty(d.db, query, callback)
 	if err != nil {
-		return errors.Wrap(err, "failed to hash file")
+		return nil, errors.Wrap(err, "failed to query runs")
 	}
 
-	return d.wrapTransaction(func(tx *sql.Tx) error {
-		query := sqlite.Query{
-			Query:     "update library set path = ?, transcoded = ?, hash = ? where id = ?;",
-			Arguments: []interface{}{entry.Path, utils.Int64P(time.Now().Unix()), hash, entry.ID},
-		}
+	return runs, nil
+}
 
-		_, err = sqlite.ExecuteQuery(tx, query)
+// Jobs - Returns all the jobs in the database, ordered by when they were started. Jobs only exist whilst entries are
+// being transcoded, so any jobs returned either belong to another goamt process or are incomplete.
+func (d *Database) Jobs() ([]value.Job, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	jobs := make([]value.Job, 0)
+
+	callback := func(scan sqlite.ScanCallback) error {
+		var job value.Job
+
+		err := job.Entry.Scan(scan, &job.Started, &job.Target, &job.Temporary)
 		if err != nil {
-			return errors.Wrap(err, "failed to update database")
+			return errors.Wrap(err, "failed to scan job")
 		}
 
-		log.WithFields(entry).Info("Completing job to transcode entry")
+		job.Entry.Path = d.resolve(job.Entry.Path)
 
-		err = d.removeJob(tx, entry)
-		if err != nil {
-			return errors.Wrapf(err, "failed to remove job %d", entry.ID)
+		if job.Target != nil {
+			job.Target = utils.StringP(d.resolve(*job.Target))
+		}
+
+		jobs = append(jobs, job)
+
+		return nil
+	}
+
+	query := sqlite.Query{
+		Query: `select ` + value.EntryColumns + `, start_time, target, temporary from jobs
+				inner join library on jobs.library_id = library.id order by start_time asc, jobs.id asc;`,
+	}
+
+	err := sqlite.QueryRowsAllowEmpty(d.db, query, callback)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to query jobs")
+	}
+
+	return jobs, nil
+}
+
+// ResetJobs - Remove the provided jobs without attempting to recover them, returning the number of jobs which were
+// removed. The corresponding entries will be selected for transcoding again; note that any partially transcoded files
+// are left in place.
+func (d *Database) ResetJobs(jobs []value.Job) (int64, error) {
+	var removed int64
+
+	return removed, d.wrapTransaction(func(tx *sql.Tx) error {
+		for _, job := range jobs {
+			log.WithFields(job).Info("Resetting job to transcode entry")
+
+			query := sqlite.Query{
+				Query:     "delete from jobs where library_id = ?;",
+				Arguments: []interface{}{job.Entry.ID},
+			}
+
+			affected, err := sqlite.ExecuteQuery(tx, query)
+			if err != nil {
+				return errors.Wrapf(err, "failed to remove job %d", job.Entry.ID)
+			}
+
+			removed += affected
 		}
 
 		return nil
 	})
 }
 
+// Compact - Rebuild the database file to reclaim the space left behind by removed rows (e.g. the churn of the jobs
+// table). The autoincrement sequences are purposefully left alone, ids are never reused since they're referenced
+// outside of the database (e.g. by webhook payloads and ffmpeg log file names).
+func (d *Database) Compact() error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	// Vacuum rebuilds the database file, omitting any free pages, but can't be run within a transaction
+	_, err := sqlite.ExecuteQuery(d.db, sqlite.Query{Query: "vacuum;"})
+	if err != nil {
+		return errors.Wrap(err, "failed to vacuum database")
+	}
+
+	return nil
+}
+
 // CancelTranscoding - Cancel the job for the provided entry.
 func (d *Database) CancelTranscoding(entry value.Entry) error {
 	return d.cancelTranscoding(entry, true)
@@ -425,3 +1856,18 @@ func (d *Database) rollbackLOCKED(tx *sql.Tx) error {
 
 	return tx.Rollback()
 }
+
+// prefixCondition - Returns a condition (and its arguments) which matches entries whose path is equal to (or is within
+// the directory) 'prefix'. Note that we purposefully don't use 'like' since it's case insensitive and would require
+// escaping any wildcards in the path.
+func prefixCondition(prefix string) (string, []interface{}) {
+	directory := strings.TrimSuffix(prefix, string(filepath.Separator)) + string(filepath.Separator)
+
+	return "(path = ? or substr(path, 1, length(?)) = ?)", []interface{}{prefix, directory, directory}
+}
+
+// escapeLike - Escape the wildcards (and the escape character itself) in the provided string, so that it's matched
+// literally by a 'like' expression using '\' as its escape character.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
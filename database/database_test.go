@@ -16,6 +16,7 @@ package database
 
 import (
 	"database/sql"
+	"fmt"
 	"hash/crc32"
 	"io/ioutil"
 	"os"
@@ -23,15 +24,22 @@ import (
 	"reflect"
 	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
 
 	"github.com/jamesl33/goamt/utils"
 	"github.com/jamesl33/goamt/utils/sqlite"
 	"github.com/jamesl33/goamt/value"
+	"github.com/jamesl33/goamt/version"
 
 	"github.com/pkg/errors"
 )
 
+func checksum(data string) uint32 {
+	return crc32.Checksum([]byte(data), crc32.MakeTable(crc32.IEEE))
+}
+
 func createAndPopulate(t *testing.T, path string, entries []value.Entry, jobs []int) {
 	db, err := Create(path)
 	if err != nil {
@@ -40,7 +48,7 @@ func createAndPopulate(t *testing.T, path string, entries []value.Entry, jobs []
 	defer db.Close()
 
 	for _, entry := range entries {
-		err = db.Upsert(entry)
+		_, err = db.Upsert(entry)
 		if err != nil {
 			t.Fatalf("Expected to be able to upsert entry: %v", err)
 		}
@@ -48,7 +56,7 @@ func createAndPopulate(t *testing.T, path string, entries []value.Entry, jobs []
 
 	for _, job := range jobs {
 		err := db.wrapTransaction(func(tx *sql.Tx) error {
-			return db.addJob(tx, value.Entry{ID: job})
+			return db.addJob(tx, value.Entry{ID: job}, "", "")
 		})
 		if err != nil {
 			t.Fatalf("Expected to be able to add job: %v", err)
@@ -64,13 +72,42 @@ func openAndUpdate(t *testing.T, path string, entries []value.Entry) {
 	defer db.Close()
 
 	for _, entry := range entries {
-		err = db.Upsert(entry)
+		_, err = db.Upsert(entry)
 		if err != nil {
 			t.Fatalf("Expected to be able to upsert entry: %v", err)
 		}
 	}
 }
 
+// markFinished - Mark the jobs for the entries with the provided ids as having finished transcoding.
+func markFinished(t *testing.T, path string, ids []int) {
+	db, err := Open(path)
+	if err != nil {
+		t.Fatalf("Expected to be able to open test database: %v", err)
+	}
+	defer db.Close()
+
+	for _, id := range ids {
+		err = db.FinishedTranscoding(value.Entry{ID: id})
+		if err != nil {
+			t.Fatalf("Expected to be able to mark transcoding finished: %v", err)
+		}
+	}
+}
+
+func openAndRecover(t *testing.T, path string) {
+	db, err := Open(path)
+	if err != nil {
+		t.Fatalf("Expected to be able to open test database: %v", err)
+	}
+	defer db.Close()
+
+	err = db.Recover()
+	if err != nil {
+		t.Fatalf("Expected to be able to recover incomplete jobs: %v", err)
+	}
+}
+
 func openAndRemove(t *testing.T, path string, entries []value.Entry) {
 	db, err := Open(path)
 	if err != nil {
@@ -79,24 +116,34 @@ func openAndRemove(t *testing.T, path string, entries []value.Entry) {
 	defer db.Close()
 
 	for _, entry := range entries {
-		err = db.Remove(entry)
+		removed, err := db.Remove(entry)
 		if err != nil {
 			t.Fatalf("Expected to be able to remove entry: %v", err)
 		}
+
+		if removed != 1 {
+			t.Fatalf("Expected to remove 1 entry but removed %d", removed)
+		}
 	}
 }
 
 func assertContains(t *testing.T, path string, expectedEntries []value.Entry, expectedJobs []int) {
 	actualEntries := make([]value.Entry, 0, len(expectedEntries))
 
+	// Only the columns which the tests populate are compared
 	callback := func(scan sqlite.ScanCallback) error {
 		var entry value.Entry
-		err := scan(&entry.Path, &entry.Discovered, &entry.Transcoded, &entry.Hash)
+		err := entry.Scan(scan)
 		if err != nil {
 			return err
 		}
 
-		actualEntries = append(actualEntries, entry)
+		actualEntries = append(actualEntries, value.Entry{
+			Path:       entry.Path,
+			Discovered: entry.Discovered,
+			Transcoded: entry.Transcoded,
+			Hash:       entry.Hash,
+		})
 		return nil
 	}
 
@@ -106,10 +153,10 @@ func assertContains(t *testing.T, path string, expectedEntries []value.Entry, ex
 	}
 	defer db.Close()
 
-	query := sqlite.Query{Query: "select path, discovered, transcoded, hash from library;"}
+	query := sqlite.Query{Query: "select " + value.EntryColumns + " from library;"}
 
-	err = sqlite.QueryRows(db.db, query, callback)
-	if err != nil && !errors.Is(err, sqlite.ErrQueryReturnedNoRows) {
+	err = sqlite.QueryRowsAllowEmpty(db.db, query, callback)
+	if err != nil {
 		t.Fatalf("Expected to be able to query entries: %v", err)
 	}
 
@@ -150,8 +197,8 @@ func assertContains(t *testing.T, path string, expectedEntries []value.Entry, ex
 
 	query = sqlite.Query{Query: "select * from jobs;"}
 
-	err = sqlite.QueryRows(db.db, query, callback)
-	if err != nil && !errors.Is(err, sqlite.ErrQueryReturnedNoRows) {
+	err = sqlite.QueryRowsAllowEmpty(db.db, query, callback)
+	if err != nil {
 		t.Fatalf("Expected to be able to query jobs: %v", err)
 	}
 
@@ -184,6 +231,114 @@ func TestCreateAlreadyExists(t *testing.T) {
 	}
 }
 
+func TestOpenWithOptions(t *testing.T) {
+	var (
+		tempDir = t.TempDir()
+		path    = filepath.Join(tempDir, "test.db")
+	)
+
+	created, err := Create(path)
+	if err != nil {
+		t.Fatalf("Expected to be able to create database: %v", err)
+	}
+	defer created.Close()
+
+	var (
+		journal     string
+		synchronous int
+	)
+
+	// The safe defaults are used unless told otherwise
+	err = sqlite.GetPragma(created.db, sqlite.PragmaJournalMode, &journal)
+	if err != nil {
+		t.Fatalf("Expected to be able to get journal mode: %v", err)
+	}
+
+	err = sqlite.GetPragma(created.db, sqlite.PragmaSynchronous, &synchronous)
+	if err != nil {
+		t.Fatalf("Expected to be able to get synchronous mode: %v", err)
+	}
+
+	if journal != "wal" || synchronous != 3 {
+		t.Fatalf("Expected the 'wal' journal and 'extra' synchronous modes but got '%s' and %d", journal, synchronous)
+	}
+
+	opened, err := OpenWithOptions(path, Options{Sync: "off"})
+	if err != nil {
+		t.Fatalf("Expected to be able to open database: %v", err)
+	}
+	defer opened.Close()
+
+	err = sqlite.GetPragma(opened.db, sqlite.PragmaSynchronous, &synchronous)
+	if err != nil {
+		t.Fatalf("Expected to be able to get synchronous mode: %v", err)
+	}
+
+	if synchronous != 0 {
+		t.Fatalf("Expected the 'off' synchronous mode but got %d", synchronous)
+	}
+
+	_, err = OpenWithOptions(path, Options{Sync: "sometimes"})
+	if err == nil {
+		t.Fatalf("Expected an error for an unsupported synchronous mode")
+	}
+
+	_, err = CreateWithOptions(filepath.Join(tempDir, "other.db"), Options{Journal: "diary"})
+	if err == nil {
+		t.Fatalf("Expected an error for an unsupported journal mode")
+	}
+}
+
+func TestDatabaseCloseCheckpoints(t *testing.T) {
+	var (
+		tempDir = t.TempDir()
+		path    = filepath.Join(tempDir, "test.db")
+	)
+
+	createAndPopulate(t, path, nil, nil)
+
+	// The write-ahead log is only removed when the last connection is closed, so keep a reader open
+	reader, err := OpenReadOnly(path)
+	if err != nil {
+		t.Fatalf("Expected to be able to open database read-only: %v", err)
+	}
+	defer reader.Close()
+
+	_, err = reader.Info()
+	if err != nil {
+		t.Fatalf("Expected to be able to get database info: %v", err)
+	}
+
+	db, err := Open(path)
+	if err != nil {
+		t.Fatalf("Expected to be able to open test database: %v", err)
+	}
+
+	_, err = db.Upsert(value.Entry{Path: "test.mp4", Discovered: 8, Hash: 16})
+	if err != nil {
+		t.Fatalf("Expected to be able to upsert entry: %v", err)
+	}
+
+	info, err := os.Stat(path + "-wal")
+	if err != nil || info.Size() == 0 {
+		t.Fatalf("Expected the write-ahead log to contain the upsert: %v", err)
+	}
+
+	err = db.Close()
+	if err != nil {
+		t.Fatalf("Expected to be able to close database: %v", err)
+	}
+
+	info, err = os.Stat(path + "-wal")
+	if err != nil {
+		t.Fatalf("Expected to be able to stat the write-ahead log: %v", err)
+	}
+
+	if info.Size() != 0 {
+		t.Fatalf("Expected the write-ahead log to have been truncated, got %d bytes", info.Size())
+	}
+}
+
 func TestOpenNotFound(t *testing.T) {
 	var (
 		tempDir = t.TempDir()
@@ -198,7 +353,175 @@ func TestOpenNotFound(t *testing.T) {
 	}
 }
 
-func TestOpenRecoverIncompleteJobs(t *testing.T) {
+func TestOpenReadOnly(t *testing.T) {
+	var (
+		tempDir     = t.TempDir()
+		path        = filepath.Join(tempDir, "test.db")
+		transcoding = filepath.Join(tempDir, "test.transcoding.mp4")
+	)
+
+	entries := []value.Entry{{Path: filepath.Join(tempDir, "test.avi"), Discovered: 8, Hash: 16}}
+
+	createAndPopulate(t, path, entries, []int{1})
+
+	err := ioutil.WriteFile(transcoding, []byte("transcoding"), 0o755)
+	if err != nil {
+		t.Fatalf("Expected to be able to create test file: %v", err)
+	}
+
+	db, err := OpenReadOnly(path)
+	if err != nil {
+		t.Fatalf("Expected to be able to open test database: %v", err)
+	}
+
+	_, err = db.FindByHash(16)
+	if err != nil {
+		t.Fatalf("Expected to be able to find entry: %v", err)
+	}
+
+	_, err = db.Upsert(value.Entry{Path: "other.avi", Discovered: 8, Hash: 32})
+	if err == nil {
+		t.Fatalf("Expected an error when writing to a read-only database")
+	}
+
+	// The incomplete job should have been left for the next read-write open to recover
+	if !utils.PathExists(transcoding) {
+		t.Fatalf("Expected the incomplete transcoded file to have been left intact")
+	}
+
+	var jobs int
+
+	err = sqlite.QueryRow(db.db, sqlite.Query{Query: "select count(*) from jobs;"}, &jobs)
+	if err != nil || jobs != 1 {
+		t.Fatalf("Expected the incomplete job to have been left intact, got %d: %v", jobs, err)
+	}
+
+	err = db.Close()
+	if err != nil {
+		t.Fatalf("Expected to be able to close test database: %v", err)
+	}
+}
+
+func TestOpenReadOnlyRequiresMigration(t *testing.T) {
+	var (
+		tempDir = t.TempDir()
+		path    = filepath.Join(tempDir, "test.db")
+	)
+
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatalf("Expected to be able to open test database: %v", err)
+	}
+
+	_, err = sqlite.ExecuteQuery(db, sqlite.Query{Query: "pragma user_version=1;"})
+	if err != nil {
+		t.Fatalf("Expected to be able to set 'user_version': %v", err)
+	}
+
+	err = db.Close()
+	if err != nil {
+		t.Fatalf("Expected to be able to close test database: %v", err)
+	}
+
+	_, err = OpenReadOnly(path)
+
+	var requiresMigration *ErrRequiresMigration
+	if !errors.As(err, &requiresMigration) {
+		t.Fatalf("Expected an 'ErrRequiresMigration' but got '%#v'", err)
+	}
+}
+
+func TestOpenUnknownVersion(t *testing.T) {
+	type test struct {
+		name        string
+		userVersion version.DatabaseVersion
+		newer       bool
+		message     string
+	}
+
+	tests := []test{
+		{
+			name:        "Newer",
+			userVersion: version.DatabaseVersionCurrent + 1,
+			newer:       true,
+			message:     "which is newer than this goamt supports",
+		},
+		{
+			name:    "Older",
+			message: "is not a goamt database (version 0)",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var (
+				tempDir = t.TempDir()
+				path    = filepath.Join(tempDir, "test.db")
+			)
+
+			db, err := sql.Open("sqlite3", path)
+			if err != nil {
+				t.Fatalf("Expected to be able to open test database: %v", err)
+			}
+
+			err = sqlite.SetPragma(db, sqlite.PragmaUserVersion, test.userVersion)
+			if err != nil {
+				t.Fatalf("Expected to be able to set 'user_version': %v", err)
+			}
+
+			err = db.Close()
+			if err != nil {
+				t.Fatalf("Expected to be able to close test database: %v", err)
+			}
+
+			_, err = Open(path)
+
+			var unknownVersion *ErrUnknownVersion
+			if !errors.As(err, &unknownVersion) {
+				t.Fatalf("Expected an 'ErrUnknownVersion' but got '%#v'", err)
+			}
+
+			if unknownVersion.found != test.userVersion || unknownVersion.Newer() != test.newer {
+				t.Fatalf("Expected version %d (newer %t) but got %d (newer %t)", test.userVersion, test.newer,
+					unknownVersion.found, unknownVersion.Newer())
+			}
+
+			if !strings.Contains(err.Error(), test.message) {
+				t.Fatalf("Expected the error to contain '%s' but got '%s'", test.message, err)
+			}
+		})
+	}
+}
+
+func TestOpenDoesNotRecover(t *testing.T) {
+	var (
+		tempDir     = t.TempDir()
+		path        = filepath.Join(tempDir, "test.db")
+		transcoding = filepath.Join(tempDir, "test.transcoding.mp4")
+	)
+
+	createAndPopulate(t, path, []value.Entry{{Path: filepath.Join(tempDir, "test.mp4"), Discovered: 42, Hash: 16}},
+		[]int{1})
+
+	err := ioutil.WriteFile(transcoding, []byte("transcoding"), 0o755)
+	if err != nil {
+		t.Fatalf("Expected to be able to create test file: %v", err)
+	}
+
+	openAndUpdate(t, path, nil)
+
+	if !utils.PathExists(transcoding) {
+		t.Fatalf("Expected opening the database not to have modified any files")
+	}
+
+	openAndRecover(t, path)
+
+	if utils.PathExists(transcoding) {
+		t.Fatalf("Expected the incomplete job to have been recovered")
+	}
+}
+
+func TestDatabaseRecover(t *testing.T) {
 	hash := func(data []byte) uint32 {
 		return crc32.Checksum(data, crc32.MakeTable(crc32.IEEE))
 	}
@@ -208,6 +531,7 @@ func TestOpenRecoverIncompleteJobs(t *testing.T) {
 		initialEntries  []value.Entry
 		initialFiles    []string
 		initialJobs     []int
+		finished        bool
 		expectedEntries []value.Entry
 		expectedFiles   []string
 		expectedJobs    []int
@@ -242,6 +566,7 @@ func TestOpenRecoverIncompleteJobs(t *testing.T) {
 		},
 		{
 			name:           "OneJobOnlyTargetFileExists",
+			finished:       true,
 			initialEntries: []value.Entry{{Path: "test.avi", Discovered: 42, Hash: hash([]byte("old_contents"))}},
 			initialFiles:   []string{"test.transcoding.mp4"},
 			initialJobs:    []int{1},
@@ -253,6 +578,7 @@ func TestOpenRecoverIncompleteJobs(t *testing.T) {
 		},
 		{
 			name:           "OneJobOnlyTargetFileExistsSameName",
+			finished:       true,
 			initialEntries: []value.Entry{{Path: "test.mp4", Discovered: 42, Hash: hash([]byte("old_contents"))}},
 			initialFiles:   []string{"test.mp4"},
 			initialJobs:    []int{1},
@@ -262,8 +588,21 @@ func TestOpenRecoverIncompleteJobs(t *testing.T) {
 			expectedFiles: []string{"test.mp4"},
 			expectedJobs:  make([]int, 0),
 		},
+		{
+			name:           "OneJobSourceFileNotYetRemoved",
+			finished:       true,
+			initialEntries: []value.Entry{{Path: "test.avi", Discovered: 42, Hash: hash([]byte("0"))}},
+			initialFiles:   []string{"test.avi", "test.mp4"},
+			initialJobs:    []int{1},
+			expectedEntries: []value.Entry{
+				{Path: "test.mp4", Discovered: 42, Transcoded: utils.Int64P(0), Hash: hash([]byte("1"))},
+			},
+			expectedFiles: []string{"test.mp4", "test.avi.original"},
+			expectedJobs:  make([]int, 0),
+		},
 		{
 			name:           "OneJobOnlyTargetFileExistsNotYetRenamed",
+			finished:       true,
 			initialEntries: []value.Entry{{Path: "test.mp4", Discovered: 42, Hash: hash([]byte("old_contents"))}},
 			initialFiles:   []string{"test.transcoding.mp4"},
 			initialJobs:    []int{1},
@@ -273,6 +612,46 @@ func TestOpenRecoverIncompleteJobs(t *testing.T) {
 			expectedFiles: []string{"test.mp4"},
 			expectedJobs:  make([]int, 0),
 		},
+		{
+			// We crashed after renaming the source file, but before the entry was updated
+			name:           "OneJobCrashedAfterSourceRenamed",
+			finished:       true,
+			initialEntries: []value.Entry{{Path: "test.avi", Discovered: 42, Hash: hash([]byte("old_contents"))}},
+			initialFiles:   []string{"test.avi.original", "test.mp4"},
+			initialJobs:    []int{1},
+			expectedEntries: []value.Entry{
+				{Path: "test.mp4", Discovered: 42, Transcoded: utils.Int64P(0), Hash: hash([]byte("1"))},
+			},
+			expectedFiles: []string{"test.mp4", "test.avi.original"},
+			expectedJobs:  make([]int, 0),
+		},
+		{
+			// An unrelated file already existed at the target, the job hadn't finished so it must not be adopted
+			name:            "OneJobTargetExistsNotFinished",
+			initialEntries:  []value.Entry{{Path: "test.avi", Discovered: 42, Hash: hash([]byte("0"))}},
+			initialFiles:    []string{"test.avi", "test.mp4"},
+			initialJobs:     []int{1},
+			expectedEntries: []value.Entry{{Path: "test.avi", Discovered: 42, Hash: hash([]byte("0"))}},
+			expectedFiles:   []string{"test.avi", "test.mp4"},
+			expectedJobs:    make([]int, 0),
+		},
+		{
+			// The transcoded file was written, but the job hadn't finished (e.g. it was still being verified)
+			name:            "OneJobTranscodingExistsNotFinished",
+			initialEntries:  []value.Entry{{Path: "test.avi", Discovered: 42, Hash: hash([]byte("0"))}},
+			initialFiles:    []string{"test.avi", "test.transcoding.mp4"},
+			initialJobs:     []int{1},
+			expectedEntries: []value.Entry{{Path: "test.avi", Discovered: 42, Hash: hash([]byte("0"))}},
+			expectedFiles:   []string{"test.avi"},
+			expectedJobs:    make([]int, 0),
+		},
+		{
+			name:            "OneJobNoFilesExist",
+			initialEntries:  []value.Entry{{Path: "test.avi", Discovered: 42, Hash: hash([]byte("0"))}},
+			initialJobs:     []int{1},
+			expectedEntries: []value.Entry{{Path: "test.avi", Discovered: 42, Hash: hash([]byte("0"))}},
+			expectedJobs:    make([]int, 0),
+		},
 	}
 
 	for _, test := range tests {
@@ -294,6 +673,10 @@ func TestOpenRecoverIncompleteJobs(t *testing.T) {
 
 			createAndPopulate(t, path, test.initialEntries, test.initialJobs)
 
+			if test.finished {
+				markFinished(t, path, test.initialJobs)
+			}
+
 			for index, path := range test.initialFiles {
 				err := ioutil.WriteFile(filepath.Join(tempDir, path), []byte(strconv.Itoa(index)), 0o755)
 				if err != nil {
@@ -301,7 +684,7 @@ func TestOpenRecoverIncompleteJobs(t *testing.T) {
 				}
 			}
 
-			openAndUpdate(t, path, nil)
+			openAndRecover(t, path)
 
 			assertContains(t, path, test.expectedEntries, test.expectedJobs)
 
@@ -447,7 +830,7 @@ func TestDatabaseUpsertHashUpdated(t *testing.T) {
 	assertContains(t, path, expected, make([]int, 0))
 }
 
-func TestDatabaseRemove(t *testing.T) {
+func TestDatabaseUpsertDuplicateEntry(t *testing.T) {
 	var (
 		tempDir = t.TempDir()
 		path    = filepath.Join(tempDir, "test.db")
@@ -455,7 +838,7 @@ func TestDatabaseRemove(t *testing.T) {
 
 	initial := []value.Entry{
 		{
-			Path:       "test.mp4",
+			Path:       filepath.Join(tempDir, "test.mp4"),
 			Discovered: 8,
 			Transcoded: utils.Int64P(0),
 			Hash:       32,
@@ -464,17 +847,29 @@ func TestDatabaseRemove(t *testing.T) {
 
 	createAndPopulate(t, path, initial, nil)
 
-	remove := []value.Entry{
+	// The original file still exists, so this is a duplicate rather than a rename
+	err := ioutil.WriteFile(initial[0].Path, []byte("test"), 0o644)
+	if err != nil {
+		t.Fatalf("Expected to be able to create test file: %v", err)
+	}
+
+	update := []value.Entry{
 		{
-			ID: 1,
+			Path:       filepath.Join(tempDir, "duplicate.mp4"),
+			Discovered: 16,
+			Hash:       32,
 		},
 	}
 
-	openAndRemove(t, path, remove)
-	assertContains(t, path, make([]value.Entry, 0), make([]int, 0))
+	openAndUpdate(t, path, update)
+	assertContains(t, path, append(update, initial...), make([]int, 0))
+
+	// Updating again shouldn't modify either entry
+	openAndUpdate(t, path, append(update, initial...))
+	assertContains(t, path, append(update, initial...), make([]int, 0))
 }
 
-func TestDatabaseBeginTranscoding(t *testing.T) {
+func TestDatabaseRemove(t *testing.T) {
 	var (
 		tempDir = t.TempDir()
 		path    = filepath.Join(tempDir, "test.db")
@@ -484,25 +879,77 @@ func TestDatabaseBeginTranscoding(t *testing.T) {
 		{
 			Path:       "test.mp4",
 			Discovered: 8,
-			Hash:       16,
+			Transcoded: utils.Int64P(0),
+			Hash:       32,
 		},
 	}
 
 	createAndPopulate(t, path, initial, nil)
 
+	remove := []value.Entry{
+		{
+			ID: 1,
+		},
+	}
+
+	openAndRemove(t, path, remove)
+	assertContains(t, path, make([]value.Entry, 0), make([]int, 0))
+}
+
+func TestDatabaseRemoveAlreadyRemoved(t *testing.T) {
+	var (
+		tempDir = t.TempDir()
+		path    = filepath.Join(tempDir, "test.db")
+	)
+
+	createAndPopulate(t, path, nil, nil)
+
 	db, err := Open(path)
 	if err != nil {
 		t.Fatalf("Expected to be able to open test database: %v", err)
 	}
 	defer db.Close()
 
-	expected := value.Entry{
-		ID:   1,
-		Path: "test.mp4",
-		Hash: 16,
+	removed, err := db.Remove(value.Entry{ID: 1})
+	if err != nil {
+		t.Fatalf("Expected to be able to remove entry: %v", err)
 	}
 
-	entry, err := db.BeginTranscoding()
+	if removed != 0 {
+		t.Fatalf("Expected to remove 0 entries but removed %d", removed)
+	}
+}
+
+func TestDatabaseBeginTranscoding(t *testing.T) {
+	var (
+		tempDir = t.TempDir()
+		path    = filepath.Join(tempDir, "test.db")
+	)
+
+	initial := []value.Entry{
+		{
+			Path:       "test.mp4",
+			Discovered: 8,
+			Hash:       16,
+		},
+	}
+
+	createAndPopulate(t, path, initial, nil)
+
+	db, err := Open(path)
+	if err != nil {
+		t.Fatalf("Expected to be able to open test database: %v", err)
+	}
+	defer db.Close()
+
+	expected := value.Entry{
+		ID:         1,
+		Path:       "test.mp4",
+		Discovered: 8,
+		Hash:       16,
+	}
+
+	entry, err := db.BeginTranscoding(SelectOptions{})
 	if err != nil {
 		t.Fatalf("Expected to be able to begin transcoding entry: %v", err)
 	}
@@ -540,12 +987,13 @@ func TestDatabaseBeginTranscodingOldestEntry(t *testing.T) {
 	defer db.Close()
 
 	expected := value.Entry{
-		ID:   2,
-		Path: "test.mp4",
-		Hash: 16,
+		ID:         2,
+		Path:       "test.mp4",
+		Discovered: 8,
+		Hash:       16,
 	}
 
-	entry, err := db.BeginTranscoding()
+	entry, err := db.BeginTranscoding(SelectOptions{})
 	if err != nil {
 		t.Fatalf("Expected to be able to begin transcoding entry: %v", err)
 	}
@@ -555,6 +1003,81 @@ func TestDatabaseBeginTranscodingOldestEntry(t *testing.T) {
 	}
 }
 
+func TestDatabaseBeginTranscodingConcurrent(t *testing.T) {
+	const (
+		entries = 64
+		workers = 8
+	)
+
+	var (
+		tempDir = t.TempDir()
+		path    = filepath.Join(tempDir, "test.db")
+	)
+
+	initial := make([]value.Entry, 0, entries)
+	for index := 0; index < entries; index++ {
+		initial = append(initial, value.Entry{Path: fmt.Sprintf("%d.mp4", index), Discovered: 8, Hash: uint32(index)})
+	}
+
+	createAndPopulate(t, path, initial, nil)
+
+	var (
+		wg      sync.WaitGroup
+		lock    sync.Mutex
+		handled = make(map[int]int)
+		errs    = make(chan error, workers)
+	)
+
+	// Each worker uses its own connection to emulate multiple goamt processes transcoding from the same database
+	for worker := 0; worker < workers; worker++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			db, err := Open(path)
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer db.Close()
+
+			for {
+				entry, err := db.BeginTranscoding(SelectOptions{})
+				if errors.Is(err, sqlite.ErrQueryReturnedNoRows) {
+					return
+				}
+
+				if err != nil {
+					errs <- err
+					return
+				}
+
+				lock.Lock()
+				handled[entry.ID]++
+				lock.Unlock()
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Fatalf("Expected to be able to begin transcoding concurrently: %v", err)
+	}
+
+	if len(handled) != entries {
+		t.Fatalf("Expected %d entries to be handed out but got %d", entries, len(handled))
+	}
+
+	for id, count := range handled {
+		if count != 1 {
+			t.Fatalf("Expected entry %d to be handed out once but got %d", id, count)
+		}
+	}
+}
+
 func TestDatabaseBeginTranscodingNoEntries(t *testing.T) {
 	var (
 		tempDir = t.TempDir()
@@ -567,7 +1090,7 @@ func TestDatabaseBeginTranscodingNoEntries(t *testing.T) {
 	}
 	defer db.Close()
 
-	_, err = db.BeginTranscoding()
+	_, err = db.BeginTranscoding(SelectOptions{})
 	if err == nil || !errors.Is(err, sqlite.ErrQueryReturnedNoRows) {
 		t.Fatalf("Expected to get an 'ErrQueryReturnedNoRows' but got '%#v'", err)
 	}
@@ -624,3 +1147,1851 @@ func TestDatabaseCompleteTranscoding(t *testing.T) {
 
 	assertContains(t, path, expected, make([]int, 0))
 }
+
+func TestDatabaseCompleteTranscodingKeepingSource(t *testing.T) {
+	var (
+		tempDir = t.TempDir()
+		path    = filepath.Join(tempDir, "test.db")
+		source  = filepath.Join(tempDir, "test.avi")
+		target  = filepath.Join(tempDir, "transcoded", "test.mp4")
+	)
+
+	createAndPopulate(t, path, []value.Entry{{Path: source, Discovered: 8, Hash: checksum("0")}}, nil)
+
+	err := os.Mkdir(filepath.Dir(target), 0o755)
+	if err != nil {
+		t.Fatalf("Expected to be able to create test directory: %v", err)
+	}
+
+	err = ioutil.WriteFile(target, []byte("Hello, World!"), 0o755)
+	if err != nil {
+		t.Fatalf("Expected to be able to create test file: %v", err)
+	}
+
+	db, err := Open(path)
+	if err != nil {
+		t.Fatalf("Expected to be able to open test database: %v", err)
+	}
+	defer db.Close()
+
+	err = db.CompleteTranscodingKeepingSource(value.Entry{ID: 1, Path: target, Hash: checksum("0")}, source)
+	if err != nil {
+		t.Fatalf("Expected to be able to mark transcoding complete: %v", err)
+	}
+
+	// The source file is unchanged, so shouldn't be added again
+	outcome, err := db.Upsert(value.Entry{Path: source, Discovered: 16, Hash: checksum("0")})
+	if err != nil {
+		t.Fatalf("Expected to be able to upsert entry: %v", err)
+	}
+
+	if outcome != UpsertSkipped {
+		t.Fatalf("Expected the source to be skipped but got %v", outcome)
+	}
+
+	outcome, err = db.InsertUnhashed(value.Entry{Path: source, Discovered: 16})
+	if err != nil {
+		t.Fatalf("Expected to be able to insert unhashed entry: %v", err)
+	}
+
+	if outcome != UpsertSkipped {
+		t.Fatalf("Expected the source to be skipped but got %v", outcome)
+	}
+
+	// The source file has been modified, so should be treated as a new file
+	outcome, err = db.Upsert(value.Entry{Path: source, Discovered: 32, Hash: checksum("1")})
+	if err != nil {
+		t.Fatalf("Expected to be able to upsert entry: %v", err)
+	}
+
+	if outcome != UpsertInserted {
+		t.Fatalf("Expected the modified source to be inserted but got %v", outcome)
+	}
+}
+
+func TestDatabaseRecoverRemoveTranscodingFails(t *testing.T) {
+	var (
+		tempDir = t.TempDir()
+		path    = filepath.Join(tempDir, "test.db")
+		entry   = value.Entry{Path: filepath.Join(tempDir, "test.mp4"), Discovered: 42, Hash: checksum("0")}
+	)
+
+	createAndPopulate(t, path, []value.Entry{entry}, []int{1})
+
+	err := ioutil.WriteFile(entry.Path, []byte("0"), 0o755)
+	if err != nil {
+		t.Fatalf("Expected to be able to create test file: %v", err)
+	}
+
+	// A non-empty directory can't be removed, simulating a crash before the incomplete transcode file is removed
+	err = os.MkdirAll(filepath.Join(tempDir, "test.transcoding.mp4", "contents"), 0o755)
+	if err != nil {
+		t.Fatalf("Expected to be able to create test directory: %v", err)
+	}
+
+	openAndRecover(t, path)
+
+	assertContains(t, path, []value.Entry{entry}, make([]int, 0))
+
+	// The job has already been rolled back, so the leftover file is ignored by subsequent recoveries
+	openAndRecover(t, path)
+
+	assertContains(t, path, []value.Entry{entry}, make([]int, 0))
+}
+
+func TestDatabaseRecoverWithTarget(t *testing.T) {
+	type test struct {
+		name            string
+		initialFiles    []string
+		finished        bool
+		expectedEntries []value.Entry
+		expectedFiles   []string
+	}
+
+	tests := []*test{
+		{
+			name:            "TargetNotStarted",
+			initialFiles:    []string{"test.avi"},
+			expectedEntries: []value.Entry{{Path: "test.avi", Discovered: 42, Hash: checksum("0")}},
+			expectedFiles:   []string{"test.avi"},
+		},
+		{
+			name:            "TargetInProgress",
+			initialFiles:    []string{"test.avi", "output/test.transcoding.mp4"},
+			expectedEntries: []value.Entry{{Path: "test.avi", Discovered: 42, Hash: checksum("0")}},
+			expectedFiles:   []string{"test.avi"},
+		},
+		{
+			name:         "TargetRenamed",
+			initialFiles: []string{"test.avi", "output/test.mp4"},
+			finished:     true,
+			expectedEntries: []value.Entry{
+				{Path: "output/test.mp4", Discovered: 42, Transcoded: utils.Int64P(0), Hash: checksum("1")},
+			},
+			expectedFiles: []string{"test.avi", "output/test.mp4"},
+		},
+		{
+			// The output of an earlier run (or an unrelated file) already existed at the target and the job hadn't
+			// finished; the source is left in place, so only the missing marker distinguishes this from a finished job
+			name:            "TargetExistsNotFinished",
+			initialFiles:    []string{"test.avi", "output/test.mp4"},
+			expectedEntries: []value.Entry{{Path: "test.avi", Discovered: 42, Hash: checksum("0")}},
+			expectedFiles:   []string{"test.avi", "output/test.mp4"},
+		},
+		{
+			// A file already existed at the target, so the job must be rolled back rather than completed using it
+			name:            "TargetExistsInProgress",
+			initialFiles:    []string{"test.avi", "output/test.mp4", "output/test.transcoding.mp4"},
+			expectedEntries: []value.Entry{{Path: "test.avi", Discovered: 42, Hash: checksum("0")}},
+			expectedFiles:   []string{"test.avi", "output/test.mp4"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var (
+				tempDir = t.TempDir()
+				path    = filepath.Join(tempDir, "test.db")
+				entry   = value.Entry{Path: filepath.Join(tempDir, "test.avi"), Discovered: 42, Hash: checksum("0")}
+			)
+
+			for index := range test.expectedEntries {
+				test.expectedEntries[index].Path = filepath.Join(tempDir, test.expectedEntries[index].Path)
+			}
+
+			createAndPopulate(t, path, []value.Entry{entry}, nil)
+
+			db, err := Open(path)
+			if err != nil {
+				t.Fatalf("Expected to be able to open test database: %v", err)
+			}
+
+			err = db.wrapTransaction(func(tx *sql.Tx) error {
+				return db.addJob(tx, value.Entry{ID: 1}, filepath.Join(tempDir, "output", "test.mp4"), "")
+			})
+			if err != nil {
+				t.Fatalf("Expected to be able to add job: %v", err)
+			}
+
+			if test.finished {
+				err = db.FinishedTranscoding(value.Entry{ID: 1})
+				if err != nil {
+					t.Fatalf("Expected to be able to mark transcoding finished: %v", err)
+				}
+			}
+
+			err = db.Close()
+			if err != nil {
+				t.Fatalf("Expected to be able to close test database: %v", err)
+			}
+
+			err = os.Mkdir(filepath.Join(tempDir, "output"), 0o755)
+			if err != nil {
+				t.Fatalf("Expected to be able to create output directory: %v", err)
+			}
+
+			for index, path := range test.initialFiles {
+				err := ioutil.WriteFile(filepath.Join(tempDir, path), []byte(strconv.Itoa(index)), 0o755)
+				if err != nil {
+					t.Fatalf("Expected to be able to create test file: %v", err)
+				}
+			}
+
+			openAndRecover(t, path)
+
+			assertContains(t, path, test.expectedEntries, make([]int, 0))
+
+			// The source is left in place by completed jobs, it must be recorded so that it's not added again
+			db, err = Open(path)
+			if err != nil {
+				t.Fatalf("Expected to be able to open test database: %v", err)
+			}
+			defer db.Close()
+
+			outcome, err := db.Upsert(entry)
+			if err != nil {
+				t.Fatalf("Expected to be able to upsert entry: %v", err)
+			}
+
+			if test.finished && outcome != UpsertSkipped {
+				t.Fatalf("Expected the source of the completed job to be skipped but got %v", outcome)
+			}
+
+			for _, path := range test.expectedFiles {
+				if !utils.PathExists(filepath.Join(tempDir, path)) {
+					t.Fatalf("Expected file '%s' to exist", path)
+				}
+			}
+
+			for _, path := range test.initialFiles {
+				if !utils.ContainsString(test.expectedFiles, path) && utils.PathExists(filepath.Join(tempDir, path)) {
+					t.Fatalf("Expected file '%s' to not exist", path)
+				}
+			}
+		})
+	}
+}
+
+func TestDatabaseRecoverWithTemporary(t *testing.T) {
+	var (
+		tempDir   = t.TempDir()
+		path      = filepath.Join(tempDir, "test.db")
+		temporary = filepath.Join(tempDir, "scratch", "1.transcoding.mp4")
+		entry     = value.Entry{Path: filepath.Join(tempDir, "test.mp4"), Discovered: 42, Hash: checksum("0")}
+	)
+
+	createAndPopulate(t, path, []value.Entry{entry}, nil)
+
+	db, err := Open(path)
+	if err != nil {
+		t.Fatalf("Expected to be able to open test database: %v", err)
+	}
+
+	err = db.wrapTransaction(func(tx *sql.Tx) error {
+		return db.addJob(tx, value.Entry{ID: 1}, "", temporary)
+	})
+	if err != nil {
+		t.Fatalf("Expected to be able to add job: %v", err)
+	}
+
+	err = db.Close()
+	if err != nil {
+		t.Fatalf("Expected to be able to close test database: %v", err)
+	}
+
+	err = os.Mkdir(filepath.Dir(temporary), 0o755)
+	if err != nil {
+		t.Fatalf("Expected to be able to create temporary directory: %v", err)
+	}
+
+	for _, path := range []string{entry.Path, temporary} {
+		err := ioutil.WriteFile(path, []byte("0"), 0o755)
+		if err != nil {
+			t.Fatalf("Expected to be able to create test file: %v", err)
+		}
+	}
+
+	openAndRecover(t, path)
+
+	assertContains(t, path, []value.Entry{entry}, make([]int, 0))
+
+	if utils.PathExists(temporary) {
+		t.Fatalf("Expected temporary transcode file to be removed")
+	}
+}
+
+func TestOpenMigrateVersionOne(t *testing.T) {
+	var (
+		tempDir = t.TempDir()
+		path    = filepath.Join(tempDir, "test.db")
+	)
+
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatalf("Expected to be able to open test database: %v", err)
+	}
+
+	queries := []string{
+		`create table library (
+			id integer primary key autoincrement,
+			path text not null unique,
+			discovered integer not null,
+			transcoded integer,
+			hash integer unique,
+			unique (path, hash)
+		);`,
+		`create table jobs (
+			id integer primary key autoincrement,
+			library_id integer not null unique,
+			start_time integer not null,
+			foreign key (library_id) references library (id)
+		);`,
+		"insert into library (path, discovered, hash) values ('test.mp4', 8, 16);",
+		"insert into jobs (library_id, start_time) values (1, 8);",
+		"pragma user_version=1;",
+	}
+
+	for _, query := range queries {
+		_, err = sqlite.ExecuteQuery(db, sqlite.Query{Query: query})
+		if err != nil {
+			t.Fatalf("Expected to be able to execute query: %v", err)
+		}
+	}
+
+	err = db.Close()
+	if err != nil {
+		t.Fatalf("Expected to be able to close test database: %v", err)
+	}
+
+	migrated, err := Open(path)
+	if err != nil {
+		t.Fatalf("Expected to be able to open and migrate test database: %v", err)
+	}
+	defer migrated.Close()
+
+	var userVersion uint32
+
+	err = sqlite.GetPragma(migrated.db, sqlite.PragmaUserVersion, &userVersion)
+	if err != nil {
+		t.Fatalf("Expected to be able to get 'user_version': %v", err)
+	}
+
+	if version.DatabaseVersion(userVersion) != version.DatabaseVersionCurrent {
+		t.Fatalf("Expected %d but got %d", version.DatabaseVersionCurrent, userVersion)
+	}
+
+	_, err = sqlite.ExecuteQuery(migrated.db, sqlite.Query{Query: "select target from jobs;"})
+	if err != nil {
+		t.Fatalf("Expected the jobs table to have a 'target' column: %v", err)
+	}
+
+	_, err = sqlite.ExecuteQuery(migrated.db, sqlite.Query{Query: "select priority from library;"})
+	if err != nil {
+		t.Fatalf("Expected the library table to have a 'priority' column: %v", err)
+	}
+
+	_, err = sqlite.ExecuteQuery(migrated.db,
+		sqlite.Query{Query: "select source_codec, source_width, source_height from library;"})
+	if err != nil {
+		t.Fatalf("Expected the library table to have the source columns: %v", err)
+	}
+
+	_, err = sqlite.ExecuteQuery(migrated.db, sqlite.Query{Query: "select failures, quarantined from library;"})
+	if err != nil {
+		t.Fatalf("Expected the library table to have the quarantine columns: %v", err)
+	}
+
+	var index string
+
+	err = sqlite.QueryRow(migrated.db,
+		sqlite.Query{Query: "select name from sqlite_master where type = 'index' and name = 'library_selection';"}, &index)
+	if err != nil {
+		t.Fatalf("Expected the library table to have a selection index: %v", err)
+	}
+
+	var jobs int
+
+	err = sqlite.QueryRow(migrated.db, sqlite.Query{Query: "select count(*) from jobs where library_id = 1;"}, &jobs)
+	if err != nil || jobs != 1 {
+		t.Fatalf("Expected the job to be retained by the migration but got %d: %v", jobs, err)
+	}
+
+	_, err = sqlite.ExecuteQuery(migrated.db,
+		sqlite.Query{Query: "insert into library (path, discovered, hash) values ('duplicate.mp4', 8, 16);"})
+	if err != nil {
+		t.Fatalf("Expected the library table to allow duplicate hashes: %v", err)
+	}
+
+	if migrated.HashAlgorithm() != utils.HashAlgorithmIEEE {
+		t.Fatalf("Expected a migrated database to use '%s' but got '%s'", utils.HashAlgorithmIEEE,
+			migrated.HashAlgorithm())
+	}
+}
+
+func TestDatabaseUpsertSource(t *testing.T) {
+	var (
+		tempDir = t.TempDir()
+		path    = filepath.Join(tempDir, "test.db")
+	)
+
+	initial := []value.Entry{
+		{
+			Path:       "test.avi",
+			Discovered: 8,
+			Hash:       16,
+		},
+	}
+
+	createAndPopulate(t, path, initial, nil)
+
+	db, err := Open(path)
+	if err != nil {
+		t.Fatalf("Expected to be able to open test database: %v", err)
+	}
+	defer db.Close()
+
+	// The source of an existing entry should be populated if it was previously unknown
+	probed := value.Entry{
+		Path:         "test.avi",
+		Discovered:   8,
+		Hash:         16,
+		SourceCodec:  utils.StringP("mpeg4"),
+		SourceWidth:  utils.Int64P(720),
+		SourceHeight: utils.Int64P(480),
+	}
+
+	_, err = db.Upsert(probed)
+	if err != nil {
+		t.Fatalf("Expected to be able to upsert entry: %v", err)
+	}
+
+	// But shouldn't be overwritten once known
+	_, err = db.Upsert(value.Entry{Path: "renamed.avi", Discovered: 8, Hash: 16, SourceCodec: utils.StringP("h264")})
+	if err != nil {
+		t.Fatalf("Expected to be able to upsert entry: %v", err)
+	}
+
+	entry, err := db.FindByHash(16)
+	if err != nil {
+		t.Fatalf("Expected to be able to find entry: %v", err)
+	}
+
+	probed.ID, probed.Path = 1, "renamed.avi"
+
+	if !reflect.DeepEqual(entry, probed) {
+		t.Fatalf("Expected %+v but got %+v", probed, entry)
+	}
+}
+
+func TestDatabaseUpsertDuration(t *testing.T) {
+	var (
+		tempDir = t.TempDir()
+		path    = filepath.Join(tempDir, "test.db")
+	)
+
+	// Entries probed before durations were recorded will have a known source codec, but an unknown duration
+	initial := []value.Entry{
+		{
+			Path:         "test.avi",
+			Discovered:   8,
+			Hash:         16,
+			SourceCodec:  utils.StringP("mpeg4"),
+			SourceWidth:  utils.Int64P(720),
+			SourceHeight: utils.Int64P(480),
+		},
+	}
+
+	createAndPopulate(t, path, initial, nil)
+
+	db, err := Open(path)
+	if err != nil {
+		t.Fatalf("Expected to be able to open test database: %v", err)
+	}
+	defer db.Close()
+
+	probed := initial[0]
+	probed.Duration = utils.Float64P(1325.48)
+
+	outcome, err := db.Upsert(probed)
+	if err != nil {
+		t.Fatalf("Expected to be able to upsert entry: %v", err)
+	}
+
+	if outcome != UpsertUpdated {
+		t.Fatalf("Expected the entry to be updated, got outcome %d", outcome)
+	}
+
+	entry, err := db.BeginTranscoding(SelectOptions{})
+	if err != nil {
+		t.Fatalf("Expected to be able to begin transcoding: %v", err)
+	}
+
+	if entry.Duration == nil || *entry.Duration != 1325.48 {
+		t.Fatalf("Expected the duration to be populated, got %+v", entry.Fields())
+	}
+}
+
+func TestDatabaseUpsertOutcome(t *testing.T) {
+	var (
+		tempDir = t.TempDir()
+		path    = filepath.Join(tempDir, "test.db")
+		source  = filepath.Join(tempDir, "test.avi")
+		renamed = filepath.Join(tempDir, "renamed.avi")
+	)
+
+	db, err := Create(path)
+	if err != nil {
+		t.Fatalf("Expected to be able to create test database: %v", err)
+	}
+	defer db.Close()
+
+	err = ioutil.WriteFile(source, []byte("0"), 0o755)
+	if err != nil {
+		t.Fatalf("Expected to be able to create test file: %v", err)
+	}
+
+	type test struct {
+		name     string
+		entry    value.Entry
+		expected UpsertOutcome
+	}
+
+	tests := []*test{
+		{
+			name:     "New",
+			entry:    value.Entry{Path: source, Discovered: 8, Hash: 16},
+			expected: UpsertInserted,
+		},
+		{
+			name:     "Unchanged",
+			entry:    value.Entry{Path: source, Discovered: 8, Hash: 16},
+			expected: UpsertSkipped,
+		},
+		{
+			name:     "Probed",
+			entry:    value.Entry{Path: source, Discovered: 8, Hash: 16, SourceCodec: utils.StringP("mpeg4")},
+			expected: UpsertUpdated,
+		},
+		{
+			name:     "Modified",
+			entry:    value.Entry{Path: source, Discovered: 8, Hash: 32},
+			expected: UpsertUpdated,
+		},
+		{
+			name:     "Renamed",
+			entry:    value.Entry{Path: renamed, Discovered: 8, Hash: 32},
+			expected: UpsertUpdated,
+		},
+	}
+
+	for _, test := range tests {
+		if test.entry.Path == renamed {
+			err = os.Rename(source, renamed)
+			if err != nil {
+				t.Fatalf("Expected to be able to rename test file: %v", err)
+			}
+		}
+
+		outcome, err := db.Upsert(test.entry)
+		if err != nil {
+			t.Fatalf("Expected to be able to upsert entry: %v", err)
+		}
+
+		if outcome != test.expected {
+			t.Fatalf("%s: Expected outcome %d but got %d", test.name, test.expected, outcome)
+		}
+	}
+}
+
+func TestDatabaseFailTranscoding(t *testing.T) {
+	var (
+		tempDir = t.TempDir()
+		path    = filepath.Join(tempDir, "test.db")
+	)
+
+	initial := []value.Entry{
+		{
+			Path:       "test.avi",
+			Discovered: 8,
+			Hash:       16,
+		},
+	}
+
+	createAndPopulate(t, path, initial, nil)
+
+	db, err := Open(path)
+	if err != nil {
+		t.Fatalf("Expected to be able to open test database: %v", err)
+	}
+	defer db.Close()
+
+	entry, err := db.BeginTranscoding(SelectOptions{})
+	if err != nil {
+		t.Fatalf("Expected to be able to begin transcoding: %v", err)
+	}
+
+	err = db.FailTranscoding(entry, false)
+	if err != nil {
+		t.Fatalf("Expected to be able to fail transcoding: %v", err)
+	}
+
+	// The entry should be selected again, now with its failure recorded
+	entry, err = db.BeginTranscoding(SelectOptions{})
+	if err != nil {
+		t.Fatalf("Expected to be able to begin transcoding: %v", err)
+	}
+
+	if entry.Failures != 1 {
+		t.Fatalf("Expected 1 failure but got %d", entry.Failures)
+	}
+
+	entry.Path = "quarantine/test.avi"
+
+	err = db.FailTranscoding(entry, true)
+	if err != nil {
+		t.Fatalf("Expected to be able to fail transcoding: %v", err)
+	}
+
+	_, err = db.BeginTranscoding(SelectOptions{})
+	if !errors.Is(err, sqlite.ErrQueryReturnedNoRows) {
+		t.Fatalf("Expected quarantined entries not to be selected but got '%#v'", err)
+	}
+
+	updated, err := db.ResetQuarantine("other")
+	if err != nil || updated != 0 {
+		t.Fatalf("Expected no entries to be reset but got %d: %v", updated, err)
+	}
+
+	updated, err = db.ResetQuarantine("")
+	if err != nil || updated != 1 {
+		t.Fatalf("Expected 1 entry to be reset but got %d: %v", updated, err)
+	}
+
+	entry, err = db.BeginTranscoding(SelectOptions{})
+	if err != nil {
+		t.Fatalf("Expected to be able to begin transcoding: %v", err)
+	}
+
+	if entry.Path != "quarantine/test.avi" || entry.Failures != 0 {
+		t.Fatalf("Expected the reset entry to be selected but got '%s' (%d)", entry.Path, entry.Failures)
+	}
+}
+
+func TestDatabaseResetTranscoded(t *testing.T) {
+	var (
+		tempDir = t.TempDir()
+		path    = filepath.Join(tempDir, "test.db")
+	)
+
+	initial := []value.Entry{
+		{Path: "movies/a.mp4", Discovered: 8, Transcoded: utils.Int64P(8), Hash: 16},
+		{Path: "movies/b.mp4", Discovered: 16, Hash: 32},
+		{Path: "tv/c.mp4", Discovered: 32, Transcoded: utils.Int64P(32), Hash: 64},
+	}
+
+	createAndPopulate(t, path, initial, nil)
+
+	db, err := Open(path)
+	if err != nil {
+		t.Fatalf("Expected to be able to open test database: %v", err)
+	}
+	defer db.Close()
+
+	updated, err := db.ResetTranscoded("other")
+	if err != nil || updated != 0 {
+		t.Fatalf("Expected no entries to be reset but got %d: %v", updated, err)
+	}
+
+	// Untranscoded entries within the prefix aren't counted
+	updated, err = db.ResetTranscoded("movies")
+	if err != nil || updated != 1 {
+		t.Fatalf("Expected 1 entry to be reset but got %d: %v", updated, err)
+	}
+
+	updated, err = db.ResetTranscoded("")
+	if err != nil || updated != 1 {
+		t.Fatalf("Expected 1 entry to be reset but got %d: %v", updated, err)
+	}
+
+	expected := []value.Entry{
+		{Path: "movies/a.mp4", Discovered: 8, Hash: 16},
+		{Path: "movies/b.mp4", Discovered: 16, Hash: 32},
+		{Path: "tv/c.mp4", Discovered: 32, Hash: 64},
+	}
+
+	assertContains(t, path, expected, make([]int, 0))
+}
+
+func TestDatabaseResetTranscodedKeptSource(t *testing.T) {
+	var (
+		tempDir = t.TempDir()
+		path    = filepath.Join(tempDir, "test.db")
+		source  = filepath.Join(tempDir, "test.avi")
+		target  = filepath.Join(tempDir, "output", "test.mp4")
+	)
+
+	createAndPopulate(t, path, []value.Entry{{Path: source, Discovered: 8, Hash: checksum("0")}}, nil)
+
+	err := os.Mkdir(filepath.Dir(target), 0o755)
+	if err != nil {
+		t.Fatalf("Expected to be able to create test directory: %v", err)
+	}
+
+	err = ioutil.WriteFile(target, []byte("1"), 0o755)
+	if err != nil {
+		t.Fatalf("Expected to be able to create test file: %v", err)
+	}
+
+	db, err := Open(path)
+	if err != nil {
+		t.Fatalf("Expected to be able to open test database: %v", err)
+	}
+	defer db.Close()
+
+	err = db.CompleteTranscodingKeepingSource(value.Entry{ID: 1, Path: target, Hash: checksum("0")}, source)
+	if err != nil {
+		t.Fatalf("Expected to be able to mark transcoding complete: %v", err)
+	}
+
+	// The entry was transcoded to an output directory, resetting it would re-encode the transcoded file
+	updated, err := db.ResetTranscoded("")
+	if err != nil || updated != 0 {
+		t.Fatalf("Expected no entries to be reset but got %d: %v", updated, err)
+	}
+
+	entries, err := db.List(ListOptions{TranscodedOnly: true, ExcludeKeptSources: true})
+	if err != nil || len(entries) != 0 {
+		t.Fatalf("Expected no resettable entries but got %d: %v", len(entries), err)
+	}
+
+	expected := []value.Entry{
+		{Path: target, Discovered: 8, Transcoded: utils.Int64P(0), Hash: checksum("1")},
+	}
+
+	assertContains(t, path, expected, make([]int, 0))
+}
+
+func TestDatabaseInsertUnhashed(t *testing.T) {
+	var (
+		tempDir = t.TempDir()
+		path    = filepath.Join(tempDir, "test.db")
+	)
+
+	initial := []value.Entry{
+		{
+			Path:       "hashed.avi",
+			Discovered: 8,
+			Hash:       16,
+		},
+	}
+
+	createAndPopulate(t, path, initial, nil)
+
+	db, err := Open(path)
+	if err != nil {
+		t.Fatalf("Expected to be able to open test database: %v", err)
+	}
+	defer db.Close()
+
+	// Existing entries shouldn't be clobbered
+	for _, entry := range []value.Entry{{Path: "hashed.avi", Discovered: 32}, {Path: "unhashed.avi", Discovered: 64}} {
+		_, err = db.InsertUnhashed(entry)
+		if err != nil {
+			t.Fatalf("Expected to be able to insert unhashed entry: %v", err)
+		}
+	}
+
+	// Unhashed entries shouldn't be selected for transcoding
+	entry, err := db.BeginTranscoding(SelectOptions{})
+	if err != nil {
+		t.Fatalf("Expected to be able to begin transcoding: %v", err)
+	}
+
+	if entry.Path != "hashed.avi" {
+		t.Fatalf("Expected the hashed entry to be selected but got '%s'", entry.Path)
+	}
+
+	_, err = db.BeginTranscoding(SelectOptions{})
+	if !errors.Is(err, sqlite.ErrQueryReturnedNoRows) {
+		t.Fatalf("Expected unhashed entries not to be selected but got '%#v'", err)
+	}
+
+	// Hashing the entry should replace it, even if the same file was previously recorded under another path
+	_, err = db.Upsert(value.Entry{Path: "unhashed.avi", Discovered: 128, Hash: 16})
+	if err != nil {
+		t.Fatalf("Expected to be able to upsert entry: %v", err)
+	}
+
+	var count int
+
+	err = db.db.QueryRow("select count(*) from library where hash is null;").Scan(&count)
+	if err != nil {
+		t.Fatalf("Expected to be able to query database: %v", err)
+	}
+
+	if count != 0 {
+		t.Fatalf("Expected no unhashed entries but got %d", count)
+	}
+
+	hashed, err := db.FindByHash(16)
+	if err != nil {
+		t.Fatalf("Expected to be able to find entry: %v", err)
+	}
+
+	if hashed.Path != "unhashed.avi" || hashed.Discovered != 8 {
+		t.Fatalf("Expected the hashed entry to be renamed but got '%s' (%d)", hashed.Path, hashed.Discovered)
+	}
+
+	// A new file should inherit the time the unhashed entry was discovered
+	_, err = db.InsertUnhashed(value.Entry{Path: "new.avi", Discovered: 256})
+	if err != nil {
+		t.Fatalf("Expected to be able to insert unhashed entry: %v", err)
+	}
+
+	_, err = db.Upsert(value.Entry{Path: "new.avi", Discovered: 512, Hash: 32})
+	if err != nil {
+		t.Fatalf("Expected to be able to upsert entry: %v", err)
+	}
+
+	entry, err = db.FindByHash(32)
+	if err != nil {
+		t.Fatalf("Expected to be able to find entry: %v", err)
+	}
+
+	if entry.Path != "new.avi" || entry.Discovered != 256 {
+		t.Fatalf("Expected the new entry discovered at 256 but got '%s' (%d)", entry.Path, entry.Discovered)
+	}
+}
+
+func TestDatabaseResetJobs(t *testing.T) {
+	var (
+		tempDir = t.TempDir()
+		path    = filepath.Join(tempDir, "test.db")
+	)
+
+	initial := []value.Entry{
+		{Path: "test1.mp4", Discovered: 8, Hash: 16},
+		{Path: "test2.mp4", Discovered: 16, Hash: 32},
+	}
+
+	createAndPopulate(t, path, initial, []int{2})
+
+	db, err := Open(path)
+	if err != nil {
+		t.Fatalf("Expected to be able to open test database: %v", err)
+	}
+	defer db.Close()
+
+	jobs, err := db.Jobs()
+	if err != nil {
+		t.Fatalf("Expected to be able to get jobs: %v", err)
+	}
+
+	if len(jobs) != 1 || jobs[0].Entry.ID != 2 || jobs[0].Entry.Path != "test2.mp4" || jobs[0].Started == 0 {
+		t.Fatalf("Expected a single job for the second entry but got %+v", jobs)
+	}
+
+	removed, err := db.ResetJobs(jobs)
+	if err != nil || removed != 1 {
+		t.Fatalf("Expected 1 job to be removed but got %d: %v", removed, err)
+	}
+
+	jobs, err = db.Jobs()
+	if err != nil || len(jobs) != 0 {
+		t.Fatalf("Expected no jobs but got %+v: %v", jobs, err)
+	}
+
+	// Both entries should be selectable now that the job has been reset
+	entry, err := db.BeginTranscoding(SelectOptions{})
+	if err != nil {
+		t.Fatalf("Expected to be able to begin transcoding: %v", err)
+	}
+
+	if entry.Path != "test1.mp4" {
+		t.Fatalf("Expected the oldest entry to be selected but got '%s'", entry.Path)
+	}
+
+	entry, err = db.BeginTranscoding(SelectOptions{})
+	if err != nil || entry.Path != "test2.mp4" {
+		t.Fatalf("Expected the reset entry to be selected: %v", err)
+	}
+}
+
+func TestDatabaseRecordSource(t *testing.T) {
+	var (
+		tempDir = t.TempDir()
+		path    = filepath.Join(tempDir, "test.db")
+	)
+
+	initial := []value.Entry{
+		{Path: "test1.mp4", Discovered: 8, Hash: 16},
+		{Path: "test2.mp4", Discovered: 16, Hash: 32, SourceCodec: utils.StringP("h264")},
+	}
+
+	createAndPopulate(t, path, initial, nil)
+
+	db, err := Open(path)
+	if err != nil {
+		t.Fatalf("Expected to be able to open test database: %v", err)
+	}
+	defer db.Close()
+
+	for id := 1; id <= 2; id++ {
+		err = db.RecordSource(value.Entry{
+			ID:           id,
+			SourceCodec:  utils.StringP("hevc"),
+			SourceWidth:  utils.Int64P(1920),
+			SourceHeight: utils.Int64P(1080),
+			Duration:     utils.Float64P(60),
+		})
+		if err != nil {
+			t.Fatalf("Expected to be able to record source: %v", err)
+		}
+	}
+
+	// Only the values which were previously unknown are populated
+	for path, codec := range map[string]string{"test1.mp4": "hevc", "test2.mp4": "h264"} {
+		entry, err := db.FindByPath(path)
+		if err != nil {
+			t.Fatalf("Expected to be able to find entry: %v", err)
+		}
+
+		if entry.SourceCodec == nil || *entry.SourceCodec != codec || entry.SourceWidth == nil ||
+			*entry.SourceWidth != 1920 || entry.Duration == nil || *entry.Duration != 60 {
+			t.Fatalf("Expected source codec '%s' to be recorded but got %+v", codec, entry)
+		}
+	}
+}
+
+func TestDatabaseCompact(t *testing.T) {
+	var (
+		tempDir = t.TempDir()
+		path    = filepath.Join(tempDir, "test.db")
+	)
+
+	initial := []value.Entry{
+		{Path: "test1.mp4", Discovered: 8, Hash: 16},
+		{Path: "test2.mp4", Discovered: 16, Hash: 32},
+		{Path: "test3.mp4", Discovered: 32, Hash: 64},
+		{Path: "test4.mp4", Discovered: 64, Hash: 128},
+	}
+
+	createAndPopulate(t, path, initial, []int{1, 2})
+	openAndRemove(t, path, []value.Entry{{ID: 3}, {ID: 4}})
+
+	db, err := Open(path)
+	if err != nil {
+		t.Fatalf("Expected to be able to open test database: %v", err)
+	}
+	defer db.Close()
+
+	jobs, err := db.Jobs()
+	if err != nil || len(jobs) != 2 {
+		t.Fatalf("Expected two jobs but got %+v: %v", jobs, err)
+	}
+
+	err = db.Compact()
+	if err != nil {
+		t.Fatalf("Expected to be able to compact database: %v", err)
+	}
+
+	var free int64
+
+	err = sqlite.QueryRow(db.db, sqlite.Query{Query: "pragma freelist_count;"}, &free)
+	if err != nil || free != 0 {
+		t.Fatalf("Expected no free pages after compacting but got %d: %v", free, err)
+	}
+
+	entries, err := db.List(ListOptions{})
+	if err != nil || len(entries) != 2 || entries[0].ID != 1 || entries[1].ID != 2 {
+		t.Fatalf("Expected the remaining entries to be unchanged but got %+v: %v", entries, err)
+	}
+
+	remaining, err := db.Jobs()
+	if err != nil || !reflect.DeepEqual(remaining, jobs) {
+		t.Fatalf("Expected the jobs to be unchanged but got %+v: %v", remaining, err)
+	}
+
+	_, err = db.Upsert(value.Entry{Path: "test5.mp4", Discovered: 128, Hash: 256})
+	if err != nil {
+		t.Fatalf("Expected to be able to upsert entry: %v", err)
+	}
+
+	// The ids of removed entries may be referenced elsewhere (e.g. run history) so must never be reused
+	entry, err := db.FindByPath("test5.mp4")
+	if err != nil || entry.ID != 5 {
+		t.Fatalf("Expected the new entry to be assigned a new id but got %d: %v", entry.ID, err)
+	}
+}
+
+func TestDatabaseSetHashAlgorithm(t *testing.T) {
+	var (
+		tempDir = t.TempDir()
+		path    = filepath.Join(tempDir, "test.db")
+	)
+
+	db, err := Create(path)
+	if err != nil {
+		t.Fatalf("Expected to be able to create test database: %v", err)
+	}
+
+	if db.HashAlgorithm() != utils.HashAlgorithmIEEE {
+		t.Fatalf("Expected a new database to default to '%s' but got '%s'", utils.HashAlgorithmIEEE,
+			db.HashAlgorithm())
+	}
+
+	err = db.SetHashAlgorithm("koopman")
+	if err == nil {
+		t.Fatalf("Expected an error when setting an unsupported hash algorithm")
+	}
+
+	err = db.SetHashAlgorithm(utils.HashAlgorithmCastagnoli)
+	if err != nil {
+		t.Fatalf("Expected to be able to set hash algorithm for an empty database: %v", err)
+	}
+
+	_, err = db.Upsert(value.Entry{Path: "test.mp4", Discovered: 8, Hash: 16})
+	if err != nil {
+		t.Fatalf("Expected to be able to upsert entry: %v", err)
+	}
+
+	var mismatch *ErrHashAlgorithmMismatch
+
+	err = db.SetHashAlgorithm(utils.HashAlgorithmIEEE)
+	if !errors.As(err, &mismatch) {
+		t.Fatalf("Expected an 'ErrHashAlgorithmMismatch' but got '%#v'", err)
+	}
+
+	db.Close()
+
+	db, err = Open(path)
+	if err != nil {
+		t.Fatalf("Expected to be able to open test database: %v", err)
+	}
+	defer db.Close()
+
+	if db.HashAlgorithm() != utils.HashAlgorithmCastagnoli {
+		t.Fatalf("Expected the hash algorithm to be persisted but got '%s'", db.HashAlgorithm())
+	}
+
+	err = db.VerifyHashAlgorithm(utils.HashAlgorithmCastagnoli)
+	if err != nil {
+		t.Fatalf("Expected hash algorithm to be verified: %v", err)
+	}
+
+	err = db.VerifyHashAlgorithm(utils.HashAlgorithmIEEE)
+	if !errors.As(err, &mismatch) {
+		t.Fatalf("Expected an 'ErrHashAlgorithmMismatch' but got '%#v'", err)
+	}
+}
+
+func TestDatabaseRelativePaths(t *testing.T) {
+	var (
+		tempDir = t.TempDir()
+		path    = filepath.Join(tempDir, "test.db")
+		root    = filepath.Join(tempDir, "library")
+		moved   = filepath.Join(tempDir, "moved")
+	)
+
+	db, err := Create(path)
+	if err != nil {
+		t.Fatalf("Expected to be able to create test database: %v", err)
+	}
+
+	err = db.SetRoot(root)
+	if err != nil {
+		t.Fatalf("Expected to be able to set library root: %v", err)
+	}
+
+	_, err = db.Upsert(value.Entry{Path: filepath.Join(root, "show", "test.mp4"), Discovered: 8, Hash: 16})
+	if err != nil {
+		t.Fatalf("Expected to be able to upsert entry: %v", err)
+	}
+
+	var outside *ErrOutsideRoot
+
+	_, err = db.Upsert(value.Entry{Path: filepath.Join(tempDir, "other.mp4"), Discovered: 8, Hash: 32})
+	if !errors.As(err, &outside) {
+		t.Fatalf("Expected an 'ErrOutsideRoot' but got '%#v'", err)
+	}
+
+	err = db.SetRoot(moved)
+	if err == nil {
+		t.Fatalf("Expected an error when changing the library root of a populated database")
+	}
+
+	db.Close()
+
+	db, err = Open(path)
+	if err != nil {
+		t.Fatalf("Expected to be able to open test database: %v", err)
+	}
+	defer db.Close()
+
+	if db.Root() != root {
+		t.Fatalf("Expected the library root '%s' to be persisted but got '%s'", root, db.Root())
+	}
+
+	var stored string
+
+	err = sqlite.QueryRow(db.db, sqlite.Query{Query: "select path from library;"}, &stored)
+	if err != nil || stored != filepath.Join("show", "test.mp4") {
+		t.Fatalf("Expected the path to be stored relative to the library root but got '%s': %v", stored, err)
+	}
+
+	err = db.OverrideRoot(moved)
+	if err != nil {
+		t.Fatalf("Expected to be able to override the library root: %v", err)
+	}
+
+	entry, err := db.FindByHash(16)
+	if err != nil || entry.Path != filepath.Join(moved, "show", "test.mp4") {
+		t.Fatalf("Expected the path to be resolved against the overridden root but got '%s': %v", entry.Path, err)
+	}
+
+	options := SelectOptions{
+		Target: func(entry value.Entry) (string, error) {
+			return utils.ReplaceExtension(entry.Path, ".mkv"), nil
+		},
+		Prefix: moved,
+	}
+
+	entry, err = db.BeginTranscoding(options)
+	if err != nil || entry.Path != filepath.Join(moved, "show", "test.mp4") {
+		t.Fatalf("Expected to select the entry within the library root but got '%s': %v", entry.Path, err)
+	}
+
+	jobs, err := db.Jobs()
+	if err != nil || len(jobs) != 1 || jobs[0].Target == nil ||
+		*jobs[0].Target != filepath.Join(moved, "show", "test.mkv") {
+		t.Fatalf("Expected the job target to be resolved against the library root but got %+v: %v", jobs, err)
+	}
+}
+
+func TestDatabaseOverrideRootAbsolutePaths(t *testing.T) {
+	var (
+		tempDir = t.TempDir()
+		path    = filepath.Join(tempDir, "test.db")
+	)
+
+	createAndPopulate(t, path, nil, nil)
+
+	db, err := Open(path)
+	if err != nil {
+		t.Fatalf("Expected to be able to open test database: %v", err)
+	}
+	defer db.Close()
+
+	if db.Root() != "" || !db.WithinRoot(filepath.Join(tempDir, "test.mp4")) {
+		t.Fatalf("Expected paths to be stored as provided by default")
+	}
+
+	err = db.OverrideRoot(tempDir)
+	if err == nil {
+		t.Fatalf("Expected an error when overriding the root of a database which stores absolute paths")
+	}
+}
+
+func TestDatabaseRuns(t *testing.T) {
+	var (
+		tempDir = t.TempDir()
+		path    = filepath.Join(tempDir, "test.db")
+	)
+
+	createAndPopulate(t, path, nil, nil)
+
+	db, err := Open(path)
+	if err != nil {
+		t.Fatalf("Expected to be able to open test database: %v", err)
+	}
+	defer db.Close()
+
+	runs, err := db.Runs(0)
+	if err != nil || len(runs) != 0 {
+		t.Fatalf("Expected no runs but got %v (%v)", runs, err)
+	}
+
+	expected := []value.Run{
+		{Command: "update", Start: 8, End: 16, Processed: 4},
+		{Command: "transcode", Start: 32, End: 64, Processed: 1, Failed: 1, Cancelled: 2, Error: "failed"},
+	}
+
+	for index, run := range expected {
+		recorded, err := db.RecordRun(run)
+		if err != nil {
+			t.Fatalf("Expected to be able to record run: %v", err)
+		}
+
+		if recorded.ID != index+1 {
+			t.Fatalf("Expected run to be assigned id %d but got %d", index+1, recorded.ID)
+		}
+
+		expected[index].ID = recorded.ID
+	}
+
+	runs, err = db.Runs(0)
+	if err != nil {
+		t.Fatalf("Expected to be able to get runs: %v", err)
+	}
+
+	// Runs are returned newest first
+	if !reflect.DeepEqual(runs, []value.Run{expected[1], expected[0]}) {
+		t.Fatalf("Expected %+v but got %+v", []value.Run{expected[1], expected[0]}, runs)
+	}
+
+	runs, err = db.Runs(1)
+	if err != nil {
+		t.Fatalf("Expected to be able to get runs: %v", err)
+	}
+
+	if !reflect.DeepEqual(runs, expected[1:]) {
+		t.Fatalf("Expected %+v but got %+v", expected[1:], runs)
+	}
+}
+
+func TestDatabaseInfo(t *testing.T) {
+	var (
+		tempDir = t.TempDir()
+		path    = filepath.Join(tempDir, "test.db")
+	)
+
+	initial := []value.Entry{
+		{Path: "transcoded.mp4", Discovered: 8, Transcoded: utils.Int64P(8), Hash: 16},
+		{Path: "untranscoded1.mp4", Discovered: 16, Hash: 32},
+		{Path: "untranscoded2.mp4", Discovered: 32, Hash: 64},
+		{Path: "quarantined.mp4", Discovered: 64, Hash: 128},
+	}
+
+	createAndPopulate(t, path, initial, []int{3})
+
+	db, err := Open(path)
+	if err != nil {
+		t.Fatalf("Expected to be able to open test database: %v", err)
+	}
+	defer db.Close()
+
+	err = db.FailTranscoding(value.Entry{ID: 4, Path: "quarantined.mp4"}, true)
+	if err != nil {
+		t.Fatalf("Expected to be able to quarantine entry: %v", err)
+	}
+
+	_, err = db.InsertUnhashed(value.Entry{Path: "unhashed.mp4", Discovered: 128})
+	if err != nil {
+		t.Fatalf("Expected to be able to insert unhashed entry: %v", err)
+	}
+
+	info, err := db.Info()
+	if err != nil {
+		t.Fatalf("Expected to be able to get database information: %v", err)
+	}
+
+	if info.UserVersion != uint32(version.DatabaseVersionCurrent) || info.SchemaVersion == 0 {
+		t.Fatalf("Unexpected versions %d/%d", info.UserVersion, info.SchemaVersion)
+	}
+
+	if info.Created == nil || *info.Created == 0 {
+		t.Fatalf("Expected the creation time to have been recorded")
+	}
+
+	if info.HashAlgorithm != string(utils.HashAlgorithmIEEE) || info.Root != "" {
+		t.Fatalf("Unexpected metadata '%s'/'%s'", info.HashAlgorithm, info.Root)
+	}
+
+	if info.Entries != 5 || info.Transcoded != 1 || info.Untranscoded != 2 || info.Unhashed != 1 ||
+		info.Quarantined != 1 || info.Jobs != 1 {
+		t.Fatalf("Unexpected counts %+v", info)
+	}
+}
+
+func TestDatabaseList(t *testing.T) {
+	var (
+		tempDir = t.TempDir()
+		path    = filepath.Join(tempDir, "test.db")
+	)
+
+	initial := []value.Entry{
+		{Path: "b/test.mp4", Discovered: 32, Hash: 16},
+		{Path: "a/test.mp4", Discovered: 16, Hash: 32},
+		{Path: "c/test.mp4", Discovered: 8, Hash: 64},
+	}
+
+	createAndPopulate(t, path, initial, nil)
+
+	db, err := Open(path)
+	if err != nil {
+		t.Fatalf("Expected to be able to open test database: %v", err)
+	}
+	defer db.Close()
+
+	_, err = db.InsertUnhashed(value.Entry{Path: "a/unhashed.mp4", Discovered: 64})
+	if err != nil {
+		t.Fatalf("Expected to be able to insert unhashed entry: %v", err)
+	}
+
+	type test struct {
+		name     string
+		options  ListOptions
+		expected []string
+	}
+
+	tests := []*test{
+		{name: "Default", expected: []string{"b/test.mp4", "a/test.mp4", "c/test.mp4", "a/unhashed.mp4"}},
+		{
+			name:     "Path",
+			options:  ListOptions{Sort: "path"},
+			expected: []string{"a/test.mp4", "a/unhashed.mp4", "b/test.mp4", "c/test.mp4"},
+		},
+		{
+			name:     "Discovered",
+			options:  ListOptions{Sort: "discovered"},
+			expected: []string{"c/test.mp4", "a/test.mp4", "b/test.mp4", "a/unhashed.mp4"},
+		},
+		{name: "Limit", options: ListOptions{Limit: 2}, expected: []string{"b/test.mp4", "a/test.mp4"}},
+		{name: "Offset", options: ListOptions{Offset: 3}, expected: []string{"a/unhashed.mp4"}},
+		{name: "LimitAndOffset", options: ListOptions{Limit: 1, Offset: 1}, expected: []string{"a/test.mp4"}},
+		{name: "OffsetPastEnd", options: ListOptions{Offset: 8}, expected: []string{}},
+		{name: "Prefix", options: ListOptions{Prefix: "a"}, expected: []string{"a/test.mp4", "a/unhashed.mp4"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			entries, err := db.List(test.options)
+			if err != nil {
+				t.Fatalf("Expected to be able to list entries: %v", err)
+			}
+
+			paths := make([]string, 0, len(entries))
+			for _, entry := range entries {
+				paths = append(paths, entry.Path)
+			}
+
+			if !reflect.DeepEqual(paths, test.expected) {
+				t.Fatalf("Expected entries %v but got %v", test.expected, paths)
+			}
+		})
+	}
+
+	_, err = db.List(ListOptions{Sort: "size"})
+	if err == nil {
+		t.Fatalf("Expected an error for an unknown sort")
+	}
+}
+
+func TestDatabaseListPattern(t *testing.T) {
+	var (
+		tempDir = t.TempDir()
+		path    = filepath.Join(tempDir, "test.db")
+	)
+
+	initial := []value.Entry{
+		{Path: "movies/100%_Complete.mkv", Discovered: 8, Transcoded: utils.Int64P(8), Hash: 16},
+		{Path: "movies/1000 Complete.mkv", Discovered: 16, Hash: 32},
+		{Path: `shows/back\slash.mp4`, Discovered: 32, Hash: 64},
+		{Path: "shows/backslash.mp4", Discovered: 64, Hash: 128},
+	}
+
+	createAndPopulate(t, path, initial, nil)
+
+	db, err := Open(path)
+	if err != nil {
+		t.Fatalf("Expected to be able to open test database: %v", err)
+	}
+	defer db.Close()
+
+	type test struct {
+		name     string
+		options  ListOptions
+		expected []string
+	}
+
+	tests := []*test{
+		{
+			name:     "Substring",
+			options:  ListOptions{Pattern: "complete"},
+			expected: []string{"movies/100%_Complete.mkv", "movies/1000 Complete.mkv"},
+		},
+		{
+			name:     "LiteralWildcards",
+			options:  ListOptions{Pattern: "100%_"},
+			expected: []string{"movies/100%_Complete.mkv"},
+		},
+		{
+			name:     "LiteralEscape",
+			options:  ListOptions{Pattern: `k\s`},
+			expected: []string{`shows/back\slash.mp4`},
+		},
+		{
+			name:     "TranscodedOnly",
+			options:  ListOptions{Pattern: "complete", TranscodedOnly: true},
+			expected: []string{"movies/100%_Complete.mkv"},
+		},
+		{
+			name:     "Glob",
+			options:  ListOptions{Pattern: "shows/*.mp4", Glob: true},
+			expected: []string{`shows/back\slash.mp4`, "shows/backslash.mp4"},
+		},
+		{
+			name:     "GlobCaseSensitive",
+			options:  ListOptions{Pattern: "*complete*", Glob: true},
+			expected: []string{},
+		},
+		{
+			name:     "GlobEntirePath",
+			options:  ListOptions{Pattern: "movies/1000", Glob: true},
+			expected: []string{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			entries, err := db.List(test.options)
+			if err != nil {
+				t.Fatalf("Expected to be able to list entries: %v", err)
+			}
+
+			paths := make([]string, 0, len(entries))
+			for _, entry := range entries {
+				paths = append(paths, entry.Path)
+			}
+
+			if !reflect.DeepEqual(paths, test.expected) {
+				t.Fatalf("Expected entries %v but got %v", test.expected, paths)
+			}
+		})
+	}
+}
+
+func TestEscapeLike(t *testing.T) {
+	escaped := escapeLike(`100%_a\b`)
+	if escaped != `100\%\_a\\b` {
+		t.Fatalf("Expected the wildcards and escape character to be escaped, got '%s'", escaped)
+	}
+}
+
+func TestDatabaseCountSelectable(t *testing.T) {
+	var (
+		tempDir = t.TempDir()
+		path    = filepath.Join(tempDir, "test.db")
+	)
+
+	initial := []value.Entry{
+		{Path: "movies/locked.mp4", Discovered: 8, Hash: 16},
+		{Path: "movies/untranscoded.mp4", Discovered: 8, Hash: 32},
+		{Path: "movies/transcoded.mp4", Discovered: 8, Hash: 64, Transcoded: utils.Int64P(8)},
+		{Path: "tv/untranscoded.mp4", Discovered: 8, Hash: 128},
+	}
+
+	// Entries which are already being transcoded can't be selected
+	createAndPopulate(t, path, initial, []int{1})
+
+	db, err := Open(path)
+	if err != nil {
+		t.Fatalf("Expected to be able to open test database: %v", err)
+	}
+	defer db.Close()
+
+	_, err = db.InsertUnhashed(value.Entry{Path: "movies/unhashed.mp4", Discovered: 8})
+	if err != nil {
+		t.Fatalf("Expected to be able to insert unhashed entry: %v", err)
+	}
+
+	for prefix, expected := range map[string]int64{"": 2, "movies": 1, "music": 0} {
+		count, err := db.CountSelectable(SelectOptions{Prefix: prefix})
+		if err != nil {
+			t.Fatalf("Expected to be able to count selectable entries: %v", err)
+		}
+
+		if count != expected {
+			t.Fatalf("Expected %d selectable entries with prefix '%s' but got %d", expected, prefix, count)
+		}
+	}
+}
+
+func TestDatabaseFindByHash(t *testing.T) {
+	var (
+		tempDir = t.TempDir()
+		path    = filepath.Join(tempDir, "test.db")
+	)
+
+	initial := []value.Entry{
+		{
+			Path:       "test.mp4",
+			Discovered: 8,
+			Hash:       16,
+		},
+	}
+
+	createAndPopulate(t, path, initial, nil)
+
+	db, err := Open(path)
+	if err != nil {
+		t.Fatalf("Expected to be able to open test database: %v", err)
+	}
+	defer db.Close()
+
+	entry, err := db.FindByHash(16)
+	if err != nil {
+		t.Fatalf("Expected to be able to find entry: %v", err)
+	}
+
+	expected := value.Entry{ID: 1, Path: "test.mp4", Discovered: 8, Hash: 16}
+	if !reflect.DeepEqual(entry, expected) {
+		t.Fatalf("Received an unexpected entry")
+	}
+
+	_, err = db.FindByHash(32)
+	if !errors.Is(err, sqlite.ErrQueryReturnedNoRows) {
+		t.Fatalf("Expected to get an 'ErrQueryReturnedNoRows' but got '%#v'", err)
+	}
+}
+
+func TestDatabaseFindByPath(t *testing.T) {
+	var (
+		tempDir = t.TempDir()
+		path    = filepath.Join(tempDir, "test.db")
+	)
+
+	createAndPopulate(t, path, []value.Entry{{Path: "movies/test.mp4", Discovered: 8, Hash: 16}}, nil)
+
+	db, err := Open(path)
+	if err != nil {
+		t.Fatalf("Expected to be able to open test database: %v", err)
+	}
+	defer db.Close()
+
+	entry, err := db.FindByPath("movies/test.mp4")
+	if err != nil {
+		t.Fatalf("Expected to be able to find entry: %v", err)
+	}
+
+	expected := value.Entry{ID: 1, Path: "movies/test.mp4", Discovered: 8, Hash: 16}
+	if !reflect.DeepEqual(entry, expected) {
+		t.Fatalf("Received an unexpected entry")
+	}
+
+	_, err = db.FindByPath("movies/missing.mp4")
+	if !errors.Is(err, sqlite.ErrQueryReturnedNoRows) {
+		t.Fatalf("Expected to get an 'ErrQueryReturnedNoRows' but got '%#v'", err)
+	}
+}
+
+func TestDatabaseListNullableColumns(t *testing.T) {
+	var (
+		tempDir = t.TempDir()
+		path    = filepath.Join(tempDir, "test.db")
+	)
+
+	probed := value.Entry{
+		Path:         "probed.avi",
+		Discovered:   8,
+		Hash:         16,
+		SourceCodec:  utils.StringP("mpeg4"),
+		SourceWidth:  utils.Int64P(720),
+		SourceHeight: utils.Int64P(480),
+		Duration:     utils.Float64P(1325.48),
+	}
+
+	createAndPopulate(t, path, []value.Entry{probed}, nil)
+
+	db, err := Open(path)
+	if err != nil {
+		t.Fatalf("Expected to be able to open test database: %v", err)
+	}
+	defer db.Close()
+
+	// Unhashed entries have a null hash, and are neither probed nor transcoded
+	_, err = db.InsertUnhashed(value.Entry{Path: "unhashed.avi", Discovered: 32})
+	if err != nil {
+		t.Fatalf("Expected to be able to insert unhashed entry: %v", err)
+	}
+
+	entries, err := db.List(ListOptions{})
+	if err != nil {
+		t.Fatalf("Expected to be able to list entries: %v", err)
+	}
+
+	probed.ID = 1
+
+	expected := []value.Entry{probed, {ID: 2, Path: "unhashed.avi", Discovered: 32}}
+	if !reflect.DeepEqual(entries, expected) {
+		t.Fatalf("Expected %+v but got %+v", expected, entries)
+	}
+}
+
+func TestDatabaseBeginTranscodingPrefix(t *testing.T) {
+	type test struct {
+		name     string
+		prefix   string
+		expected []string
+	}
+
+	tests := []*test{
+		{
+			name:     "File",
+			prefix:   "tv/c.mp4",
+			expected: []string{"tv/c.mp4"},
+		},
+		{
+			name:     "Directory",
+			prefix:   "movies",
+			expected: []string{"movies/a.mp4"},
+		},
+		{
+			name:     "DirectoryTrailingSlash",
+			prefix:   "movies/",
+			expected: []string{"movies/a.mp4"},
+		},
+		{
+			name:     "NoMatches",
+			prefix:   "music",
+			expected: make([]string, 0),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "test.db")
+
+			initial := []value.Entry{
+				{Path: "movies/a.mp4", Discovered: 8, Hash: 16},
+				{Path: "movies2/b.mp4", Discovered: 8, Hash: 32},
+				{Path: "tv/c.mp4", Discovered: 8, Hash: 64},
+			}
+
+			createAndPopulate(t, path, initial, nil)
+
+			db, err := Open(path)
+			if err != nil {
+				t.Fatalf("Expected to be able to open test database: %v", err)
+			}
+			defer db.Close()
+
+			actual := make([]string, 0)
+
+			for {
+				entry, err := db.BeginTranscoding(SelectOptions{Prefix: test.prefix})
+				if errors.Is(err, sqlite.ErrQueryReturnedNoRows) {
+					break
+				}
+
+				if err != nil {
+					t.Fatalf("Expected to be able to begin transcoding entry: %v", err)
+				}
+
+				actual = append(actual, entry.Path)
+			}
+
+			if !reflect.DeepEqual(actual, test.expected) {
+				t.Fatalf("Expected %v but got %v", test.expected, actual)
+			}
+		})
+	}
+}
+
+func TestDatabaseBeginTranscodingPriority(t *testing.T) {
+	var (
+		tempDir = t.TempDir()
+		path    = filepath.Join(tempDir, "test.db")
+	)
+
+	initial := []value.Entry{
+		{Path: "old.mp4", Discovered: 8, Hash: 16},
+		{Path: "movies/new.mp4", Discovered: 16, Hash: 32},
+		{Path: "newest.mp4", Discovered: 32, Hash: 64},
+	}
+
+	createAndPopulate(t, path, initial, nil)
+
+	db, err := Open(path)
+	if err != nil {
+		t.Fatalf("Expected to be able to open test database: %v", err)
+	}
+	defer db.Close()
+
+	updated, err := db.SetPriority("movies", 10)
+	if err != nil {
+		t.Fatalf("Expected to be able to set priority: %v", err)
+	}
+
+	if updated != 1 {
+		t.Fatalf("Expected 1 entry to be updated but got %d", updated)
+	}
+
+	// Updating an existing entry shouldn't reset its priority
+	_, err = db.Upsert(value.Entry{Path: "movies/new.mp4", Discovered: 64, Hash: 32})
+	if err != nil {
+		t.Fatalf("Expected to be able to upsert entry: %v", err)
+	}
+
+	actual := make([]string, 0)
+
+	for {
+		entry, err := db.BeginTranscoding(SelectOptions{})
+		if errors.Is(err, sqlite.ErrQueryReturnedNoRows) {
+			break
+		}
+
+		if err != nil {
+			t.Fatalf("Expected to be able to begin transcoding entry: %v", err)
+		}
+
+		actual = append(actual, entry.Path)
+	}
+
+	expected := []string{"movies/new.mp4", "old.mp4", "newest.mp4"}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("Expected %v but got %v", expected, actual)
+	}
+}
+
+func TestDatabaseBeginTranscodingShuffle(t *testing.T) {
+	var (
+		tempDir = t.TempDir()
+		path    = filepath.Join(tempDir, "test.db")
+	)
+
+	initial := make([]value.Entry, 0, 32)
+	for i := 0; i < 32; i++ {
+		initial = append(initial, value.Entry{Path: fmt.Sprintf("%02d.mp4", i), Discovered: int64(i), Hash: uint32(i + 1)})
+	}
+
+	createAndPopulate(t, path, initial, nil)
+
+	db, err := Open(path)
+	if err != nil {
+		t.Fatalf("Expected to be able to open test database: %v", err)
+	}
+	defer db.Close()
+
+	actual := make([]string, 0, len(initial))
+
+	for {
+		entry, err := db.BeginTranscoding(SelectOptions{Shuffle: true})
+		if errors.Is(err, sqlite.ErrQueryReturnedNoRows) {
+			break
+		}
+
+		if err != nil {
+			t.Fatalf("Expected to be able to begin transcoding entry: %v", err)
+		}
+
+		actual = append(actual, entry.Path)
+	}
+
+	// The chance of 32 entries being shuffled into discovered order is negligible
+	if sort.StringsAreSorted(actual) {
+		t.Fatalf("Expected the entries to be selected in a random order, got %v", actual)
+	}
+
+	// Each entry should still only be selected once, since a job is added for it
+	sort.Strings(actual)
+
+	for index, entry := range initial {
+		if actual[index] != entry.Path {
+			t.Fatalf("Expected every entry to be selected exactly once, got %v", actual)
+		}
+	}
+}
+
+func TestDatabaseBeginTranscodingExclude(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+
+	initial := []value.Entry{
+		{Path: "a.mp4", Discovered: 8, Hash: 16},
+		{Path: "b.mp4", Discovered: 16, Hash: 32},
+		{Path: "c.mp4", Discovered: 32, Hash: 64},
+	}
+
+	createAndPopulate(t, path, initial, nil)
+
+	db, err := Open(path)
+	if err != nil {
+		t.Fatalf("Expected to be able to open test database: %v", err)
+	}
+	defer db.Close()
+
+	actual := make([]string, 0)
+
+	for {
+		entry, err := db.BeginTranscoding(SelectOptions{Exclude: []int{1, 3}})
+		if errors.Is(err, sqlite.ErrQueryReturnedNoRows) {
+			break
+		}
+
+		if err != nil {
+			t.Fatalf("Expected to be able to begin transcoding entry: %v", err)
+		}
+
+		actual = append(actual, entry.Path)
+	}
+
+	if !reflect.DeepEqual(actual, []string{"b.mp4"}) {
+		t.Fatalf("Expected the excluded entries not to be selected, got %v", actual)
+	}
+}
+
+func BenchmarkDatabaseBeginTranscoding(b *testing.B) {
+	const rows = 50000
+
+	setup := func(b *testing.B, indexed bool) *Database {
+		path := filepath.Join(b.TempDir(), "test.db")
+
+		db, err := Create(path)
+		if err != nil {
+			b.Fatalf("Expected to be able to create test database: %v", err)
+		}
+
+		err = db.wrapTransaction(func(tx *sql.Tx) error {
+			for row := 0; row < rows; row++ {
+				query := sqlite.Query{
+					Query:     "insert into library (path, discovered, transcoded, hash) values (?, ?, ?, ?);",
+					Arguments: []interface{}{fmt.Sprintf("%d.mp4", row), row, utils.Int64P(int64(row)), row},
+				}
+
+				// Leave the most recently discovered entries untranscoded, so they're found last by a scan
+				if row >= rows-10 {
+					query.Arguments[2] = nil
+				}
+
+				_, err := sqlite.ExecuteQuery(tx, query)
+				if err != nil {
+					return err
+				}
+			}
+
+			if indexed {
+				return nil
+			}
+
+			_, err := sqlite.ExecuteQuery(tx, sqlite.Query{Query: "drop index library_selection;"})
+
+			return err
+		})
+		if err != nil {
+			b.Fatalf("Expected to be able to populate test database: %v", err)
+		}
+
+		return db
+	}
+
+	for _, indexed := range []bool{false, true} {
+		b.Run(fmt.Sprintf("Indexed=%t", indexed), func(b *testing.B) {
+			db := setup(b, indexed)
+			defer db.Close()
+
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				entry, err := db.BeginTranscoding(SelectOptions{})
+				if err != nil {
+					b.Fatalf("Expected to be able to begin transcoding: %v", err)
+				}
+
+				err = db.cancelTranscoding(entry, false)
+				if err != nil {
+					b.Fatalf("Expected to be able to cancel transcoding: %v", err)
+				}
+			}
+		})
+	}
+}
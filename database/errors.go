@@ -16,15 +16,64 @@ package database
 
 import (
 	"fmt"
+
+	"github.com/jamesl33/goamt/utils"
+	"github.com/jamesl33/goamt/version"
 )
 
 // ErrUnknownVersion - Returned when the user attempts to open a database with an unknown version.
 type ErrUnknownVersion struct {
 	what, where string
+	found       version.DatabaseVersion
+}
+
+// Newer - Returns a boolean indicating whether the database was created by a newer version of goamt, in which case
+// goamt must be upgraded before it can be opened.
+func (e *ErrUnknownVersion) Newer() bool {
+	return e.found > version.DatabaseVersionCurrent
 }
 
 func (e *ErrUnknownVersion) Error() string {
-	return fmt.Sprintf("%s at '%s' is an unknown version", e.what, e.where)
+	if e.Newer() {
+		return fmt.Sprintf("%s at '%s' is version %d which is newer than this goamt supports (versions %d-%d), "+
+			"upgrade goamt to open it", e.what, e.where, e.found, version.DatabaseVersionOne,
+			version.DatabaseVersionCurrent)
+	}
+
+	// Every version from the first is migrated, so an older version means 'user_version' was never set i.e. the file
+	// wasn't created by goamt (or is empty)
+	return fmt.Sprintf("%s at '%s' is not a goamt database (version %d)", e.what, e.where, e.found)
+}
+
+// ErrRequiresMigration - Returned when the user attempts to open a database read-only which must first be migrated.
+type ErrRequiresMigration struct {
+	what, where string
+	found       version.DatabaseVersion
+}
+
+func (e *ErrRequiresMigration) Error() string {
+	return fmt.Sprintf("%s at '%s' is version %d which is older than the current version %d, open it read-write to "+
+		"migrate it", e.what, e.where, e.found, version.DatabaseVersionCurrent)
+}
+
+// ErrHashAlgorithmMismatch - Returned when the user attempts to use a hash algorithm which differs from the one used
+// to hash the entries in the database.
+type ErrHashAlgorithmMismatch struct {
+	expected, actual utils.HashAlgorithm
+}
+
+func (e *ErrHashAlgorithmMismatch) Error() string {
+	return fmt.Sprintf("database was hashed using '%s' but '%s' was requested", e.expected, e.actual)
+}
+
+// ErrOutsideRoot - Returned when the user attempts to store a path which isn't within the library root, when paths are
+// stored relative to one.
+type ErrOutsideRoot struct {
+	path, root string
+}
+
+func (e *ErrOutsideRoot) Error() string {
+	return fmt.Sprintf("path '%s' is not within the library root '%s'", e.path, e.root)
 }
 
 // ErrAlreadyExists - Returned when the user attempts to create a database which already exists.
@@ -0,0 +1,209 @@
+// Copyright 2020 James Lee <jamesl33info@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package database
+
+import (
+	"database/sql"
+
+	"github.com/jamesl33/goamt/utils/sqlite"
+	"github.com/jamesl33/goamt/version"
+
+	"github.com/apex/log"
+	"github.com/pkg/errors"
+)
+
+// migration - Represents the queries required to migrate a database from the previous version to 'version'.
+type migration struct {
+	version version.DatabaseVersion
+	queries []string
+}
+
+// migrations - The ordered list of migrations, a new entry should be added whenever the database version is bumped.
+var migrations = []migration{
+	{
+		version: version.DatabaseVersionTwo,
+		queries: []string{
+			"alter table jobs add column target text;",
+		},
+	},
+	{
+		version: version.DatabaseVersionThree,
+		queries: []string{
+			"alter table library add column priority integer not null default 0;",
+		},
+	},
+	{
+		version: version.DatabaseVersionFour,
+		queries: []string{
+			"alter table library add column source_codec text;",
+			"alter table library add column source_width integer;",
+			"alter table library add column source_height integer;",
+		},
+	},
+	{
+		version: version.DatabaseVersionFive,
+		queries: []string{
+			"alter table library add column failures integer not null default 0;",
+			"alter table library add column quarantined integer;",
+		},
+	},
+	{
+		// Note that 'jobs.library_id' is unique so is already indexed
+		version: version.DatabaseVersionSix,
+		queries: []string{
+			"create index library_selection on library (transcoded, priority desc, discovered asc);",
+		},
+	},
+	{
+		// SQLite doesn't support dropping a constraint so the library table must be rebuilt, the jobs table is rebuilt
+		// alongside it since the library table can't be dropped whilst it's referenced.
+		version: version.DatabaseVersionSeven,
+		queries: []string{
+			"create temporary table jobs_backup as select * from jobs;",
+			"drop table jobs;",
+			`create table library_rebuild (
+				id integer primary key autoincrement,
+				path text not null unique,
+				discovered integer not null,
+				transcoded integer,
+				hash integer,
+				priority integer not null default 0,
+				source_codec text,
+				source_width integer,
+				source_height integer,
+				failures integer not null default 0,
+				quarantined integer
+			);`,
+			`insert into library_rebuild
+				select id, path, discovered, transcoded, hash, priority, source_codec, source_width, source_height,
+					failures, quarantined
+				from library;`,
+			"drop table library;",
+			"alter table library_rebuild rename to library;",
+			"create index library_selection on library (transcoded, priority desc, discovered asc);",
+			"create index library_hash on library (hash);",
+			`create table jobs (
+				id integer primary key autoincrement,
+				library_id integer not null unique,
+				start_time integer not null,
+				target text,
+				foreign key (library_id) references library (id)
+			);`,
+			"insert into jobs select id, library_id, start_time, target from jobs_backup;",
+			"drop table jobs_backup;",
+		},
+	},
+	{
+		// Existing databases will have been hashed using the IEEE polynomial, since it was the only one supported
+		version: version.DatabaseVersionEight,
+		queries: []string{
+			"create table metadata (key text primary key, value text not null);",
+			"insert into metadata (key, value) values ('" + metadataHashAlgorithm + "', 'ieee');",
+		},
+	},
+	{
+		version: version.DatabaseVersionNine,
+		queries: []string{
+			"alter table jobs add column temporary text;",
+		},
+	},
+	{
+		version: version.DatabaseVersionTen,
+		queries: []string{
+			`create table runs (
+				id integer primary key autoincrement,
+				command text not null,
+				start_time integer not null,
+				end_time integer not null,
+				processed integer not null,
+				failed integer not null,
+				cancelled integer not null,
+				error text
+			);`,
+		},
+	},
+	{
+		version: version.DatabaseVersionEleven,
+		queries: []string{
+			"alter table library add column duration real;",
+		},
+	},
+	{
+		version: version.DatabaseVersionTwelve,
+		queries: []string{
+			"alter table library add column source_path text;",
+			"alter table library add column source_hash integer;",
+			"create index library_source on library (source_path);",
+		},
+	},
+	{
+		version: version.DatabaseVersionThirteen,
+		queries: []string{
+			"alter table jobs add column finished integer;",
+		},
+	},
+}
+
+// migrate - Migrate the provided database from the given version to the current version; all the migrations are run in
+// a single transaction so a failure will leave the database at its original version.
+func migrate(db *sql.DB, from version.DatabaseVersion) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return errors.Wrap(err, "failed to begin transaction")
+	}
+
+	err = migrateTx(tx, from)
+	if err != nil {
+		if err := tx.Rollback(); err != nil {
+			return errors.Wrap(err, "failed to rollback transaction")
+		}
+
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return errors.Wrap(err, "failed to commit transaction")
+	}
+
+	return nil
+}
+
+// migrateTx - Run the required migrations using the provided transaction, bumping the 'user_version' once complete.
+func migrateTx(tx *sql.Tx, from version.DatabaseVersion) error {
+	for _, migration := range migrations {
+		if migration.version <= from {
+			continue
+		}
+
+		log.WithFields(log.Fields{"from": from, "to": migration.version}).Debug("Running migration")
+
+		for _, query := range migration.queries {
+			_, err := sqlite.ExecuteQuery(tx, sqlite.Query{Query: query})
+			if err != nil {
+				return errors.Wrapf(err, "failed to migrate to version %d", migration.version)
+			}
+		}
+
+		from = migration.version
+	}
+
+	err := sqlite.SetPragma(tx, sqlite.PragmaUserVersion, from)
+	if err != nil {
+		return errors.Wrap(err, "failed to set 'user_version'")
+	}
+
+	return nil
+}
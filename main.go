@@ -48,6 +48,12 @@ func main() {
 	stacktrace := os.Getenv("GOAMT_DISPLAY_STACKTRACE")
 	if display, parseError := strconv.ParseBool(stacktrace); parseError == nil && display {
 		fmt.Printf("Error: %+v\n", err)
+
+		// The ffmpeg output is only logged at the point of failure, include it so the failure can be diagnosed
+		var ffmpegErr *utils.ErrFFmpeg
+		if errors.As(err, &ffmpegErr) {
+			fmt.Printf("Command: %s\nOutput:\n%s\n", ffmpegErr.Command, ffmpegErr.Output)
+		}
 	} else {
 		fmt.Printf("Error: %s\n", errors.Cause(err))
 	}
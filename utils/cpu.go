@@ -0,0 +1,76 @@
+// Copyright 2020 James Lee <jamesl33info@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// cpuInfoPath - The path to the file describing the processors of the machine.
+const cpuInfoPath = "/proc/cpuinfo"
+
+// PhysicalCores - Returns the number of physical cores of the machine, which (unlike 'runtime.NumCPU') doesn't count
+// the additional logical cores provided by hyper-threading. An error is returned if the number can't be determined,
+// e.g. when not running on Linux or on architectures which don't report their topology.
+func PhysicalCores() (int, error) {
+	file, err := os.Open(cpuInfoPath)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to open cpuinfo")
+	}
+	defer file.Close()
+
+	return physicalCores(file)
+}
+
+// physicalCores - Returns the number of unique physical cores described by the provided cpuinfo, each of which is
+// identified by the socket ('physical id') and core ('core id') of its logical processors.
+func physicalCores(reader io.Reader) (int, error) {
+	var (
+		cores    = make(map[[2]string]struct{})
+		scanner  = bufio.NewScanner(reader)
+		physical string
+	)
+
+	for scanner.Scan() {
+		split := strings.SplitN(scanner.Text(), ":", 2)
+		if len(split) != 2 {
+			continue
+		}
+
+		switch key, value := strings.TrimSpace(split[0]), strings.TrimSpace(split[1]); key {
+		case "processor":
+			physical = ""
+		case "physical id":
+			physical = value
+		case "core id":
+			cores[[2]string{physical, value}] = struct{}{}
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return 0, errors.Wrap(err, "failed to read cpuinfo")
+	}
+
+	if len(cores) == 0 {
+		return 0, errors.New("cpuinfo doesn't describe the physical cores")
+	}
+
+	return len(cores), nil
+}
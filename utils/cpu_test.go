@@ -0,0 +1,89 @@
+// Copyright 2020 James Lee <jamesl33info@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// cpuInfo - Returns cpuinfo describing the provided sockets, each with the given number of cores and threads per core.
+func cpuInfo(sockets, cores, threads int) string {
+	var (
+		builder   strings.Builder
+		processor int
+	)
+
+	for thread := 0; thread < threads; thread++ {
+		for socket := 0; socket < sockets; socket++ {
+			for core := 0; core < cores; core++ {
+				fmt.Fprintf(&builder, "processor\t: %d\nmodel name\t: Test CPU\nphysical id\t: %d\nsiblings\t: %d\n"+
+					"core id\t\t: %d\ncpu cores\t: %d\n\n", processor, socket, cores*threads, core, cores)
+
+				processor++
+			}
+		}
+	}
+
+	return builder.String()
+}
+
+func TestPhysicalCoresCPUInfo(t *testing.T) {
+	type test struct {
+		name     string
+		cpuinfo  string
+		expected int
+	}
+
+	tests := []*test{
+		{
+			name:     "SingleCore",
+			cpuinfo:  cpuInfo(1, 1, 1),
+			expected: 1,
+		},
+		{
+			name:     "HyperThreading",
+			cpuinfo:  cpuInfo(1, 4, 2),
+			expected: 4,
+		},
+		{
+			name:     "MultipleSockets",
+			cpuinfo:  cpuInfo(2, 8, 2),
+			expected: 16,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			actual, err := physicalCores(strings.NewReader(test.cpuinfo))
+			if err != nil {
+				t.Fatalf("Expected to be able to determine physical cores: %v", err)
+			}
+
+			if actual != test.expected {
+				t.Fatalf("Expected %d physical cores but got %d", test.expected, actual)
+			}
+		})
+	}
+}
+
+func TestPhysicalCoresNoTopology(t *testing.T) {
+	// Some architectures (e.g. ARM) only list the processors
+	_, err := physicalCores(strings.NewReader("processor\t: 0\nBogoMIPS\t: 48.00\n\nprocessor\t: 1\nBogoMIPS\t: 48.00\n"))
+	if err == nil {
+		t.Fatalf("Expected an error when the physical cores aren't described")
+	}
+}
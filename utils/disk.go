@@ -0,0 +1,46 @@
+// Copyright 2020 James Lee <jamesl33info@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// FreeSpace - Returns the number of bytes available (to an unprivileged user) on the filesystem containing the provided
+// path.
+func FreeSpace(path string) (uint64, error) {
+	var stat unix.Statfs_t
+
+	err := unix.Statfs(path, &stat)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to stat filesystem")
+	}
+
+	return stat.Bavail * uint64(stat.Bsize), nil
+}
+
+// Device - Returns the identifier of the device containing the provided path, files on the same disk will have the
+// same device.
+func Device(path string) (uint64, error) {
+	var stat unix.Stat_t
+
+	err := unix.Stat(path, &stat)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to stat file")
+	}
+
+	return uint64(stat.Dev), nil
+}
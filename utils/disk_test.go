@@ -0,0 +1,71 @@
+// Copyright 2020 James Lee <jamesl33info@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestFreeSpace(t *testing.T) {
+	free, err := FreeSpace(t.TempDir())
+	if err != nil {
+		t.Fatalf("Expected to be able to get free space: %v", err)
+	}
+
+	if free == 0 {
+		t.Fatalf("Expected a non-zero amount of free space")
+	}
+}
+
+func TestFreeSpaceNotFound(t *testing.T) {
+	_, err := FreeSpace(filepath.Join(t.TempDir(), "missing"))
+	if err == nil {
+		t.Fatalf("Expected an error for a path which doesn't exist")
+	}
+}
+
+func TestDevice(t *testing.T) {
+	tempDir := t.TempDir()
+
+	path := filepath.Join(tempDir, "test.mp4")
+
+	err := ioutil.WriteFile(path, []byte("test"), 0o644)
+	if err != nil {
+		t.Fatalf("Expected to be able to create test file: %v", err)
+	}
+
+	file, err := Device(path)
+	if err != nil {
+		t.Fatalf("Expected to be able to get device: %v", err)
+	}
+
+	directory, err := Device(tempDir)
+	if err != nil {
+		t.Fatalf("Expected to be able to get device: %v", err)
+	}
+
+	if file != directory {
+		t.Fatalf("Expected a file to be on the same device as its directory, %d != %d", file, directory)
+	}
+}
+
+func TestDeviceNotFound(t *testing.T) {
+	_, err := Device(filepath.Join(t.TempDir(), "missing"))
+	if err == nil {
+		t.Fatalf("Expected an error for a path which doesn't exist")
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright 2020 James Lee <jamesl33info@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// rename - The function used to rename files, overridden in tests to simulate renaming across filesystems.
+var rename = os.Rename
+
+// SyncPath - Flush the provided file (or directory) to stable storage; syncing a directory ensures that any renames or
+// removals of the files it contains are durable.
+func SyncPath(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	err = file.Sync()
+	if err != nil {
+		return errors.Wrapf(err, "failed to sync '%s'", path)
+	}
+
+	return nil
+}
+
+// DurableRename - Atomically rename the source file to the given target (replacing the target if it exists), ensuring
+// that both the file contents and the rename itself are durable before returning.
+func DurableRename(source, target string) error {
+	err := SyncPath(source)
+	if err != nil {
+		return err
+	}
+
+	err = rename(source, target)
+	if err != nil {
+		return err
+	}
+
+	err = SyncPath(filepath.Dir(target))
+	if err != nil {
+		return err
+	}
+
+	if filepath.Dir(source) == filepath.Dir(target) {
+		return nil
+	}
+
+	return SyncPath(filepath.Dir(source))
+}
+
+// DurableRemove - Remove the provided file, ensuring that the removal is durable before returning.
+func DurableRemove(path string) error {
+	err := os.Remove(path)
+	if err != nil {
+		return err
+	}
+
+	return SyncPath(filepath.Dir(path))
+}
+
+// DurableMove - Move the source file to the given target, which may be on a different filesystem. A rename is used
+// where possible (see 'DurableRename'), otherwise the file is copied then removed; note that the copy isn't atomic so
+// the target should be a temporary path which is renamed into place by the caller.
+func DurableMove(source, target string) error {
+	err := DurableRename(source, target)
+	if err == nil || !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+
+	err = durableCopy(source, target)
+	if err != nil {
+		return err
+	}
+
+	return DurableRemove(source)
+}
+
+// durableCopy - Copy the source file to the given target (replacing the target if it exists), ensuring that the file
+// contents are durable before returning.
+func durableCopy(source, target string) error {
+	reader, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	info, err := reader.Stat()
+	if err != nil {
+		return err
+	}
+
+	writer, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(writer, reader)
+	if err != nil {
+		writer.Close()
+		return errors.Wrapf(err, "failed to copy '%s'", source)
+	}
+
+	err = writer.Sync()
+	if err != nil {
+		writer.Close()
+		return errors.Wrapf(err, "failed to sync '%s'", target)
+	}
+
+	err = writer.Close()
+	if err != nil {
+		return err
+	}
+
+	return SyncPath(filepath.Dir(target))
+}
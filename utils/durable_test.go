@@ -0,0 +1,212 @@
+// Copyright 2020 James Lee <jamesl33info@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestSyncPath(t *testing.T) {
+	tempDir := t.TempDir()
+
+	err := ioutil.WriteFile(filepath.Join(tempDir, "test.mp4"), []byte("0"), 0o755)
+	if err != nil {
+		t.Fatalf("Expected to be able to create test file: %v", err)
+	}
+
+	for _, path := range []string{tempDir, filepath.Join(tempDir, "test.mp4")} {
+		err = SyncPath(path)
+		if err != nil {
+			t.Fatalf("Expected to be able to sync '%s': %v", path, err)
+		}
+	}
+
+	err = SyncPath(filepath.Join(tempDir, "missing.mp4"))
+	if !os.IsNotExist(err) {
+		t.Fatalf("Expected a 'not exist' error but got '%v'", err)
+	}
+}
+
+func TestDurableRename(t *testing.T) {
+	var (
+		tempDir = t.TempDir()
+		source  = filepath.Join(tempDir, "test.transcoding.mp4")
+		target  = filepath.Join(tempDir, "output", "test.mp4")
+	)
+
+	err := os.Mkdir(filepath.Join(tempDir, "output"), 0o755)
+	if err != nil {
+		t.Fatalf("Expected to be able to create output directory: %v", err)
+	}
+
+	for path, contents := range map[string]string{source: "new", target: "old"} {
+		err = ioutil.WriteFile(path, []byte(contents), 0o755)
+		if err != nil {
+			t.Fatalf("Expected to be able to create test file: %v", err)
+		}
+	}
+
+	err = DurableRename(source, target)
+	if err != nil {
+		t.Fatalf("Expected to be able to rename file: %v", err)
+	}
+
+	if PathExists(source) {
+		t.Fatalf("Expected source file to have been renamed")
+	}
+
+	data, err := ioutil.ReadFile(target)
+	if err != nil {
+		t.Fatalf("Expected to be able to read target file: %v", err)
+	}
+
+	if string(data) != "new" {
+		t.Fatalf("Expected target file to have been replaced, got '%s'", data)
+	}
+}
+
+func TestDurableRemove(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.mp4")
+
+	err := ioutil.WriteFile(path, []byte("0"), 0o755)
+	if err != nil {
+		t.Fatalf("Expected to be able to create test file: %v", err)
+	}
+
+	err = DurableRemove(path)
+	if err != nil {
+		t.Fatalf("Expected to be able to remove file: %v", err)
+	}
+
+	if PathExists(path) {
+		t.Fatalf("Expected file to have been removed")
+	}
+}
+
+func TestDurableMove(t *testing.T) {
+	var (
+		tempDir = t.TempDir()
+		source  = filepath.Join(tempDir, "scratch", "1.transcoding.mp4")
+		target  = filepath.Join(tempDir, "test.transcoding.mp4")
+	)
+
+	err := os.Mkdir(filepath.Join(tempDir, "scratch"), 0o755)
+	if err != nil {
+		t.Fatalf("Expected to be able to create scratch directory: %v", err)
+	}
+
+	err = ioutil.WriteFile(source, []byte("transcoded"), 0o755)
+	if err != nil {
+		t.Fatalf("Expected to be able to create test file: %v", err)
+	}
+
+	err = DurableMove(source, target)
+	if err != nil {
+		t.Fatalf("Expected to be able to move file: %v", err)
+	}
+
+	if PathExists(source) || !PathExists(target) {
+		t.Fatalf("Expected source file to have been moved")
+	}
+}
+
+func TestDurableMoveAcrossFilesystems(t *testing.T) {
+	var (
+		tempDir = t.TempDir()
+		source  = filepath.Join(tempDir, "scratch", "1.transcoding.mp4")
+		target  = filepath.Join(tempDir, "test.transcoding.mp4")
+	)
+
+	rename = func(source, target string) error {
+		return &os.LinkError{Op: "rename", Old: source, New: target, Err: syscall.EXDEV}
+	}
+
+	defer func() { rename = os.Rename }()
+
+	err := os.Mkdir(filepath.Join(tempDir, "scratch"), 0o755)
+	if err != nil {
+		t.Fatalf("Expected to be able to create scratch directory: %v", err)
+	}
+
+	err = ioutil.WriteFile(source, []byte("transcoded"), 0o755)
+	if err != nil {
+		t.Fatalf("Expected to be able to create test file: %v", err)
+	}
+
+	err = DurableMove(source, target)
+	if err != nil {
+		t.Fatalf("Expected to be able to move file: %v", err)
+	}
+
+	if PathExists(source) {
+		t.Fatalf("Expected source file to have been removed after being copied")
+	}
+
+	data, err := ioutil.ReadFile(target)
+	if err != nil {
+		t.Fatalf("Expected to be able to read target file: %v", err)
+	}
+
+	if string(data) != "transcoded" {
+		t.Fatalf("Expected target to contain '%s', got '%s'", "transcoded", data)
+	}
+}
+
+func TestDurableMoveOtherError(t *testing.T) {
+	tempDir := t.TempDir()
+
+	err := DurableMove(filepath.Join(tempDir, "missing.mp4"), filepath.Join(tempDir, "test.mp4"))
+	if !os.IsNotExist(err) {
+		t.Fatalf("Expected a not exist error, got %v", err)
+	}
+}
+
+func TestDurableCopy(t *testing.T) {
+	var (
+		tempDir = t.TempDir()
+		source  = filepath.Join(tempDir, "1.transcoding.mp4")
+		target  = filepath.Join(tempDir, "test.transcoding.mp4")
+	)
+
+	for path, contents := range map[string]string{source: "transcoded", target: "stale contents"} {
+		err := ioutil.WriteFile(path, []byte(contents), 0o755)
+		if err != nil {
+			t.Fatalf("Expected to be able to create test file: %v", err)
+		}
+	}
+
+	err := durableCopy(source, target)
+	if err != nil {
+		t.Fatalf("Expected to be able to copy file: %v", err)
+	}
+
+	data, err := ioutil.ReadFile(target)
+	if err != nil {
+		t.Fatalf("Expected to be able to read target file: %v", err)
+	}
+
+	if string(data) != "transcoded" || !PathExists(source) {
+		t.Fatalf("Expected target file to have been replaced by a copy, got '%s'", data)
+	}
+
+	err = durableCopy(filepath.Join(tempDir, "missing.mp4"), target)
+	if !os.IsNotExist(err) {
+		t.Fatalf("Expected a 'not exist' error but got '%v'", err)
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright 2020 James Lee <jamesl33info@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"fmt"
+	"os/exec"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// ErrFFmpeg - Returned when running ffmpeg fails, contains enough information for callers to determine why it failed
+// e.g. whether it wasn't found, exited with a non-zero exit code or was killed by a signal.
+type ErrFFmpeg struct {
+	// Command - The command which was run.
+	Command string
+
+	// ExitCode - The exit code of the process, this will be -1 if the process didn't exit normally.
+	ExitCode int
+
+	// Signal - The signal which killed the process, this will be zero if the process wasn't killed by a signal.
+	Signal syscall.Signal
+
+	// Output - The combined stdout/stderr output of the process.
+	Output []byte
+
+	err error
+}
+
+// newErrFFmpeg - Create a new 'ErrFFmpeg' from the error returned when running the provided command.
+func newErrFFmpeg(command *exec.Cmd, output []byte, err error) *ErrFFmpeg {
+	ffmpegErr := &ErrFFmpeg{Command: command.String(), ExitCode: -1, Output: output, err: err}
+
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return ffmpegErr
+	}
+
+	ffmpegErr.ExitCode = exitErr.ExitCode()
+
+	if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		ffmpegErr.Signal = status.Signal()
+	}
+
+	return ffmpegErr
+}
+
+func (e *ErrFFmpeg) Error() string {
+	switch {
+	case e.Signaled():
+		return fmt.Sprintf("killed by signal '%s'", e.Signal)
+	case e.ExitCode > 0:
+		return fmt.Sprintf("exited with code %d", e.ExitCode)
+	default:
+		return e.err.Error()
+	}
+}
+
+func (e *ErrFFmpeg) Unwrap() error {
+	return e.err
+}
+
+// NotFound - Returns a boolean indicating whether the error occurred because the ffmpeg executable couldn't be found.
+func (e *ErrFFmpeg) NotFound() bool {
+	return errors.Is(e.err, exec.ErrNotFound)
+}
+
+// Signaled - Returns a boolean indicating whether ffmpeg was killed by a signal.
+func (e *ErrFFmpeg) Signaled() bool {
+	return e.Signal != 0
+}
+
+// ErrToolNotFound - Returned when an executable which is required to transcode files (e.g. ffmpeg) isn't installed.
+type ErrToolNotFound struct {
+	// Tool - The name of the executable which couldn't be found.
+	Tool string
+
+	err error
+}
+
+func (e *ErrToolNotFound) Error() string {
+	return fmt.Sprintf("'%s' is not installed (or isn't in the PATH), it's required to transcode files", e.Tool)
+}
+
+func (e *ErrToolNotFound) Unwrap() error {
+	return e.err
+}
@@ -15,10 +15,12 @@
 package utils
 
 import (
+	"bytes"
 	"hash/crc32"
 	"io"
 	"os"
 
+	"github.com/apex/log"
 	"github.com/pkg/errors"
 )
 
@@ -31,22 +33,216 @@ const (
 	MaxSeekSize = 64 * 1024 * 1024
 )
 
-// table - IEEE CRC32 table, use a global variable to avoid atomic operations in 'MakeTable' function.
-var table = crc32.MakeTable(crc32.IEEE)
+// HashAlgorithm - The CRC32 polynomial used when hashing files, hashes created using different algorithms can't be
+// compared.
+type HashAlgorithm string
+
+const (
+	// HashAlgorithmIEEE - Hash using the IEEE polynomial, this is the default.
+	HashAlgorithmIEEE HashAlgorithm = "ieee"
+
+	// HashAlgorithmCastagnoli - Hash using the Castagnoli polynomial (CRC32C), this is hardware accelerated on most
+	// modern CPUs.
+	HashAlgorithmCastagnoli HashAlgorithm = "castagnoli"
+)
+
+// tables - CRC32 tables for each algorithm, use a global variable to avoid atomic operations in 'MakeTable' function.
+var tables = map[HashAlgorithm]*crc32.Table{
+	HashAlgorithmIEEE:       crc32.MakeTable(crc32.IEEE),
+	HashAlgorithmCastagnoli: crc32.MakeTable(crc32.Castagnoli),
+}
+
+// Supported - Returns a boolean indicating whether this hash algorithm is supported by goamt.
+func (h HashAlgorithm) Supported() bool {
+	_, ok := tables[h]
+	return ok
+}
+
+// HashOptions - Encapsulates the options which control how files are hashed.
+type HashOptions struct {
+	// Limiter - When non-nil, used to limit the rate at which data is read from disk.
+	Limiter *RateLimiter
+
+	// Algorithm - The polynomial used when hashing, defaults to 'HashAlgorithmIEEE' when empty.
+	Algorithm HashAlgorithm
+
+	// MemoryMap - Sample the file using a read-only memory mapping rather than reading/seeking, which avoids a pair of
+	// system calls per sample for large files. Produces identical hashes, files are read where this isn't supported.
+	// Note that a file which is truncated whilst being hashed will crash the process (SIGBUS) rather than failing.
+	MemoryMap bool
+}
+
+// table - Returns the CRC32 table for the chosen algorithm.
+func (h HashOptions) table() *crc32.Table {
+	if h.Algorithm == "" {
+		return tables[HashAlgorithmIEEE]
+	}
+
+	return tables[h.Algorithm]
+}
 
 // HashFile - Open then hash the file at the provided path.
 func HashFile(path string) (uint32, error) {
+	return HashFileWithOptions(path, HashOptions{})
+}
+
+// HashFileWithOptions - Open then hash the file at the provided path using the given options.
+func HashFileWithOptions(path string, options HashOptions) (uint32, error) {
+	if options.Algorithm != "" && !options.Algorithm.Supported() {
+		return 0, errors.Errorf("hash algorithm '%s' is not supported", options.Algorithm)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to open hash file")
+	}
+	defer file.Close()
+
+	if options.MemoryMap && memoryMapSupported {
+		digest, mapped, err := hashMappedFile(file, options)
+		if mapped || err != nil {
+			return digest, err
+		}
+	}
+
+	var reader io.ReadSeeker = file
+	if options.Limiter != nil {
+		reader = &rateLimitedReader{reader: file, limiter: options.Limiter}
+	}
+
+	return hashReader(reader, options.table())
+}
+
+// HashFileFull - Open then hash the entire contents of the file at the provided path. This is considerably slower than
+// 'HashFile' but detects differences anywhere in the file; note that matching CRC32 hashes don't prove two files are
+// identical, use 'IdenticalFiles' for that.
+func HashFileFull(path string) (uint32, error) {
 	file, err := os.Open(path)
 	if err != nil {
 		return 0, errors.Wrap(err, "failed to open hash file")
 	}
 	defer file.Close()
 
-	return hashReader(file)
+	digest := crc32.New(tables[HashAlgorithmIEEE])
+
+	_, err = io.Copy(digest, file)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to read from hash file")
+	}
+
+	return digest.Sum32(), nil
+}
+
+// IdenticalFiles - Returns a boolean indicating whether the files at the provided paths have identical contents, their
+// sizes are compared first so that the (considerably slower) byte-by-byte comparison is only required for files which
+// may be identical.
+func IdenticalFiles(a, b string) (bool, error) {
+	statA, err := os.Stat(a)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to stat file")
+	}
+
+	statB, err := os.Stat(b)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to stat file")
+	}
+
+	if statA.Size() != statB.Size() {
+		return false, nil
+	}
+
+	fileA, err := os.Open(a)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to open file")
+	}
+	defer fileA.Close()
+
+	fileB, err := os.Open(b)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to open file")
+	}
+	defer fileB.Close()
+
+	bufferA, bufferB := make([]byte, 64*1024), make([]byte, 64*1024)
+
+	for {
+		readA, errA := io.ReadFull(fileA, bufferA)
+		readB, errB := io.ReadFull(fileB, bufferB)
+
+		if !bytes.Equal(bufferA[:readA], bufferB[:readB]) {
+			return false, nil
+		}
+
+		// A short read indicates we've reached the end of the file
+		doneA := errA == io.EOF || errA == io.ErrUnexpectedEOF
+		doneB := errB == io.EOF || errB == io.ErrUnexpectedEOF
+
+		if errA != nil && !doneA {
+			return false, errors.Wrap(errA, "failed to read from file")
+		}
+
+		if errB != nil && !doneB {
+			return false, errors.Wrap(errB, "failed to read from file")
+		}
+
+		if doneA || doneB {
+			return doneA && doneB, nil
+		}
+	}
+}
+
+// hashMappedFile - Return the CRC32 hash of the provided file by memory-mapping it, along with a boolean indicating
+// whether the file could be mapped; if not (e.g. it's too large to map on a 32-bit system) it should be read instead.
+func hashMappedFile(file *os.File, options HashOptions) (uint32, bool, error) {
+	stat, err := file.Stat()
+	if err != nil {
+		return 0, false, errors.Wrap(err, "failed to stat hash file")
+	}
+
+	// Empty files can't be mapped, but their hash is known
+	if stat.Size() == 0 {
+		return 0, true, nil
+	}
+
+	data, err := mapFile(file, stat.Size())
+	if err != nil {
+		log.WithError(err).WithField("path", file.Name()).Debug("Failed to memory-map file, reading it instead")
+		return 0, false, nil
+	}
+	defer unmapFile(data)
+
+	return hashMapped(data, options.table(), options.Limiter), true, nil
+}
+
+// hashMapped - Return the CRC32 hash of the provided data using the given table, sampling the same windows as
+// 'hashReader' so that the hashes are identical. Each window counts towards the limiter (if any), since reading it
+// faults the pages in from disk.
+func hashMapped(data []byte, table *crc32.Table, limiter *RateLimiter) uint32 {
+	var (
+		size   = int64(len(data))
+		digest uint32
+	)
+
+	for offset := int64(0); offset < size; {
+		end := offset + BufferSize
+		if end > size {
+			end = size
+		}
+
+		digest = crc32.Update(digest, table, data[offset:end])
+
+		if limiter != nil {
+			limiter.Wait(int(end - offset))
+		}
+
+		offset = end + int64(digest%MaxSeekSize)
+	}
+
+	return digest
 }
 
-// hashReader - Return the CRC32 hash of the provided ReadSeeker.
-func hashReader(reader io.ReadSeeker) (uint32, error) {
+// hashReader - Return the CRC32 hash of the provided ReadSeeker using the given table.
+func hashReader(reader io.ReadSeeker, table *crc32.Table) (uint32, error) {
 	var (
 		buffer [BufferSize]byte
 		digest uint32
@@ -0,0 +1,46 @@
+// Copyright 2020 James Lee <jamesl33info@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// memoryMapSupported - Files may be memory-mapped when hashing.
+const memoryMapSupported = true
+
+// mapFile - Map the provided file (of the given size) into memory, read-only. Only small windows are read from the
+// mapping, so the kernel is advised not to read ahead.
+func mapFile(file *os.File, size int64) ([]byte, error) {
+	data, err := unix.Mmap(int(file.Fd()), 0, int(size), unix.PROT_READ, unix.MAP_SHARED)
+	if err != nil {
+		return nil, err
+	}
+
+	err = unix.Madvise(data, unix.MADV_RANDOM)
+	if err != nil {
+		_ = unix.Munmap(data)
+		return nil, err
+	}
+
+	return data, nil
+}
+
+// unmapFile - Remove a mapping created by 'mapFile'.
+func unmapFile(data []byte) error {
+	return unix.Munmap(data)
+}
@@ -0,0 +1,37 @@
+// Copyright 2020 James Lee <jamesl33info@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !linux
+// +build !linux
+
+package utils
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// memoryMapSupported - Files are always read when hashing on this platform.
+const memoryMapSupported = false
+
+// mapFile - Memory-mapping isn't supported on this platform.
+func mapFile(_ *os.File, _ int64) ([]byte, error) {
+	return nil, errors.New("memory-mapping is not supported on this platform")
+}
+
+// unmapFile - Memory-mapping isn't supported on this platform.
+func unmapFile(_ []byte) error {
+	return nil
+}
@@ -15,7 +15,11 @@
 package utils
 
 import (
+	"fmt"
+	"hash/crc32"
 	"io/ioutil"
+	"math/rand"
+	"os"
 	"path/filepath"
 	"strings"
 	"testing"
@@ -69,6 +73,242 @@ func TestHashFile(t *testing.T) {
 			if actual != test.expected {
 				t.Fatalf("Expected %d but got %d", test.expected, actual)
 			}
+
+			actual, err = HashFileWithOptions(path, HashOptions{Limiter: NewRateLimiter(1024 * 1024)})
+			if err != nil {
+				t.Fatalf("Expected to be able to hash test file with a rate limit: %v", err)
+			}
+
+			if actual != test.expected {
+				t.Fatalf("Expected %d but got %d", test.expected, actual)
+			}
+		})
+	}
+}
+
+func TestHashFileAlgorithm(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.file")
+
+	err := ioutil.WriteFile(path, []byte("Hello, World!"), 0o755)
+	if err != nil {
+		t.Fatalf("Expected to be able to create test file: %v", err)
+	}
+
+	actual, err := HashFileWithOptions(path, HashOptions{Algorithm: HashAlgorithmIEEE})
+	if err != nil || actual != 3964322768 {
+		t.Fatalf("Expected the IEEE hash but got %d: %v", actual, err)
+	}
+
+	expected := crc32.Checksum([]byte("Hello, World!"), crc32.MakeTable(crc32.Castagnoli))
+
+	actual, err = HashFileWithOptions(path, HashOptions{Algorithm: HashAlgorithmCastagnoli})
+	if err != nil || actual != expected {
+		t.Fatalf("Expected %d but got %d: %v", expected, actual, err)
+	}
+
+	_, err = HashFileWithOptions(path, HashOptions{Algorithm: "md5"})
+	if err == nil {
+		t.Fatalf("Expected an error for an unsupported algorithm")
+	}
+}
+
+func TestHashFileFull(t *testing.T) {
+	type test struct {
+		name     string
+		contents string
+		expected uint32
+	}
+
+	tests := []*test{
+		{
+			name:     "EqualTo4K",
+			contents: strings.Repeat("x", 4096),
+			expected: 1041266625,
+		},
+		{
+			// Unlike 'HashFile', the entire file is hashed so we shouldn't get the same hash as the test above
+			name:     "GreaterThan4K",
+			contents: strings.Repeat("x", 8192),
+			expected: crc32.ChecksumIEEE([]byte(strings.Repeat("x", 8192))),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "test.file")
+
+			err := ioutil.WriteFile(path, []byte(test.contents), 0o755)
+			if err != nil {
+				t.Fatalf("Expected to be able to create test file: %v", err)
+			}
+
+			actual, err := HashFileFull(path)
+			if err != nil {
+				t.Fatalf("Expected to be able to hash test file: %v", err)
+			}
+
+			if actual != test.expected {
+				t.Fatalf("Expected %d but got %d", test.expected, actual)
+			}
+		})
+	}
+}
+
+func TestIdenticalFiles(t *testing.T) {
+	type test struct {
+		name     string
+		a, b     string
+		expected bool
+	}
+
+	// Files larger than the comparison buffer, which differ only in the final byte
+	large := strings.Repeat("x", 128*1024)
+
+	tests := []*test{
+		{name: "Identical", a: large + "x", b: large + "x", expected: true},
+		{name: "DifferentSize", a: "abc", b: "abcd"},
+		{name: "DifferentContents", a: large + "x", b: large + "y"},
+		{name: "Empty", expected: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var (
+				tempDir = t.TempDir()
+				a       = filepath.Join(tempDir, "a.file")
+				b       = filepath.Join(tempDir, "b.file")
+			)
+
+			for path, contents := range map[string]string{a: test.a, b: test.b} {
+				err := ioutil.WriteFile(path, []byte(contents), 0o755)
+				if err != nil {
+					t.Fatalf("Expected to be able to create test file: %v", err)
+				}
+			}
+
+			actual, err := IdenticalFiles(a, b)
+			if err != nil {
+				t.Fatalf("Expected to be able to compare test files: %v", err)
+			}
+
+			if actual != test.expected {
+				t.Fatalf("Expected %t but got %t", test.expected, actual)
+			}
+		})
+	}
+
+	_, err := IdenticalFiles(filepath.Join(t.TempDir(), "missing.file"), filepath.Join(t.TempDir(), "missing.file"))
+	if err == nil {
+		t.Fatalf("Expected an error when comparing files which don't exist")
+	}
+}
+
+// createSparseFile - Create a sparse file of the given size containing blocks of random data, allowing large files to
+// be hashed without writing (or reading) every byte.
+func createSparseFile(tb testing.TB, path string, size int64) {
+	file, err := os.Create(path)
+	if err != nil {
+		tb.Fatalf("Expected to be able to create test file: %v", err)
+	}
+	defer file.Close()
+
+	err = file.Truncate(size)
+	if err != nil {
+		tb.Fatalf("Expected to be able to truncate test file: %v", err)
+	}
+
+	var (
+		random = rand.New(rand.NewSource(size))
+		block  = make([]byte, 1024*1024)
+	)
+
+	for offset := int64(0); offset < size; offset += 16 * 1024 * 1024 {
+		random.Read(block)
+
+		_, err = file.WriteAt(block, offset)
+		if err != nil {
+			tb.Fatalf("Expected to be able to write test file: %v", err)
+		}
+	}
+}
+
+func TestHashFileMemoryMap(t *testing.T) {
+	type test struct {
+		name     string
+		contents string
+		size     int64
+	}
+
+	tests := []*test{
+		{name: "Empty"},
+		{name: "LessThan4K", contents: "Hello, World!"},
+		{name: "EqualTo4K", contents: strings.Repeat("x", 4096)},
+		{name: "GreaterThan4K", contents: strings.Repeat("x", 8192)},
+		{name: "Large", size: 1024 * 1024 * 1024},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "test.file")
+
+			if test.size != 0 {
+				createSparseFile(t, path, test.size)
+			} else {
+				err := ioutil.WriteFile(path, []byte(test.contents), 0o755)
+				if err != nil {
+					t.Fatalf("Expected to be able to create test file: %v", err)
+				}
+			}
+
+			// The hashes must be identical, otherwise databases hashed using the other method would be invalidated
+			for _, algorithm := range []HashAlgorithm{HashAlgorithmIEEE, HashAlgorithmCastagnoli} {
+				expected, err := HashFileWithOptions(path, HashOptions{Algorithm: algorithm})
+				if err != nil {
+					t.Fatalf("Expected to be able to hash test file: %v", err)
+				}
+
+				actual, err := HashFileWithOptions(path, HashOptions{Algorithm: algorithm, MemoryMap: true})
+				if err != nil {
+					t.Fatalf("Expected to be able to hash test file using a memory mapping: %v", err)
+				}
+
+				if actual != expected {
+					t.Fatalf("Expected %d but got %d using the '%s' algorithm", expected, actual, algorithm)
+				}
+			}
+
+			if !memoryMapSupported {
+				return
+			}
+
+			file, err := os.Open(path)
+			if err != nil {
+				t.Fatalf("Expected to be able to open test file: %v", err)
+			}
+			defer file.Close()
+
+			// Otherwise, we'd only be comparing the hashes from reading the file
+			_, mapped, err := hashMappedFile(file, HashOptions{})
+			if err != nil || !mapped {
+				t.Fatalf("Expected the file to have been memory-mapped: %v", err)
+			}
+		})
+	}
+}
+
+func BenchmarkHashFile(b *testing.B) {
+	path := filepath.Join(b.TempDir(), "test.file")
+
+	createSparseFile(b, path, 16*1024*1024*1024)
+
+	for _, memoryMap := range []bool{false, true} {
+		b.Run(fmt.Sprintf("MemoryMap=%t", memoryMap), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				_, err := HashFileWithOptions(path, HashOptions{MemoryMap: memoryMap})
+				if err != nil {
+					b.Fatalf("Expected to be able to hash test file: %v", err)
+				}
+			}
 		})
 	}
 }
@@ -26,6 +26,71 @@ func PathExists(path string) bool {
 	return err == nil
 }
 
+// SamePath - Returns a boolean indicating whether the provided paths refer to the same file; paths which differ may
+// still do so e.g. when they only differ by case on a case-insensitive filesystem (macOS, SMB/CIFS mounts).
+func SamePath(a, b string) bool {
+	if a == b {
+		return true
+	}
+
+	statA, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+
+	statB, err := os.Stat(b)
+	if err != nil {
+		return false
+	}
+
+	return os.SameFile(statA, statB)
+}
+
+// WithinDirectory - Returns a boolean indicating whether the provided path is equal to (or is within) the given
+// directory, relative paths are first made absolute using the working directory.
+func WithinDirectory(path, directory string) (bool, error) {
+	absolutePath, err := filepath.Abs(path)
+	if err != nil {
+		return false, err
+	}
+
+	absoluteDirectory, err := filepath.Abs(directory)
+	if err != nil {
+		return false, err
+	}
+
+	relative, err := filepath.Rel(absoluteDirectory, absolutePath)
+	if err != nil {
+		return false, nil
+	}
+
+	return relative != ".." && !strings.HasPrefix(relative, ".."+string(filepath.Separator)), nil
+}
+
+// MatchPath - Returns a boolean indicating whether the provided relative path matches the given glob pattern. Patterns
+// without a separator are matched against each element of the path (e.g. '*.mkv' or 'extras'), otherwise they're
+// matched against the path and each of its parent directories (e.g. 'tv/*' matches everything within 'tv').
+func MatchPath(pattern, path string) (bool, error) {
+	var (
+		elements  = strings.Split(filepath.Clean(path), string(filepath.Separator))
+		separator = strings.ContainsRune(filepath.Clean(pattern), filepath.Separator)
+	)
+
+	for index := range elements {
+		candidate := elements[index]
+		if separator {
+			candidate = filepath.Join(elements[:index+1]...)
+		}
+
+		matched, err := filepath.Match(filepath.Clean(pattern), candidate)
+		if err != nil || matched {
+			return matched, err
+		}
+	}
+
+	return false, nil
+}
+
 // ReplaceExtension - Replace the extension for the provided path with the given extension.
 func ReplaceExtension(path, extension string) string {
 	return strings.TrimSuffix(path, filepath.Ext(path)) + extension
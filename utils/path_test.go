@@ -15,6 +15,7 @@
 package utils
 
 import (
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"testing"
@@ -47,6 +48,110 @@ func TestPathExists(t *testing.T) {
 	}
 }
 
+func TestSamePath(t *testing.T) {
+	var (
+		tempDir = t.TempDir()
+		path    = filepath.Join(tempDir, "Test.file")
+		link    = filepath.Join(tempDir, "test.file")
+		other   = filepath.Join(tempDir, "other.file")
+	)
+
+	if !SamePath(path, path) {
+		t.Fatalf("Expected identical paths to be the same, even if they don't exist")
+	}
+
+	for _, path := range []string{path, other} {
+		err := ioutil.WriteFile(path, []byte("test"), 0o755)
+		if err != nil {
+			t.Fatalf("Expected to be able to create test file: %v", err)
+		}
+	}
+
+	// A hard link behaves like a path which only differs by case on a case-insensitive filesystem
+	err := os.Link(path, link)
+	if err != nil {
+		t.Fatalf("Expected to be able to create hard link: %v", err)
+	}
+
+	if !SamePath(path, link) {
+		t.Fatalf("Expected paths to the same file to be the same")
+	}
+
+	if SamePath(path, other) || SamePath(path, filepath.Join(tempDir, "missing.file")) {
+		t.Fatalf("Expected paths to different files not to be the same")
+	}
+}
+
+func TestWithinDirectory(t *testing.T) {
+	type test struct {
+		name            string
+		path, directory string
+		expected        bool
+	}
+
+	tests := []*test{
+		{name: "Equal", path: "/mnt/media", directory: "/mnt/media", expected: true},
+		{name: "Within", path: "/mnt/media/movies/a.mp4", directory: "/mnt/media", expected: true},
+		{name: "TrailingSlash", path: "/mnt/media/movies", directory: "/mnt/media/", expected: true},
+		{name: "Sibling", path: "/mnt/media2", directory: "/mnt/media"},
+		{name: "Parent", path: "/mnt", directory: "/mnt/media"},
+		{name: "DotDotPrefix", path: "/mnt/media/..hidden", directory: "/mnt/media", expected: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			actual, err := WithinDirectory(test.path, test.directory)
+			if err != nil {
+				t.Fatalf("Expected to be able to check path: %v", err)
+			}
+
+			if actual != test.expected {
+				t.Fatalf("Expected %t but got %t", test.expected, actual)
+			}
+		})
+	}
+}
+
+func TestMatchPath(t *testing.T) {
+	type test struct {
+		pattern, path string
+		expected      bool
+	}
+
+	tests := []*test{
+		{pattern: "*.mkv", path: "movie.mkv", expected: true},
+		{pattern: "*.mkv", path: "tv/show/episode.mkv", expected: true},
+		{pattern: "*.mkv", path: "tv/show/episode.mp4"},
+		{pattern: "extras", path: "movies/film/extras/trailer.mp4", expected: true},
+		{pattern: "extras", path: "movies/extras.mp4"},
+		{pattern: "tv", path: "tv/show/episode.mkv", expected: true},
+		{pattern: "tv/", path: "tv/show/episode.mkv", expected: true},
+		{pattern: "tv/*", path: "tv/show/episode.mkv", expected: true},
+		{pattern: "tv/*", path: "movies/tv/episode.mkv"},
+		{pattern: "*/show", path: "tv/show/episode.mkv", expected: true},
+		{pattern: "tv/show/*.mkv", path: "tv/show/episode.mkv", expected: true},
+		{pattern: "tv/show/*.mkv", path: "tv/show/season 1/episode.mkv"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.pattern+" "+test.path, func(t *testing.T) {
+			matched, err := MatchPath(test.pattern, test.path)
+			if err != nil {
+				t.Fatalf("Expected to be able to match path: %v", err)
+			}
+
+			if matched != test.expected {
+				t.Fatalf("Expected %t but got %t", test.expected, matched)
+			}
+		})
+	}
+
+	_, err := MatchPath("[", "movie.mkv")
+	if err == nil {
+		t.Fatalf("Expected an error for a malformed pattern")
+	}
+}
+
 func TestPathReplaceExtension(t *testing.T) {
 	type test struct {
 		path      string
@@ -18,3 +18,13 @@ package utils
 func Int64P(n int64) *int64 {
 	return &n
 }
+
+// Float64P - Utility function to return a pointer to the provided float.
+func Float64P(f float64) *float64 {
+	return &f
+}
+
+// StringP - Utility function to return a pointer to the provided string.
+func StringP(s string) *string {
+	return &s
+}
@@ -24,3 +24,17 @@ func TestInt64P(t *testing.T) {
 		t.Fatalf("Expected 42 but got %d", *n)
 	}
 }
+
+func TestFloat64P(t *testing.T) {
+	f := Float64P(4.2)
+	if *f != 4.2 {
+		t.Fatalf("Expected 4.2 but got %g", *f)
+	}
+}
+
+func TestStringP(t *testing.T) {
+	s := StringP("string")
+	if *s != "string" {
+		t.Fatalf("Expected 'string' but got '%s'", *s)
+	}
+}
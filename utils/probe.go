@@ -0,0 +1,242 @@
+// Copyright 2020 James Lee <jamesl33info@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// VideoInfo - Describes the first video stream of a media file, as reported by ffprobe.
+type VideoInfo struct {
+	Codec         string
+	Width, Height int64
+
+	// Duration - The duration (in seconds) of the file, zero if it's not reported by the container.
+	Duration float64
+}
+
+// ProbeVideo - Use ffprobe to determine the codec and dimensions of the first video stream in the provided file, along
+// with the duration of the file.
+func ProbeVideo(ctx context.Context, path string) (VideoInfo, error) {
+	command := exec.Command(
+		"ffprobe",
+		"-v", "error",
+		"-select_streams", "v:0",
+		"-show_entries", "stream=codec_name,width,height:format=duration",
+		"-of", "json",
+		path,
+	)
+
+	command.SysProcAttr = &unix.SysProcAttr{
+		Pdeathsig: syscall.SIGINT,
+		Setpgid:   true,
+	}
+
+	output, err := runCommand(ctx, command, TranscodeOptions{})
+	if err != nil {
+		return VideoInfo{}, errors.Wrap(err, "failed to run 'ffprobe'")
+	}
+
+	return parseVideoInfo(output)
+}
+
+// parseVideoInfo - Parse the JSON output of ffprobe, note that the output may be preceded by (non-fatal) errors since
+// stderr is also captured. The duration is optional since some containers (e.g. raw streams) don't report it.
+func parseVideoInfo(output []byte) (VideoInfo, error) {
+	start := bytes.IndexByte(output, '{')
+	if start == -1 {
+		return VideoInfo{}, fmt.Errorf("stream information not found in output")
+	}
+
+	var decoded struct {
+		Streams []struct {
+			CodecName string `json:"codec_name"`
+			Width     int64  `json:"width"`
+			Height    int64  `json:"height"`
+		} `json:"streams"`
+		Format struct {
+			Duration string `json:"duration"`
+		} `json:"format"`
+	}
+
+	err := json.NewDecoder(bytes.NewReader(output[start:])).Decode(&decoded)
+	if err != nil {
+		return VideoInfo{}, errors.Wrap(err, "failed to unmarshal stream information")
+	}
+
+	if len(decoded.Streams) == 0 {
+		return VideoInfo{}, fmt.Errorf("no video stream found")
+	}
+
+	stream := decoded.Streams[0]
+
+	info := VideoInfo{Codec: stream.CodecName, Width: stream.Width, Height: stream.Height}
+
+	duration, err := strconv.ParseFloat(decoded.Format.Duration, 64)
+	if err == nil && duration > 0 {
+		info.Duration = duration
+	}
+
+	return info, nil
+}
+
+// ColorInfo - Describes the pixel format and color properties of the first video stream of a media file, as reported
+// by ffprobe; unreported properties are empty.
+type ColorInfo struct {
+	PixelFormat string
+	Primaries   string
+	Transfer    string
+	Space       string
+}
+
+// hdrTransfers - The transfer characteristics (as reported by ffprobe) used by HDR video, i.e. PQ (HDR10) and HLG.
+var hdrTransfers = []string{"smpte2084", "arib-std-b67"}
+
+// HDR - Returns a boolean indicating whether the video is HDR, which is determined by its transfer characteristics.
+func (c ColorInfo) HDR() bool {
+	return ContainsString(hdrTransfers, c.Transfer)
+}
+
+// ProbeColor - Use ffprobe to determine the pixel format and color properties of the first video stream in the
+// provided file.
+func ProbeColor(ctx context.Context, path string) (ColorInfo, error) {
+	command := exec.Command(
+		"ffprobe",
+		"-v", "error",
+		"-select_streams", "v:0",
+		"-show_entries", "stream=pix_fmt,color_primaries,color_transfer,color_space",
+		"-of", "json",
+		path,
+	)
+
+	command.SysProcAttr = &unix.SysProcAttr{
+		Pdeathsig: syscall.SIGINT,
+		Setpgid:   true,
+	}
+
+	output, err := runCommand(ctx, command, TranscodeOptions{})
+	if err != nil {
+		return ColorInfo{}, errors.Wrap(err, "failed to run 'ffprobe'")
+	}
+
+	return parseColorInfo(output)
+}
+
+// parseColorInfo - Parse the pixel format and color properties from the JSON output of ffprobe.
+func parseColorInfo(output []byte) (ColorInfo, error) {
+	start := bytes.IndexByte(output, '{')
+	if start == -1 {
+		return ColorInfo{}, fmt.Errorf("stream information not found in output")
+	}
+
+	var decoded struct {
+		Streams []struct {
+			PixelFormat string `json:"pix_fmt"`
+			Primaries   string `json:"color_primaries"`
+			Transfer    string `json:"color_transfer"`
+			Space       string `json:"color_space"`
+		} `json:"streams"`
+	}
+
+	err := json.NewDecoder(bytes.NewReader(output[start:])).Decode(&decoded)
+	if err != nil {
+		return ColorInfo{}, errors.Wrap(err, "failed to unmarshal stream information")
+	}
+
+	if len(decoded.Streams) == 0 {
+		return ColorInfo{}, fmt.Errorf("no video stream found")
+	}
+
+	stream := decoded.Streams[0]
+
+	return ColorInfo{
+		PixelFormat: stream.PixelFormat,
+		Primaries:   stream.Primaries,
+		Transfer:    stream.Transfer,
+		Space:       stream.Space,
+	}, nil
+}
+
+// ProbeBitRate - Use ffprobe to determine the bit rate (in bits per second) of the first video stream in the provided
+// file. Some containers (e.g. mkv) don't record the bit rate of each stream, in which case the overall bit rate of the
+// file is returned; this includes the audio so will overestimate the video bit rate.
+func ProbeBitRate(ctx context.Context, path string) (int64, error) {
+	command := exec.Command(
+		"ffprobe",
+		"-v", "error",
+		"-select_streams", "v:0",
+		"-show_entries", "stream=bit_rate:format=bit_rate",
+		"-of", "json",
+		path,
+	)
+
+	command.SysProcAttr = &unix.SysProcAttr{
+		Pdeathsig: syscall.SIGINT,
+		Setpgid:   true,
+	}
+
+	output, err := runCommand(ctx, command, TranscodeOptions{})
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to run 'ffprobe'")
+	}
+
+	return parseBitRate(output)
+}
+
+// parseBitRate - Parse the bit rate from the JSON output of ffprobe, preferring the bit rate of the video stream over
+// that of the file when both are available.
+func parseBitRate(output []byte) (int64, error) {
+	start := bytes.IndexByte(output, '{')
+	if start == -1 {
+		return 0, fmt.Errorf("bit rate not found in output")
+	}
+
+	var decoded struct {
+		Streams []struct {
+			BitRate string `json:"bit_rate"`
+		} `json:"streams"`
+		Format struct {
+			BitRate string `json:"bit_rate"`
+		} `json:"format"`
+	}
+
+	err := json.NewDecoder(bytes.NewReader(output[start:])).Decode(&decoded)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to unmarshal bit rate")
+	}
+
+	candidates := []string{decoded.Format.BitRate}
+	if len(decoded.Streams) != 0 {
+		candidates = append([]string{decoded.Streams[0].BitRate}, candidates...)
+	}
+
+	for _, candidate := range candidates {
+		bitRate, err := strconv.ParseInt(candidate, 10, 64)
+		if err == nil && bitRate > 0 {
+			return bitRate, nil
+		}
+	}
+
+	return 0, fmt.Errorf("bit rate not reported")
+}
@@ -0,0 +1,186 @@
+// Copyright 2020 James Lee <jamesl33info@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"testing"
+)
+
+func TestParseVideoInfo(t *testing.T) {
+	output := []byte(`[mpeg4 @ 0x5581] Video uses a non-standard and wasteful way to store B-frames
+{
+    "programs": [
+
+    ],
+    "streams": [
+        {
+            "codec_name": "mpeg4",
+            "width": 720,
+            "height": 480
+        }
+    ],
+    "format": {
+        "duration": "1325.480000"
+    }
+}
+`)
+
+	info, err := parseVideoInfo(output)
+	if err != nil {
+		t.Fatalf("Expected to be able to parse video info: %v", err)
+	}
+
+	expected := VideoInfo{Codec: "mpeg4", Width: 720, Height: 480, Duration: 1325.48}
+	if info != expected {
+		t.Fatalf("Expected %+v but got %+v", expected, info)
+	}
+}
+
+func TestParseVideoInfoNoDuration(t *testing.T) {
+	for _, output := range []string{
+		`{"streams": [{"codec_name": "h264"}]}`,
+		`{"streams": [{"codec_name": "h264"}], "format": {"duration": "N/A"}}`,
+	} {
+		info, err := parseVideoInfo([]byte(output))
+		if err != nil {
+			t.Fatalf("Expected to be able to parse video info: %v", err)
+		}
+
+		if info.Duration != 0 {
+			t.Fatalf("Expected an unknown duration but got %g", info.Duration)
+		}
+	}
+}
+
+func TestParseVideoInfoNoStreams(t *testing.T) {
+	for _, output := range []string{"", `{"programs": [], "streams": []}`, `{"streams": [`} {
+		_, err := parseVideoInfo([]byte(output))
+		if err == nil {
+			t.Fatalf("Expected an error when parsing '%s'", output)
+		}
+	}
+}
+
+func TestParseColorInfo(t *testing.T) {
+	type test struct {
+		name     string
+		output   string
+		expected ColorInfo
+		hdr      bool
+		err      bool
+	}
+
+	tests := []*test{
+		{
+			name: "HDR10",
+			output: `{"streams": [{"pix_fmt": "yuv420p10le", "color_primaries": "bt2020", ` +
+				`"color_transfer": "smpte2084", "color_space": "bt2020nc"}]}`,
+			expected: ColorInfo{PixelFormat: "yuv420p10le", Primaries: "bt2020", Transfer: "smpte2084", Space: "bt2020nc"},
+			hdr:      true,
+		},
+		{
+			name:     "HLG",
+			output:   `{"streams": [{"pix_fmt": "yuv420p10le", "color_transfer": "arib-std-b67"}]}`,
+			expected: ColorInfo{PixelFormat: "yuv420p10le", Transfer: "arib-std-b67"},
+			hdr:      true,
+		},
+		{
+			name:     "SDR",
+			output:   `{"streams": [{"pix_fmt": "yuv420p"}]}`,
+			expected: ColorInfo{PixelFormat: "yuv420p"},
+		},
+		{
+			name:   "NoStreams",
+			output: `{"streams": []}`,
+			err:    true,
+		},
+		{
+			name:   "NoOutput",
+			output: "",
+			err:    true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			info, err := parseColorInfo([]byte(test.output))
+			if test.err {
+				if err == nil {
+					t.Fatalf("Expected an error when parsing '%s'", test.output)
+				}
+
+				return
+			}
+
+			if err != nil || info != test.expected {
+				t.Fatalf("Expected %+v but got %+v: %v", test.expected, info, err)
+			}
+
+			if info.HDR() != test.hdr {
+				t.Fatalf("Expected HDR to be %t", test.hdr)
+			}
+		})
+	}
+}
+
+func TestParseBitRate(t *testing.T) {
+	type test struct {
+		name     string
+		output   string
+		expected int64
+		err      bool
+	}
+
+	tests := []*test{
+		{
+			name:     "Stream",
+			output:   `{"streams": [{"bit_rate": "1500000"}], "format": {"bit_rate": "1700000"}}`,
+			expected: 1500000,
+		},
+		{
+			name:     "Format",
+			output:   `{"streams": [{}], "format": {"bit_rate": "1700000"}}`,
+			expected: 1700000,
+		},
+		{
+			name:     "NoStreams",
+			output:   `{"streams": [], "format": {"bit_rate": "1700000"}}`,
+			expected: 1700000,
+		},
+		{
+			name:   "NotReported",
+			output: `{"streams": [{}], "format": {}}`,
+			err:    true,
+		},
+		{
+			name:   "NoOutput",
+			output: "",
+			err:    true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			bitRate, err := parseBitRate([]byte(test.output))
+			if test.err && err == nil {
+				t.Fatalf("Expected an error when parsing '%s'", test.output)
+			}
+
+			if !test.err && (err != nil || bitRate != test.expected) {
+				t.Fatalf("Expected %d but got %d: %v", test.expected, bitRate, err)
+			}
+		})
+	}
+}
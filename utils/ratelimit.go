@@ -0,0 +1,67 @@
+// Copyright 2020 James Lee <jamesl33info@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// RateLimiter - Thread safe limiter which may be shared between multiple readers to limit the aggregate rate (in bytes
+// per second) at which data is read.
+type RateLimiter struct {
+	lock     sync.Mutex
+	limit    int64
+	start    time.Time
+	consumed int64
+}
+
+// NewRateLimiter - Create a new rate limiter which will limit reads to the provided number of bytes per second.
+func NewRateLimiter(limit int64) *RateLimiter {
+	return &RateLimiter{limit: limit, start: time.Now()}
+}
+
+// Wait - Account for 'n' bytes having been read, blocking until the aggregate read rate is within the limit.
+func (r *RateLimiter) Wait(n int) {
+	r.lock.Lock()
+	r.consumed += int64(n)
+	expected := time.Duration(float64(r.consumed) / float64(r.limit) * float64(time.Second))
+	r.lock.Unlock()
+
+	if elapsed := time.Since(r.start); elapsed < expected {
+		time.Sleep(expected - elapsed)
+	}
+}
+
+// rateLimitedReader - Wraps an 'io.ReadSeeker' so that reads are limited by the provided rate limiter, note that seeks
+// are not limited since they don't read any data.
+type rateLimitedReader struct {
+	reader  io.ReadSeeker
+	limiter *RateLimiter
+}
+
+// Read - Implement the 'io.Reader' interface, blocking after the read if we've exceeded the rate limit.
+func (r *rateLimitedReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.limiter.Wait(n)
+
+	return n, err
+}
+
+// Seek - Implement the 'io.Seeker' interface.
+func (r *rateLimitedReader) Seek(offset int64, whence int) (int64, error) {
+	return r.reader.Seek(offset, whence)
+}
@@ -0,0 +1,45 @@
+// Copyright 2020 James Lee <jamesl33info@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestRateLimitedReader(t *testing.T) {
+	var (
+		data   = make([]byte, 64*1024)
+		reader = &rateLimitedReader{reader: bytes.NewReader(data), limiter: NewRateLimiter(512 * 1024)}
+		start  = time.Now()
+	)
+
+	read, err := io.Copy(ioutil.Discard, reader)
+	if err != nil {
+		t.Fatalf("Expected to be able to read data: %v", err)
+	}
+
+	if read != int64(len(data)) {
+		t.Fatalf("Expected %d but got %d", len(data), read)
+	}
+
+	// Reading 64KiB at 512KiB/s should take at least 125ms
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Fatalf("Expected reads to be rate limited but took %s", elapsed)
+	}
+}
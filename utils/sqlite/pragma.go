@@ -28,6 +28,33 @@ const (
 	// PragmaForiegnKeys - The pragma to enable/disable foreign keys between tables; this will ensure foreign references
 	// exist when creating/updating/modifying rows.
 	PragmaForiegnKeys Pragma = "foreign_keys"
+
+	// PragmaSchemaVersion - The pragma to get the SQLite schema version; this is incremented by the SQLite library
+	// whenever the schema is modified.
+	PragmaSchemaVersion Pragma = "schema_version"
+
+	// PragmaJournalMode - The pragma to get/set the journal mode, which determines how transactions are made atomic.
+	PragmaJournalMode Pragma = "journal_mode"
+
+	// PragmaSynchronous - The pragma to get/set how aggressively writes are synced to disk, trading durability against
+	// performance; returned as an integer from 0 (off) to 3 (extra).
+	PragmaSynchronous Pragma = "synchronous"
+
+	// PragmaWalCheckpoint - The pragma to checkpoint the write-ahead log, copying its contents into the database file;
+	// see 'Checkpoint'.
+	PragmaWalCheckpoint Pragma = "wal_checkpoint"
+)
+
+// CheckpointMode - Determines how aggressively the write-ahead log is checkpointed, see 'Checkpoint'.
+type CheckpointMode string
+
+const (
+	// CheckpointPassive - Checkpoint as much as possible without waiting for other connections.
+	CheckpointPassive CheckpointMode = "PASSIVE"
+
+	// CheckpointTruncate - Wait for other connections to finish writing/reading then checkpoint the entire log,
+	// truncating it to zero bytes once complete.
+	CheckpointTruncate CheckpointMode = "TRUNCATE"
 )
 
 // GetPragma - Query the provided pragma and store it in the given interface, note that it's the responsibility of the
@@ -40,6 +67,24 @@ func GetPragma(db Queryable, pragma Pragma, data interface{}) error {
 	return QueryRow(db, query, data)
 }
 
+// Checkpoint - Checkpoint the write-ahead log of the provided database using the given mode, returning a boolean which
+// indicates whether the checkpoint was prevented from completing by another connection. This has no effect when the
+// database isn't using the 'wal' journal mode.
+func Checkpoint(db Queryable, mode CheckpointMode) (bool, error) {
+	query := Query{
+		Query: fmt.Sprintf("pragma %s(%s);", PragmaWalCheckpoint, mode),
+	}
+
+	var busy, pages, checkpointed int
+
+	err := QueryRow(db, query, &busy, &pages, &checkpointed)
+	if err != nil {
+		return false, err
+	}
+
+	return busy != 0, nil
+}
+
 // SetPragma - Set the provided pragma to the given value, note that it's the responsibility of the caller to ensure the
 // value is of the correct type.
 func SetPragma(db Executable, pragma Pragma, value interface{}) error {
@@ -16,6 +16,7 @@ package sqlite
 
 import (
 	"database/sql"
+	"os"
 	"path/filepath"
 	"testing"
 
@@ -58,3 +59,44 @@ func TestGetSetPragma(t *testing.T) {
 		t.Fatalf("Expected 42 but got %d", version)
 	}
 }
+
+func TestCheckpoint(t *testing.T) {
+	var (
+		tempDir = t.TempDir()
+		path    = filepath.Join(tempDir, "test.db")
+	)
+
+	db, err := sql.Open("sqlite3", path+"?_journal=wal")
+	if err != nil {
+		t.Fatalf("Expected to be able to open test database: %v", err)
+	}
+	defer db.Close()
+
+	_, err = ExecuteQuery(db, Query{Query: "create table test (id integer primary key);"})
+	if err != nil {
+		t.Fatalf("Expected to be able to create table: %v", err)
+	}
+
+	info, err := os.Stat(path + "-wal")
+	if err != nil || info.Size() == 0 {
+		t.Fatalf("Expected the write-ahead log to contain the write: %v", err)
+	}
+
+	busy, err := Checkpoint(db, CheckpointTruncate)
+	if err != nil {
+		t.Fatalf("Expected to be able to checkpoint: %v", err)
+	}
+
+	if busy {
+		t.Fatalf("Expected the checkpoint not to be blocked")
+	}
+
+	info, err = os.Stat(path + "-wal")
+	if err != nil {
+		t.Fatalf("Expected to be able to stat the write-ahead log: %v", err)
+	}
+
+	if info.Size() != 0 {
+		t.Fatalf("Expected the write-ahead log to have been truncated, got %d bytes", info.Size())
+	}
+}
@@ -20,7 +20,10 @@ import (
 
 // Query - Encapsulates the options for an SQLite query.
 type Query struct {
-	Query     string
+	Query string
+
+	// Arguments - The values for the parameters in the query, either positional ('?') or named (':name') using
+	// 'sql.Named'. Positional arguments are bound by their index in the list, so a query shouldn't mix the two.
 	Arguments []interface{}
 }
 
@@ -70,8 +73,20 @@ func QueryRow(db Queryable, query Query, dest ...interface{}) error {
 	return rows.Scan(dest...)
 }
 
-// QueryRows - Utility function to execute a query an run the provided callback for each row returned.
+// QueryRows - Utility function to execute a query an run the provided callback for each row returned, returns an
+// 'ErrQueryReturnedNoRows' error if the query didn't return any rows.
 func QueryRows(db Queryable, query Query, callback RowCallback) error {
+	return queryRows(db, query, callback, false)
+}
+
+// QueryRowsAllowEmpty - Utility function which behaves like 'QueryRows' except that a query which doesn't return any
+// rows isn't an error, this should be preferred when an empty result is expected (e.g. listing entries).
+func QueryRowsAllowEmpty(db Queryable, query Query, callback RowCallback) error {
+	return queryRows(db, query, callback, true)
+}
+
+// queryRows - See 'QueryRows'/'QueryRowsAllowEmpty'.
+func queryRows(db Queryable, query Query, callback RowCallback, allowEmpty bool) error {
 	rows, err := db.Query(query.Query, query.Arguments...)
 	if err != nil {
 		return err
@@ -88,7 +103,7 @@ func QueryRows(db Queryable, query Query, callback RowCallback) error {
 		containedRows = true
 	}
 
-	if !containedRows {
+	if !containedRows && !allowEmpty {
 		return ErrQueryReturnedNoRows
 	}
 
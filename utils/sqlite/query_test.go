@@ -169,3 +169,123 @@ func TestQueryRowsNoRows(t *testing.T) {
 		t.Fatalf("Expected an 'ErrQueryReturnedNoRows' error but got '%#v'", err)
 	}
 }
+
+func TestQueryRowsAllowEmpty(t *testing.T) {
+	var (
+		tempDir = t.TempDir()
+		path    = filepath.Join(tempDir, "test.db")
+	)
+
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatalf("Expected to be able to open test database: %v", err)
+	}
+	defer db.Close()
+
+	_, err = ExecuteQuery(db, Query{Query: "create table test (id integer primary key);"})
+	if err != nil {
+		t.Fatalf("Expected to be able to execute query: %v", err)
+	}
+
+	var called bool
+
+	err = QueryRowsAllowEmpty(db, Query{Query: "select id from test;"}, func(scan ScanCallback) error {
+		called = true
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Expected no error for an empty result but got '%#v'", err)
+	}
+
+	if called {
+		t.Fatalf("Expected the callback not to be run for an empty result")
+	}
+
+	// Errors from the callback (including the sentinel) must still be returned
+	_, err = ExecuteQuery(db, Query{Query: "insert into test (id) values (42)"})
+	if err != nil {
+		t.Fatalf("Expected to be able to execute query: %v", err)
+	}
+
+	err = QueryRowsAllowEmpty(db, Query{Query: "select id from test;"}, func(scan ScanCallback) error {
+		return ErrQueryReturnedNoRows
+	})
+	if !errors.Is(err, ErrQueryReturnedNoRows) {
+		t.Fatalf("Expected the callback error to be returned but got '%#v'", err)
+	}
+}
+
+func TestQueryNamedArguments(t *testing.T) {
+	var (
+		tempDir = t.TempDir()
+		path    = filepath.Join(tempDir, "test.db")
+	)
+
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatalf("Expected to be able to open test database: %v", err)
+	}
+	defer db.Close()
+
+	_, err = ExecuteQuery(db, Query{Query: "create table test (id integer primary key, name text not null);"})
+	if err != nil {
+		t.Fatalf("Expected to be able to execute query: %v", err)
+	}
+
+	for id, name := range []string{"zero", "one", "two"} {
+		query := Query{
+			Query:     "insert into test (id, name) values (:id, :name);",
+			Arguments: []interface{}{sql.Named("name", name), sql.Named("id", id)},
+		}
+
+		affected, err := ExecuteQuery(db, query)
+		if err != nil {
+			t.Fatalf("Expected to be able to execute query: %v", err)
+		}
+
+		if affected != 1 {
+			t.Fatalf("Expected 1 row to be affected but got %d", affected)
+		}
+	}
+
+	var name string
+
+	// A named argument may be referenced multiple times
+	query := Query{
+		Query:     "select name from test where id = :id and id >= :id;",
+		Arguments: []interface{}{sql.Named("id", 1)},
+	}
+
+	err = QueryRow(db, query, &name)
+	if err != nil {
+		t.Fatalf("Expected to be able to query row: %v", err)
+	}
+
+	if name != "one" {
+		t.Fatalf("Expected 'one' but got '%s'", name)
+	}
+
+	names := make([]string, 0)
+
+	callback := func(scan ScanCallback) error {
+		var name string
+		err := scan(&name)
+		names = append(names, name)
+		return err
+	}
+
+	// The order of named arguments doesn't matter
+	query = Query{
+		Query:     "select name from test where id >= :min and name != :exclude order by id;",
+		Arguments: []interface{}{sql.Named("exclude", "two"), sql.Named("min", 1)},
+	}
+
+	err = QueryRows(db, query, callback)
+	if err != nil {
+		t.Fatalf("Expected to be able to query rows: %v", err)
+	}
+
+	if len(names) != 1 || names[0] != "one" {
+		t.Fatalf("Expected only 'one' but got %v", names)
+	}
+}
@@ -16,14 +16,20 @@ package utils
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"syscall"
 
-	"github.com/jamesl33/goamt/value"
-
 	"github.com/apex/log"
+	"github.com/pkg/errors"
 	"golang.org/x/sys/unix"
 )
 
@@ -37,37 +43,373 @@ type LoudnormStats struct {
 	TargetOffset      string `json:"target_offset"`
 }
 
-// TranscodeFile - Use ffmpeg to transcode the file at the provided path, note that the resulting file will have the
-// '.transcoding.mp4' extension.
-func TranscodeFile(path string) error {
-	lns, err := firstPass(path)
-	if err != nil {
-		return fmt.Errorf("failed to run first pass: %w", err)
+const (
+	// AudioCodecAAC - Re-encode the audio using AAC, this is the default.
+	AudioCodecAAC = "aac"
+
+	// AudioCodecAC3 - Re-encode the audio using AC3 (Dolby Digital), which is widely supported by AV receivers.
+	AudioCodecAC3 = "ac3"
+
+	// AudioCodecOpus - Re-encode the audio using Opus, this gives better quality at a given bit rate than AAC but is
+	// less widely supported by players when stored in an mp4 container.
+	AudioCodecOpus = "opus"
+
+	// AudioCodecCopy - Copy the audio streams without re-encoding them; note that this implies the audio won't be
+	// normalised.
+	AudioCodecCopy = "copy"
+
+	// VideoCodecH264 - Encode the video using h264, this is the default.
+	VideoCodecH264 = "h264"
+
+	// VideoCodecH265 - Encode the video using h265 (hevc), this produces smaller files but is slower to encode and less
+	// widely supported by players.
+	VideoCodecH265 = "hevc"
+
+	// PixelFormat8Bit - Encode 8-bit video, this is the default and is supported by virtually every player.
+	PixelFormat8Bit = "yuv420p"
+
+	// PixelFormat10Bit - Encode 10-bit video, which is required to preserve HDR.
+	PixelFormat10Bit = "yuv420p10le"
+)
+
+// PixelFormats - The supported pixel formats.
+var PixelFormats = []string{PixelFormat8Bit, PixelFormat10Bit}
+
+// profiles10Bit - The profiles which support 10-bit video, for each of the 8-bit profiles used by the presets.
+var profiles10Bit = map[string]string{"high": "high10", "main": "main10"}
+
+// EncoderPresets - The encoder presets supported by both x264 and x265, ordered from fastest to slowest (slower presets
+// produce smaller files at the same quality).
+var EncoderPresets = []string{
+	"ultrafast", "superfast", "veryfast", "faster", "fast", "medium", "slow", "slower", "veryslow", "placebo",
+}
+
+// AudioCodecs - The supported audio codecs.
+var AudioCodecs = []string{AudioCodecAAC, AudioCodecAC3, AudioCodecOpus, AudioCodecCopy}
+
+// audioEncoders - The ffmpeg encoder used for each of the audio codecs which are re-encoded, the native Opus encoder is
+// experimental so libopus is used instead.
+var audioEncoders = map[string]string{AudioCodecAAC: "aac", AudioCodecAC3: "ac3", AudioCodecOpus: "libopus"}
+
+// audioBitRates - The range of bit rates (in kbit/s) accepted by the encoders which have fixed limits.
+var audioBitRates = map[string][2]int{AudioCodecAC3: {32, 640}, AudioCodecOpus: {6, 510}}
+
+// RequiredTools - The executables which must be installed to transcode files.
+var RequiredTools = []string{"ffmpeg", "ffprobe"}
+
+// mp4AudioCodecs - The audio codecs (as reported by ffprobe) which may be copied into an mp4 container.
+var mp4AudioCodecs = []string{"aac", "ac3", "alac", "eac3", "flac", "mp3", "opus"}
+
+// mp4VideoCodecs - The video codecs (as reported by ffprobe) which may be copied into an mp4 container.
+var mp4VideoCodecs = []string{"av1", "h264", "hevc", "mpeg4", "vp9"}
+
+// ValidateAudio - Returns an error if the provided audio codec isn't supported, or the bit rate (in kbit/s, zero leaves
+// the choice to the encoder) can't be used with it.
+func ValidateAudio(codec string, bitRate int) error {
+	if !ContainsString(AudioCodecs, codec) {
+		return fmt.Errorf("audio codec '%s' is not supported, expected one of '%s'", codec,
+			strings.Join(AudioCodecs, "', '"))
+	}
+
+	if bitRate == 0 {
+		return nil
+	}
+
+	if bitRate < 0 {
+		return fmt.Errorf("audio bit rate %d must be positive", bitRate)
+	}
+
+	if codec == AudioCodecCopy {
+		return errors.New("an audio bit rate can't be used when copying the audio")
+	}
+
+	limits, ok := audioBitRates[codec]
+	if ok && (bitRate < limits[0] || bitRate > limits[1]) {
+		return fmt.Errorf("audio bit rate %d is not in the range %d to %d for '%s'", bitRate, limits[0], limits[1],
+			codec)
+	}
+
+	return nil
+}
+
+// audioArgs - Returns the arguments which select the audio encoder (and bit rate), defaulting to AAC.
+func audioArgs(options TranscodeOptions) []string {
+	codec := options.AudioCodec
+	if codec == "" {
+		codec = AudioCodecAAC
+	}
+
+	if codec == AudioCodecCopy {
+		return []string{"-acodec", AudioCodecCopy}
+	}
+
+	args := []string{"-acodec", audioEncoders[codec]}
+
+	if options.AudioBitRate != 0 {
+		args = append(args, "-b:a", strconv.Itoa(options.AudioBitRate)+"k")
+	}
+
+	// libopus rejects some common surround layouts (e.g. 5.1(side)) unless the channel mapping is explicit, and older
+	// versions of ffmpeg consider Opus in mp4 to be experimental
+	if codec == AudioCodecOpus {
+		args = append(args, "-mapping_family", "1", "-strict", "experimental")
+	}
+
+	return args
+}
+
+// LoudnormTarget - The target integrated loudness (LUFS), loudness range (LU) and true peak (dBTP) used by the loudnorm
+// filter; nil values leave the choice to ffmpeg (-24 LUFS, 7 LU and -2 dBTP).
+type LoudnormTarget struct {
+	I, LRA, TP *float64
+}
+
+// Validate - Returns an error if any of the provided targets are outside of the range accepted by the loudnorm filter.
+func (l LoudnormTarget) Validate() error {
+	if l.I != nil && (*l.I < -70 || *l.I > -5) {
+		return fmt.Errorf("target integrated loudness %g is not in the range -70 to -5", *l.I)
+	}
+
+	if l.LRA != nil && (*l.LRA < 1 || *l.LRA > 50) {
+		return fmt.Errorf("target loudness range %g is not in the range 1 to 50", *l.LRA)
+	}
+
+	if l.TP != nil && (*l.TP < -9 || *l.TP > 0) {
+		return fmt.Errorf("target true peak %g is not in the range -9 to 0", *l.TP)
+	}
+
+	return nil
+}
+
+// filter - Returns the loudnorm filter using the provided (colon separated) options followed by any targets.
+func (l LoudnormTarget) filter(options string) string {
+	filter := "loudnorm=" + options
+
+	for _, target := range []struct {
+		name  string
+		value *float64
+	}{{"i", l.I}, {"lra", l.LRA}, {"tp", l.TP}} {
+		if target.value != nil {
+			filter += fmt.Sprintf(":%s=%s", target.name, strconv.FormatFloat(*target.value, 'f', -1, 64))
+		}
+	}
+
+	return filter
+}
+
+// TranscodeOptions - Encapsulates the options which control how ffmpeg is run when transcoding.
+type TranscodeOptions struct {
+	// Nice - The niceness applied to the ffmpeg processes, zero leaves the priority unchanged.
+	Nice int
+
+	// DisableLoudnorm - Skip the loudnorm first pass and don't normalise the audio in the second pass.
+	DisableLoudnorm bool
+
+	// AudioCodec - The codec (one of 'AudioCodecs') used for the audio streams, defaults to 'AudioCodecAAC' when empty.
+	AudioCodec string
+
+	// AudioBitRate - The bit rate (in kbit/s) of the re-encoded audio streams, zero leaves the choice to the encoder.
+	AudioBitRate int
+
+	// MaxWidth/MaxHeight - The maximum dimensions of the transcoded video, larger videos are downscaled (preserving their
+	// aspect ratio) but smaller videos are never upscaled. Zero means no limit.
+	MaxWidth, MaxHeight int
+
+	// Threads - The number of threads used by each ffmpeg process, zero leaves the choice to ffmpeg (which will typically
+	// use every vCPU).
+	Threads int
+
+	// VideoCodec - The codec used for the video stream, defaults to 'VideoCodecH264' when empty.
+	VideoCodec string
+
+	// CRF - The constant rate factor used when encoding the video (lower is higher quality), zero leaves the choice to
+	// the encoder.
+	CRF int
+
+	// EncoderPreset - The encoder preset (one of 'EncoderPresets') which trades encoding speed against compression, empty
+	// leaves the choice to the encoder (typically 'medium').
+	EncoderPreset string
+
+	// Profile/Level - The profile/level of the video stream, these should be valid for the chosen codec; empty leaves
+	// the choice to the encoder. When encoding 10-bit video, the 'high'/'main' profiles are replaced by their 10-bit
+	// equivalents.
+	Profile, Level string
+
+	// PixelFormat - The pixel format (one of 'PixelFormats') of the encoded video, defaults to 'PixelFormat8Bit' when
+	// empty.
+	PixelFormat string
+
+	// Color - When non-nil, the encoded video is tagged with these color properties; used alongside a 10-bit pixel format
+	// to preserve the HDR of the source.
+	Color *ColorInfo
+
+	// Tonemap - Tone map the (HDR) video to SDR using the BT.709 color space, this requires ffmpeg to be built with
+	// 'libzimg' (for the 'zscale' filter).
+	Tonemap bool
+
+	// Remux - Copy the audio/video streams into an mp4 container without re-encoding them, this skips the first pass and
+	// ignores the other encoding options. Files whose streams can't be copied into an mp4 container are transcoded.
+	Remux bool
+
+	// TargetBitRate - The average video bit rate (in kbit/s) targeted using two-pass encoding, an additional pass is
+	// run to gather stats about the video before it's encoded; this replaces the CRF. Zero uses single-pass CRF
+	// encoding. Note that this is independent of the loudnorm analysis, which remains a separate audio-only pass.
+	TargetBitRate int
+
+	// passLog - The prefix of the stats files written by the first video pass and read by the final pass, this is set by
+	// 'TranscodeFile' when using a target bit rate.
+	passLog string
+
+	// FixTimestamps - Regenerate missing presentation timestamps when reading the source and shift the output so that it
+	// starts at zero, repairing sources whose broken timestamps cause players to stutter. Applies when remuxing too.
+	FixTimestamps bool
+
+	// LoudnormTarget - The loudness targeted when normalising the audio, this is used in both passes.
+	LoudnormTarget LoudnormTarget
+
+	// LoudnormStats - Stats from a first pass which has already been run (see 'AnalyseLoudness'), when provided the
+	// first pass is skipped.
+	LoudnormStats *LoudnormStats
+
+	// Log - When non-nil, the commands run and their output are written here as they run; the output of failed
+	// commands is then no longer logged, since it would be interleaved with the output of other transcodes.
+	Log io.Writer
+}
+
+// CheckTools - Returns an '*ErrToolNotFound' error if any of the 'RequiredTools' (or the provided extra tools) aren't
+// installed, this should be used before starting work which would be interrupted by a missing executable.
+func CheckTools(extra ...string) error {
+	for _, tool := range append(append([]string{}, RequiredTools...), extra...) {
+		_, err := exec.LookPath(tool)
+		if err != nil {
+			return &ErrToolNotFound{Tool: tool, err: err}
+		}
+	}
+
+	return nil
+}
+
+// TranscodeFile - Use ffmpeg to transcode the file at the provided path, the resulting file will be written to the
+// given target path (which should have the '.transcoding.mp4' extension). ffmpeg is killed if the context is cancelled.
+func TranscodeFile(ctx context.Context, path, target string, options TranscodeOptions) error {
+	var (
+		lns *LoudnormStats
+		err error
+	)
+
+	if options.Remux {
+		video, ok := checkRemux(ctx, path, options)
+		if ok {
+			err = remux(ctx, path, target, video, options)
+			if err != nil {
+				return errors.Wrap(err, "failed to remux")
+			}
+
+			return nil
+		}
+
+		// The streams can't be copied, fallback to transcoding the file (which normalises the audio, as usual)
+		options.Remux = false
 	}
 
-	err = secondPass(path, lns)
+	if options.AudioCodec == AudioCodecCopy {
+		checkAudioCopy(ctx, path, options)
+	}
+
+	// The loudnorm filter requires re-encoding the audio, so it's skipped when copying
+	if options.LoudnormStats != nil {
+		lns = options.LoudnormStats
+	} else if RequiresAnalysis(options) {
+		lns, err = firstPass(ctx, path, options)
+		if err != nil {
+			return errors.Wrap(err, "failed to run first pass")
+		}
+	}
+
+	if options.TargetBitRate != 0 {
+		dir, err := ioutil.TempDir("", "goamt-passlog-")
+		if err != nil {
+			return errors.Wrap(err, "failed to create pass log directory")
+		}
+		defer os.RemoveAll(dir)
+
+		options.passLog = filepath.Join(dir, "pass")
+
+		err = statsPass(ctx, path, options)
+		if err != nil {
+			return errors.Wrap(err, "failed to run stats pass")
+		}
+	}
+
+	err = secondPass(ctx, path, target, lns, options)
 	if err != nil {
-		return fmt.Errorf("failed to run second pass: %w", err)
+		return errors.Wrap(err, "failed to run second pass")
 	}
 
 	return nil
 }
 
+// TranscodeCommands - Returns the ffmpeg commands which 'TranscodeFile' would run to transcode the file at the provided
+// path (in the order they'd be run), without running them. The loudnorm stats and pass log are only known once the
+// earlier passes have run, so placeholders are used in their place. Note that ffprobe is still run when remuxing, since
+// whether the streams can be copied determines which commands would be run.
+func TranscodeCommands(ctx context.Context, path, target string, options TranscodeOptions) []string {
+	if options.Remux {
+		video, ok := checkRemux(ctx, path, options)
+		if ok {
+			return []string{ffmpegCommand(remuxArgs(path, target, video, options))}
+		}
+
+		options.Remux = false
+	}
+
+	var (
+		commands []string
+		lns      = options.LoudnormStats
+	)
+
+	if lns == nil && RequiresAnalysis(options) {
+		commands = append(commands, ffmpegCommand(firstPassArgs(path, options)))
+
+		lns = &LoudnormStats{
+			MeasuredI:         "<input_i>",
+			MeasuredTP:        "<input_tp>",
+			MeasuredLRA:       "<input_lra>",
+			MeasuredThreshold: "<input_thresh>",
+			TargetOffset:      "<target_offset>",
+		}
+	}
+
+	if options.TargetBitRate != 0 {
+		options.passLog = "<passlog>"
+		commands = append(commands, ffmpegCommand(statsPassArgs(path, options)))
+	}
+
+	return append(commands, ffmpegCommand(secondPassArgs(path, target, lns, options)))
+}
+
+// ffmpegCommand - Returns the ffmpeg command line with the provided arguments, as it's logged when the command is run.
+func ffmpegCommand(args []string) string {
+	return exec.Command("ffmpeg", args...).String()
+}
+
+// RequiresAnalysis - Returns a boolean indicating whether transcoding with the provided options requires a first pass
+// to analyse the loudness of the audio.
+func RequiresAnalysis(options TranscodeOptions) bool {
+	return !options.DisableLoudnorm && !options.Remux && options.AudioCodec != AudioCodecCopy
+}
+
+// AnalyseLoudness - Run the first pass for the file at the provided path ahead of time, the returned stats may be
+// provided to 'TranscodeFile' (using the 'LoudnormStats' option) to skip the first pass. ffmpeg is killed if the
+// context is cancelled.
+func AnalyseLoudness(ctx context.Context, path string, options TranscodeOptions) (*LoudnormStats, error) {
+	return firstPass(ctx, path, options)
+}
+
 // firstPass - Run the first pass, this doesn't perform any transcoding; it simply gets the loudnorm stats which will be
 // used in the second pass the achieve the best normalisation results.
-func firstPass(path string) (*LoudnormStats, error) {
-	command := exec.Command(
-		"ffmpeg",
-		"-i",
-		path,
-		"-hide_banner",
-		"-vn",
-		"-af",
-		"loudnorm=print_format=json",
-		"-f",
-		"null",
-		"-",
-	)
+func firstPass(ctx context.Context, path string, options TranscodeOptions) (*LoudnormStats, error) {
+	command := exec.Command("ffmpeg", firstPassArgs(path, options)...)
 
 	command.SysProcAttr = &unix.SysProcAttr{
 		Pdeathsig: syscall.SIGINT,
@@ -81,19 +423,15 @@ func firstPass(path string) (*LoudnormStats, error) {
 
 	log.WithFields(fields).Debugf("Running first pass")
 
-	output, err := command.CombinedOutput()
+	output, err := runCommand(ctx, command, options)
 	if err != nil {
-		log.Errorf("%s", output)
-		return nil, fmt.Errorf("failed to run 'ffmpeg': %s", err)
+		logOutput(output, options)
+		return nil, errors.Wrap(err, "failed to run 'ffmpeg'")
 	}
 
-	split := bytes.Split(output, []byte("\n"))
-	stats := split[len(split)-13:]
-
-	var lns *LoudnormStats
-	err = json.Unmarshal(bytes.Join(stats, []byte("\n")), &lns)
+	lns, err := parseLoudnormStats(output)
 	if err != nil {
-		return nil, fmt.Errorf("failed to unmarshal loudnorm stats: %w", err)
+		return nil, errors.Wrap(err, "failed to parse loudnorm stats")
 	}
 
 	fields = log.Fields{
@@ -106,10 +444,145 @@ func firstPass(path string) (*LoudnormStats, error) {
 	return lns, nil
 }
 
-// secondPass - Run the second pass transcoding the input file using the loudnorm stats from the first pass.
-func secondPass(path string, lns *LoudnormStats) error {
-	command := exec.Command(
-		"ffmpeg",
+// firstPassArgs - Returns the arguments for the first pass ffmpeg command.
+func firstPassArgs(path string, options TranscodeOptions) []string {
+	args := []string{
+		"-i",
+		path,
+		"-hide_banner",
+		"-vn",
+		"-af",
+		options.LoudnormTarget.filter("print_format=json"),
+	}
+
+	args = append(args, threadArgs(options)...)
+
+	return append(args, "-f", "null", "-")
+}
+
+// parseLoudnormStats - Parse the loudnorm stats from the output of the first pass. The amount of output (and what
+// follows the stats) varies between ffmpeg versions, so we locate the JSON object which follows the last loudnorm
+// marker.
+func parseLoudnormStats(output []byte) (*LoudnormStats, error) {
+	marker := bytes.LastIndex(output, []byte("[Parsed_loudnorm"))
+	if marker == -1 {
+		return nil, fmt.Errorf("loudnorm stats not found in output")
+	}
+
+	start := bytes.IndexByte(output[marker:], '{')
+	if start == -1 {
+		return nil, fmt.Errorf("loudnorm stats not found in output")
+	}
+
+	start += marker
+
+	end := bytes.IndexByte(output[start:], '}')
+	if end == -1 {
+		return nil, fmt.Errorf("loudnorm stats are incomplete")
+	}
+
+	var lns *LoudnormStats
+
+	err := json.Unmarshal(output[start:start+end+1], &lns)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal loudnorm stats")
+	}
+
+	return lns, nil
+}
+
+// statsPass - Run the first pass of a two-pass video encode, this discards the encoded video and only writes the stats
+// (to the pass log provided in the options) which the final pass uses to distribute the target bit rate.
+func statsPass(ctx context.Context, path string, options TranscodeOptions) error {
+	command := exec.Command("ffmpeg", statsPassArgs(path, options)...)
+
+	command.SysProcAttr = &unix.SysProcAttr{
+		Pdeathsig: syscall.SIGINT,
+		Setpgid:   true,
+	}
+
+	fields := log.Fields{
+		"path":    path,
+		"command": command.String(),
+	}
+
+	log.WithFields(fields).Debugf("Running stats pass")
+
+	output, err := runCommand(ctx, command, options)
+	if err != nil {
+		logOutput(output, options)
+		return errors.Wrap(err, "failed to run 'ffmpeg'")
+	}
+
+	return nil
+}
+
+// statsPassArgs - Returns the arguments for the stats pass ffmpeg command, the video must be encoded using the same
+// options as the final pass (including scaling) for the stats to be valid.
+func statsPassArgs(path string, options TranscodeOptions) []string {
+	args := append(inputTimestampArgs(options), []string{
+		"-i",
+		path,
+		"-an",
+		"-sn",
+	}...)
+
+	args = append(args, pixelFormatArgs(options)...)
+	args = append(args, videoArgs(options)...)
+	args = append(args, videoFilterArgs(options)...)
+	args = append(args, passArgs(options, 1)...)
+	args = append(args, threadArgs(options)...)
+
+	return append(args, "-f", "null", "-")
+}
+
+// passArgs - Returns the arguments which select the given pass of a two-pass encode, libx265 doesn't support ffmpeg's
+// generic pass options so they're provided using its own parameters.
+func passArgs(options TranscodeOptions, pass int) []string {
+	if options.VideoCodec == VideoCodecH265 {
+		return []string{"-x265-params", fmt.Sprintf("pass=%d:stats=%s.log", pass, options.passLog)}
+	}
+
+	return []string{"-pass", strconv.Itoa(pass), "-passlogfile", options.passLog}
+}
+
+// secondPass - Run the second pass transcoding the input file using the loudnorm stats from the first pass, the audio
+// won't be normalised if no stats are provided.
+func secondPass(ctx context.Context, path, target string, lns *LoudnormStats, options TranscodeOptions) error {
+	command := exec.Command("ffmpeg", secondPassArgs(path, target, lns, options)...)
+
+	command.SysProcAttr = &unix.SysProcAttr{
+		Pdeathsig: syscall.SIGINT,
+		Setpgid:   true,
+	}
+
+	fields := log.Fields{
+		"path":    path,
+		"command": command.String(),
+	}
+
+	log.WithFields(fields).Debugf("Running second pass")
+
+	output, err := runCommand(ctx, command, options)
+	if err != nil {
+		logOutput(output, options)
+		return errors.Wrap(err, "failed to run 'ffmpeg'")
+	}
+
+	return nil
+}
+
+// logOutput - Log the output of a failed command, unless it has already been written to the log provided in the
+// options.
+func logOutput(output []byte, options TranscodeOptions) {
+	if options.Log == nil {
+		log.Errorf("%s", output)
+	}
+}
+
+// secondPassArgs - Returns the arguments for the second pass ffmpeg command.
+func secondPassArgs(path, target string, lns *LoudnormStats, options TranscodeOptions) []string {
+	args := append(inputTimestampArgs(options), []string{
 		"-i",
 		path,
 		"-map_chapters", "-1",
@@ -117,22 +590,58 @@ func secondPass(path string, lns *LoudnormStats) error {
 		"-metadata:s:a", "language=eng",
 		"-metadata:s:v", "language=eng",
 		"-sn",
-		"-profile:v", "high",
-		"-level:v", "4.0",
-		"-pix_fmt", "yuv420p",
-		"-acodec", "aac",
-		"-vcodec", "h264",
-		"-af",
-		fmt.Sprintf(
-			"loudnorm=linear=true:measured_i=%s:measured_tp=%s:measured_lra=%s:measured_thresh=%s:offset=%s",
+	}...)
+
+	args = append(args, pixelFormatArgs(options)...)
+	args = append(args, audioArgs(options)...)
+	args = append(args, videoArgs(options)...)
+	args = append(args, videoFilterArgs(options)...)
+
+	if lns != nil && options.AudioCodec != AudioCodecCopy {
+		args = append(args, "-af", options.LoudnormTarget.filter(fmt.Sprintf(
+			"linear=true:measured_i=%s:measured_tp=%s:measured_lra=%s:measured_thresh=%s:offset=%s",
 			lns.MeasuredI,
 			lns.MeasuredTP,
 			lns.MeasuredLRA,
 			lns.MeasuredThreshold,
 			lns.TargetOffset,
-		),
-		ReplaceExtension(path, value.TranscodingExtension),
-	)
+		)))
+	}
+
+	if options.passLog != "" {
+		args = append(args, passArgs(options, 2)...)
+	}
+
+	args = append(args, outputTimestampArgs(options)...)
+	args = append(args, threadArgs(options)...)
+
+	return append(args, target)
+}
+
+// inputTimestampArgs - Returns the input arguments which regenerate missing presentation timestamps when
+// '--fix-timestamps' is enabled, these must precede the input file.
+func inputTimestampArgs(options TranscodeOptions) []string {
+	if !options.FixTimestamps {
+		return nil
+	}
+
+	return []string{"-fflags", "+genpts"}
+}
+
+// outputTimestampArgs - Returns the output arguments which shift the timestamps so that the output starts at zero when
+// '--fix-timestamps' is enabled; negative timestamps cause some players to stutter or desync the audio.
+func outputTimestampArgs(options TranscodeOptions) []string {
+	if !options.FixTimestamps {
+		return nil
+	}
+
+	return []string{"-avoid_negative_ts", "make_zero"}
+}
+
+// remux - Copy the streams of the file at the provided path into an mp4 container at the given target path, the video
+// codec (as reported by ffprobe) is used to tag the video stream.
+func remux(ctx context.Context, path, target, video string, options TranscodeOptions) error {
+	command := exec.Command("ffmpeg", remuxArgs(path, target, video, options)...)
 
 	command.SysProcAttr = &unix.SysProcAttr{
 		Pdeathsig: syscall.SIGINT,
@@ -144,13 +653,338 @@ func secondPass(path string, lns *LoudnormStats) error {
 		"command": command.String(),
 	}
 
-	log.WithFields(fields).Debugf("Running second pass")
+	log.WithFields(fields).Debugf("Running remux")
 
-	output, err := command.CombinedOutput()
+	output, err := runCommand(ctx, command, options)
 	if err != nil {
-		log.Errorf("%s", output)
-		return fmt.Errorf("failed to run 'ffmpeg': %s", err)
+		logOutput(output, options)
+		return errors.Wrap(err, "failed to run 'ffmpeg'")
 	}
 
 	return nil
 }
+
+// remuxArgs - Returns the arguments for the ffmpeg command which copies the streams into an mp4 container, note that
+// no codec/filter arguments are used since the streams aren't re-encoded.
+func remuxArgs(path, target, video string, options TranscodeOptions) []string {
+	args := append(inputTimestampArgs(options), []string{
+		"-i",
+		path,
+		"-map_chapters", "-1",
+		"-map_metadata", "-1",
+		"-metadata:s:a", "language=eng",
+		"-metadata:s:v", "language=eng",
+		"-sn",
+		"-c", "copy",
+	}...)
+
+	// Apple devices will only play h265 in an mp4 container when it's tagged as 'hvc1'
+	if video == VideoCodecH265 {
+		args = append(args, "-tag:v", "hvc1")
+	}
+
+	args = append(args, outputTimestampArgs(options)...)
+	args = append(args, threadArgs(options)...)
+
+	return append(args, target)
+}
+
+// videoArgs - Returns the arguments which control how the video stream is encoded.
+func videoArgs(options TranscodeOptions) []string {
+	codec := options.VideoCodec
+	if codec == "" {
+		codec = VideoCodecH264
+	}
+
+	args := []string{"-vcodec", codec}
+
+	// Apple devices will only play h265 in an mp4 container when it's tagged as 'hvc1'
+	if codec == VideoCodecH265 {
+		args = append(args, "-tag:v", "hvc1")
+	}
+
+	switch {
+	case options.TargetBitRate != 0:
+		args = append(args, "-b:v", strconv.Itoa(options.TargetBitRate)+"k")
+	case options.CRF != 0:
+		args = append(args, "-crf", strconv.Itoa(options.CRF))
+	}
+
+	if options.EncoderPreset != "" {
+		args = append(args, "-preset", options.EncoderPreset)
+	}
+
+	if options.Profile != "" {
+		profile := options.Profile
+		if tenBit(options) && profiles10Bit[profile] != "" {
+			profile = profiles10Bit[profile]
+		}
+
+		args = append(args, "-profile:v", profile)
+	}
+
+	if options.Level != "" {
+		args = append(args, "-level:v", options.Level)
+	}
+
+	return args
+}
+
+// pixelFormatArgs - Returns the arguments which select the pixel format of the encoded video, then tag it with the
+// provided color properties (if any).
+func pixelFormatArgs(options TranscodeOptions) []string {
+	format := options.PixelFormat
+	if format == "" {
+		format = PixelFormat8Bit
+	}
+
+	args := []string{"-pix_fmt", format}
+
+	if options.Color == nil {
+		return args
+	}
+
+	for _, property := range []struct{ name, value string }{
+		{name: "-color_primaries", value: options.Color.Primaries},
+		{name: "-color_trc", value: options.Color.Transfer},
+		{name: "-colorspace", value: options.Color.Space},
+	} {
+		if property.value != "" {
+			args = append(args, property.name, property.value)
+		}
+	}
+
+	return args
+}
+
+// tenBit - Returns a boolean indicating whether the provided options encode 10-bit video.
+func tenBit(options TranscodeOptions) bool {
+	return options.PixelFormat == PixelFormat10Bit
+}
+
+// threadArgs - Returns the arguments which limit the number of threads used by ffmpeg, if a limit was provided.
+func threadArgs(options TranscodeOptions) []string {
+	if options.Threads == 0 {
+		return nil
+	}
+
+	return []string{"-threads", strconv.Itoa(options.Threads)}
+}
+
+// videoFilterArgs - Returns the arguments which apply the video filters (scaling then tone mapping) required by the
+// provided options, if any.
+func videoFilterArgs(options TranscodeOptions) []string {
+	filters := make([]string, 0, 2)
+
+	if options.MaxWidth != 0 || options.MaxHeight != 0 {
+		filters = append(filters, scaleFilter(options.MaxWidth, options.MaxHeight))
+	}
+
+	if options.Tonemap {
+		filters = append(filters, tonemapFilter)
+	}
+
+	if len(filters) == 0 {
+		return nil
+	}
+
+	return []string{"-vf", strings.Join(filters, ",")}
+}
+
+// tonemapFilter - The filter chain which tone maps HDR video to SDR; the video is converted to linear light (in
+// floating point RGB) so it can be tone mapped using the 'hable' curve, then converted to BT.709.
+const tonemapFilter = "zscale=t=linear:npl=100,format=gbrpf32le,zscale=p=bt709,tonemap=tonemap=hable:desat=0," +
+	"zscale=t=bt709:m=bt709:r=tv"
+
+// scaleFilter - Returns a video filter which will downscale the video to fit within the provided dimensions (where zero
+// means unlimited) without ever upscaling; the dimensions are kept even since this is required by 'yuv420p'.
+func scaleFilter(maxWidth, maxHeight int) string {
+	width, height := "iw", "ih"
+
+	if maxWidth != 0 {
+		width = fmt.Sprintf("min(iw,%d)", maxWidth)
+	}
+
+	if maxHeight != 0 {
+		height = fmt.Sprintf("min(ih,%d)", maxHeight)
+	}
+
+	return fmt.Sprintf("scale='%s':'%s':force_original_aspect_ratio=decrease:force_divisible_by=2", width, height)
+}
+
+// checkRemux - Returns the codec of the video stream in the provided file and a boolean indicating whether its streams
+// may be copied into an mp4 container; a warning is logged when they can't, since the file will be transcoded instead.
+func checkRemux(ctx context.Context, path string, options TranscodeOptions) (string, bool) {
+	fields := log.Fields{"path": path}
+
+	videos, err := probeCodecs(ctx, path, "V", options)
+	if err != nil {
+		log.WithError(err).WithFields(fields).Warn("Failed to determine video codecs, transcoding instead of remuxing")
+		return "", false
+	}
+
+	audios, err := probeCodecs(ctx, path, "a", options)
+	if err != nil {
+		log.WithError(err).WithFields(fields).Warn("Failed to determine audio codecs, transcoding instead of remuxing")
+		return "", false
+	}
+
+	if len(videos) == 0 {
+		log.WithFields(fields).Warn("No video streams found, transcoding instead of remuxing")
+		return "", false
+	}
+
+	for _, codec := range videos {
+		if !ContainsString(mp4VideoCodecs, codec) {
+			log.WithFields(fields).WithField("codec", codec).
+				Warn("Video codec is not supported by the mp4 container, transcoding instead of remuxing")
+
+			return "", false
+		}
+	}
+
+	for _, codec := range audios {
+		if !ContainsString(mp4AudioCodecs, codec) {
+			log.WithFields(fields).WithField("codec", codec).
+				Warn("Audio codec is not supported by the mp4 container, transcoding instead of remuxing")
+
+			return "", false
+		}
+	}
+
+	return videos[0], true
+}
+
+// checkAudioCopy - Warn if the audio streams in the provided file can't be copied into an mp4 container, in which case
+// the second pass is likely to fail.
+func checkAudioCopy(ctx context.Context, path string, options TranscodeOptions) {
+	codecs, err := probeCodecs(ctx, path, "a", options)
+	if err != nil {
+		log.WithError(err).WithField("path", path).Warn("Failed to determine audio codecs, unable to validate audio copy")
+		return
+	}
+
+	for _, codec := range codecs {
+		if !ContainsString(mp4AudioCodecs, codec) {
+			log.WithFields(log.Fields{"path": path, "codec": codec}).
+				Warn("Audio codec is not supported by the mp4 container, copying the audio is likely to fail")
+		}
+	}
+}
+
+// probeCodecs - Use ffprobe to determine the codecs of the streams in the provided file which match the given stream
+// specifier (e.g. 'a' for audio, or 'V' for video excluding attached pictures such as cover art).
+func probeCodecs(ctx context.Context, path, streams string, options TranscodeOptions) ([]string, error) {
+	command := exec.Command(
+		"ffprobe",
+		"-v", "error",
+		"-select_streams", streams,
+		"-show_entries", "stream=codec_name",
+		"-of", "csv=p=0",
+		path,
+	)
+
+	command.SysProcAttr = &unix.SysProcAttr{
+		Pdeathsig: syscall.SIGINT,
+		Setpgid:   true,
+	}
+
+	output, err := runCommand(ctx, command, options)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to run 'ffprobe'")
+	}
+
+	return strings.Fields(string(output)), nil
+}
+
+// VerifyDecode - Use ffmpeg to fully decode the file at the provided path (discarding the output), returning an error
+// if ffmpeg reports any errors; this detects corrupt files which would otherwise only be noticed during playback. Note
+// that decoding a file takes a similar amount of time to the first pass.
+func VerifyDecode(ctx context.Context, path string, options TranscodeOptions) error {
+	command := exec.Command("ffmpeg", verifyDecodeArgs(path, options)...)
+
+	command.SysProcAttr = &unix.SysProcAttr{
+		Pdeathsig: syscall.SIGINT,
+		Setpgid:   true,
+	}
+
+	fields := log.Fields{
+		"path":    path,
+		"command": command.String(),
+	}
+
+	log.WithFields(fields).Debugf("Verifying file decodes")
+
+	output, err := runCommand(ctx, command, options)
+	if err != nil {
+		logOutput(output, options)
+		return errors.Wrap(err, "failed to run 'ffmpeg'")
+	}
+
+	// Only errors are logged, and ffmpeg exits successfully despite most decode errors
+	output = bytes.TrimSpace(output)
+	if len(output) == 0 {
+		return nil
+	}
+
+	logOutput(output, options)
+
+	return fmt.Errorf("ffmpeg reported decode errors: %s", bytes.SplitN(output, []byte("\n"), 2)[0])
+}
+
+// verifyDecodeArgs - Returns the arguments for the ffmpeg command which decodes every stream, discarding the output.
+func verifyDecodeArgs(path string, options TranscodeOptions) []string {
+	args := []string{"-v", "error", "-i", path, "-map", "0", "-f", "null"}
+	args = append(args, threadArgs(options)...)
+
+	return append(args, "-")
+}
+
+// runCommand - Run the provided ffmpeg command returning its combined output, the priority of the process (and
+// therefore all its threads) will be adjusted once it has started. The process group is killed if the provided context
+// is cancelled. Any error returned will be an '*ErrFFmpeg'.
+func runCommand(ctx context.Context, command *exec.Cmd, options TranscodeOptions) ([]byte, error) {
+	var output bytes.Buffer
+
+	// Note that the same writer is used for stdout/stderr, so 'exec' will never write to it concurrently
+	var writer io.Writer = &output
+
+	if options.Log != nil {
+		fmt.Fprintf(options.Log, "$ %s\n", command)
+		writer = io.MultiWriter(&output, options.Log)
+	}
+
+	command.Stdout = writer
+	command.Stderr = writer
+
+	err := command.Start()
+	if err != nil {
+		return nil, newErrFFmpeg(command, nil, err)
+	}
+
+	if options.Nice != 0 {
+		// ffmpeg is started in its own process group, setting the priority of the group covers every thread
+		err = unix.Setpriority(unix.PRIO_PGRP, command.Process.Pid, options.Nice)
+		if err != nil {
+			log.WithError(err).WithField("nice", options.Nice).Warn("Failed to set ffmpeg priority")
+		}
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = unix.Kill(-command.Process.Pid, unix.SIGKILL)
+		case <-done:
+		}
+	}()
+
+	err = command.Wait()
+	if err != nil {
+		return output.Bytes(), newErrFFmpeg(command, output.Bytes(), err)
+	}
+
+	return output.Bytes(), nil
+}
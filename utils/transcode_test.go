@@ -0,0 +1,861 @@
+// Copyright 2020 James Lee <jamesl33info@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+func TestRunCommandNice(t *testing.T) {
+	command := exec.Command("sh", "-c", "sleep 0.2; nice")
+	command.SysProcAttr = &unix.SysProcAttr{Setpgid: true}
+
+	output, err := runCommand(context.Background(), command, TranscodeOptions{Nice: 5})
+	if err != nil {
+		t.Fatalf("Expected to be able to run command: %v", err)
+	}
+
+	if strings.TrimSpace(string(output)) != "5" {
+		t.Fatalf("Expected a niceness of 5 but got '%s'", output)
+	}
+}
+
+func TestRunCommandLog(t *testing.T) {
+	command := exec.Command("sh", "-c", "echo stdout; echo stderr >&2")
+	command.SysProcAttr = &unix.SysProcAttr{Setpgid: true}
+
+	var log strings.Builder
+
+	output, err := runCommand(context.Background(), command, TranscodeOptions{Log: &log})
+	if err != nil {
+		t.Fatalf("Expected to be able to run command: %v", err)
+	}
+
+	if !strings.HasPrefix(log.String(), "$ ") || !strings.HasSuffix(log.String(), string(output)) {
+		t.Fatalf("Expected the command and its output to be logged but got '%s'", log.String())
+	}
+
+	if string(output) != "stdout\nstderr\n" {
+		t.Fatalf("Unexpected output '%s'", output)
+	}
+}
+
+func TestRunCommandErrFFmpeg(t *testing.T) {
+	type test struct {
+		name     string
+		command  []string
+		exitCode int
+		signal   unix.Signal
+		notFound bool
+		output   string
+	}
+
+	tests := []*test{
+		{
+			name:     "NotFound",
+			command:  []string{"goamt-missing-ffmpeg"},
+			exitCode: -1,
+			notFound: true,
+		},
+		{
+			name:     "ExitCode",
+			command:  []string{"sh", "-c", "echo failed; exit 3"},
+			exitCode: 3,
+			output:   "failed\n",
+		},
+		{
+			name:     "Signal",
+			command:  []string{"sh", "-c", "kill -9 $$"},
+			exitCode: -1,
+			signal:   unix.SIGKILL,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			command := exec.Command(test.command[0], test.command[1:]...)
+			command.SysProcAttr = &unix.SysProcAttr{Setpgid: true}
+
+			_, err := runCommand(context.Background(), command, TranscodeOptions{})
+
+			var ffmpegErr *ErrFFmpeg
+			if !errors.As(err, &ffmpegErr) {
+				t.Fatalf("Expected an 'ErrFFmpeg' but got '%v'", err)
+			}
+
+			if ffmpegErr.ExitCode != test.exitCode {
+				t.Fatalf("Expected exit code %d but got %d", test.exitCode, ffmpegErr.ExitCode)
+			}
+
+			if ffmpegErr.Signal != test.signal || ffmpegErr.Signaled() != (test.signal != 0) {
+				t.Fatalf("Expected signal '%v' but got '%v'", test.signal, ffmpegErr.Signal)
+			}
+
+			if ffmpegErr.NotFound() != test.notFound {
+				t.Fatalf("Expected not found to be %t", test.notFound)
+			}
+
+			if string(ffmpegErr.Output) != test.output {
+				t.Fatalf("Expected output '%s' but got '%s'", test.output, ffmpegErr.Output)
+			}
+
+			if ffmpegErr.Command != command.String() {
+				t.Fatalf("Expected command '%s' but got '%s'", command.String(), ffmpegErr.Command)
+			}
+		})
+	}
+}
+
+func TestParseLoudnormStats(t *testing.T) {
+	type test struct {
+		name   string
+		output string
+	}
+
+	tests := []*test{
+		{
+			name: "FFmpeg4",
+			output: `Input #0, matroska,webm, from 'test.mkv':
+  Duration: 00:00:10.01, start: 0.000000, bitrate: 1234 kb/s
+    Stream #0:0: Video: h264 (High), yuv420p(progressive), 1920x1080, 23.98 fps
+    Stream #0:1: Audio: ac3, 48000 Hz, 5.1(side), fltp, 384 kb/s
+Stream mapping:
+  Stream #0:1 -> #0:0 (ac3 (native) -> pcm_s16le (native))
+Output #0, null, to 'pipe:':
+size=N/A time=00:00:10.00 bitrate=N/A speed= 120x
+video:0kB audio:1875kB subtitle:0kB other streams:0kB global headers:0kB muxing overhead: unknown
+[Parsed_loudnorm_0 @ 0x55d0c8a0a2c0]
+{
+	"input_i" : "-23.54",
+	"input_tp" : "-4.71",
+	"input_lra" : "8.20",
+	"input_thresh" : "-34.10",
+	"output_i" : "-24.04",
+	"output_tp" : "-5.73",
+	"output_lra" : "7.30",
+	"output_thresh" : "-34.56",
+	"normalization_type" : "dynamic",
+	"target_offset" : "0.04"
+}
+`,
+		},
+		{
+			name: "FFmpeg6TrailingOutput",
+			output: `[aist#0:1/ac3 @ 0x5581a4d7c940] Guessed Channel Layout: 5.1(side)
+Input #0, matroska,webm, from 'test.mkv':
+  Duration: 00:00:10.01, start: 0.000000, bitrate: 1234 kb/s
+Stream mapping:
+  Stream #0:1 -> #0:0 (ac3 (native) -> pcm_s16le (native))
+Output #0, null, to 'pipe:':
+[Parsed_loudnorm_0 @ 0x7f3b4c001a00] 
+{
+	"input_i" : "-23.54",
+	"input_tp" : "-4.71",
+	"input_lra" : "8.20",
+	"input_thresh" : "-34.10",
+	"output_i" : "-24.04",
+	"output_tp" : "-5.73",
+	"output_lra" : "7.30",
+	"output_thresh" : "-34.56",
+	"normalization_type" : "dynamic",
+	"target_offset" : "0.04"
+}
+[out#0/null @ 0x5581a4d7b2c0] video:0KiB audio:1875KiB global headers:0KiB muxing overhead: unknown
+size=N/A time=00:00:10.00 bitrate=N/A speed= 150x
+`,
+		},
+	}
+
+	expected := &LoudnormStats{
+		MeasuredI:         "-23.54",
+		MeasuredTP:        "-4.71",
+		MeasuredLRA:       "8.20",
+		MeasuredThreshold: "-34.10",
+		TargetOffset:      "0.04",
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			actual, err := parseLoudnormStats([]byte(test.output))
+			if err != nil {
+				t.Fatalf("Expected to be able to parse loudnorm stats: %v", err)
+			}
+
+			if !reflect.DeepEqual(actual, expected) {
+				t.Fatalf("Expected %+v but got %+v", expected, actual)
+			}
+		})
+	}
+}
+
+func TestParseLoudnormStatsNotFound(t *testing.T) {
+	outputs := []string{
+		"",
+		"Output #0, null, to 'pipe:':\n",
+		"[Parsed_loudnorm_0 @ 0x0]\n{\n\t\"input_i\" : \"-23.54\",\n",
+	}
+
+	for _, output := range outputs {
+		_, err := parseLoudnormStats([]byte(output))
+		if err == nil {
+			t.Fatalf("Expected an error when parsing '%s'", output)
+		}
+	}
+}
+
+func TestSecondPassArgs(t *testing.T) {
+	lns := &LoudnormStats{
+		MeasuredI:         "-23.54",
+		MeasuredTP:        "-4.71",
+		MeasuredLRA:       "8.20",
+		MeasuredThreshold: "-34.10",
+		TargetOffset:      "0.04",
+	}
+
+	args := strings.Join(secondPassArgs("test.mkv", "test.transcoding.mp4", lns, TranscodeOptions{}), " ")
+	if !strings.Contains(args, "-af loudnorm=linear=true:measured_i=-23.54") {
+		t.Fatalf("Expected the loudnorm filter to be used, got '%s'", args)
+	}
+
+	args = strings.Join(secondPassArgs("test.mkv", "test.transcoding.mp4", nil, TranscodeOptions{}), " ")
+	if strings.Contains(args, "loudnorm") {
+		t.Fatalf("Expected the loudnorm filter not to be used, got '%s'", args)
+	}
+
+	if !strings.HasSuffix(args, "test.transcoding.mp4") {
+		t.Fatalf("Expected the target to be the last argument, got '%s'", args)
+	}
+}
+
+func TestLoudnormTargetArgs(t *testing.T) {
+	var (
+		i, tp   = -16.0, -1.5
+		options = TranscodeOptions{LoudnormTarget: LoudnormTarget{I: &i, TP: &tp}}
+		lns     = &LoudnormStats{MeasuredI: "-23.54"}
+	)
+
+	args := strings.Join(firstPassArgs("test.mkv", options), " ")
+	if !strings.Contains(args, "-af loudnorm=print_format=json:i=-16:tp=-1.5 ") {
+		t.Fatalf("Expected the targets to be used in the first pass, got '%s'", args)
+	}
+
+	args = strings.Join(secondPassArgs("test.mkv", "test.transcoding.mp4", lns, options), " ")
+	if !strings.Contains(args, ":offset=:i=-16:tp=-1.5 ") {
+		t.Fatalf("Expected the targets to be used in the second pass, got '%s'", args)
+	}
+
+	args = strings.Join(firstPassArgs("test.mkv", TranscodeOptions{}), " ")
+	if !strings.Contains(args, "-af loudnorm=print_format=json ") {
+		t.Fatalf("Expected the ffmpeg default targets to be used, got '%s'", args)
+	}
+}
+
+func TestLoudnormTargetValidate(t *testing.T) {
+	value := func(v float64) *float64 { return &v }
+
+	type test struct {
+		name   string
+		target LoudnormTarget
+		valid  bool
+	}
+
+	tests := []*test{
+		{name: "Defaults", valid: true},
+		{name: "Streaming", target: LoudnormTarget{I: value(-16), LRA: value(11), TP: value(-1)}, valid: true},
+		{name: "Bounds", target: LoudnormTarget{I: value(-70), LRA: value(50), TP: value(0)}, valid: true},
+		{name: "IntegratedTooLoud", target: LoudnormTarget{I: value(-4)}},
+		{name: "RangeTooSmall", target: LoudnormTarget{LRA: value(0.5)}},
+		{name: "TruePeakTooHigh", target: LoudnormTarget{TP: value(1)}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.target.Validate()
+			if test.valid && err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+
+			if !test.valid && err == nil {
+				t.Fatalf("Expected an error for an out of range target")
+			}
+		})
+	}
+}
+
+func TestSecondPassArgsAudioCopy(t *testing.T) {
+	lns := &LoudnormStats{MeasuredI: "-23.54"}
+
+	args := strings.Join(secondPassArgs("test.mkv", "test.transcoding.mp4", lns,
+		TranscodeOptions{AudioCodec: AudioCodecCopy}), " ")
+
+	if !strings.Contains(args, "-acodec copy") {
+		t.Fatalf("Expected the audio to be copied, got '%s'", args)
+	}
+
+	if strings.Contains(args, "loudnorm") {
+		t.Fatalf("Expected the loudnorm filter not to be used when copying audio, got '%s'", args)
+	}
+}
+
+func TestSecondPassArgsAudioCodec(t *testing.T) {
+	type test struct {
+		name     string
+		options  TranscodeOptions
+		expected string
+	}
+
+	tests := []*test{
+		{
+			name:     "Default",
+			expected: "-acodec aac ",
+		},
+		{
+			name:     "BitRate",
+			options:  TranscodeOptions{AudioCodec: AudioCodecAAC, AudioBitRate: 192},
+			expected: "-acodec aac -b:a 192k ",
+		},
+		{
+			name:     "AC3",
+			options:  TranscodeOptions{AudioCodec: AudioCodecAC3, AudioBitRate: 640},
+			expected: "-acodec ac3 -b:a 640k ",
+		},
+		{
+			name:     "Opus",
+			options:  TranscodeOptions{AudioCodec: AudioCodecOpus, AudioBitRate: 128},
+			expected: "-acodec libopus -b:a 128k -mapping_family 1 -strict experimental ",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			args := strings.Join(secondPassArgs("test.mkv", "test.transcoding.mp4", nil, test.options), " ")
+			if !strings.Contains(args, test.expected) {
+				t.Fatalf("Expected '%s' in the arguments, got '%s'", test.expected, args)
+			}
+		})
+	}
+}
+
+func TestValidateAudio(t *testing.T) {
+	type test struct {
+		name    string
+		codec   string
+		bitRate int
+		valid   bool
+	}
+
+	tests := []*test{
+		{name: "AAC", codec: AudioCodecAAC, valid: true},
+		{name: "AACBitRate", codec: AudioCodecAAC, bitRate: 256, valid: true},
+		{name: "Opus", codec: AudioCodecOpus, bitRate: 96, valid: true},
+		{name: "Copy", codec: AudioCodecCopy, valid: true},
+		{name: "Unsupported", codec: "dts"},
+		{name: "NegativeBitRate", codec: AudioCodecAAC, bitRate: -1},
+		{name: "CopyBitRate", codec: AudioCodecCopy, bitRate: 128},
+		{name: "AC3BitRateTooHigh", codec: AudioCodecAC3, bitRate: 1024},
+		{name: "OpusBitRateTooLow", codec: AudioCodecOpus, bitRate: 4},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := ValidateAudio(test.codec, test.bitRate)
+			if test.valid && err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+
+			if !test.valid && err == nil {
+				t.Fatalf("Expected an error for an invalid codec/bit rate")
+			}
+		})
+	}
+}
+
+func TestSecondPassArgsScale(t *testing.T) {
+	type test struct {
+		name                string
+		maxWidth, maxHeight int
+		expected            string
+	}
+
+	tests := []*test{
+		{
+			name: "NoLimit",
+		},
+		{
+			name:      "Both",
+			maxWidth:  1920,
+			maxHeight: 1080,
+			expected:  "-vf scale='min(iw,1920)':'min(ih,1080)':force_original_aspect_ratio=decrease:force_divisible_by=2",
+		},
+		{
+			name:      "HeightOnly",
+			maxHeight: 720,
+			expected:  "-vf scale='iw':'min(ih,720)':force_original_aspect_ratio=decrease:force_divisible_by=2",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			args := strings.Join(secondPassArgs("test.mkv", "test.transcoding.mp4", nil,
+				TranscodeOptions{MaxWidth: test.maxWidth, MaxHeight: test.maxHeight}), " ")
+
+			if test.expected == "" && strings.Contains(args, "-vf") {
+				t.Fatalf("Expected no video filter, got '%s'", args)
+			}
+
+			if !strings.Contains(args, test.expected) {
+				t.Fatalf("Expected '%s' in '%s'", test.expected, args)
+			}
+		})
+	}
+}
+
+func TestSecondPassArgsVideo(t *testing.T) {
+	args := strings.Join(secondPassArgs("test.mkv", "test.transcoding.mp4", nil, TranscodeOptions{}), " ")
+	if !strings.Contains(args, "-vcodec h264") || strings.Contains(args, "-crf") || strings.Contains(args, "-profile") {
+		t.Fatalf("Expected h264 with the encoder defaults, got '%s'", args)
+	}
+
+	options := TranscodeOptions{VideoCodec: VideoCodecH265, CRF: 22, EncoderPreset: "slow", Profile: "main"}
+
+	args = strings.Join(secondPassArgs("test.mkv", "test.transcoding.mp4", nil, options), " ")
+	if !strings.Contains(args, "-vcodec hevc -tag:v hvc1 -crf 22 -preset slow -profile:v main") {
+		t.Fatalf("Expected the video options to be used, got '%s'", args)
+	}
+
+	if strings.Contains(args, "-level") {
+		t.Fatalf("Expected the encoder to choose the level, got '%s'", args)
+	}
+}
+
+func TestSecondPassArgsPixelFormat(t *testing.T) {
+	args := strings.Join(secondPassArgs("test.mkv", "test.transcoding.mp4", nil, TranscodeOptions{}), " ")
+	if !strings.Contains(args, "-pix_fmt yuv420p ") || strings.Contains(args, "-color_") {
+		t.Fatalf("Expected 8-bit video without color properties by default, got '%s'", args)
+	}
+
+	options := TranscodeOptions{
+		VideoCodec:  VideoCodecH265,
+		Profile:     "main",
+		PixelFormat: PixelFormat10Bit,
+		Color:       &ColorInfo{Primaries: "bt2020", Transfer: "smpte2084", Space: "bt2020nc"},
+	}
+
+	for _, args := range [][]string{
+		secondPassArgs("test.mkv", "test.transcoding.mp4", nil, options),
+		statsPassArgs("test.mkv", options),
+	} {
+		joined := strings.Join(args, " ")
+
+		expected := "-pix_fmt yuv420p10le -color_primaries bt2020 -color_trc smpte2084 -colorspace bt2020nc"
+		if !strings.Contains(joined, expected) {
+			t.Fatalf("Expected 10-bit video tagged with the color properties, got '%s'", joined)
+		}
+
+		// The 8-bit profile from the preset is replaced by its 10-bit equivalent
+		if !strings.Contains(joined, "-profile:v main10") {
+			t.Fatalf("Expected the 10-bit profile to be used, got '%s'", joined)
+		}
+	}
+}
+
+func TestSecondPassArgsTonemap(t *testing.T) {
+	args := strings.Join(secondPassArgs("test.mkv", "test.transcoding.mp4", nil, TranscodeOptions{}), " ")
+	if strings.Contains(args, "-vf") {
+		t.Fatalf("Expected no video filters by default, got '%s'", args)
+	}
+
+	options := TranscodeOptions{MaxWidth: 1920, Tonemap: true}
+
+	for _, args := range [][]string{
+		secondPassArgs("test.mkv", "test.transcoding.mp4", nil, options),
+		statsPassArgs("test.mkv", options),
+	} {
+		joined := strings.Join(args, " ")
+
+		// Tone mapping is applied after scaling, within the same filter graph
+		expected := "-vf " + scaleFilter(1920, 0) + "," + tonemapFilter + " "
+		if !strings.Contains(joined, expected) {
+			t.Fatalf("Expected the video to be scaled then tone mapped, got '%s'", joined)
+		}
+
+		if strings.Count(joined, "-vf") != 1 {
+			t.Fatalf("Expected a single video filter argument, got '%s'", joined)
+		}
+	}
+}
+
+func TestPassArgsThreads(t *testing.T) {
+	for _, args := range [][]string{
+		firstPassArgs("test.mkv", TranscodeOptions{}),
+		secondPassArgs("test.mkv", "test.transcoding.mp4", nil, TranscodeOptions{}),
+	} {
+		if joined := strings.Join(args, " "); strings.Contains(joined, "-threads") {
+			t.Fatalf("Expected ffmpeg to choose the number of threads, got '%s'", joined)
+		}
+	}
+
+	for _, args := range [][]string{
+		firstPassArgs("test.mkv", TranscodeOptions{Threads: 4}),
+		secondPassArgs("test.mkv", "test.transcoding.mp4", nil, TranscodeOptions{Threads: 4}),
+	} {
+		if joined := strings.Join(args, " "); !strings.Contains(joined, "-threads 4") {
+			t.Fatalf("Expected the number of threads to be limited, got '%s'", joined)
+		}
+	}
+
+	args := firstPassArgs("test.mkv", TranscodeOptions{Threads: 4})
+	if args[len(args)-1] != "-" {
+		t.Fatalf("Expected the output to be the last argument, got '%s'", strings.Join(args, " "))
+	}
+}
+
+func TestRunCommandCancelled(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	command := exec.Command("sh", "-c", "sleep 10 & wait")
+	command.SysProcAttr = &unix.SysProcAttr{Setpgid: true}
+
+	start := time.Now()
+
+	_, err := runCommand(ctx, command, TranscodeOptions{})
+
+	var ffmpegErr *ErrFFmpeg
+	if !errors.As(err, &ffmpegErr) || !ffmpegErr.Signaled() {
+		t.Fatalf("Expected the command to have been killed but got '%v'", err)
+	}
+
+	if time.Since(start) > 5*time.Second {
+		t.Fatalf("Expected the command to have been killed once the context was cancelled")
+	}
+}
+
+func TestRemuxArgs(t *testing.T) {
+	args := strings.Join(remuxArgs("test.mkv", "test.transcoding.mp4", VideoCodecH264, TranscodeOptions{Threads: 4}), " ")
+
+	if !strings.Contains(args, "-c copy") || !strings.HasSuffix(args, "-threads 4 test.transcoding.mp4") {
+		t.Fatalf("Expected the streams to be copied, got '%s'", args)
+	}
+
+	for _, unexpected := range []string{"-acodec", "-vcodec", "-af", "-vf", "-pix_fmt", "-tag:v"} {
+		if strings.Contains(args, unexpected) {
+			t.Fatalf("Expected no '%s' argument when remuxing, got '%s'", unexpected, args)
+		}
+	}
+
+	args = strings.Join(remuxArgs("test.mkv", "test.transcoding.mp4", VideoCodecH265, TranscodeOptions{}), " ")
+	if !strings.Contains(args, "-tag:v hvc1") {
+		t.Fatalf("Expected h265 to be tagged as 'hvc1', got '%s'", args)
+	}
+}
+
+func TestPassArgsFixTimestamps(t *testing.T) {
+	options := TranscodeOptions{FixTimestamps: true}
+
+	for name, args := range map[string][]string{
+		"SecondPass": secondPassArgs("test.mkv", "test.transcoding.mp4", nil, options),
+		"Remux":      remuxArgs("test.mkv", "test.transcoding.mp4", VideoCodecH264, options),
+	} {
+		t.Run(name, func(t *testing.T) {
+			joined := strings.Join(args, " ")
+
+			// The input flags must precede the input file to apply to it
+			if !strings.HasPrefix(joined, "-fflags +genpts -i test.mkv") {
+				t.Fatalf("Expected timestamps to be generated for the input, got '%s'", joined)
+			}
+
+			if !strings.HasSuffix(joined, "-avoid_negative_ts make_zero test.transcoding.mp4") {
+				t.Fatalf("Expected the output timestamps to start at zero, got '%s'", joined)
+			}
+		})
+	}
+
+	args := strings.Join(secondPassArgs("test.mkv", "test.transcoding.mp4", nil, TranscodeOptions{}), " ")
+	if strings.Contains(args, "-fflags") || strings.Contains(args, "-avoid_negative_ts") {
+		t.Fatalf("Expected timestamps to be left untouched by default, got '%s'", args)
+	}
+}
+
+func TestPassArgsTargetBitRate(t *testing.T) {
+	type test struct {
+		name, codec, stats, final string
+	}
+
+	tests := []*test{
+		{
+			name:  "H264",
+			codec: VideoCodecH264,
+			stats: "-i test.mkv -an -sn -pix_fmt yuv420p -vcodec h264 -b:v 2000k -pass 1 -passlogfile /tmp/pass -f null -",
+			final: "-b:v 2000k -pass 2 -passlogfile /tmp/pass test.transcoding.mp4",
+		},
+		{
+			name:  "H265",
+			codec: VideoCodecH265,
+			stats: "-vcodec hevc -tag:v hvc1 -b:v 2000k -x265-params pass=1:stats=/tmp/pass.log -f null -",
+			final: "-b:v 2000k -x265-params pass=2:stats=/tmp/pass.log test.transcoding.mp4",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// The target bit rate replaces the constant rate factor
+			options := TranscodeOptions{VideoCodec: test.codec, CRF: 23, TargetBitRate: 2000, passLog: "/tmp/pass"}
+
+			stats := strings.Join(statsPassArgs("test.mkv", options), " ")
+			if !strings.HasSuffix(stats, test.stats) {
+				t.Fatalf("Expected the stats pass to end with '%s', got '%s'", test.stats, stats)
+			}
+
+			final := strings.Join(secondPassArgs("test.mkv", "test.transcoding.mp4", nil, options), " ")
+			if !strings.HasSuffix(final, test.final) || strings.Contains(final, "-crf") {
+				t.Fatalf("Expected the final pass to end with '%s', got '%s'", test.final, final)
+			}
+		})
+	}
+}
+
+func TestTranscodeFileTargetBitRate(t *testing.T) {
+	tempDir := t.TempDir()
+
+	defer func(path string) { os.Setenv("PATH", path) }(os.Getenv("PATH"))
+
+	os.Setenv("PATH", tempDir+string(os.PathListSeparator)+"/bin:/usr/bin")
+
+	// Record the arguments of each pass, so that the pass log can be checked
+	script := fmt.Sprintf("#!/bin/sh\necho \"$*\" >> '%s'\n", filepath.Join(tempDir, "args"))
+
+	err := ioutil.WriteFile(filepath.Join(tempDir, "ffmpeg"), []byte(script), 0o755)
+	if err != nil {
+		t.Fatalf("Expected to be able to create fake executable: %v", err)
+	}
+
+	options := TranscodeOptions{DisableLoudnorm: true, TargetBitRate: 2000, Log: ioutil.Discard}
+
+	err = TranscodeFile(context.Background(), "test.mkv", "test.transcoding.mp4", options)
+	if err != nil {
+		t.Fatalf("Expected to be able to transcode file: %v", err)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(tempDir, "args"))
+	if err != nil {
+		t.Fatalf("Expected to be able to read arguments: %v", err)
+	}
+
+	passes := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(passes) != 2 || !strings.Contains(passes[0], "-pass 1") || !strings.Contains(passes[1], "-pass 2") {
+		t.Fatalf("Expected a stats pass followed by the final pass, got %q", passes)
+	}
+
+	fields := strings.Fields(passes[0])
+
+	var passLog string
+
+	for index, field := range fields {
+		if field == "-passlogfile" {
+			passLog = fields[index+1]
+		}
+	}
+
+	if passLog == "" || PathExists(filepath.Dir(passLog)) {
+		t.Fatalf("Expected the pass log directory '%s' to be removed once complete", filepath.Dir(passLog))
+	}
+}
+
+func TestTranscodeCommands(t *testing.T) {
+	defer func(path string) { os.Setenv("PATH", path) }(os.Getenv("PATH"))
+
+	// Commands are printed using the name of the executable when it's not installed
+	os.Setenv("PATH", t.TempDir())
+
+	type test struct {
+		name     string
+		options  TranscodeOptions
+		expected []string
+	}
+
+	tests := []*test{
+		{
+			name: "Default",
+			expected: []string{
+				"ffmpeg -i test.mkv -hide_banner -vn -af loudnorm=print_format=json -f null -",
+				"ffmpeg -i test.mkv -map_chapters -1 -map_metadata -1 -metadata:s:a language=eng " +
+					"-metadata:s:v language=eng -sn -pix_fmt yuv420p -acodec aac -vcodec h264 -af " +
+					"loudnorm=linear=true:measured_i=<input_i>:measured_tp=<input_tp>:measured_lra=<input_lra>:" +
+					"measured_thresh=<input_thresh>:offset=<target_offset> test.transcoding.mp4",
+			},
+		},
+		{
+			name:    "TargetBitRate",
+			options: TranscodeOptions{DisableLoudnorm: true, TargetBitRate: 2000},
+			expected: []string{
+				"ffmpeg -i test.mkv -an -sn -pix_fmt yuv420p -vcodec h264 -b:v 2000k -pass 1 -passlogfile <passlog> " +
+					"-f null -",
+				"ffmpeg -i test.mkv -map_chapters -1 -map_metadata -1 -metadata:s:a language=eng " +
+					"-metadata:s:v language=eng -sn -pix_fmt yuv420p -acodec aac -vcodec h264 -b:v 2000k -pass 2 " +
+					"-passlogfile <passlog> test.transcoding.mp4",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			commands := TranscodeCommands(context.Background(), "test.mkv", "test.transcoding.mp4", test.options)
+			if !reflect.DeepEqual(commands, test.expected) {
+				t.Fatalf("Expected commands %q but got %q", test.expected, commands)
+			}
+		})
+	}
+}
+
+func TestCheckRemux(t *testing.T) {
+	type test struct {
+		name, video, audio string
+		expected           bool
+	}
+
+	tests := []*test{
+		{name: "Compatible", video: "h264", audio: "aac\\nac3", expected: true},
+		{name: "IncompatibleVideo", video: "vc1", audio: "aac"},
+		{name: "IncompatibleAudio", video: "hevc", audio: "aac\\ndts"},
+		{name: "NoVideo", audio: "aac"},
+	}
+
+	defer func(path string) { os.Setenv("PATH", path) }(os.Getenv("PATH"))
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tempDir := t.TempDir()
+
+			os.Setenv("PATH", tempDir+string(os.PathListSeparator)+"/bin:/usr/bin")
+
+			script := fmt.Sprintf("#!/bin/sh\ncase \"$*\" in *\"-select_streams V\"*) printf '%s' ;; "+
+				"*) printf '%s' ;; esac\n", test.video, test.audio)
+
+			err := ioutil.WriteFile(filepath.Join(tempDir, "ffprobe"), []byte(script), 0o755)
+			if err != nil {
+				t.Fatalf("Expected to be able to create fake executable: %v", err)
+			}
+
+			video, ok := checkRemux(context.Background(), "test.mkv", TranscodeOptions{})
+			if ok != test.expected || (ok && video != test.video) {
+				t.Fatalf("Expected %t ('%s') but got %t ('%s')", test.expected, test.video, ok, video)
+			}
+		})
+	}
+}
+
+func TestVerifyDecode(t *testing.T) {
+	type test struct {
+		name, output string
+		code         int
+		valid        bool
+	}
+
+	tests := []*test{
+		{name: "Valid", valid: true},
+		{name: "DecodeErrors", output: "[h264 @ 0x0] error while decoding MB 10 20"},
+		{name: "Failed", code: 1},
+	}
+
+	defer func(path string) { os.Setenv("PATH", path) }(os.Getenv("PATH"))
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tempDir := t.TempDir()
+
+			os.Setenv("PATH", tempDir+string(os.PathListSeparator)+"/bin:/usr/bin")
+
+			script := fmt.Sprintf("#!/bin/sh\nprintf '%s' >&2\nexit %d\n", test.output, test.code)
+
+			err := ioutil.WriteFile(filepath.Join(tempDir, "ffmpeg"), []byte(script), 0o755)
+			if err != nil {
+				t.Fatalf("Expected to be able to create fake executable: %v", err)
+			}
+
+			err = VerifyDecode(context.Background(), "test.mp4", TranscodeOptions{Log: ioutil.Discard})
+			if test.valid && err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+
+			if !test.valid && err == nil {
+				t.Fatalf("Expected an error for a file which failed to decode")
+			}
+
+			if test.output != "" && !strings.Contains(err.Error(), test.output) {
+				t.Fatalf("Expected the error to contain the decode error, got %v", err)
+			}
+		})
+	}
+}
+
+func TestVerifyDecodeArgs(t *testing.T) {
+	args := strings.Join(verifyDecodeArgs("test.mp4", TranscodeOptions{Threads: 2}), " ")
+
+	expected := "-v error -i test.mp4 -map 0 -f null -threads 2 -"
+	if args != expected {
+		t.Fatalf("Expected '%s' but got '%s'", expected, args)
+	}
+}
+
+func TestRequiresAnalysisRemux(t *testing.T) {
+	if RequiresAnalysis(TranscodeOptions{Remux: true}) {
+		t.Fatalf("Expected remuxing not to require analysis")
+	}
+}
+
+func TestCheckTools(t *testing.T) {
+	tempDir := t.TempDir()
+
+	defer func(path string) { os.Setenv("PATH", path) }(os.Getenv("PATH"))
+
+	os.Setenv("PATH", tempDir)
+
+	var notFound *ErrToolNotFound
+
+	err := CheckTools()
+	if !errors.As(err, &notFound) || notFound.Tool != "ffmpeg" || !errors.Is(err, exec.ErrNotFound) {
+		t.Fatalf("Expected an 'ErrToolNotFound' for 'ffmpeg' but got '%#v'", err)
+	}
+
+	for _, tool := range RequiredTools {
+		err = ioutil.WriteFile(filepath.Join(tempDir, tool), []byte("#!/bin/sh\n"), 0o755)
+		if err != nil {
+			t.Fatalf("Expected to be able to create fake executable: %v", err)
+		}
+	}
+
+	err = CheckTools()
+	if err != nil {
+		t.Fatalf("Expected the required tools to be found: %v", err)
+	}
+
+	err = CheckTools("HandBrakeCLI")
+	if !errors.As(err, &notFound) || notFound.Tool != "HandBrakeCLI" {
+		t.Fatalf("Expected an 'ErrToolNotFound' for 'HandBrakeCLI' but got '%#v'", err)
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright 2020 James Lee <jamesl33info@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// BackendFFmpeg - The name of the default transcoder backend, which uses ffmpeg.
+const BackendFFmpeg = "ffmpeg"
+
+// Transcoder - A backend which transcodes media files, allowing alternatives to ffmpeg to be used. Note that ffmpeg and
+// ffprobe are still used to probe/analyse files regardless of the backend.
+type Transcoder interface {
+	// Transcode - Transcode the file at the provided path using the given options, the resulting file should be written
+	// to the target path (which will have the '.transcoding.mp4' extension). The transcode should be aborted if the
+	// context is cancelled.
+	Transcode(ctx context.Context, path, target string, options TranscodeOptions) error
+
+	// RequiredTools - The executables (other than those in 'RequiredTools') which must be installed to use the backend.
+	RequiredTools() []string
+}
+
+// TranscoderFunc - Adapter allowing an ordinary function to be used as a 'Transcoder' which requires no extra tools.
+type TranscoderFunc func(ctx context.Context, path, target string, options TranscodeOptions) error
+
+// Transcode - Calls the underlying function.
+func (f TranscoderFunc) Transcode(ctx context.Context, path, target string, options TranscodeOptions) error {
+	return f(ctx, path, target, options)
+}
+
+// RequiredTools - The function requires no extra tools.
+func (f TranscoderFunc) RequiredTools() []string {
+	return nil
+}
+
+// ffmpegTranscoder - The default backend, which transcodes files using ffmpeg (see 'TranscodeFile').
+type ffmpegTranscoder struct{}
+
+// Transcode - Transcode the file using ffmpeg.
+func (f ffmpegTranscoder) Transcode(ctx context.Context, path, target string, options TranscodeOptions) error {
+	return TranscodeFile(ctx, path, target, options)
+}
+
+// RequiredTools - ffmpeg is already one of the 'RequiredTools'.
+func (f ffmpegTranscoder) RequiredTools() []string {
+	return nil
+}
+
+// Transcoders - The available backends by name, new backends should be added here to make them selectable.
+var Transcoders = map[string]Transcoder{
+	BackendFFmpeg: ffmpegTranscoder{},
+}
+
+// TranscoderNames - Returns the sorted names of the available backends.
+func TranscoderNames() []string {
+	names := make([]string, 0, len(Transcoders))
+	for name := range Transcoders {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// NewTranscoder - Returns the backend with the provided name, or an error if there's no such backend.
+func NewTranscoder(name string) (Transcoder, error) {
+	transcoder, ok := Transcoders[name]
+	if !ok {
+		return nil, fmt.Errorf("backend '%s' is not supported, expected one of '%s'", name,
+			strings.Join(TranscoderNames(), "', '"))
+	}
+
+	return transcoder, nil
+}
@@ -0,0 +1,54 @@
+// Copyright 2020 James Lee <jamesl33info@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"context"
+	"testing"
+)
+
+func TestNewTranscoder(t *testing.T) {
+	transcoder, err := NewTranscoder(BackendFFmpeg)
+	if err != nil {
+		t.Fatalf("Expected to be able to get the ffmpeg backend: %v", err)
+	}
+
+	if len(transcoder.RequiredTools()) != 0 {
+		t.Fatalf("Expected the ffmpeg backend to only require the default tools")
+	}
+
+	_, err = NewTranscoder("handbrake")
+	if err == nil || err.Error() != "backend 'handbrake' is not supported, expected one of 'ffmpeg'" {
+		t.Fatalf("Expected an error for an unsupported backend, got %v", err)
+	}
+}
+
+func TestTranscoderFunc(t *testing.T) {
+	var called bool
+
+	transcoder := TranscoderFunc(func(_ context.Context, path, target string, _ TranscodeOptions) error {
+		called = path == "test.mkv" && target == "test.transcoding.mp4"
+		return nil
+	})
+
+	err := transcoder.Transcode(context.Background(), "test.mkv", "test.transcoding.mp4", TranscodeOptions{})
+	if err != nil {
+		t.Fatalf("Expected to be able to transcode: %v", err)
+	}
+
+	if !called {
+		t.Fatalf("Expected the function to be called with the provided paths")
+	}
+}
@@ -15,16 +15,87 @@
 package value
 
 import (
+	"fmt"
+	"strings"
+
+	"github.com/jamesl33/goamt/utils/sqlite"
+
 	"github.com/apex/log"
 )
 
+// EntryColumns - The columns of the library table which must be selected (in this order) for an entry to be scanned
+// using 'Entry.Scan'.
+var EntryColumns = strings.Join([]string{
+	"library.id",
+	"library.path",
+	"library.discovered",
+	"library.transcoded",
+	"library.hash",
+	"library.priority",
+	"library.source_codec",
+	"library.source_width",
+	"library.source_height",
+	"library.duration",
+	"library.failures",
+	"library.quarantined",
+}, ", ")
+
 // Entry - Represents an entry in the SQLite database, used when interacting with a '*database.Database'.
 type Entry struct {
-	ID         int
-	Path       string
-	Discovered int64
-	Transcoded *int64
-	Hash       uint32
+	ID         int    `json:"id"`
+	Path       string `json:"path"`
+	Discovered int64  `json:"discovered"`
+	Transcoded *int64 `json:"transcoded"`
+	Hash       uint32 `json:"hash"`
+	Priority   int    `json:"priority"`
+
+	// SourceCodec/SourceWidth/SourceHeight - Describe the video stream of the file before it was transcoded, these are
+	// nil when unknown (e.g. entries which were transcoded before they were recorded).
+	SourceCodec  *string `json:"source_codec,omitempty"`
+	SourceWidth  *int64  `json:"source_width,omitempty"`
+	SourceHeight *int64  `json:"source_height,omitempty"`
+
+	// Duration - The duration (in seconds) of the source file, nil when unknown.
+	Duration *float64 `json:"duration,omitempty"`
+
+	// Failures/Quarantined - The number of failed attempts to transcode the entry, and when it was quarantined (after
+	// which it's no longer selected for transcoding).
+	Failures    int    `json:"failures"`
+	Quarantined *int64 `json:"quarantined"`
+}
+
+// Scan - Populate the entry from a row which begins with the 'EntryColumns', any additional columns are scanned into
+// the provided destinations. Nullable columns are handled here so that it's done consistently; the hash of an unhashed
+// entry is zero, and other unknown values are nil.
+func (e *Entry) Scan(scan sqlite.ScanCallback, extra ...interface{}) error {
+	var hash *uint32
+
+	dest := []interface{}{
+		&e.ID,
+		&e.Path,
+		&e.Discovered,
+		&e.Transcoded,
+		&hash,
+		&e.Priority,
+		&e.SourceCodec,
+		&e.SourceWidth,
+		&e.SourceHeight,
+		&e.Duration,
+		&e.Failures,
+		&e.Quarantined,
+	}
+
+	err := scan(append(dest, extra...)...)
+	if err != nil {
+		return err
+	}
+
+	e.Hash = 0
+	if hash != nil {
+		e.Hash = *hash
+	}
+
+	return nil
 }
 
 // Fields - Implement the fielder interface for the apex log module, note that fields with a default value will be
@@ -52,5 +123,29 @@ func (e Entry) Fields() log.Fields {
 		fields["hash"] = e.Hash
 	}
 
+	if e.Priority != 0 {
+		fields["priority"] = e.Priority
+	}
+
+	if e.SourceCodec != nil {
+		fields["source_codec"] = *e.SourceCodec
+	}
+
+	if e.SourceWidth != nil && e.SourceHeight != nil {
+		fields["source_resolution"] = fmt.Sprintf("%dx%d", *e.SourceWidth, *e.SourceHeight)
+	}
+
+	if e.Duration != nil {
+		fields["duration"] = *e.Duration
+	}
+
+	if e.Failures != 0 {
+		fields["failures"] = e.Failures
+	}
+
+	if e.Quarantined != nil {
+		fields["quarantined"] = e.Quarantined
+	}
+
 	return fields
 }
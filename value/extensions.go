@@ -22,6 +22,10 @@ const (
 	// TranscodingExtension - The extension used for files which are being transcoded; this is a temporary extension
 	// which will be renamed to the target extension upon completion.
 	TranscodingExtension = ".transcoding" + TargetExtension
+
+	// OriginalExtension - The extension appended to source files which are kept after transcoding; this ensures they're
+	// not detected by the update sub-command and that they don't clash with the transcoded file.
+	OriginalExtension = ".original"
 )
 
 // SupportedExtensions - The list of extensions supported by goamt i.e. the files that will be detected by the update
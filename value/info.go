@@ -0,0 +1,36 @@
+// Copyright 2020 James Lee <jamesl33info@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package value
+
+// Info - A summary of a goamt SQLite database, used when inspecting a '*database.Database'.
+type Info struct {
+	// UserVersion/SchemaVersion - The goamt database version, and the SQLite schema version (which is incremented
+	// whenever the schema is modified).
+	UserVersion, SchemaVersion uint32
+
+	// Created - When the database was created, nil for databases created before this was recorded.
+	Created *int64
+
+	// HashAlgorithm/Root - The algorithm used to hash entries, and the library root which paths are stored relative to
+	// (empty when paths are stored as provided).
+	HashAlgorithm, Root string
+
+	// Entries - The total number of entries, followed by the number in each state; note that quarantined entries are
+	// untranscoded but aren't counted as such since they won't be selected for transcoding.
+	Entries, Transcoded, Untranscoded, Unhashed, Quarantined int64
+
+	// Jobs - The number of in-progress (or incomplete) transcode jobs.
+	Jobs int64
+}
@@ -0,0 +1,52 @@
+// Copyright 2020 James Lee <jamesl33info@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package value
+
+import (
+	"time"
+
+	"github.com/apex/log"
+)
+
+// Job - Represents a job to transcode an entry in the SQLite database, jobs exist whilst an entry is being transcoded
+// (or if goamt was killed before the job could be completed/recovered).
+type Job struct {
+	Entry   Entry
+	Started int64
+	Target  *string
+
+	// Temporary - The path the entry is being transcoded to when using a temporary directory, nil otherwise.
+	Temporary *string
+}
+
+// Fields - Implement the fielder interface for the apex log module, note that fields with a default value will be
+// omitted.
+func (j Job) Fields() log.Fields {
+	fields := j.Entry.Fields()
+
+	if j.Started != 0 {
+		fields["started"] = time.Unix(j.Started, 0).UTC().Format(time.RFC3339)
+	}
+
+	if j.Target != nil {
+		fields["target"] = *j.Target
+	}
+
+	if j.Temporary != nil {
+		fields["temporary"] = *j.Temporary
+	}
+
+	return fields
+}
@@ -0,0 +1,33 @@
+// Copyright 2020 James Lee <jamesl33info@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package value
+
+// Run - A summary of an update/transcode run, recorded in the SQLite database so that past runs may be audited.
+type Run struct {
+	// ID - The id of the run, assigned when it's recorded.
+	ID int
+
+	// Command - The sub-command which was run e.g. 'update' or 'transcode'.
+	Command string
+
+	// Start/End - When the run started/ended, as unix timestamps.
+	Start, End int64
+
+	// Processed/Failed/Cancelled - The number of entries handled by the worker pool in each state.
+	Processed, Failed, Cancelled int64
+
+	// Error - The error which caused the run to fail, empty if it succeeded.
+	Error string
+}
@@ -21,12 +21,60 @@ const (
 	// DatabaseVersionOne - Initial release version.
 	DatabaseVersionOne DatabaseVersion = iota + 1
 
+	// DatabaseVersionTwo - Added the 'target' column to the jobs table, allowing transcoded files to be written to a
+	// location other than alongside the source file.
+	DatabaseVersionTwo
+
+	// DatabaseVersionThree - Added the 'priority' column to the library table, allowing users to control the order in
+	// which entries are transcoded.
+	DatabaseVersionThree
+
+	// DatabaseVersionFour - Added the 'source_codec', 'source_width' and 'source_height' columns to the library table,
+	// recording what each entry was before it was transcoded.
+	DatabaseVersionFour
+
+	// DatabaseVersionFive - Added the 'failures' and 'quarantined' columns to the library table, allowing entries which
+	// repeatedly fail to transcode to be excluded from selection.
+	DatabaseVersionFive
+
+	// DatabaseVersionSix - Added an index on the library table covering the columns used when selecting entries to
+	// transcode.
+	DatabaseVersionSix
+
+	// DatabaseVersionSeven - Removed the unique constraint on the 'hash' column of the library table, allowing files
+	// with identical contents to be recorded at different paths.
+	DatabaseVersionSeven
+
+	// DatabaseVersionEight - Added the metadata table, recording the algorithm used to hash the entries in the library
+	// table.
+	DatabaseVersionEight
+
+	// DatabaseVersionNine - Added the 'temporary' column to the jobs table, allowing files to be transcoded in a
+	// temporary directory before being moved alongside the target.
+	DatabaseVersionNine
+
+	// DatabaseVersionTen - Added the runs table, recording a summary of each update/transcode run so that they may be
+	// audited.
+	DatabaseVersionTen
+
+	// DatabaseVersionEleven - Added the 'duration' column to the library table, allowing the time remaining for a
+	// transcode run to be estimated.
+	DatabaseVersionEleven
+
+	// DatabaseVersionTwelve - Added the 'source_path' and 'source_hash' columns to the library table, recording source
+	// files which were left in place when transcoding to an output directory so they're not added again.
+	DatabaseVersionTwelve
+
+	// DatabaseVersionThirteen - Added the 'finished' column to the jobs table, recording when the transcoded file is
+	// about to replace the source so that recovery only completes jobs which finished transcoding.
+	DatabaseVersionThirteen
+
 	// DatabaseVersionCurrent - Convenience alias to avoid having to update the version in multiple places when bumping
 	// the version number.
-	DatabaseVersionCurrent = DatabaseVersionOne
+	DatabaseVersionCurrent = DatabaseVersionThirteen
 )
 
 // Supported - Returns a boolean indicating whether this database version is supported by goamt.
 func (d DatabaseVersion) Supported() bool {
-	return d != 0 && d <= 1
+	return d != 0 && d <= DatabaseVersionCurrent
 }
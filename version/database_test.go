@@ -21,6 +21,10 @@ func TestDatabaseVersionSupported(t *testing.T) {
 		t.Fatalf("Expected true but got false")
 	}
 
+	if !DatabaseVersionTwo.Supported() {
+		t.Fatalf("Expected true but got false")
+	}
+
 	if !DatabaseVersionCurrent.Supported() {
 		t.Fatalf("Expected true but got false")
 	}